@@ -231,13 +231,26 @@ func (c *CFG) build() {
 			})
 		}
 	}
+	// the operands evaluated in blocks of their own (see visitCond) were
+	// added to the block of their statement above
+	for _, blk := range c.Blocks {
+		if len(blk.Stmts) == 0 && blk.Cond != nil {
+			c.AddToBlk(blk, *blk.Cond)
+			blkExprs(*blk.Cond, func(expr ast.Expr) {
+				c.AddToBlk(blk, expr)
+			})
+		}
+	}
 }
 
 func (c *CFG) filterEmpty() {
-	for i := len(c.Blocks) - 1; i >= 0; i-- {
+	// the entry block is kept (even if it is empty) so a loop at the start
+	// of the function is not mistaken for its entry
+	for i := len(c.Blocks) - 1; i > 0; i-- {
 		blk := c.Blocks[i]
 		// there are no stmts AND one or more prev blks ===> a next blk exists
-		if len(blk.Stmts) == 0 && (len(blk.Prev) <= 0 || len(blk.Next) > 0) {
+		// (blocks evaluating a condition have no stmts but are kept)
+		if len(blk.Stmts) == 0 && blk.Cond == nil && (len(blk.Prev) <= 0 || len(blk.Next) > 0) {
 			err := c.removeBlock(blk)
 			if err != nil {
 				panic(err)
@@ -419,18 +432,18 @@ func (c *CFG) visitIfStmt(idx int, body *[]ast.Stmt, s *ast.Stmt, entry *Block)
 		entry.Add(&stmt.Init)
 	}
 	entry.Add(s)
-	entry.Cond = &stmt.Cond
 	thenBlk := c.addBlock(nil, -1)
 	var elseBlk *Block = nil
 	if stmt.Else != nil {
 		elseBlk = c.addBlock(nil, -1)
 	}
 	exitBlk := c.addBlock(nil, -1)
+	if stmt.Else != nil {
+		c.visitCond(entry, &stmt.Cond, thenBlk, elseBlk)
+	} else {
+		c.visitCond(entry, &stmt.Cond, thenBlk, exitBlk)
+	}
 	{
-		entry.Link(&Flow{
-			Block: thenBlk,
-			Type:  True,
-		})
 		thenBody := ast.Stmt(stmt.Body)
 		thenBlk = c.visitBlockStmt(idx, body, &thenBody, thenBlk)
 		if thenBlk != nil && !thenBlk.Exits() {
@@ -441,10 +454,6 @@ func (c *CFG) visitIfStmt(idx int, body *[]ast.Stmt, s *ast.Stmt, entry *Block)
 		}
 	}
 	if stmt.Else != nil {
-		entry.Link(&Flow{
-			Block: elseBlk,
-			Type:  False,
-		})
 		elseBlk = c.visitStmt(idx, body, &stmt.Else, elseBlk)
 		if elseBlk != nil && !elseBlk.Exits() {
 			elseBlk.Link(&Flow{
@@ -452,15 +461,45 @@ func (c *CFG) visitIfStmt(idx int, body *[]ast.Stmt, s *ast.Stmt, entry *Block)
 				Type:  Unconditional,
 			})
 		}
-	} else {
-		entry.Link(&Flow{
-			Block: exitBlk,
-			Type:  False,
-		})
 	}
 	return exitBlk
 }
 
+// visitCond links blk, which ends by evaluating the condition cond, to the
+// blocks taken when it is true and when it is false. The right operand of a
+// && or || is only evaluated depending on its left operand so it is
+// evaluated in a block of its own: the block's Cond is the operand and it
+// has no statements.
+func (c *CFG) visitCond(blk *Block, cond *ast.Expr, t, f *Block) {
+	switch e := (*cond).(type) {
+	case *ast.ParenExpr:
+		c.visitCond(blk, &e.X, t, f)
+		return
+	case *ast.BinaryExpr:
+		switch e.Op {
+		case token.LAND:
+			right := c.addBlock(nil, -1)
+			c.visitCond(blk, &e.X, right, f)
+			c.visitCond(right, &e.Y, t, f)
+			return
+		case token.LOR:
+			right := c.addBlock(nil, -1)
+			c.visitCond(blk, &e.X, t, right)
+			c.visitCond(right, &e.Y, t, f)
+			return
+		}
+	}
+	blk.Cond = cond
+	blk.Link(&Flow{
+		Block: t,
+		Type:  True,
+	})
+	blk.Link(&Flow{
+		Block: f,
+		Type:  False,
+	})
+}
+
 func (c *CFG) visitForStmt(idx int, stmts *[]ast.Stmt, s *ast.Stmt, entry *Block) *Block {
 	stmt := (*s).(*ast.ForStmt)
 	if entry == nil {
@@ -481,22 +520,10 @@ func (c *CFG) visitForStmt(idx int, stmts *[]ast.Stmt, s *ast.Stmt, entry *Block
 		c.labels[c.breakLabel] = exitBlk
 		c.breakLabel = ""
 	}
-	if c.continueLabel != "" {
-		c.labels[c.continueLabel] = header
-		c.continueLabel = ""
-	}
 	var bodyBlk *Block = nil
 	if stmt.Cond != nil {
 		bodyBlk = c.addBlock(nil, -1)
-		header.Cond = &stmt.Cond
-		header.Link(&Flow{
-			Block: bodyBlk,
-			Type:  True,
-		})
-		header.Link(&Flow{
-			Block: exitBlk,
-			Type:  False,
-		})
+		c.visitCond(header, &stmt.Cond, bodyBlk, exitBlk)
 	} else {
 		bodyBlk = header
 	}
@@ -510,6 +537,15 @@ func (c *CFG) visitForStmt(idx int, stmts *[]ast.Stmt, s *ast.Stmt, entry *Block
 			Type:  Unconditional,
 		})
 	}
+	if c.continueLabel != "" {
+		// a continue runs the post statement (if any) like an unlabeled one
+		if postBlk != nil {
+			c.labels[c.continueLabel] = postBlk
+		} else {
+			c.labels[c.continueLabel] = header
+		}
+		c.continueLabel = ""
+	}
 
 	if postBlk != nil {
 		c.pushLoop(postBlk, exitBlk)
@@ -615,11 +651,13 @@ func (c *CFG) visitSelectStmt(idx int, body *[]ast.Stmt, s *ast.Stmt, entry *Blo
 			Type:  Select,
 			Comm:  cond,
 		})
+		c.pushSwitch(nil, exit)
 		if cond != nil {
 			commBlk = c.visitStmt(i, &stmt.Body.List, cond, commBlk)
 		}
 		commBlk = c.visitStmts(&comm.Body, commBlk)
-		if commBlk != nil {
+		c.popSwitch()
+		if commBlk != nil && !commBlk.Exits() {
 			commBlk.Link(&Flow{
 				Block: exit,
 				Type:  Unconditional,
@@ -662,13 +700,21 @@ func (c *CFG) visitTypeSwitchStmt(idx int, body *[]ast.Stmt, s *ast.Stmt, entry
 		c.pushSwitch(nil, exit)
 		caseBlk = c.visitStmts(&cas.Body, caseBlk)
 		c.popSwitch()
-		if caseBlk != nil {
+		if caseBlk != nil && !caseBlk.Exits() {
 			caseBlk.Link(&Flow{
 				Block: exit,
 				Type:  Unconditional,
 			})
 		}
 	}
+	if !hasDefault(stmt.Body) {
+		// no case matches
+		entry.Link(&Flow{
+			FSet:  c.FSet,
+			Block: exit,
+			Type:  TypeSwitch,
+		})
+	}
 	return exit
 }
 
@@ -681,7 +727,9 @@ func (c *CFG) visitSwitchStmt(idx int, body *[]ast.Stmt, s *ast.Stmt, entry *Blo
 		entry.Add(&stmt.Init)
 	}
 	entry.Add(s)
-	entry.Cond = &stmt.Tag
+	if stmt.Tag != nil {
+		entry.Cond = &stmt.Tag
+	}
 	if len(stmt.Body.List) <= 0 {
 		return entry
 	}
@@ -690,25 +738,28 @@ func (c *CFG) visitSwitchStmt(idx int, body *[]ast.Stmt, s *ast.Stmt, entry *Blo
 		c.labels[c.breakLabel] = exit
 		c.breakLabel = ""
 	}
-	if len(stmt.Body.List) <= 0 {
-	}
 	blks := make([]*Block, 0, len(stmt.Body.List))
 	for range stmt.Body.List {
 		blks = append(blks, c.addBlock(nil, -1))
 	}
+	if stmt.Tag == nil {
+		c.visitCases(entry, stmt, blks, exit)
+	}
 	for i, s := range stmt.Body.List {
 		cas := s.(*ast.CaseClause)
 		caseBlk := blks[i]
-		var cases *[]ast.Expr = nil
-		if cas.List != nil {
-			cases = &cas.List
+		if stmt.Tag != nil {
+			var cases *[]ast.Expr = nil
+			if cas.List != nil {
+				cases = &cas.List
+			}
+			entry.Link(&Flow{
+				FSet:  c.FSet,
+				Block: caseBlk,
+				Type:  Switch,
+				Cases: cases,
+			})
 		}
-		entry.Link(&Flow{
-			FSet:  c.FSet,
-			Block: caseBlk,
-			Type:  Switch,
-			Cases: cases,
-		})
 		if i+1 < len(blks) {
 			c.pushSwitch(blks[i+1], exit)
 		} else {
@@ -716,16 +767,58 @@ func (c *CFG) visitSwitchStmt(idx int, body *[]ast.Stmt, s *ast.Stmt, entry *Blo
 		}
 		caseBlk = c.visitStmts(&cas.Body, caseBlk)
 		c.popSwitch()
-		if caseBlk != nil {
+		if caseBlk != nil && !caseBlk.Exits() {
 			caseBlk.Link(&Flow{
 				Block: exit,
 				Type:  Unconditional,
 			})
 		}
 	}
+	if stmt.Tag != nil && !hasDefault(stmt.Body) {
+		// no case matches (see visitCases for the tagless switches)
+		entry.Link(&Flow{
+			FSet:  c.FSet,
+			Block: exit,
+			Type:  Switch,
+		})
+	}
 	return exit
 }
 
+// hasDefault reports whether the body of a switch has a default case
+func hasDefault(body *ast.BlockStmt) bool {
+	for _, s := range body.List {
+		if s.(*ast.CaseClause).List == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// visitCases links the cases of a tagless switch. Its case expressions are
+// conditions tried in order (the default case is taken when they are all
+// false) so each is evaluated in a block of its own. The first is evaluated
+// by the switch's block.
+func (c *CFG) visitCases(entry *Block, stmt *ast.SwitchStmt, blks []*Block, exit *Block) {
+	test := entry
+	otherwise := exit
+	for i, s := range stmt.Body.List {
+		cas := s.(*ast.CaseClause)
+		if cas.List == nil {
+			otherwise = blks[i]
+		}
+		for j := range cas.List {
+			next := c.addBlock(nil, -1)
+			c.visitCond(test, &cas.List[j], blks[i], next)
+			test = next
+		}
+	}
+	test.Link(&Flow{
+		Block: otherwise,
+		Type:  Unconditional,
+	})
+}
+
 func (c *CFG) pushSwitch(next, exit *Block) {
 	c.nextCase = append(c.nextCase, next)
 	c.exits = append(c.exits, exit)
@@ -853,6 +946,8 @@ func (b *Block) String() string {
 	insts := make([]string, 0, len(b.Stmts))
 	if len(b.Stmts) > 0 {
 		insts = append(insts, "")
+	} else if b.Cond != nil {
+		insts = append(insts, "", fmt.Sprintf("cond %v", FmtNode(b.FSet, *b.Cond)))
 	}
 	for _, s := range b.Stmts {
 		switch stmt := (*s).(type) {
@@ -917,6 +1012,9 @@ func (b *Block) String() string {
 func (b *Block) DotLabel() string {
 	insts := make([]string, 0, len(b.Stmts))
 	insts = append(insts, fmt.Sprintf("blk-%v", b.Id))
+	if len(b.Stmts) == 0 && b.Cond != nil {
+		insts = append(insts, fmt.Sprintf("cond %v", FmtNode(b.FSet, *b.Cond)))
+	}
 	for _, s := range b.Stmts {
 		switch stmt := (*s).(type) {
 		default:
@@ -0,0 +1,205 @@
+package analysis
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// buildCFG builds the CFG of the last function (declared or literal) in src
+func buildCFG(t *testing.T, src string) *CFG {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "test.go", "package test\n"+src, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fn ast.Node
+	var body *ast.BlockStmt
+	ast.Inspect(f, func(n ast.Node) bool {
+		switch x := n.(type) {
+		case *ast.FuncDecl:
+			fn, body = x, x.Body
+		case *ast.FuncLit:
+			fn, body = x, x.Body
+		}
+		return true
+	})
+	if fn == nil {
+		t.Fatalf("no function in %q", src)
+	}
+	return BuildCFG(fset, "test.f", fn, &body.List)
+}
+
+func TestPostDominatorsWithoutExit(t *testing.T) {
+	for _, src := range []string{
+		`func f() { g() }`,
+		`func f() { for { g() } }`,
+		`func f() { x := 1; for { x++ } }`,
+		`func f(c bool) { if c { return }; for { g() } }`,
+		`func f() { for { if g() { continue }; h() } }`,
+		`func f() { go func() { for { g() } }() }`,
+		`func f() { L: g(); goto L }`,
+	} {
+		cfg := buildCFG(t, src)
+		ipdom := cfg.PostDominators().ImmediateDominators()
+		if len(ipdom) != len(cfg.Blocks) {
+			t.Errorf("%v: %d immediate post dominators for %d blocks", src, len(ipdom), len(cfg.Blocks))
+			continue
+		}
+		for id, p := range ipdom {
+			if p < 0 || p >= len(cfg.Blocks) {
+				t.Errorf("%v: block %d is post dominated by %d", src, id, p)
+			}
+		}
+		for _, b := range cfg.Blocks {
+			for _, f := range b.Next {
+				if f.Block != nil && f.Block.Id >= len(cfg.Blocks) {
+					t.Errorf("%v: block %d still flows to the virtual exit", src, b.Id)
+				}
+			}
+		}
+	}
+}
+
+// blockName names a block by its condition or else its first statement
+func blockName(cfg *CFG, b *Block) string {
+	switch {
+	case b.Cond != nil:
+		return types.ExprString(*b.Cond)
+	case len(b.Stmts) > 0:
+		return FmtNode(cfg.FSet, *b.Stmts[0])
+	case len(b.Next) == 0:
+		return "exit"
+	}
+	return fmt.Sprintf("blk %d", b.Id)
+}
+
+func TestConditions(t *testing.T) {
+	for _, c := range []struct {
+		src  string
+		want map[string]string // condition => true and false successors
+	}{
+		{
+			src: `func f(a, b, c bool) { if a && (b || c) { g() } else { h() } }`,
+			want: map[string]string{
+				"a": "b, h()",
+				"b": "g(), c",
+				"c": "g(), h()",
+			},
+		},
+		{
+			src: `func f(a, b bool) { for a || !b { g() } }`,
+			want: map[string]string{
+				"a":  "g(), !b",
+				"!b": "g(), exit",
+			},
+		},
+		{
+			src: `func f(x int) { switch { case x < 0, x > 10: g(); case x == 5: h(); default: k() } }`,
+			want: map[string]string{
+				"x < 0":  "g(), x > 10",
+				"x > 10": "g(), x == 5",
+				"x == 5": "h(), k()",
+			},
+		},
+		{
+			// the default case is taken after the later cases are tried
+			src: `func f(x int) { switch { default: k(); case x < 0: g(); case x > 0 && x < 10: h() } }`,
+			want: map[string]string{
+				"x < 0":  "g(), x > 0",
+				"x > 0":  "x < 10, k()",
+				"x < 10": "h(), k()",
+			},
+		},
+		{
+			src: `func f(x int) { switch { case x < 0: g() } }`,
+			want: map[string]string{
+				"x < 0": "g(), exit",
+			},
+		},
+	} {
+		cfg := buildCFG(t, c.src)
+		got := make(map[string]string)
+		for _, b := range cfg.Blocks {
+			if b.Cond == nil {
+				continue
+			}
+			var yes, no string
+			for _, flow := range b.Next {
+				switch flow.Type {
+				case True:
+					yes = blockName(cfg, flow.Block)
+				case False:
+					no = blockName(cfg, flow.Block)
+				}
+			}
+			got[blockName(cfg, b)] = yes + ", " + no
+		}
+		if len(got) != len(c.want) {
+			t.Errorf("%v: conditions %v, expected %v", c.src, got, c.want)
+			continue
+		}
+		for cond, want := range c.want {
+			if got[cond] != want {
+				t.Errorf("%v: %v flows to %q, expected %q", c.src, cond, got[cond], want)
+			}
+		}
+	}
+}
+
+func TestSwitchExits(t *testing.T) {
+	for _, c := range []struct {
+		src  string
+		from string // the prefix of the name of the block
+		want []string
+	}{
+		{
+			// a break in a select leaves the select, not the loop
+			src:  `func f(c chan int) { for { select { case <-c: break }; g() } }`,
+			from: "<-c",
+			want: []string{"g()"},
+		},
+		{
+			// the switch is left when no case matches
+			src:  `func f(x int) { switch x { case 1: g() }; h() }`,
+			from: "x",
+			want: []string{"g()", "h()"},
+		},
+		{
+			src:  `func f(x interface{}) { switch x.(type) { case int: g() }; h() }`,
+			from: "switch",
+			want: []string{"g()", "h()"},
+		},
+		{
+			src:  `func f(x int) { switch x { case 1: g(); default: k() }; h() }`,
+			from: "x",
+			want: []string{"g()", "k()"},
+		},
+	} {
+		cfg := buildCFG(t, c.src)
+		var from *Block
+		for _, b := range cfg.Blocks {
+			if strings.HasPrefix(blockName(cfg, b), c.from) {
+				from = b
+			}
+		}
+		if from == nil {
+			t.Errorf("%v: no block %v", c.src, c.from)
+			continue
+		}
+		got := make([]string, 0, len(from.Next))
+		for _, f := range from.Next {
+			got = append(got, blockName(cfg, f.Block))
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%v: %v flows to %v, expected %v", c.src, c.from, got, c.want)
+		}
+	}
+}
@@ -274,14 +274,18 @@ func (rd *ReachingDefinitions) GenKill(loc *BlockLocation) (gen, kill *set.Sorte
 }
 
 func ForwardSolveSets(cfg *CFG, flow func(*BlockLocation, *set.SortedSet) *set.SortedSet) (in, out map[BlockLocation]*set.SortedSet) {
+	// a block without statements (see visitCond) has a single location
 	lastLocation := func(blk *Block) BlockLocation {
+		if len(blk.Stmts) == 0 {
+			return BlockLocation{blk.Id, 0}
+		}
 		return BlockLocation{blk.Id, len(blk.Stmts) - 1}
 	}
 	in = make(map[BlockLocation]*set.SortedSet)
 	out = make(map[BlockLocation]*set.SortedSet)
 	stack := make([]BlockLocation, 0, 10)
 	for bid := len(cfg.Blocks) - 1; bid >= 0; bid-- {
-		for sid := len(cfg.Blocks[bid].Stmts) - 1; sid >= 0; sid-- {
+		for sid := lastLocation(cfg.Blocks[bid]).Stmt; sid >= 0; sid-- {
 			loc := BlockLocation{bid, sid}
 			in[loc] = set.NewSortedSet(10)
 			out[loc] = set.NewSortedSet(10)
@@ -208,13 +208,41 @@ func PostDominators(cfg *CFG) *DominatorTree {
 	id := len(cfg.Blocks)
 	exit := NewBlock(cfg.FSet, id, nil, -1)
 	exits := make([]*Block, 0, 10)
+	toExit := func(blk *Block) {
+		exits = append(exits, blk)
+		blk.Link(&Flow{
+			Block: exit,
+			Type:  Unconditional,
+		})
+	}
 	for _, blk := range cfg.Blocks {
 		if len(blk.Next) == 0 {
-			exits = append(exits, blk)
-			blk.Link(&Flow{
-				Block: exit,
-				Type:  Unconditional,
-			})
+			toExit(blk)
+		}
+	}
+	// A loop which never exits (and whatever only leads to it) does not
+	// reach the exit. Its first block is treated as an exit too so every
+	// block has a post dominator.
+	reaches := make(map[*Block]bool, len(cfg.Blocks))
+	var reach func(*Block)
+	reach = func(blk *Block) {
+		if reaches[blk] {
+			return
+		}
+		reaches[blk] = true
+		for _, flow := range blk.Prev {
+			if flow.Block != nil {
+				reach(flow.Block)
+			}
+		}
+	}
+	for _, blk := range exits {
+		reach(blk)
+	}
+	for _, blk := range cfg.Blocks {
+		if !reaches[blk] {
+			toExit(blk)
+			reach(blk)
 		}
 	}
 	t := dominators(cfg, len(cfg.Blocks)+1, exit,
@@ -238,7 +266,7 @@ func PostDominators(cfg *CFG) *DominatorTree {
 		},
 	)
 	for _, blk := range exits {
-		blk.Next = blk.Next[:0]
+		blk.Next = blk.Next[:len(blk.Next)-1]
 	}
 	root := t.roots[0]
 	t.roots = t.children[root]
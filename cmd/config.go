@@ -1,7 +1,11 @@
 package cmd
 
 type Config struct {
-	GOROOT string
-	GOPATH string
-	DGPATH string
+	GOROOT  string
+	GOPATH  string
+	DGPATH  string
+	Modules bool // load and build through go modules with a stock toolchain
+	// PortableRuntime builds dgruntime without the patched runtime (so GOROOT
+	// is never rebuilt). It is always set in modules mode.
+	PortableRuntime bool
 }
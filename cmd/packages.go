@@ -0,0 +1,133 @@
+package cmd
+
+import (
+	"fmt"
+	"go/types"
+	"os"
+	"strings"
+)
+
+import (
+	"github.com/timtadh/data-structures/errors"
+	"golang.org/x/tools/go/loader"
+	"golang.org/x/tools/go/packages"
+)
+
+const loadMode = packages.NeedName |
+	packages.NeedFiles |
+	packages.NeedCompiledGoFiles |
+	packages.NeedImports |
+	packages.NeedDeps |
+	packages.NeedTypes |
+	packages.NeedTypesInfo |
+	packages.NeedTypesSizes |
+	packages.NeedSyntax |
+	packages.NeedModule
+
+// ModuleEnv is the environment used to load and build packages in modules
+// mode. Unlike the GOPATH mode it does not replace GOROOT, the stock
+// toolchain is used as is.
+func ModuleEnv(c *Config) []string {
+	env := os.Environ()
+	if c.GOROOT != "" {
+		env = append(env, fmt.Sprintf("GOROOT=%v", c.GOROOT))
+	}
+	return append(env, "GO111MODULE=on")
+}
+
+// LoadModulePkg loads pkg through golang.org/x/tools/go/packages and presents
+// the result as a *loader.Program so the instrumenter, the mutator and the
+// analyses can work on it unchanged.
+//
+// Only packages which belong to a module are put in AllPackages. The standard
+// library is compiled by the stock toolchain and cannot import dgruntime so
+// it is never offered for instrumentation. Packages using cgo are skipped as
+// well since their compiled files are generated by the go command. The entry
+// packages are recorded in Created so Program.Package can find them.
+func LoadModulePkg(c *Config, pkg string) (*loader.Program, error) {
+	return loadModulePkg(c, pkg, false)
+}
+
+// LoadModuleTestPkg is LoadModulePkg for a package's tests. The go command
+// reports the package compiled with its tests as a separate variant (with the
+// ID "pkg [pkg.test]"). The variants are used in place of the plain packages
+// and the generated test main is left out.
+func LoadModuleTestPkg(c *Config, pkg string) (*loader.Program, error) {
+	return loadModulePkg(c, pkg, true)
+}
+
+func loadModulePkg(c *Config, pkg string, tests bool) (*loader.Program, error) {
+	conf := &packages.Config{
+		Mode:  loadMode,
+		Env:   ModuleEnv(c),
+		Tests: tests,
+	}
+	pkgs, err := packages.Load(conf, pkg)
+	if err != nil {
+		return nil, err
+	}
+	if packages.PrintErrors(pkgs) > 0 {
+		return nil, errors.Errorf("could not load %v", pkg)
+	}
+	if tests {
+		pkgs = testVariants(pkgs)
+	}
+	if len(pkgs) <= 0 {
+		return nil, errors.Errorf("no packages matched %v", pkg)
+	}
+	prog := &loader.Program{
+		Fset:        pkgs[0].Fset,
+		Imported:    make(map[string]*loader.PackageInfo),
+		AllPackages: make(map[*types.Package]*loader.PackageInfo),
+	}
+	seen := make(map[string]bool)
+	packages.Visit(pkgs, nil, func(p *packages.Package) {
+		if p.Module == nil || len(p.CompiledGoFiles) != len(p.GoFiles) {
+			return
+		}
+		if seen[p.PkgPath] {
+			return
+		}
+		seen[p.PkgPath] = true
+		prog.AllPackages[p.Types] = &loader.PackageInfo{
+			Pkg:                   p.Types,
+			Importable:            true,
+			TransitivelyErrorFree: true,
+			Files:                 p.Syntax,
+			Info:                  *p.TypesInfo,
+		}
+	})
+	for _, p := range pkgs {
+		info, has := prog.AllPackages[p.Types]
+		if !has {
+			return nil, errors.Errorf("%v is not part of a module (or uses cgo) and cannot be instrumented", p.PkgPath)
+		}
+		prog.Created = append(prog.Created, info)
+		prog.Imported[p.PkgPath] = info
+	}
+	return prog, nil
+}
+
+// testVariants picks the roots to use when tests are loaded: the test
+// variants of the packages, the external test packages and any plain package
+// which has no test variant.
+func testVariants(pkgs []*packages.Package) []*packages.Package {
+	hasVariant := make(map[string]bool)
+	for _, p := range pkgs {
+		if p.ID != p.PkgPath {
+			hasVariant[p.PkgPath] = true
+		}
+	}
+	roots := make([]*packages.Package, 0, len(pkgs))
+	for _, p := range pkgs {
+		if p.Name == "main" && strings.HasSuffix(p.PkgPath, ".test") {
+			// the generated test main
+			continue
+		}
+		if p.ID == p.PkgPath && hasVariant[p.PkgPath] {
+			continue
+		}
+		roots = append(roots, p)
+	}
+	return roots
+}
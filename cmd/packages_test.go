@@ -0,0 +1,149 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+import (
+	"golang.org/x/tools/go/packages"
+)
+
+func TestTestVariants(t *testing.T) {
+	pkg := func(id, path, name string) *packages.Package {
+		return &packages.Package{ID: id, PkgPath: path, Name: name}
+	}
+	pkgs := []*packages.Package{
+		pkg("example.com/m/a", "example.com/m/a", "a"),
+		pkg("example.com/m/a [example.com/m/a.test]", "example.com/m/a", "a"),
+		pkg("example.com/m/a_test [example.com/m/a.test]", "example.com/m/a_test", "a_test"),
+		pkg("example.com/m/a.test", "example.com/m/a.test", "main"),
+		pkg("example.com/m/b", "example.com/m/b", "b"),
+	}
+	var got []string
+	for _, p := range testVariants(pkgs) {
+		got = append(got, p.ID)
+	}
+	want := []string{
+		"example.com/m/a [example.com/m/a.test]",
+		"example.com/m/a_test [example.com/m/a.test]",
+		"example.com/m/b",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("testVariants = %v, want %v", got, want)
+	}
+}
+
+// testModule writes the files (relative path to content) of a module in a
+// temporary directory and changes into it.
+func testModule(t *testing.T, files map[string]string) {
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("the go command is not on the PATH")
+	}
+	dir, err := ioutil.TempDir("", "dynagrok-packages")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.Chdir(wd)
+		os.RemoveAll(dir)
+	})
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0775); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0664); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+}
+
+var testModuleFiles = map[string]string{
+	"go.mod": "module example.com/m\n\ngo 1.16\n",
+	"main.go": `package main
+
+import (
+	"fmt"
+
+	"example.com/m/lib"
+)
+
+func main() {
+	fmt.Println(lib.Double(2))
+}
+`,
+	"lib/lib.go": `package lib
+
+func Double(x int) int {
+	return 2 * x
+}
+`,
+	"lib/lib_test.go": `package lib
+
+import "testing"
+
+func TestDouble(t *testing.T) {
+	if Double(2) != 4 {
+		t.Fatal("Double(2) != 4")
+	}
+}
+`,
+}
+
+func TestLoadModulePkg(t *testing.T) {
+	testModule(t, testModuleFiles)
+	prog, err := LoadModulePkg(&Config{}, "example.com/m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info := prog.Package("example.com/m"); info == nil || len(prog.Created) != 1 || prog.Created[0] != info {
+		t.Errorf("the entry package is not the created package: %v", prog.Created)
+	}
+	var paths []string
+	for pkg := range prog.AllPackages {
+		paths = append(paths, pkg.Path())
+	}
+	sort.Strings(paths)
+	// fmt belongs to the standard library, not to a module
+	if want := []string{"example.com/m", "example.com/m/lib"}; !reflect.DeepEqual(paths, want) {
+		t.Errorf("AllPackages = %v, want %v", paths, want)
+	}
+}
+
+func TestLoadModuleTestPkg(t *testing.T) {
+	testModule(t, testModuleFiles)
+	prog, err := LoadModuleTestPkg(&Config{}, "example.com/m/lib")
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := prog.Package("example.com/m/lib")
+	if info == nil {
+		t.Fatal("the entry package was not loaded")
+	}
+	var files []string
+	for _, f := range info.Files {
+		files = append(files, filepath.Base(prog.Fset.File(f.Pos()).Name()))
+	}
+	sort.Strings(files)
+	if want := []string{"lib.go", "lib_test.go"}; !reflect.DeepEqual(files, want) {
+		t.Errorf("the entry package's files = %v, want %v", files, want)
+	}
+	for pkg := range prog.AllPackages {
+		if pkg.Name() == "main" {
+			t.Errorf("the generated test main %v was loaded", pkg.Path())
+		}
+	}
+}
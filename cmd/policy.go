@@ -0,0 +1,115 @@
+package cmd
+
+import (
+	"go/build"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+import (
+	"github.com/timtadh/getopt"
+)
+
+import (
+	"github.com/timtadh/dynagrok/dgruntime/excludes"
+)
+
+// PolicyUsage documents the flags handled by PolicyOpt
+const PolicyUsage = `
+Instrumentation Policy
+    --include=<patterns>              Only instrument packages matching these
+                                      comma separated patterns (eg. my/prog/...)
+    --exclude=<patterns>              Do not instrument packages matching these
+    --exclude-func=<patterns>         Do not instrument functions matching these
+                                      (eg. ...String)
+    --policy=<path>                   Read include/exclude/exclude-func lines
+                                      from a policy file
+`
+
+// PolicyLongOpts are the long options handled by PolicyOpt
+var PolicyLongOpts = []string{
+	"include=",
+	"exclude=",
+	"exclude-func=",
+	"policy=",
+}
+
+// PolicyOpt applies oa to the policy if it is one of the policy flags. It
+// reports whether the flag was handled.
+func PolicyOpt(p *excludes.Policy, oa getopt.OptArg) (bool, *Error) {
+	var err error
+	switch oa.Opt() {
+	case "--include":
+		err = p.AddInclude(oa.Arg())
+	case "--exclude":
+		err = p.AddExclude(oa.Arg())
+	case "--exclude-func":
+		err = p.AddExcludeFunc(oa.Arg())
+	case "--policy":
+		err = p.Load(oa.Arg())
+	default:
+		return false, nil
+	}
+	if err != nil {
+		return true, Errorf(1, "bad policy flag %v: %v", oa.Opt(), err)
+	}
+	return true, nil
+}
+
+// RuntimeDeps lists the packages dgruntime depends on (see
+// excludes.Policy.ExcludeDeps) as the standard library at c.GOROOT has them.
+// dgruntime itself is read from c.DGPATH and is followed with and without
+// the patched runtime's build tag.
+func RuntimeDeps(c *Config) ([]string, error) {
+	seen := make(map[string]bool)
+	for _, tags := range [][]string{nil, {"dgpatched"}} {
+		ctx := *BuildContext(c)
+		ctx.BuildTags = tags
+		ctx.CgoEnabled = true
+		var visit func(path, srcDir string) error
+		visit = func(path, srcDir string) error {
+			var pkg *build.Package
+			var err error
+			if path == "dgruntime" || strings.HasPrefix(path, "dgruntime/") {
+				pkg, err = ctx.ImportDir(filepath.Join(c.DGPATH, filepath.FromSlash(path)), 0)
+			} else if pkg, err = ctx.Import(path, srcDir, 0); err == nil {
+				// the standard library's vendored packages are found by
+				// their full path
+				path = pkg.ImportPath
+			}
+			if err != nil {
+				return err
+			}
+			if seen[path] {
+				return nil
+			}
+			seen[path] = true
+			imports := pkg.Imports
+			if len(pkg.CgoFiles) > 0 {
+				// cgo links the package with runtime/cgo
+				imports = append(imports, "runtime/cgo")
+			}
+			for _, imp := range imports {
+				if imp == "C" {
+					continue
+				}
+				if err := visit(imp, pkg.Dir); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		if err := visit("dgruntime", ""); err != nil {
+			return nil, err
+		}
+	}
+	deps := make([]string, 0, len(seen))
+	for path := range seen {
+		if path != "dgruntime" && !strings.HasPrefix(path, "dgruntime/") {
+			deps = append(deps, path)
+		}
+	}
+	sort.Strings(deps)
+	return deps, nil
+}
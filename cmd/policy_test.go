@@ -0,0 +1,29 @@
+package cmd
+
+import (
+	"runtime"
+	"sort"
+	"testing"
+)
+
+func TestRuntimeDeps(t *testing.T) {
+	deps, err := RuntimeDeps(&Config{GOROOT: runtime.GOROOT(), DGPATH: ".."})
+	if err != nil {
+		t.Fatal(err)
+	}
+	has := func(pkg string) bool {
+		i := sort.SearchStrings(deps, pkg)
+		return i < len(deps) && deps[i] == pkg
+	}
+	// imported by dgruntime, by its dependencies and by cgo
+	for _, pkg := range []string{"fmt", "errors", "unsafe", "runtime", "runtime/cgo"} {
+		if !has(pkg) {
+			t.Errorf("%v is missing from %v", pkg, deps)
+		}
+	}
+	for _, pkg := range []string{"dgruntime", "dgruntime/dgtypes", "net/http", "testing"} {
+		if has(pkg) {
+			t.Errorf("unexpected %v in %v", pkg, deps)
+		}
+	}
+}
@@ -37,9 +37,26 @@ func BuildContext(c *Config) *build.Context {
 }
 
 func LoadPkg(c *Config, pkg string) (*loader.Program, error) {
+	if c.Modules {
+		return LoadModulePkg(c, pkg)
+	}
 	var conf loader.Config
 	conf.Build = BuildContext(c)
 	conf.Build.CgoEnabled = true
 	conf.Import(pkg)
 	return conf.Load()
 }
+
+// LoadTestPkg loads pkg along with its _test.go files. The in package tests
+// are part of the package itself and the external tests (package pkg_test)
+// are a created package with the path pkg_test.
+func LoadTestPkg(c *Config, pkg string) (*loader.Program, error) {
+	if c.Modules {
+		return LoadModuleTestPkg(c, pkg)
+	}
+	var conf loader.Config
+	conf.Build = BuildContext(c)
+	conf.Build.CgoEnabled = true
+	conf.ImportWithTests(pkg)
+	return conf.Load()
+}
@@ -0,0 +1,119 @@
+package coverage
+
+import (
+	"io"
+	"os"
+)
+
+import (
+	"github.com/timtadh/getopt"
+)
+
+import (
+	"github.com/timtadh/dynagrok/cmd"
+	"github.com/timtadh/dynagrok/dgruntime/excludes"
+	"github.com/timtadh/dynagrok/profile"
+)
+
+func NewCommand(c *cmd.Config) cmd.Runnable {
+	return cmd.Cmd(
+		"coverage",
+		`[options] <pkg> <profiles>+`,
+		`
+Report which basic blocks and branches of <pkg> executed in the profiled runs.
+<profiles> are flow graph files (or directories of them) written by a copy of
+<pkg> built with instrument. The static CFGs are rebuilt from the source so it
+must be the same source that was instrumented.
+
+Without --include only the packages with at least one executed function (and
+<pkg> itself) are reported.
+
+Option Flags
+    -h,--help                         Show this message
+    -o,--output=<path>                Output file to create
+                                      (defaults to standard output)
+    -f,--format=<format>              text (default), html or cover (the
+                                      format of go test -coverprofile)
+    -u,--uncovered                    List the blocks and branches which never
+                                      executed (text format)
+    --test                            Report on the package's tests too (use
+                                      with profiles from instrument --test)
+`+cmd.PolicyUsage,
+		"o:f:u",
+		append([]string{
+			"output=",
+			"format=",
+			"uncovered",
+			"test",
+		}, cmd.PolicyLongOpts...),
+		func(r cmd.Runnable, args []string, optargs []getopt.OptArg) ([]string, *cmd.Error) {
+			output := ""
+			format := "text"
+			uncovered := false
+			test := false
+			policy := excludes.NewPolicy()
+			for _, oa := range optargs {
+				if ok, err := cmd.PolicyOpt(policy, oa); err != nil {
+					return nil, err
+				} else if ok {
+					continue
+				}
+				switch oa.Opt() {
+				case "-o", "--output":
+					output = oa.Arg()
+				case "-f", "--format":
+					format = oa.Arg()
+					switch format {
+					case "text", "html", "cover":
+					default:
+						return nil, cmd.Usage(r, 2, "Unknown format %v", format)
+					}
+				case "-u", "--uncovered":
+					uncovered = true
+				case "--test":
+					test = true
+				}
+			}
+			if len(args) < 2 {
+				return nil, cmd.Usage(r, 2, "Expected a package and at least one profile got %v", args)
+			}
+			pkgName := args[0]
+			p, err := profile.Load(args[1:])
+			if err != nil {
+				return nil, cmd.Err(2, err)
+			}
+			load := cmd.LoadPkg
+			if test {
+				load = cmd.LoadTestPkg
+			}
+			program, err := load(c, pkgName)
+			if err != nil {
+				return nil, cmd.Usage(r, 6, err.Error())
+			}
+			report, err := Build(program, profile.Reported(pkgName, policy, p), p)
+			if err != nil {
+				return nil, cmd.Err(1, err)
+			}
+			var fout io.Writer = os.Stdout
+			if output != "" {
+				f, err := os.Create(output)
+				if err != nil {
+					return nil, cmd.Errorf(1, "Could not create output file: %v, error: %v", output, err)
+				}
+				defer f.Close()
+				fout = f
+			}
+			switch format {
+			case "html":
+				err = report.WriteHTML(fout)
+			case "cover":
+				err = report.WriteCover(fout)
+			default:
+				err = report.WriteText(fout, uncovered)
+			}
+			if err != nil {
+				return nil, cmd.Err(1, err)
+			}
+			return nil, nil
+		})
+}
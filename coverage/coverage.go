@@ -0,0 +1,211 @@
+package coverage
+
+import (
+	"go/ast"
+	"go/token"
+	"sort"
+	"strings"
+)
+
+import (
+	"github.com/timtadh/data-structures/errors"
+	"golang.org/x/tools/go/loader"
+)
+
+import (
+	"github.com/timtadh/dynagrok/analysis"
+	"github.com/timtadh/dynagrok/dgruntime/dgtypes"
+)
+
+// Block is an instrumented basic block of a function's static CFG. Blocks
+// without statements are never instrumented so they are not reported.
+type Block struct {
+	Id         int
+	Start, End token.Pos // the statements of the block (headers only for compound statements)
+	Stmts      int
+	Count      int // times the block was entered (or returned to from a call)
+}
+
+// Branch is an edge of the static CFG leaving a block with more than one
+// successor.
+type Branch struct {
+	From, To *Block
+	Count    int
+}
+
+type Function struct {
+	Name     string
+	Pkg      *loader.PackageInfo
+	Pos      token.Pos
+	Blocks   []*Block
+	Branches []*Branch
+}
+
+func (f *Function) Covered() (blocks, branches int) {
+	for _, b := range f.Blocks {
+		if b.Count > 0 {
+			blocks++
+		}
+	}
+	for _, b := range f.Branches {
+		if b.Count > 0 {
+			branches++
+		}
+	}
+	return blocks, branches
+}
+
+// Report is the coverage of every function in the reported packages sorted
+// by position.
+type Report struct {
+	Fset  *token.FileSet
+	Funcs []*Function
+}
+
+// Build joins the static CFGs of the packages for which report returns true
+// with the flow graph of the profile.
+func Build(program *loader.Program, report func(pkg *loader.PackageInfo) bool, p *dgtypes.Profile) (*Report, error) {
+	type blk struct {
+		fn   string
+		bbid int
+	}
+	type edge struct {
+		fn       string
+		from, to int
+	}
+	entered := make(map[blk]int)
+	taken := make(map[edge]int)
+	name := func(pc uintptr) string {
+		if f, has := p.Funcs[pc]; has {
+			return f.Name
+		}
+		return ""
+	}
+	for e, count := range p.Flows {
+		if e.Targ.In == 0 || e.Kind != "" {
+			// (edges between goroutines do not enter their target)
+			continue
+		}
+		fn := name(e.Targ.In)
+		entered[blk{fn, e.Targ.BasicBlockId}] += count
+		if e.Src.In == e.Targ.In {
+			taken[edge{fn, e.Src.BasicBlockId, e.Targ.BasicBlockId}] += count
+		}
+	}
+	r := &Report{Fset: program.Fset}
+	for _, pkg := range program.AllPackages {
+		if !report(pkg) {
+			continue
+		}
+		for _, fileAst := range pkg.Files {
+			err := analysis.Functions(pkg, fileAst, func(fn ast.Node, fnName string) error {
+				var body *ast.BlockStmt
+				switch x := fn.(type) {
+				case *ast.FuncDecl:
+					body = x.Body
+				case *ast.FuncLit:
+					body = x.Body
+				default:
+					return errors.Errorf("unexpected type %T", x)
+				}
+				if body == nil {
+					return nil
+				}
+				cfg := analysis.BuildCFG(program.Fset, fnName, fn, &body.List)
+				f := &Function{Name: fnName, Pkg: pkg, Pos: fn.Pos()}
+				blocks := make(map[int]*Block, len(cfg.Blocks))
+				for _, b := range cfg.Blocks {
+					if b.Id != 0 && len(b.Stmts) == 0 && b.Cond == nil {
+						continue
+					}
+					start, end := body.Lbrace, body.Lbrace+1
+					if len(b.Stmts) > 0 {
+						start, end = blockRange(b)
+					} else if b.Cond != nil {
+						// an operand of && or || or a tagless switch case
+						start, end = (*b.Cond).Pos(), (*b.Cond).End()
+					}
+					blocks[b.Id] = &Block{
+						Id:    b.Id,
+						Start: start,
+						End:   end,
+						Stmts: len(b.Stmts),
+						Count: entered[blk{fnName, b.Id}],
+					}
+					f.Blocks = append(f.Blocks, blocks[b.Id])
+				}
+				for _, b := range cfg.Blocks {
+					if len(b.Next) <= 1 || blocks[b.Id] == nil {
+						continue
+					}
+					for _, flow := range b.Next {
+						if flow.Block == nil || blocks[flow.Block.Id] == nil {
+							continue
+						}
+						f.Branches = append(f.Branches, &Branch{
+							From:  blocks[b.Id],
+							To:    blocks[flow.Block.Id],
+							Count: taken[edge{fnName, b.Id, flow.Block.Id}],
+						})
+					}
+				}
+				r.Funcs = append(r.Funcs, f)
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	sort.Slice(r.Funcs, func(i, j int) bool {
+		a := program.Fset.Position(r.Funcs[i].Pos)
+		b := program.Fset.Position(r.Funcs[j].Pos)
+		if a.Filename != b.Filename {
+			return a.Filename < b.Filename
+		}
+		return a.Offset < b.Offset
+	})
+	return r, nil
+}
+
+// blockRange is the source range of the block's statements. Compound
+// statements contribute their header (`for i := 0; i < n; i++ {`) as their
+// bodies are made of other blocks.
+func blockRange(b *analysis.Block) (start, end token.Pos) {
+	start = (*b.Stmts[0]).Pos()
+	for _, s := range b.Stmts {
+		if e := headerEnd(*s); e > end {
+			end = e
+		}
+	}
+	return start, end
+}
+
+func headerEnd(s ast.Stmt) token.Pos {
+	switch x := s.(type) {
+	case *ast.LabeledStmt:
+		return headerEnd(x.Stmt)
+	case *ast.IfStmt:
+		return x.Body.Lbrace + 1
+	case *ast.ForStmt:
+		return x.Body.Lbrace + 1
+	case *ast.RangeStmt:
+		return x.Body.Lbrace + 1
+	case *ast.SwitchStmt:
+		return x.Body.Lbrace + 1
+	case *ast.TypeSwitchStmt:
+		return x.Body.Lbrace + 1
+	case *ast.SelectStmt:
+		return x.Body.Lbrace + 1
+	}
+	return s.End()
+}
+
+// importPath is the path go tool cover expects for files of the package.
+// External test packages live in the directory of the package they test.
+func importPath(pkg *loader.PackageInfo) string {
+	if strings.HasSuffix(pkg.Pkg.Name(), "_test") {
+		return strings.TrimSuffix(pkg.Pkg.Path(), "_test")
+	}
+	return pkg.Pkg.Path()
+}
@@ -0,0 +1,89 @@
+package coverage
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+import (
+	"golang.org/x/tools/go/loader"
+)
+
+import (
+	"github.com/timtadh/dynagrok/dgruntime/dgtypes"
+)
+
+func TestBuild(t *testing.T) {
+	src := `package test
+
+func f(x int) int {
+	if x > 0 && x < 10 {
+		return 1
+	}
+	return 2
+}
+
+func g() {
+	f(1)
+}
+`
+	conf := loader.Config{}
+	file, err := conf.ParseFile("test.go", src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf.CreateFromFiles("test", file)
+	program, err := conf.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// f's blocks: 0 `if x > 0`, 1 `return 1`, 2 `return 2`, 3 `x < 10`
+	at := func(pc uintptr, bbid int) dgtypes.BlkEntrance {
+		return dgtypes.BlkEntrance{In: pc, BasicBlockId: bbid}
+	}
+	p := dgtypes.NewProfile()
+	p.Funcs[1] = &dgtypes.Function{Name: "test.f", FuncPc: 1}
+	p.Funcs[2] = &dgtypes.Function{Name: "test.g", FuncPc: 2}
+	for e, count := range map[dgtypes.FlowEdge]int{
+		{Targ: at(2, 0)}:                                         1, // a trace starts in g
+		{Src: at(2, 0), Targ: at(1, 0)}:                          3, // g calls f
+		{Src: at(1, 0), Targ: at(1, 3)}:                          2,
+		{Src: at(1, 0), Targ: at(1, 2)}:                          1,
+		{Src: at(1, 3), Targ: at(1, 1)}:                          2,
+		{Src: at(1, 1), Targ: at(2, 0)}:                          2, // f returns to g
+		{Src: at(2, 0), Targ: at(1, 2), Kind: dgtypes.SpawnEdge}: 4, // f runs in another goroutine
+	} {
+		p.Flows[e] = count
+	}
+	r, err := Build(program, func(*loader.PackageInfo) bool { return true }, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, fn := range r.Funcs {
+		for _, b := range fn.Blocks {
+			got = append(got, fmt.Sprintf("%v %d: %d", fn.Name, b.Id, b.Count))
+		}
+		for _, b := range fn.Branches {
+			got = append(got, fmt.Sprintf("%v %d->%d: %d", fn.Name, b.From.Id, b.To.Id, b.Count))
+		}
+	}
+	want := []string{
+		"test.f 0: 3",
+		"test.f 1: 2",
+		"test.f 2: 1",
+		"test.f 3: 2",
+		"test.f 0->3: 2",
+		"test.f 0->2: 1",
+		"test.f 3->1: 2",
+		"test.f 3->2: 0",
+		"test.g 0: 3",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("coverage\n%v\nexpected\n%v", got, want)
+	}
+	if blocks, branches := r.Funcs[0].Covered(); blocks != 4 || branches != 3 {
+		t.Errorf("%v covers %d blocks and %d branches, expected 4 and 3", r.Funcs[0].Name, blocks, branches)
+	}
+}
@@ -0,0 +1,199 @@
+package coverage
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"text/tabwriter"
+)
+
+func percent(n, d int) string {
+	if d == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.1f%%", 100*float64(n)/float64(d))
+}
+
+// WriteText writes the block and branch coverage of every function followed
+// by the totals. When uncovered is set the blocks and branches which never
+// executed are listed as well.
+func (r *Report) WriteText(fout io.Writer, uncovered bool) error {
+	w := tabwriter.NewWriter(fout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "function\tblocks\t\tbranches\t")
+	var blocks, branches, coveredBlocks, coveredBranches int
+	for _, f := range r.Funcs {
+		blks, brs := f.Covered()
+		fmt.Fprintf(w, "%v\t%d/%d\t%v\t%d/%d\t%v\n",
+			f.Name,
+			blks, len(f.Blocks), percent(blks, len(f.Blocks)),
+			brs, len(f.Branches), percent(brs, len(f.Branches)))
+		blocks += len(f.Blocks)
+		branches += len(f.Branches)
+		coveredBlocks += blks
+		coveredBranches += brs
+	}
+	fmt.Fprintf(w, "total\t%d/%d\t%v\t%d/%d\t%v\n",
+		coveredBlocks, blocks, percent(coveredBlocks, blocks),
+		coveredBranches, branches, percent(coveredBranches, branches))
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if !uncovered {
+		return nil
+	}
+	fmt.Fprintln(fout, "\nnever executed")
+	for _, f := range r.Funcs {
+		for _, b := range f.Blocks {
+			if b.Count == 0 {
+				fmt.Fprintf(fout, "  %v: %v blk %d\n", r.Fset.Position(b.Start), f.Name, b.Id)
+			}
+		}
+		for _, b := range f.Branches {
+			if b.Count == 0 {
+				fmt.Fprintf(fout, "  %v: %v blk %d -> blk %d\n", r.Fset.Position(b.From.Start), f.Name, b.From.Id, b.To.Id)
+			}
+		}
+	}
+	return nil
+}
+
+// WriteCover writes the block coverage in the format of `go test
+// -coverprofile` (count mode) so `go tool cover` can read it.
+func (r *Report) WriteCover(fout io.Writer) error {
+	type line struct {
+		file       string
+		start, end int
+		text       string
+	}
+	lines := make([]line, 0, len(r.Funcs)*4)
+	for _, f := range r.Funcs {
+		for _, b := range f.Blocks {
+			start := r.Fset.Position(b.Start)
+			end := r.Fset.Position(b.End)
+			file := importPath(f.Pkg) + "/" + filepath.Base(start.Filename)
+			lines = append(lines, line{
+				file:  file,
+				start: start.Offset,
+				end:   end.Offset,
+				text: fmt.Sprintf("%v:%d.%d,%d.%d %d %d",
+					file, start.Line, start.Column, end.Line, end.Column, b.Stmts, b.Count),
+			})
+		}
+	}
+	sort.Slice(lines, func(i, j int) bool {
+		if lines[i].file != lines[j].file {
+			return lines[i].file < lines[j].file
+		}
+		if lines[i].start != lines[j].start {
+			return lines[i].start < lines[j].start
+		}
+		return lines[i].end < lines[j].end
+	})
+	if _, err := fmt.Fprintln(fout, "mode: count"); err != nil {
+		return err
+	}
+	for _, l := range lines {
+		if _, err := fmt.Fprintln(fout, l.text); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+const htmlHead = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>dynagrok coverage</title>
+<style>
+body { font-family: sans-serif; }
+pre { font-family: monospace; line-height: 1.3; }
+table { border-collapse: collapse; }
+td, th { padding: 0 1em; text-align: left; }
+.cov { background: #c8f0c8; }
+.uncov { background: #f4c0c0; }
+</style>
+</head>
+<body>
+`
+
+// WriteHTML writes the coverage summary followed by the source of every
+// file with functions in the report. Executed blocks are green, blocks which
+// never executed are red and hovering over a block shows how often it ran.
+func (r *Report) WriteHTML(fout io.Writer) error {
+	files := make([]string, 0, 10)
+	fileFuncs := make(map[string][]*Function)
+	for _, f := range r.Funcs {
+		name := r.Fset.Position(f.Pos).Filename
+		if _, has := fileFuncs[name]; !has {
+			files = append(files, name)
+		}
+		fileFuncs[name] = append(fileFuncs[name], f)
+	}
+	io.WriteString(fout, htmlHead)
+	fmt.Fprintln(fout, "<table>\n<tr><th>function</th><th>blocks</th><th>branches</th></tr>")
+	for _, f := range r.Funcs {
+		blks, brs := f.Covered()
+		fmt.Fprintf(fout, "<tr><td>%v</td><td>%d/%d %v</td><td>%d/%d %v</td></tr>\n",
+			html.EscapeString(f.Name),
+			blks, len(f.Blocks), percent(blks, len(f.Blocks)),
+			brs, len(f.Branches), percent(brs, len(f.Branches)))
+	}
+	fmt.Fprintln(fout, "</table>")
+	for _, name := range files {
+		if err := r.writeHTMLFile(fout, name, fileFuncs[name]); err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(fout, "</body>\n</html>\n")
+	return err
+}
+
+func (r *Report) writeHTMLFile(fout io.Writer, name string, fns []*Function) error {
+	src, err := ioutil.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	// mark the bytes of each block, inner (shorter) blocks win
+	blocks := make([]*Block, 0, 10)
+	for _, f := range fns {
+		blocks = append(blocks, f.Blocks...)
+	}
+	sort.Slice(blocks, func(i, j int) bool {
+		return blocks[i].End-blocks[i].Start > blocks[j].End-blocks[j].Start
+	})
+	marks := make([]*Block, len(src))
+	for _, b := range blocks {
+		start := r.Fset.Position(b.Start).Offset
+		end := r.Fset.Position(b.End).Offset
+		for i := start; i < end && i < len(marks); i++ {
+			marks[i] = b
+		}
+	}
+	fmt.Fprintf(fout, "<h2>%v</h2>\n<pre>", html.EscapeString(name))
+	var cur *Block
+	for i := range src {
+		if marks[i] != cur {
+			if cur != nil {
+				io.WriteString(fout, "</span>")
+			}
+			cur = marks[i]
+			if cur != nil {
+				class := "cov"
+				if cur.Count == 0 {
+					class = "uncov"
+				}
+				fmt.Fprintf(fout, `<span class="%v" title="blk %d visited %d times">`, class, cur.Id, cur.Count)
+			}
+		}
+		io.WriteString(fout, html.EscapeString(string(src[i:i+1])))
+	}
+	if cur != nil {
+		io.WriteString(fout, "</span>")
+	}
+	_, err = fmt.Fprintln(fout, "</pre>")
+	return err
+}
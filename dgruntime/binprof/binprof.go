@@ -0,0 +1,96 @@
+// Package binprof reads and writes dynagrok's binary flow graph format.
+//
+// A file starts with a header: the magic bytes followed by the format version
+// as a uvarint. The rest of the file is a sequence of records. Each record is
+// a kind byte, the length of its payload as a uvarint and the payload. Strings
+// (labels, function names and positions) are written once as string records
+// and then referred to by their index in the file's string table.
+//
+// Readers skip records of kinds they do not know and ignore trailing payload
+// fields they do not know. New fields may be added to the end of a record's
+// payload without changing the version.
+//
+// Files may be concatenated: a header may appear wherever a record may, it
+// starts a new string table.
+//
+// The package only depends on the standard library so that it can be used by
+// dgruntime as well as by the analyses.
+package binprof
+
+import (
+	"bytes"
+	"time"
+)
+
+// Magic starts every binary profile. Its first byte is not a record kind so
+// a concatenated file's header can be told apart from a record.
+var Magic = []byte{0x89, 'D', 'G', 'P'}
+
+// Version is the version of the format written by Writer
+const Version = 1
+
+// Kind identifies a record
+type Kind byte
+
+const (
+	stringRecord Kind = 's'
+	// GraphStart begins a graph. Its Label is the graph's (optional) label.
+	GraphStart Kind = 'g'
+	// VertexRecord is a basic block of the graph
+	VertexRecord Kind = 'v'
+	// EdgeRecord is a traversed edge between two vertices of the graph
+	EdgeRecord Kind = 'e'
+	// GraphEnd ends the current graph
+	GraphEnd Kind = 'G'
+	// SamplingRecord describes how the current graph was sampled
+	SamplingRecord Kind = 'p'
+	// GranularityRecord names what the probes of the current graph recorded
+	// ("func" or "edge", graphs without one are of basic blocks)
+	GranularityRecord Kind = 'l'
+)
+
+// Vertex is a basic block (or a predicate which held in a basic block). Ids
+// are local to their graph. Its fields are those of dgtypes.GraphVertex (in
+// the same order) so the two convert to one another.
+type Vertex struct {
+	Id           int
+	Label        string
+	BasicBlockId int
+	FnName       string
+	Position     string
+	Duration     time.Duration
+	Site         int    // the predicate's site
+	Predicate    string // the predicate, empty for basic blocks
+	Observed     int    // how often the predicate's site was observed
+}
+
+// Edge is a traversed edge between two vertices of a graph. Kind is empty
+// for control flow edges, edges between goroutines are "spawn", "send" or
+// "close" and edges to predicates are "pred".
+type Edge struct {
+	Src, Targ int
+	Count     int
+	Kind      string
+}
+
+// Sampling describes how a graph was sampled. Rate is the expected fraction
+// of function calls recorded. It converts to and from dgtypes.Sampling.
+type Sampling struct {
+	Params string
+	Rate   float64
+}
+
+// Record is one record read by Reader.Next
+type Record struct {
+	Kind        Kind
+	Label       string   // set for GraphStart
+	Vertex      Vertex   // set for VertexRecord
+	Edge        Edge     // set for EdgeRecord
+	Sampling    Sampling // set for SamplingRecord
+	Granularity string   // set for GranularityRecord
+}
+
+// IsBinary reports whether a stream starting with prefix is a binary profile
+func IsBinary(prefix []byte) bool {
+	return bytes.HasPrefix(prefix, Magic)
+}
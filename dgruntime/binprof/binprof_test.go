@@ -0,0 +1,107 @@
+package binprof
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func writeGraph(t *testing.T, buf *bytes.Buffer, label string, vs []Vertex, es []Edge) {
+	w, err := NewWriter(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.StartGraph(label); err != nil {
+		t.Fatal(err)
+	}
+	for i := range vs {
+		if err := w.Vertex(&vs[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := range es {
+		if err := w.Edge(&es[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.EndGraph(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRoundTripConcatenated(t *testing.T) {
+	vs := []Vertex{
+		{Id: 0, Label: "entry", FnName: "entry", Position: "<none>"},
+		{Id: 1, Label: "main.main blk 1", BasicBlockId: 1, FnName: "main.main", Position: "main.go:3:2", Duration: 1500},
+		{Id: 2, Label: "main.main blk 2", BasicBlockId: 2, FnName: "main.main", Position: "main.go:5:2", Duration: -1},
+		{Id: 3, Label: "main.main blk 2 pred 0: x < 0", BasicBlockId: 2, FnName: "main.main", Position: "main.go:5:5", Site: 0, Predicate: "x < 0", Observed: 9},
+	}
+	es := []Edge{{Src: 0, Targ: 1, Count: 1}, {Src: 1, Targ: 2, Count: 300}, {Src: 2, Targ: 3, Count: 7, Kind: "pred"}}
+	var buf bytes.Buffer
+	writeGraph(t, &buf, "first", vs, es)
+	writeGraph(t, &buf, "second", vs[:2], es[:1])
+
+	r, err := NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []Record
+	for {
+		rec, err := r.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, *rec)
+	}
+	var want []Record
+	for _, g := range []struct {
+		label string
+		vs    []Vertex
+		es    []Edge
+	}{{"first", vs, es}, {"second", vs[:2], es[:1]}} {
+		want = append(want, Record{Kind: GraphStart, Label: g.label})
+		for _, v := range g.vs {
+			want = append(want, Record{Kind: VertexRecord, Vertex: v})
+		}
+		for _, e := range g.es {
+			want = append(want, Record{Kind: EdgeRecord, Edge: e})
+		}
+		want = append(want, Record{Kind: GraphEnd})
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("round trip mismatch\ngot  %v\nwant %v", got, want)
+	}
+}
+
+func TestNotBinary(t *testing.T) {
+	if _, err := NewReader(bytes.NewBufferString("start-graph\n")); err == nil {
+		t.Fatal("expected an error for a text profile")
+	}
+}
+
+func TestCorrupt(t *testing.T) {
+	header := append(append([]byte{}, Magic...), Version)
+	for _, c := range []struct {
+		name string
+		data []byte
+	}{
+		{"huge record", append(header, byte(EdgeRecord), 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f)},
+		{"short record", append(header, byte(EdgeRecord), 10, 1, 2, 3)},
+		{"bad length", append(header, byte(EdgeRecord), 0xff)},
+		{"bad field", append(header, byte(EdgeRecord), 1, 0xff)},
+	} {
+		r, err := NewReader(bytes.NewReader(c.data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rec, err := r.Next(); err == nil || err == io.EOF {
+			t.Errorf("%v: read %v, expected an error", c.name, rec)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package binprof
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"time"
+)
+
+// MaxRecord is the size of the largest record a Reader accepts. The length
+// of a record is read from the input: a corrupt one must not allocate the
+// memory it claims.
+const MaxRecord = 1 << 24
+
+// Reader reads the records of a binary profile (or of several concatenated
+// profiles).
+type Reader struct {
+	r       *bufio.Reader
+	strings []string
+	payload []byte
+	off     int
+	err     error
+}
+
+// NewReader checks the header at the start of r and returns a Reader for the
+// records which follow it.
+func NewReader(r io.Reader) (*Reader, error) {
+	br := &Reader{r: bufio.NewReader(r)}
+	kind, err := br.r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	if err := br.header(kind); err != nil {
+		return nil, err
+	}
+	return br, nil
+}
+
+func (r *Reader) header(first byte) error {
+	magic := make([]byte, len(Magic))
+	magic[0] = first
+	if _, err := io.ReadFull(r.r, magic[1:]); err != nil {
+		return fmt.Errorf("binprof: reading header: %v", err)
+	}
+	if !IsBinary(magic) {
+		return fmt.Errorf("binprof: not a binary profile")
+	}
+	version, err := binary.ReadUvarint(r.r)
+	if err != nil {
+		return fmt.Errorf("binprof: reading version: %v", err)
+	}
+	if version > Version {
+		return fmt.Errorf("binprof: unsupported version %d (expected <= %d)", version, Version)
+	}
+	r.strings = r.strings[:0]
+	return nil
+}
+
+// Next returns the next graph, sampling, granularity, vertex or edge record.
+// At the end of the input it returns io.EOF.
+func (r *Reader) Next() (*Record, error) {
+	for {
+		kind, err := r.r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if kind == Magic[0] {
+			if err := r.header(kind); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		length, err := binary.ReadUvarint(r.r)
+		if err != nil {
+			return nil, unexpected(err)
+		}
+		if length > MaxRecord {
+			return nil, fmt.Errorf("binprof: %d byte record (the limit is %d bytes)", length, MaxRecord)
+		}
+		if uint64(cap(r.payload)) < length {
+			r.payload = make([]byte, length)
+		}
+		r.payload = r.payload[:length]
+		r.off = 0
+		r.err = nil
+		if _, err := io.ReadFull(r.r, r.payload); err != nil {
+			return nil, unexpected(err)
+		}
+		rec := &Record{Kind: Kind(kind)}
+		switch rec.Kind {
+		case stringRecord:
+			r.strings = append(r.strings, string(r.payload))
+			continue
+		case GraphStart:
+			rec.Label = r.str()
+		case VertexRecord:
+			rec.Vertex = Vertex{
+				Id:           int(r.uvarint()),
+				Label:        r.str(),
+				BasicBlockId: int(r.uvarint()),
+				FnName:       r.str(),
+				Position:     r.str(),
+				Duration:     time.Duration(r.varint()),
+			}
+			if r.more() {
+				rec.Vertex.Site = int(r.uvarint())
+				rec.Vertex.Predicate = r.str()
+			}
+			if r.more() {
+				rec.Vertex.Observed = int(r.uvarint())
+			}
+		case EdgeRecord:
+			rec.Edge = Edge{
+				Src:   int(r.uvarint()),
+				Targ:  int(r.uvarint()),
+				Count: int(r.uvarint()),
+			}
+			if r.more() {
+				rec.Edge.Kind = r.str()
+			}
+		case SamplingRecord:
+			rec.Sampling = Sampling{
+				Params: r.str(),
+				Rate:   math.Float64frombits(r.uvarint()),
+			}
+		case GranularityRecord:
+			rec.Granularity = r.str()
+		case GraphEnd:
+		default:
+			// a record from a newer writer
+			continue
+		}
+		if r.err != nil {
+			return nil, fmt.Errorf("binprof: malformed %q record: %v", kind, r.err)
+		}
+		return rec, nil
+	}
+}
+
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// more reports whether the payload has fields left (added by a newer writer)
+func (r *Reader) more() bool {
+	return r.err == nil && r.off < len(r.payload)
+}
+
+func (r *Reader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	x, n := binary.Uvarint(r.payload[r.off:])
+	if n <= 0 {
+		r.err = fmt.Errorf("bad uvarint at offset %d", r.off)
+		return 0
+	}
+	r.off += n
+	return x
+}
+
+func (r *Reader) varint() int64 {
+	if r.err != nil {
+		return 0
+	}
+	x, n := binary.Varint(r.payload[r.off:])
+	if n <= 0 {
+		r.err = fmt.Errorf("bad varint at offset %d", r.off)
+		return 0
+	}
+	r.off += n
+	return x
+}
+
+func (r *Reader) str() string {
+	id := r.uvarint()
+	if r.err != nil {
+		return ""
+	}
+	if id >= uint64(len(r.strings)) {
+		r.err = fmt.Errorf("unknown string %d", id)
+		return ""
+	}
+	return r.strings[id]
+}
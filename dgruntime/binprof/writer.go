@@ -0,0 +1,210 @@
+package binprof
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"math"
+)
+
+// WriteGraph writes a binary profile of a single graph labeled label: its
+// sampling and granularity (when given) then the vertices and edges visit
+// hands to vertex and edge. Once a write fails the rest of the graph is
+// skipped and the error returned.
+func WriteGraph(fout io.Writer, label string, sampling *Sampling, granularity string, visit func(vertex func(*Vertex), edge func(*Edge))) (err error) {
+	w, err := NewWriter(fout)
+	if err != nil {
+		return err
+	}
+	if err := w.StartGraph(label); err != nil {
+		return err
+	}
+	if sampling != nil {
+		if err := w.Sampling(sampling); err != nil {
+			return err
+		}
+	}
+	if granularity != "" {
+		if err := w.Granularity(granularity); err != nil {
+			return err
+		}
+	}
+	visit(
+		func(v *Vertex) {
+			if err == nil {
+				err = w.Vertex(v)
+			}
+		},
+		func(e *Edge) {
+			if err == nil {
+				err = w.Edge(e)
+			}
+		},
+	)
+	if err != nil {
+		return err
+	}
+	if err := w.EndGraph(); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// Writer writes a binary profile. Records are buffered, call Flush when done.
+type Writer struct {
+	w       *bufio.Writer
+	strings map[string]uint64
+	payload []byte
+	scratch [binary.MaxVarintLen64]byte
+}
+
+// NewWriter writes the header to w and returns a Writer for the records
+func NewWriter(w io.Writer) (*Writer, error) {
+	bw := &Writer{
+		w:       bufio.NewWriter(w),
+		strings: make(map[string]uint64),
+	}
+	if _, err := bw.w.Write(Magic); err != nil {
+		return nil, err
+	}
+	n := binary.PutUvarint(bw.scratch[:], Version)
+	if _, err := bw.w.Write(bw.scratch[:n]); err != nil {
+		return nil, err
+	}
+	return bw, nil
+}
+
+// StartGraph begins a graph with an optional label
+func (w *Writer) StartGraph(label string) error {
+	id, err := w.str(label)
+	if err != nil {
+		return err
+	}
+	w.payload = w.payload[:0]
+	w.uvarint(id)
+	return w.record(GraphStart)
+}
+
+// Vertex writes a vertex of the current graph
+func (w *Writer) Vertex(v *Vertex) error {
+	label, err := w.str(v.Label)
+	if err != nil {
+		return err
+	}
+	fnName, err := w.str(v.FnName)
+	if err != nil {
+		return err
+	}
+	pos, err := w.str(v.Position)
+	if err != nil {
+		return err
+	}
+	var pred uint64
+	if v.Predicate != "" {
+		if pred, err = w.str(v.Predicate); err != nil {
+			return err
+		}
+	}
+	w.payload = w.payload[:0]
+	w.uvarint(uint64(v.Id))
+	w.uvarint(label)
+	w.uvarint(uint64(v.BasicBlockId))
+	w.uvarint(fnName)
+	w.uvarint(pos)
+	w.varint(int64(v.Duration))
+	if v.Predicate != "" {
+		// written only when set so basic blocks stay as they were
+		w.uvarint(uint64(v.Site))
+		w.uvarint(pred)
+		w.uvarint(uint64(v.Observed))
+	}
+	return w.record(VertexRecord)
+}
+
+// Edge writes an edge of the current graph
+func (w *Writer) Edge(e *Edge) error {
+	var kind uint64
+	if e.Kind != "" {
+		var err error
+		if kind, err = w.str(e.Kind); err != nil {
+			return err
+		}
+	}
+	w.payload = w.payload[:0]
+	w.uvarint(uint64(e.Src))
+	w.uvarint(uint64(e.Targ))
+	w.uvarint(uint64(e.Count))
+	if e.Kind != "" {
+		// written only when set so control flow edges stay as they were
+		w.uvarint(kind)
+	}
+	return w.record(EdgeRecord)
+}
+
+// Sampling records how the current graph was sampled
+func (w *Writer) Sampling(s *Sampling) error {
+	params, err := w.str(s.Params)
+	if err != nil {
+		return err
+	}
+	w.payload = w.payload[:0]
+	w.uvarint(params)
+	w.uvarint(math.Float64bits(s.Rate))
+	return w.record(SamplingRecord)
+}
+
+// Granularity records what the probes of the current graph recorded
+func (w *Writer) Granularity(g string) error {
+	id, err := w.str(g)
+	if err != nil {
+		return err
+	}
+	w.payload = w.payload[:0]
+	w.uvarint(id)
+	return w.record(GranularityRecord)
+}
+
+// EndGraph ends the current graph
+func (w *Writer) EndGraph() error {
+	w.payload = w.payload[:0]
+	return w.record(GraphEnd)
+}
+
+// Flush writes any buffered records to the underlying writer
+func (w *Writer) Flush() error {
+	return w.w.Flush()
+}
+
+// str returns the string table index of s writing a string record if s has
+// not been seen before.
+func (w *Writer) str(s string) (uint64, error) {
+	if id, has := w.strings[s]; has {
+		return id, nil
+	}
+	id := uint64(len(w.strings))
+	w.strings[s] = id
+	w.payload = append(w.payload[:0], s...)
+	return id, w.record(stringRecord)
+}
+
+func (w *Writer) uvarint(x uint64) {
+	n := binary.PutUvarint(w.scratch[:], x)
+	w.payload = append(w.payload, w.scratch[:n]...)
+}
+
+func (w *Writer) varint(x int64) {
+	n := binary.PutVarint(w.scratch[:], x)
+	w.payload = append(w.payload, w.scratch[:n]...)
+}
+
+func (w *Writer) record(kind Kind) error {
+	if err := w.w.WriteByte(byte(kind)); err != nil {
+		return err
+	}
+	n := binary.PutUvarint(w.scratch[:], uint64(len(w.payload)))
+	if _, err := w.w.Write(w.scratch[:n]); err != nil {
+		return err
+	}
+	_, err := w.w.Write(w.payload)
+	return err
+}
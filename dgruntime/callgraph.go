@@ -0,0 +1,62 @@
+package dgruntime
+
+import (
+	"dgruntime/dgtypes"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+)
+
+// The calls between the instrumented functions are written as a call graph
+// next to the flow graph: call-graph.dot, call-graph.json and a pprof
+// profile call-graph.pb.gz (`go tool pprof -top call-graph.pb.gz`). Setting
+//
+//	DGPROF_CONTEXT=<k>
+//
+// also counts the calls by their k-limited calling context (the callee and
+// up to k of its callers). The pprof profile then has a sample for each
+// context.
+
+// callContexts reads DGPROF_CONTEXT, 0 means no contexts are recorded
+func callContexts() int {
+	v := os.Getenv("DGPROF_CONTEXT")
+	if v == "" {
+		return 0
+	}
+	k, err := strconv.Atoi(v)
+	if err != nil || k < 1 || k >= dgtypes.MaxContext {
+		panic(fmt.Errorf("dynagrok: bad DGPROF_CONTEXT=%v expected an integer from 1 to %d", v, dgtypes.MaxContext-1))
+	}
+	return k
+}
+
+// callContext is the calling context of the call on top of g's stack
+func (g *Goroutine) callContext(k int) dgtypes.CallContext {
+	var c dgtypes.CallContext
+	n := 0
+	for i := len(g.Stack) - 1; i > 0 && n <= k; i-- {
+		fc := g.Stack[i]
+		if fc.Skip {
+			break
+		}
+		c[n] = fc.FuncPc
+		n++
+	}
+	return c
+}
+
+// writeCallGraph writes the profile's call graph in each format
+func (e *Execution) writeCallGraph(p *dgtypes.Profile) {
+	writeOut(e, "call-graph.dot", p.WriteCallGraphDot)
+	writeOut(e, "call-graph.json", func(fout io.Writer) {
+		if err := p.WriteCallGraphJSON(fout); err != nil {
+			panic(err)
+		}
+	})
+	writeOut(e, "call-graph.pb.gz", func(fout io.Writer) {
+		if err := p.WritePprof(fout); err != nil {
+			panic(err)
+		}
+	})
+}
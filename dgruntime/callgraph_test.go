@@ -0,0 +1,41 @@
+package dgruntime
+
+import (
+	"dgruntime/dgtypes"
+	"testing"
+)
+
+func TestCallContext(t *testing.T) {
+	// the goroutine's entry (which is never part of a context) and 4 calls
+	stack := func(skip int) []*dgtypes.FuncCall {
+		s := []*dgtypes.FuncCall{{Name: "entry"}}
+		for pc := uintptr(1); pc <= 4; pc++ {
+			s = append(s, &dgtypes.FuncCall{FuncPc: pc, Skip: int(pc) == skip})
+		}
+		return s
+	}
+	for _, c := range []struct {
+		k, skip int
+		want    dgtypes.CallContext
+	}{
+		{1, 0, dgtypes.CallContext{4, 3}},
+		{2, 0, dgtypes.CallContext{4, 3, 2}},
+		{3, 0, dgtypes.CallContext{4, 3, 2, 1}},
+		{dgtypes.MaxContext - 1, 0, dgtypes.CallContext{4, 3, 2, 1}},
+		{3, 2, dgtypes.CallContext{4, 3}}, // ends at the call which was not sampled
+		{3, 3, dgtypes.CallContext{4}},
+	} {
+		g := &Goroutine{Stack: stack(c.skip)}
+		if got := g.callContext(c.k); got != c.want {
+			t.Errorf("k %d, skip %d: got %v expected %v", c.k, c.skip, got, c.want)
+		}
+	}
+	deep := &Goroutine{Stack: []*dgtypes.FuncCall{{Name: "entry"}}}
+	for pc := uintptr(1); pc <= 2*dgtypes.MaxContext; pc++ {
+		deep.Stack = append(deep.Stack, &dgtypes.FuncCall{FuncPc: pc})
+	}
+	c := deep.callContext(dgtypes.MaxContext - 1)
+	if c.Len() != dgtypes.MaxContext || c[0] != 2*dgtypes.MaxContext || c[dgtypes.MaxContext-1] != dgtypes.MaxContext+1 {
+		t.Errorf("deep stack context %v", c)
+	}
+}
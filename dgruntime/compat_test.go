@@ -0,0 +1,245 @@
+package dgruntime
+
+import (
+	"bufio"
+	"fmt"
+	"go/ast"
+	"go/build"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// dgruntime is copied into the patched go1.8 GOROOT and compiled by go1.8
+// (unless --portable-runtime is used). Its packages may use neither the
+// language features nor the standard library API added since.
+const minGoMinor = 8
+
+func TestGo18Compatible(t *testing.T) {
+	newer, err := newerAPI(runtime.GOROOT(), minGoMinor)
+	if err != nil {
+		t.Skipf("the API of the standard library is not available: %v", err)
+	}
+	for _, tags := range [][]string{nil, {"dgpatched"}} {
+		c := &compatChecker{
+			t:     t,
+			fset:  token.NewFileSet(),
+			tags:  tags,
+			std:   importer.Default(),
+			pkgs:  make(map[string]*types.Package),
+			newer: newer,
+		}
+		err := filepath.Walk(".", func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !info.IsDir() {
+				return nil
+			}
+			if info.Name() == "testdata" {
+				return filepath.SkipDir
+			}
+			_, err = c.Import(filepath.ToSlash(filepath.Join("dgruntime", path)))
+			if _, ok := err.(*build.NoGoError); ok {
+				return nil
+			}
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// compatChecker type checks the dgruntime packages as go1.8 code
+type compatChecker struct {
+	t     *testing.T
+	fset  *token.FileSet
+	tags  []string
+	std   types.Importer
+	pkgs  map[string]*types.Package
+	newer map[string]string
+}
+
+func (c *compatChecker) Import(path string) (*types.Package, error) {
+	if path != "dgruntime" && !strings.HasPrefix(path, "dgruntime/") {
+		return c.std.Import(path)
+	}
+	if pkg, has := c.pkgs[path]; has {
+		return pkg, nil
+	}
+	ctx := build.Default
+	ctx.BuildTags = c.tags
+	dir := filepath.FromSlash(strings.TrimPrefix(strings.TrimPrefix(path, "dgruntime"), "/"))
+	if dir == "" {
+		dir = "."
+	}
+	bpkg, err := ctx.ImportDir(dir, 0)
+	if err != nil {
+		return nil, err
+	}
+	files := make([]*ast.File, 0, len(bpkg.GoFiles))
+	for _, name := range bpkg.GoFiles {
+		f, err := parser.ParseFile(c.fset, filepath.Join(dir, name), nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	info := &types.Info{
+		Uses:       make(map[*ast.Ident]types.Object),
+		Selections: make(map[*ast.SelectorExpr]*types.Selection),
+	}
+	conf := types.Config{
+		GoVersion: fmt.Sprintf("go1.%d", minGoMinor),
+		Importer:  c,
+		Error: func(err error) {
+			// the stock runtime lacks the accessors of the patched one
+			if len(c.tags) > 0 && strings.Contains(err.Error(), "undefined: runtime.") {
+				return
+			}
+			c.t.Errorf("%v (tags %v)", err, c.tags)
+		},
+	}
+	pkg, _ := conf.Check(path, c.fset, files, info)
+	c.pkgs[path] = pkg
+	for id, obj := range info.Uses {
+		// fields and methods are looked up through the selections
+		if obj.Pkg() != nil && obj.Parent() == obj.Pkg().Scope() {
+			c.api(id.Pos(), obj.Pkg().Path(), obj.Name())
+		}
+	}
+	for sel, s := range info.Selections {
+		if owner := selectedOwner(s); owner != "" {
+			c.api(sel.Sel.Pos(), s.Obj().Pkg().Path(), owner+"."+s.Obj().Name())
+		}
+	}
+	return pkg, nil
+}
+
+// api reports the use of name (of the package path) if it is newer than go1.8
+func (c *compatChecker) api(pos token.Pos, path, name string) {
+	if version, has := c.newer[path+"."+name]; has {
+		c.t.Errorf("%v: %v.%v requires %v (tags %v)", c.fset.Position(pos), path, name, version, c.tags)
+	}
+}
+
+// selectedOwner is the name of the type declaring the selected field or
+// method ("" when it cannot tell)
+func selectedOwner(s *types.Selection) string {
+	if s.Obj().Pkg() == nil {
+		return ""
+	}
+	var t types.Type
+	switch obj := s.Obj().(type) {
+	case *types.Func:
+		t = obj.Type().(*types.Signature).Recv().Type()
+	case *types.Var:
+		if len(s.Index()) != 1 {
+			// a promoted field
+			return ""
+		}
+		t = s.Recv()
+	}
+	if p, ok := t.(*types.Pointer); ok {
+		t = p.Elem()
+	}
+	if named, ok := t.(*types.Named); ok {
+		return named.Obj().Name()
+	}
+	return ""
+}
+
+// newerAPI reads the API added to the standard library after go1.<minor>
+// from $GOROOT/api. It maps "path.Name" (or "path.Type.Name" for fields and
+// methods) to the release which added it. The API files list declarations
+// again when their types change, what go1.<minor> had is left out.
+func newerAPI(goroot string, minor int) (map[string]string, error) {
+	old := make(map[string]bool)
+	newer := make(map[string]string)
+	platform := runtime.GOOS + "-" + runtime.GOARCH
+	for v := 0; ; v++ {
+		version := fmt.Sprintf("go1.%d", v)
+		if v == 0 {
+			version = "go1"
+		}
+		f, err := os.Open(filepath.Join(goroot, "api", version+".txt"))
+		if os.IsNotExist(err) && v > minor+1 {
+			return newer, nil
+		} else if err != nil {
+			return nil, err
+		}
+		s := bufio.NewScanner(f)
+		for s.Scan() {
+			key := apiKey(s.Text(), platform)
+			if key == "" || old[key] {
+				continue
+			}
+			if v <= minor {
+				old[key] = true
+			} else if _, has := newer[key]; !has {
+				newer[key] = version
+			}
+		}
+		f.Close()
+		if err := s.Err(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// apiKey is the key (see newerAPI) of a line of an API file such as
+//
+//	pkg sync, method (*Map) Load(interface{}) (interface{}, bool)
+//	pkg archive/tar, type Header struct, Format Format
+//
+// It is "" for lines of other platforms.
+func apiKey(line, platform string) string {
+	if !strings.HasPrefix(line, "pkg ") {
+		return ""
+	}
+	comma := strings.Index(line, ", ")
+	if comma < 0 {
+		return ""
+	}
+	path, decl := line[len("pkg "):comma], line[comma+2:]
+	if i := strings.Index(path, " ("); i >= 0 {
+		if !strings.HasPrefix(path[i+2:], platform) {
+			return ""
+		}
+		path = path[:i]
+	}
+	fields := strings.FieldsFunc(decl, func(r rune) bool {
+		return r == ' ' || r == '(' || r == ')' || r == ','
+	})
+	if len(fields) < 2 {
+		return ""
+	}
+	switch fields[0] {
+	case "func", "const", "var":
+		return path + "." + fields[1]
+	case "method":
+		if len(fields) < 3 {
+			return ""
+		}
+		return path + "." + strings.TrimPrefix(fields[1], "*") + "." + fields[2]
+	case "type":
+		// a field or interface method follows the ", " after the type
+		if i := strings.Index(decl, ", "); i >= 0 {
+			member := strings.FieldsFunc(decl[i+2:], func(r rune) bool {
+				return r == ' ' || r == '('
+			})
+			if len(member) > 0 {
+				return path + "." + fields[1] + "." + member[0]
+			}
+		}
+		return path + "." + fields[1]
+	}
+	return ""
+}
@@ -0,0 +1,205 @@
+package dgruntime
+
+import (
+	"dgruntime/dgtypes"
+	"reflect"
+	"sync"
+	"sync/atomic"
+)
+
+// The instrumenter links the flow graphs of different goroutines with typed
+// edges (see dgtypes.SpawnEdge, SendEdge and CloseEdge). A go statement
+//
+//	go f(a, b)
+//
+// becomes
+//
+//	{
+//		__dgf, __dga0, __dga1 := f, a, b
+//		__dgspawn := dgruntime.Spawn()
+//		go func() {
+//			dgruntime.Spawned(__dgspawn)
+//			defer dgruntime.SpawnDone()
+//			__dgf(__dga0, __dga1)
+//		}()
+//	}
+//
+// and channel sends, receives and closes report the channel after (for
+// close, before) the operation.
+
+// Origin is the block of the goroutine which executed a go statement
+type Origin struct {
+	blk dgtypes.BlkEntrance
+}
+
+// current is the block g is executing. It is the zero BlkEntrance when the
+// current call is not recorded.
+func (g *Goroutine) current() dgtypes.BlkEntrance {
+	fc := g.Stack[len(g.Stack)-1]
+	if fc.Skip || fc.FuncPc == 0 {
+		return dgtypes.BlkEntrance{}
+	}
+	return fc.Last
+}
+
+// link records an edge of the given kind between blocks of two goroutines in
+// g's buffer. Edges with an unrecorded end are dropped.
+func (g *Goroutine) link(src, targ dgtypes.BlkEntrance, kind string) {
+	if src.In == 0 || targ.In == 0 {
+		return
+	}
+	b := g.begin()
+	b.Flows[dgtypes.FlowEdge{Src: src, Targ: targ, Kind: kind}]++
+	g.end()
+}
+
+// Spawn is called by a goroutine about to execute a go statement
+func Spawn() Origin {
+	execCheck()
+	return Origin{blk: exec.Goroutine(identity.GoID()).current()}
+}
+
+// Spawned is called first thing by a goroutine started by an instrumented go
+// statement. Its first recorded block is linked to the spawning block.
+func Spawned(o Origin) {
+	execCheck()
+	if o.blk.In == 0 {
+		return
+	}
+	g := exec.Goroutine(identity.GoID())
+	g.spawnedFrom = o.blk
+}
+
+// SpawnDone is deferred by a goroutine started by an instrumented go
+// statement. If the function it ran was not instrumented the goroutine never
+// left the instrumented code, it does now.
+func SpawnDone() {
+	execCheck()
+	g := exec.goroutines.lookup(identity.GoID())
+	if g != nil && len(g.Stack) == 1 {
+		g.Exit()
+	}
+}
+
+// chanSlots is the size of the table of channel states. Channels hash into
+// it, a channel taking the slot of another drops the pending operations of
+// the other (so memory stays bounded no matter how many channels are made).
+const chanSlots = 1024
+
+// maxPending bounds the operations waiting for a partner in a slot. An
+// operation on a channel whose other end is not instrumented never finds a
+// partner.
+const maxPending = 64
+
+// chanState pairs the sends and receives of a channel. Whichever of a send
+// and its receive is reported second records the edge.
+type chanState struct {
+	m        sync.Mutex
+	ch       uintptr
+	sends    []dgtypes.BlkEntrance // sends waiting for their receive
+	recvs    []dgtypes.BlkEntrance // receives waiting for their send
+	closed   dgtypes.BlkEntrance   // the block which closed the channel
+	isClosed bool
+}
+
+var chans [chanSlots]chanState
+
+// lockChan returns the channel's (locked) state
+func lockChan(ch interface{}) *chanState {
+	p := reflect.ValueOf(ch).Pointer()
+	s := &chans[((uint64(p)>>4)*0x9E3779B97F4A7C15)>>54]
+	s.m.Lock()
+	if s.ch != p {
+		s.ch = p
+		s.sends = s.sends[:0]
+		s.recvs = s.recvs[:0]
+		s.closed = dgtypes.BlkEntrance{}
+		s.isClosed = false
+	}
+	return s
+}
+
+// Send is called after a value was sent on the channel
+func Send(ch interface{}) {
+	execCheck()
+	g := exec.Goroutine(identity.GoID())
+	from := g.current()
+	s := lockChan(ch)
+	var to dgtypes.BlkEntrance
+	matched := len(s.recvs) > 0
+	if matched {
+		to = s.recvs[0]
+		s.recvs = s.recvs[1:]
+	} else if len(s.sends) < maxPending {
+		s.sends = append(s.sends, from)
+	}
+	s.m.Unlock()
+	if matched {
+		g.link(from, to, dgtypes.SendEdge)
+	}
+}
+
+// Recv is called after a value was received from the channel. A receive
+// with no send to pair with on a closed channel saw the close.
+func Recv(ch interface{}) {
+	execCheck()
+	recv(ch, true, false)
+}
+
+// RecvOk is called after a `v, ok := <-ch` receive
+func RecvOk(ch interface{}, ok bool) {
+	execCheck()
+	recv(ch, ok, ok)
+}
+
+func recv(ch interface{}, maybeValue, value bool) {
+	g := exec.Goroutine(identity.GoID())
+	to := g.current()
+	s := lockChan(ch)
+	var from dgtypes.BlkEntrance
+	kind := ""
+	switch {
+	case maybeValue && len(s.sends) > 0:
+		from, kind = s.sends[0], dgtypes.SendEdge
+		s.sends = s.sends[1:]
+	case !value && s.isClosed:
+		from, kind = s.closed, dgtypes.CloseEdge
+	case maybeValue && len(s.recvs) < maxPending:
+		s.recvs = append(s.recvs, to)
+	}
+	s.m.Unlock()
+	if kind != "" {
+		g.link(from, to, kind)
+	}
+}
+
+// Close is called before the channel is closed
+func Close(ch interface{}) {
+	execCheck()
+	g := exec.Goroutine(identity.GoID())
+	from := g.current()
+	s := lockChan(ch)
+	s.closed = from
+	s.isClosed = true
+	s.m.Unlock()
+}
+
+// own counts the goroutines dgruntime runs itself (the signal handler and
+// os/signal's loop, the merger and the segment triggers)
+var own int32
+
+// goOwn runs f in one of dgruntime's own goroutines
+func goOwn(f func()) {
+	atomic.AddInt32(&own, 1)
+	go func() {
+		defer atomic.AddInt32(&own, -1)
+		f()
+	}()
+}
+
+// NumGoroutine wraps the program's calls to runtime.NumGoroutine, n is the
+// count they return. It takes away dgruntime's own goroutines: programs
+// waiting for their goroutines to exit would otherwise wait forever.
+func NumGoroutine(n int) int {
+	return n - int(atomic.LoadInt32(&own))
+}
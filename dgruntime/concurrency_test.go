@@ -0,0 +1,162 @@
+package dgruntime
+
+import (
+	"dgruntime/dgtypes"
+	"os"
+	"reflect"
+	"runtime"
+	"testing"
+)
+
+func blk(pc uintptr, bbid int) dgtypes.BlkEntrance {
+	return dgtypes.BlkEntrance{In: pc, BasicBlockId: bbid}
+}
+
+// at makes the calling goroutine's current block b (the zero block for a
+// call which was not sampled)
+func at(e *Execution, b dgtypes.BlkEntrance) {
+	g := e.Goroutine(identity.GoID())
+	g.Stack = append(g.Stack[:1], &dgtypes.FuncCall{FuncPc: b.In, Last: b, Skip: b.In == 0})
+}
+
+// linked takes the edges the calling goroutine recorded
+func linked(e *Execution) map[dgtypes.FlowEdge]int {
+	return e.Goroutine(identity.GoID()).take().Flows
+}
+
+func TestChanPairing(t *testing.T) {
+	e, dir := testExec(t)
+	defer os.RemoveAll(dir)
+	// the channels are kept alive so a new one never reuses the address (and
+	// the state) of an old one
+	var chans []chan int
+	edge := func(src, targ dgtypes.BlkEntrance, kind string) dgtypes.FlowEdge {
+		return dgtypes.FlowEdge{Src: src, Targ: targ, Kind: kind}
+	}
+	for _, c := range []struct {
+		name string
+		ops  func(ch chan int)
+		want map[dgtypes.FlowEdge]int
+	}{
+		{"send then receive", func(ch chan int) {
+			at(e, blk(1, 1))
+			Send(ch)
+			at(e, blk(2, 1))
+			Recv(ch)
+		}, map[dgtypes.FlowEdge]int{edge(blk(1, 1), blk(2, 1), dgtypes.SendEdge): 1}},
+		{"the receive is reported first", func(ch chan int) {
+			at(e, blk(2, 1))
+			Recv(ch)
+			at(e, blk(1, 1))
+			Send(ch)
+		}, map[dgtypes.FlowEdge]int{edge(blk(1, 1), blk(2, 1), dgtypes.SendEdge): 1}},
+		{"in order", func(ch chan int) {
+			at(e, blk(1, 1))
+			Send(ch)
+			at(e, blk(1, 2))
+			Send(ch)
+			at(e, blk(2, 1))
+			Recv(ch)
+			at(e, blk(2, 2))
+			RecvOk(ch, true)
+		}, map[dgtypes.FlowEdge]int{
+			edge(blk(1, 1), blk(2, 1), dgtypes.SendEdge): 1,
+			edge(blk(1, 2), blk(2, 2), dgtypes.SendEdge): 1,
+		}},
+		{"close", func(ch chan int) {
+			at(e, blk(1, 1))
+			Send(ch)
+			at(e, blk(1, 2))
+			Close(ch)
+			// the value sent before the close is still received
+			at(e, blk(2, 1))
+			RecvOk(ch, true)
+			at(e, blk(2, 2))
+			RecvOk(ch, false)
+			at(e, blk(3, 1))
+			Recv(ch)
+		}, map[dgtypes.FlowEdge]int{
+			edge(blk(1, 1), blk(2, 1), dgtypes.SendEdge):  1,
+			edge(blk(1, 2), blk(2, 2), dgtypes.CloseEdge): 1,
+			edge(blk(1, 2), blk(3, 1), dgtypes.CloseEdge): 1,
+		}},
+		{"a receive on an open channel does not see a close", func(ch chan int) {
+			at(e, blk(2, 1))
+			RecvOk(ch, false)
+			at(e, blk(1, 1))
+			Send(ch)
+		}, map[dgtypes.FlowEdge]int{}},
+		{"an end which was not recorded", func(ch chan int) {
+			at(e, dgtypes.BlkEntrance{})
+			Send(ch)
+			at(e, blk(2, 1))
+			Recv(ch)
+			Recv(ch)
+			at(e, dgtypes.BlkEntrance{})
+			Send(ch)
+		}, map[dgtypes.FlowEdge]int{}},
+		{"at most maxPending wait", func(ch chan int) {
+			at(e, blk(1, 1))
+			for k := 0; k < 2*maxPending; k++ {
+				Send(ch)
+			}
+			at(e, blk(2, 1))
+			for k := 0; k < 2*maxPending; k++ {
+				Recv(ch)
+			}
+		}, map[dgtypes.FlowEdge]int{
+			edge(blk(1, 1), blk(2, 1), dgtypes.SendEdge): maxPending,
+		}},
+	} {
+		ch := make(chan int)
+		chans = append(chans, ch)
+		c.ops(ch)
+		if got := linked(e); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%v: linked %v expected %v", c.name, got, c.want)
+		}
+	}
+
+	// the operations on other channels do not pair up
+	a, b := make(chan int), make(chan int)
+	chans = append(chans, a, b)
+	at(e, blk(1, 1))
+	Send(a)
+	at(e, blk(2, 1))
+	Recv(b)
+	if got := linked(e); len(got) != 0 {
+		t.Errorf("different channels linked %v", got)
+	}
+	runtime.KeepAlive(chans)
+}
+
+// TestChanRace sends on a channel from one goroutine and receives from
+// another. Either end may report first, every value is linked once.
+func TestChanRace(t *testing.T) {
+	e, dir := testExec(t)
+	defer os.RemoveAll(dir)
+	const n = 1000
+	ch := make(chan int)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		at(e, blk(2, 1))
+		for range ch {
+			Recv(ch)
+		}
+		e.Goroutine(identity.GoID()).Exit()
+	}()
+	at(e, blk(1, 1))
+	for k := 0; k < n; k++ {
+		ch <- k
+		Send(ch)
+	}
+	close(ch)
+	<-done
+	e.flush()
+	e.sync()
+	e.m.Lock()
+	defer e.m.Unlock()
+	if got := e.Profile.Flows[dgtypes.FlowEdge{Src: blk(1, 1), Targ: blk(2, 1), Kind: dgtypes.SendEdge}]; got != n {
+		t.Errorf("%d sends linked expected %d (%v)", got, n, e.Profile.Flows)
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"os"
 	"os/signal"
 	"runtime"
+	"sync/atomic"
 	"syscall"
 	"time"
 	"unsafe"
@@ -16,58 +17,179 @@ import (
 func init() {
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
-	go func() {
+	// the first Notify starts os/signal's loop goroutine
+	atomic.AddInt32(&own, 1)
+	goOwn(func() {
 		sig := <-sigs
-		fmt.Println("dynagrok got a sig", sig)
+		logf("dynagrok got a sig %v\n", sig)
 		Shutdown()
 		panic(fmt.Errorf("dynagrok caught signal: %v", sig))
-	}()
+	})
 }
 
 func Shutdown() {
-	fmt.Println(runtime.Wacky())
 	execCheck()
 	shutdown(exec)
 }
 
+// SetPolicy records the instrumentation policy (in the policy file format)
+// the program was built with. It is written to the profile directory so
+// analyses can tell which code was never observed.
+func SetPolicy(policy string) {
+	execCheck()
+	exec.m.Lock()
+	defer exec.m.Unlock()
+	exec.Policy = policy
+}
+
+// SetGranularity records the granularity the program was instrumented at:
+// func, block or edge (see dgtypes.FuncGranularity). The flow graphs record
+// it so the analyses know what a missing block means.
+func SetGranularity(granularity string) {
+	execCheck()
+	exec.m.Lock()
+	defer exec.m.Unlock()
+	if granularity == dgtypes.BlockGranularity {
+		granularity = ""
+	}
+	exec.Granularity = granularity
+}
+
 func ReportFailBool(fnName string, bbid int, pos string) bool {
 	execCheck()
-	exec.Fail(fnName, bbid, pos)
+	exec.Fail(&dgtypes.Failure{FnName: fnName, BasicBlockId: bbid, Position: pos})
 	return true
 }
 
 func ReportFailInt(fnName string, bbid int, pos string) int {
 	execCheck()
-	exec.Fail(fnName, bbid, pos)
+	exec.Fail(&dgtypes.Failure{FnName: fnName, BasicBlockId: bbid, Position: pos})
 	return 0
 }
 
 func ReportFailFloat(fnName string, bbid int, pos string) float64 {
 	execCheck()
-	exec.Fail(fnName, bbid, pos)
+	exec.Fail(&dgtypes.Failure{FnName: fnName, BasicBlockId: bbid, Position: pos})
 	return 0
 }
 
+// Fail marks the run as failing. The failure is reported at the block being
+// executed with the message and the instrumented call stack.
+func Fail(msg string) {
+	execCheck()
+	exec.Fail(failure(msg))
+}
+
+// Assert fails the run (see Fail) when cond is false. The instrumenter
+// compiles `//dynagrok:invariant <expr>` comments into calls to Assert.
+func Assert(cond bool, msg string) {
+	if !cond {
+		execCheck()
+		exec.Fail(failure(msg))
+	}
+}
+
+// failure describes a failure the program reported at the block the calling
+// goroutine is executing
+func failure(msg string) *dgtypes.Failure {
+	f := &dgtypes.Failure{Message: msg}
+	if g := exec.goroutines.lookup(identity.GoID()); g != nil {
+		for i := len(g.Stack) - 1; i > 0; i-- {
+			f.Stack = append(f.Stack, *frame(g.Stack[i]))
+		}
+	}
+	if len(f.Stack) > 0 {
+		f.Position, f.FnName, f.BasicBlockId = f.Stack[0].Position, f.Stack[0].FnName, f.Stack[0].BasicBlockId
+	} else if _, file, line, ok := runtime.Caller(2); ok {
+		// not called from the instrumented code
+		f.Position = fmt.Sprintf("%v:%d", file, line)
+	}
+	return f
+}
+
 func EnterBlkFromCond(bbid int, pos string) bool {
 	EnterBlk(bbid, pos)
 	return true
 }
 
 func EnterBlk(bbid int, pos string) {
+	enterBlk(false, -1, bbid, pos)
+}
+
+// EnterEdgeFromCond is EnterEdge for the probes placed in conditions
+func EnterEdgeFromCond(src, bbid int, pos string) bool {
+	enterBlk(true, src, bbid, pos)
+	return true
+}
+
+// EnterEdge enters the block bbid by the control flow edge from the block
+// src. Programs instrumented at edge granularity call it instead of
+// EnterBlk. The probe is on the edge: at the end of src or at the head of
+// bbid when src branches there (a switch to its case, a range loop to its
+// body or exit). The edges which jump to such a probe from elsewhere name
+// their own source first (see EdgeFrom).
+func EnterEdge(src, bbid int, pos string) {
+	enterBlk(true, src, bbid, pos)
+}
+
+// EnterEdgeIf wraps the condition evaluated by the block src. It enters the
+// block t by the edge from src when cond holds and f otherwise. It returns
+// cond.
+func EnterEdgeIf(src, t, f int, tpos, fpos string, cond bool) bool {
+	if cond {
+		enterBlk(true, src, t, tpos)
+	} else {
+		enterBlk(true, src, f, fpos)
+	}
+	return cond
+}
+
+// EdgeFrom names src as the source of the edge the next EnterEdge enters
+// the block bbid by. It is placed before a fallthrough (or a break, or a
+// loop) jumping to the probe of another edge into bbid.
+func EdgeFrom(src, bbid int) {
+	execCheck()
+	g := exec.Goroutine(identity.GoID())
+	if fc := g.Stack[len(g.Stack)-1]; !fc.Skip {
+		fc.Via = dgtypes.FlowEdge{
+			Src:  dgtypes.BlkEntrance{In: fc.FuncPc, BasicBlockId: src},
+			Targ: dgtypes.BlkEntrance{In: fc.FuncPc, BasicBlockId: bbid},
+		}
+	}
+}
+
+// enterBlk enters the block bbid. The flow into it is the CFG edge from src
+// for the edge probes and the one from the last block entered otherwise.
+func enterBlk(edge bool, src, bbid int, pos string) {
 	execCheck()
-	g := exec.Goroutine(runtime.GoID())
-	g.m.Lock()
-	defer g.m.Unlock()
+	g := exec.Goroutine(identity.GoID())
+	if g.unwinding != nil {
+		g.resumed()
+	}
 	fc := g.Stack[len(g.Stack)-1]
+	if fc.Skip {
+		return
+	}
+	b := g.begin()
+	defer g.end()
 	last := fc.Last
-	start := fc.LastTime
 	cur := dgtypes.BlkEntrance{In: fc.FuncPc, BasicBlockId: bbid}
+	from := last
+	if edge {
+		from = dgtypes.BlkEntrance{In: fc.FuncPc, BasicBlockId: src}
+		if fc.Via.Targ == cur {
+			from = fc.Via.Src
+		}
+		fc.Via = dgtypes.FlowEdge{}
+	}
+	start := fc.LastTime
 	fc.Last = cur
+	fc.Pos = pos
 	fc.LastTime = time.Now()
 	dur := fc.LastTime.Sub(start)
-	g.Flows[dgtypes.FlowEdge{Src: last, Targ: cur}]++
-	g.Positions[cur] = pos
-	g.Durations[last] += dur
+	b.Flows[dgtypes.FlowEdge{Src: from, Targ: cur}]++
+	b.Positions[cur] = pos
+	b.Durations[last] += dur
 	//
 	// Masri's Algorithm for dynamic control dependence
 	//
@@ -91,15 +213,30 @@ func EnterBlk(bbid int, pos string) {
 	}
 }
 
-func EnterFunc(name, pos string, cfg [][]int, ipdom []int) {
+// CFG and IPDom are the types of EnterFunc's tables: the successors and the
+// immediate post dominator of each block. The instrumented code names them
+// here as the program may redeclare int (or nil, see NoCFG).
+type (
+	CFG   [][]int
+	IPDom []int
+)
+
+// NoCFG and NoIPDom are the tables of the functions instrumented at the func
+// granularity
+var (
+	NoCFG   CFG
+	NoIPDom IPDom
+)
+
+func EnterFunc(name, pos string, cfg CFG, ipdom IPDom) {
 	execCheck()
-	g := exec.Goroutine(runtime.GoID())
-	// g.m.Lock()
-	if g.Closed {
-		// g.m.Unlock()
-		panic("enter func on closed Goroutine")
+	g := exec.Goroutine(identity.GoID())
+	if !exec.sampler.sample(g) {
+		// skipped calls only go on the stack, they never touch the buffer
+		g.Stack = append(g.Stack, &dgtypes.FuncCall{Name: name, Skip: true})
+		return
 	}
-	pc := runtime.GetCallerPC(unsafe.Pointer(&name))
+	pc := identity.CallerPC(unsafe.Pointer(&name), 2)
 	f := runtime.FuncForPC(pc)
 	fpc := f.Entry()
 	cur := dgtypes.BlkEntrance{In: fpc, BasicBlockId: 0}
@@ -107,6 +244,7 @@ func EnterFunc(name, pos string, cfg [][]int, ipdom []int) {
 		Name:     name,
 		FuncPc:   fpc,
 		Last:     cur,
+		Pos:      pos,
 		LastTime: time.Now(),
 		CFG:      cfg,
 		IPDom:    ipdom,
@@ -117,10 +255,24 @@ func EnterFunc(name, pos string, cfg [][]int, ipdom []int) {
 	for i := range fc.DynCDP {
 		fc.DynCDP[i] = make(map[int]bool)
 	}
-	g.Flows[dgtypes.FlowEdge{Src: g.Stack[len(g.Stack)-2].Last, Targ: cur}]++
-	g.Calls[dgtypes.Call{Caller: g.Stack[len(g.Stack)-2].FuncPc, Callee: fpc}]++
-	g.Positions[cur] = pos
-	// g.m.Unlock()
+	b := g.begin()
+	if g.spawnedFrom.In != 0 {
+		// the goroutine's first recorded call (see Spawned)
+		b.Flows[dgtypes.FlowEdge{Src: g.spawnedFrom, Targ: cur, Kind: dgtypes.SpawnEdge}]++
+		g.spawnedFrom = dgtypes.BlkEntrance{}
+	}
+	if caller := g.Stack[len(g.Stack)-2]; caller.Skip {
+		// the caller was not sampled so the call starts a new trace
+		b.Flows[dgtypes.FlowEdge{Src: dgtypes.BlkEntrance{}, Targ: cur}]++
+	} else {
+		b.Flows[dgtypes.FlowEdge{Src: caller.Last, Targ: cur}]++
+		b.Calls[dgtypes.Call{Caller: caller.FuncPc, Callee: fpc}]++
+		if exec.Contexts > 0 {
+			b.Contexts[g.callContext(exec.Contexts)]++
+		}
+	}
+	b.Positions[cur] = pos
+	g.end()
 }
 
 func deriveProfile(items []interface{}) (dgtypes.ObjectProfile, []dgtypes.Type) {
@@ -142,60 +294,77 @@ func deriveProfile(items []interface{}) (dgtypes.ObjectProfile, []dgtypes.Type)
 
 func MethodInput(fnName string, pos string, inputs ...interface{}) {
 	execCheck()
-	g := exec.Goroutine(runtime.GoID())
+	g := exec.Goroutine(identity.GoID())
 	values, types := deriveProfile(inputs)
-	g.Inputs[fnName] = append(g.Inputs[fnName], values)
+	b := g.begin()
+	defer g.end()
+	b.Inputs[fnName] = append(b.Inputs[fnName], values)
 	for _, typ := range types {
-		g.Types[typ.Name()] = typ
+		b.Types[typ.Name()] = typ
 	}
 }
 
 func MethodOutput(fnName string, pos string, outputs ...interface{}) {
 	execCheck()
-	g := exec.Goroutine(runtime.GoID())
+	g := exec.Goroutine(identity.GoID())
 	values, types := deriveProfile(outputs)
-	g.Outputs[fnName] = append(g.Outputs[fnName], values)
+	b := g.begin()
+	defer g.end()
+	b.Outputs[fnName] = append(b.Outputs[fnName], values)
 	for _, typ := range types {
-		g.Types[typ.Name()] = typ
+		b.Types[typ.Name()] = typ
 	}
 }
 
+// ExitFunc is deferred by every instrumented function. It also runs when a
+// panic unwinds the function (see panics.go).
 func ExitFunc(name string) {
 	execCheck()
-	g := exec.Goroutine(runtime.GoID())
-	// g.m.Lock()
-	if g.Closed {
-		// g.m.Unlock()
-		panic("enter func on closed Goroutine")
-	}
-	g.CallCount++
+	g := exec.Goroutine(identity.GoID())
 	fc := g.Stack[len(g.Stack)-1]
+	// skipped calls only look for a panic while one is being unwound
+	unwinding := (!fc.Skip || g.unwinding != nil) && panicUnwinding()
+	if !unwinding && g.unwinding != nil {
+		g.resumed()
+	}
 	g.Stack = g.Stack[:len(g.Stack)-1]
+	kind := ""
+	if unwinding {
+		kind = g.unwound(fc)
+	}
+	if fc.Skip {
+		if len(g.Stack) == 1 {
+			g.Exit()
+		}
+		return
+	}
+	b := g.begin()
+	b.CallCount++
 	// Println(fmt.Sprintf("exit %v %v", fc.Name, fc.Flow))
 	if len(g.Stack) >= 1 {
 		ret := g.Stack[len(g.Stack)-1]
 		start := fc.LastTime
 		now := time.Now()
-		g.Flows[dgtypes.FlowEdge{Src: fc.Last, Targ: ret.Last}]++
-		g.Durations[fc.Last] += now.Sub(start)
+		if !ret.Skip {
+			b.Flows[dgtypes.FlowEdge{Src: fc.Last, Targ: ret.Last, Kind: kind}]++
+		}
+		b.Durations[fc.Last] += now.Sub(start)
 		ret.LastTime = now
 	}
-	if f, has := g.Funcs[fc.FuncPc]; has {
+	if f, has := b.Funcs[fc.FuncPc]; has {
 		f.Update(fc)
 	} else {
-		g.Funcs[fc.FuncPc] = dgtypes.NewFunction(fc)
+		b.Funcs[fc.FuncPc] = dgtypes.NewFunction(fc)
 	}
+	g.end()
 	if len(g.Stack) == 1 {
-		// g.m.Unlock()
 		g.Exit()
-		return
 	}
-	// g.m.Unlock()
 }
 
 func Println(data string) {
 	execCheck()
 	exec.m.Lock()
 	defer exec.m.Unlock()
-	fmt.Printf("goid %v:\t %v\n", runtime.GoID(), data)
+	fmt.Printf("goid %v:\t %v\n", identity.GoID(), data)
 }
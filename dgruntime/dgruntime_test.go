@@ -0,0 +1,50 @@
+package dgruntime
+
+import (
+	"dgruntime/dgtypes"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestEnterEdge(t *testing.T) {
+	e, dir := testExec(t)
+	defer os.RemoveAll(dir)
+	edge := func(src, targ int) dgtypes.FlowEdge {
+		return dgtypes.FlowEdge{Src: blk(10, src), Targ: blk(10, targ)}
+	}
+	// 0 -> 1, 2 (a switch); 1 -> 2 (a fallthrough); 2 -> 3
+	cfg := [][]int{{1, 2}, {2}, {3}, {}}
+	for _, c := range []struct {
+		name  string
+		probe func()
+		want  dgtypes.FlowEdge
+	}{
+		{"the true edge", func() { EnterEdgeIf(0, 1, 2, "a.go:2:1", "a.go:3:1", true) }, edge(0, 1)},
+		{"the false edge", func() { EnterEdgeIf(0, 1, 2, "a.go:2:1", "a.go:3:1", false) }, edge(0, 2)},
+		{"the probe's edge", func() { EnterEdge(0, 2, "a.go:3:1") }, edge(0, 2)},
+		{"an edge named ahead", func() {
+			EdgeFrom(1, 2)
+			EnterEdge(0, 2, "a.go:3:1")
+		}, edge(1, 2)},
+		{"named for another block", func() {
+			EdgeFrom(1, 2)
+			EnterEdge(2, 3, "a.go:4:1")
+		}, edge(2, 3)},
+	} {
+		fc := &dgtypes.FuncCall{FuncPc: 10, Last: blk(10, 0), CFG: cfg, IPDom: []int{2, 2, 3, 4}, DynCDP: make([]map[int]bool, len(cfg))}
+		for i := range fc.DynCDP {
+			fc.DynCDP[i] = make(map[int]bool)
+		}
+		g := e.Goroutine(identity.GoID())
+		g.Stack = append(g.Stack[:1], fc)
+		c.probe()
+		got := linked(e)
+		if want := map[dgtypes.FlowEdge]int{c.want: 1}; !reflect.DeepEqual(got, want) {
+			t.Errorf("%v: got %v expected %v", c.name, got, want)
+		}
+		if fc.Via != (dgtypes.FlowEdge{}) {
+			t.Errorf("%v: the edge named ahead was not used up: %v", c.name, fc.Via)
+		}
+	}
+}
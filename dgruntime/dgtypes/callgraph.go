@@ -0,0 +1,153 @@
+package dgtypes
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// MaxContext is the most frames a calling context holds: the callee and up
+// to MaxContext-1 of its callers.
+const MaxContext = 8
+
+// CallContext is the k-limited calling context of a call. It holds the pcs
+// of the called function and its callers innermost first, unused frames are
+// 0. A context shorter than k ends at the first call which was not sampled
+// (or at the goroutine's entry).
+type CallContext [MaxContext]uintptr
+
+// Len is the number of frames in the context
+func (c CallContext) Len() int {
+	n := 0
+	for n < len(c) && c[n] != 0 {
+		n++
+	}
+	return n
+}
+
+// CallGraph is the dynamic call graph of a profile with the functions named.
+// Each list is sorted so the call graphs of the same profile are the same.
+type CallGraph struct {
+	Functions []CallGraphFunc
+	Calls     []CallGraphEdge
+	Contexts  []CallGraphContext `json:",omitempty"`
+}
+
+// CallGraphFunc is a function which was called. Position is where the
+// function starts.
+type CallGraphFunc struct {
+	Name     string
+	Position string
+	Calls    int
+}
+
+// CallGraphEdge counts the calls from Caller to Callee. Calls made by the
+// goroutines' entries have the caller "entry".
+type CallGraphEdge struct {
+	Caller string
+	Callee string
+	Count  int
+}
+
+// CallGraphContext counts the calls made in a calling context. Stack names
+// the callee first and then its callers.
+type CallGraphContext struct {
+	Stack []string
+	Count int
+}
+
+// CallGraph names the functions of the profile's calls and calling contexts
+func (p *Profile) CallGraph() *CallGraph {
+	g := &CallGraph{
+		Functions: make([]CallGraphFunc, 0, len(p.Funcs)),
+		Calls:     make([]CallGraphEdge, 0, len(p.Calls)),
+		Contexts:  make([]CallGraphContext, 0, len(p.Contexts)),
+	}
+	for pc, f := range p.Funcs {
+		g.Functions = append(g.Functions, CallGraphFunc{
+			Name:     f.Name,
+			Position: p.Positions[BlkEntrance{In: pc}],
+			Calls:    f.Calls,
+		})
+	}
+	sort.Slice(g.Functions, func(i, j int) bool {
+		return g.Functions[i].Name < g.Functions[j].Name
+	})
+	for c, count := range p.Calls {
+		g.Calls = append(g.Calls, CallGraphEdge{
+			Caller: p.fn_name(BlkEntrance{In: c.Caller}),
+			Callee: p.fn_name(BlkEntrance{In: c.Callee}),
+			Count:  count,
+		})
+	}
+	sort.Slice(g.Calls, func(i, j int) bool {
+		a, b := g.Calls[i], g.Calls[j]
+		if a.Caller != b.Caller {
+			return a.Caller < b.Caller
+		}
+		return a.Callee < b.Callee
+	})
+	for c, count := range p.Contexts {
+		stack := make([]string, 0, c.Len())
+		for _, pc := range c[:c.Len()] {
+			stack = append(stack, p.fn_name(BlkEntrance{In: pc}))
+		}
+		g.Contexts = append(g.Contexts, CallGraphContext{Stack: stack, Count: count})
+	}
+	sort.Slice(g.Contexts, func(i, j int) bool {
+		return strings.Join(g.Contexts[i].Stack, "\x00") < strings.Join(g.Contexts[j].Stack, "\x00")
+	})
+	return g
+}
+
+// WriteCallGraphJSON writes the profile's call graph (see CallGraph) as JSON
+func (p *Profile) WriteCallGraphJSON(fout io.Writer) error {
+	e := json.NewEncoder(fout)
+	e.SetIndent("", "  ")
+	return e.Encode(p.CallGraph())
+}
+
+// LoadCallGraph reads a call graph written by WriteCallGraphJSON
+func LoadCallGraph(r io.Reader) (*CallGraph, error) {
+	var g CallGraph
+	if err := json.NewDecoder(r).Decode(&g); err != nil {
+		return nil, fmt.Errorf("could not read the call graph: %v", err)
+	}
+	return &g, nil
+}
+
+// WriteCallGraphDot writes the profile's call graph in the dot format. The
+// edges are labeled with their call counts.
+func (p *Profile) WriteCallGraphDot(fout io.Writer) {
+	g := p.CallGraph()
+	ids := make(map[string]int, len(g.Functions)+1)
+	fmt.Fprintf(fout, "digraph {\n")
+	fmt.Fprintf(fout, "%d [label=%v, shape=rect];\n", 0, strconv.Quote("entry"))
+	ids["entry"] = 0
+	vertex := func(name, pos string, calls int) {
+		if _, has := ids[name]; has {
+			return
+		}
+		ids[name] = len(ids)
+		fmt.Fprintf(fout, "%d [label=%v, shape=rect, fn_name=%v, position=%v, calls=%d];\n",
+			ids[name],
+			strconv.Quote(name),
+			strconv.Quote(name),
+			strconv.Quote(pos),
+			calls,
+		)
+	}
+	for _, f := range g.Functions {
+		vertex(f.Name, f.Position, f.Calls)
+	}
+	for _, c := range g.Calls {
+		vertex(c.Caller, "", 0)
+		vertex(c.Callee, "", 0)
+		fmt.Fprintf(fout, "%d -> %d [label=%d, calls=%d];\n",
+			ids[c.Caller], ids[c.Callee], c.Count, c.Count)
+	}
+	fmt.Fprint(fout, "}\n")
+}
@@ -0,0 +1,70 @@
+package dgtypes
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// Failure is a point in the program which reported itself as failing. For a
+// panic it is the block which panicked.
+type Failure struct {
+	Position     string
+	FnName       string
+	BasicBlockId int
+	Message      string  `json:",omitempty"` // given to dgruntime.Fail or Assert
+	Stack        []Frame `json:",omitempty"` // the instrumented calls, innermost first
+	Panic        *Panic  `json:",omitempty"` // nil unless the failure is a panic
+}
+
+// Panic describes how a panic went through the instrumented code.
+type Panic struct {
+	Value     string  `json:",omitempty"` // the recovered value (when known)
+	Frames    []Frame // the instrumented frames unwound, innermost first
+	Recovered bool    // the program swallowed the panic
+	// RecoverSite is the block which called recover. It is nil if the panic
+	// was not recovered or was recovered outside of the instrumented code.
+	RecoverSite *Frame `json:",omitempty"`
+}
+
+// Frame is a block of an instrumented function call
+type Frame struct {
+	Position     string
+	FnName       string
+	BasicBlockId int
+}
+
+func (f *Failure) String() string {
+	more := ""
+	if f.Message != "" {
+		more += `, "Message":` + toJSON(f.Message)
+	}
+	if len(f.Stack) > 0 {
+		more += `, "Stack":` + toJSON(f.Stack)
+	}
+	if f.Panic != nil {
+		more += `, "Panic":` + toJSON(f.Panic)
+	}
+	return fmt.Sprintf(`{"Position":%v, "FnName":%v, "BasicBlockId":%d%v}`,
+		toJSON(f.Position), toJSON(f.FnName), f.BasicBlockId, more)
+}
+
+func toJSON(v interface{}) string {
+	bytes, _ := json.Marshal(v)
+	return string(bytes)
+}
+
+// ReadFailures reads the failures file, one Failure per line.
+func ReadFailures(r io.Reader) ([]*Failure, error) {
+	fails := make([]*Failure, 0, 10)
+	d := json.NewDecoder(r)
+	for {
+		f := new(Failure)
+		if err := d.Decode(f); err == io.EOF {
+			return fails, nil
+		} else if err != nil {
+			return nil, err
+		}
+		fails = append(fails, f)
+	}
+}
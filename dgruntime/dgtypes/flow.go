@@ -9,8 +9,18 @@ type Flow []BlkEntrance
 type FlowEdge struct {
 	Src  BlkEntrance
 	Targ BlkEntrance
+	Kind string // empty for control flow within a goroutine
 }
 
+// The kinds of edges which are not ordinary control flow
+const (
+	SpawnEdge = "spawn" // from a go statement to the new goroutine's first block
+	SendEdge  = "send"  // from a channel send to the receive which got the value
+	CloseEdge = "close" // from a channel close to a receive which saw it
+	PanicEdge = "panic" // from a block unwound by a panic to its caller
+	PredEdge  = "pred"  // from a block to a predicate which held in it
+)
+
 type BlkEntrance struct {
 	In           uintptr
 	BasicBlockId int
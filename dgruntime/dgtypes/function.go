@@ -26,7 +26,10 @@ type FuncCall struct {
 	CDStack  []int
 	DynCDP   []map[int]bool // Dynamic Control Dependence Predecessors
 	Last     BlkEntrance
+	Pos      string // the position of Last
 	LastTime time.Time
+	Skip     bool     // the call was not sampled, nothing is recorded for it
+	Via      FlowEdge // the edge named by dgruntime.EdgeFrom for the next edge probe
 }
 
 func ExportFunctions(funcs map[uintptr]*Function) map[string]*ExportFunction {
@@ -66,7 +69,19 @@ func (f *Function) Merge(b *Function) {
 		panic("can't merge")
 	}
 	f.Calls += b.Calls
-	for x, preds := range b.DynCDP {
+	f.addDynCDP(b.DynCDP)
+}
+
+// addDynCDP unions dcdp into the function's control dependence predecessors
+// growing them as needed (functions read from a flow graph have none).
+func (f *Function) addDynCDP(dcdp []map[int]bool) {
+	for len(f.DynCDP) < len(dcdp) {
+		f.DynCDP = append(f.DynCDP, make(map[int]bool))
+	}
+	for x, preds := range dcdp {
+		if f.DynCDP[x] == nil {
+			f.DynCDP[x] = make(map[int]bool)
+		}
 		for pred := range preds {
 			f.DynCDP[x][pred] = true
 		}
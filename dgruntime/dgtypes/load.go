@@ -0,0 +1,527 @@
+package dgtypes
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// GraphBuilder rebuilds the flow graph of a Profile from the vertices and
+// edges of a serialized graph. It is the inverse of VisitGraph. Serialized
+// graphs carry function names rather than program counters so every
+// function is given a stand in pc which is stable within the Profile.
+type GraphBuilder struct {
+	p           *Profile
+	blks        map[int]BlkEntrance
+	preds       map[int]Predicate
+	observed    map[PredicateSite]bool // every predicate of a site carries its count
+	first       bool                   // p had no flows when the graph started
+	sampling    *Sampling
+	granularity string
+}
+
+// NewGraphBuilder starts a new graph which is added to p. Counts and
+// durations of blocks and edges p already has are summed.
+func NewGraphBuilder(p *Profile) *GraphBuilder {
+	return &GraphBuilder{
+		p:        p,
+		blks:     make(map[int]BlkEntrance),
+		preds:    make(map[int]Predicate),
+		observed: make(map[PredicateSite]bool),
+		first:    p.Empty(),
+	}
+}
+
+func (b *GraphBuilder) Vertex(v *GraphVertex) {
+	if v.FnName == "entry" && v.BasicBlockId == 0 {
+		b.blks[v.Id] = BlkEntrance{}
+		return
+	}
+	name := v.FnName
+	if name == "unknown" || name == "" {
+		// blocks of functions without a Function are named by the runtime
+		name = v.Label
+		if i := strings.Index(name, fmt.Sprintf(" blk %d", v.BasicBlockId)); i >= 0 {
+			name = name[:i]
+		}
+	}
+	blk := BlkEntrance{In: b.p.funcPc(name), BasicBlockId: v.BasicBlockId}
+	if v.Predicate != "" {
+		pred := Predicate{At: blk, Site: v.Site, Name: v.Predicate, Position: v.Position}
+		b.preds[v.Id] = pred
+		if site := pred.SiteOf(); !b.observed[site] {
+			b.observed[site] = true
+			b.p.Observed[site] += v.Observed
+		}
+		return
+	}
+	b.blks[v.Id] = blk
+	if v.Position != "" {
+		b.p.Positions[blk] = v.Position
+	}
+	b.p.Durations[blk] += v.Duration
+}
+
+// Sampling records how the graph was sampled (see End)
+func (b *GraphBuilder) Sampling(s *Sampling) {
+	b.sampling = s
+}
+
+// Granularity records what the graph's probes recorded (see Profile and End)
+func (b *GraphBuilder) Granularity(g string) {
+	if g == BlockGranularity {
+		g = ""
+	}
+	b.granularity = g
+}
+
+// End completes the graph. As with Merge the graphs of a profile must have
+// been sampled in the same way and be of the same granularity.
+func (b *GraphBuilder) End() error {
+	if b.first {
+		b.p.Sampling = b.sampling
+		b.p.Granularity = b.granularity
+		return nil
+	}
+	return b.p.sameKind(b.sampling, b.granularity)
+}
+
+func (b *GraphBuilder) Edge(src, targ, count int, kind string) error {
+	s, has := b.blks[src]
+	if !has {
+		return fmt.Errorf("edge from unknown vertex %d", src)
+	}
+	if pred, has := b.preds[targ]; has && kind == PredEdge {
+		b.p.Predicates[pred] += count
+		return nil
+	}
+	t, has := b.blks[targ]
+	if !has {
+		return fmt.Errorf("edge to unknown vertex %d", targ)
+	}
+	b.p.Flows[FlowEdge{Src: s, Targ: t, Kind: kind}] += count
+	return nil
+}
+
+// funcPc returns the program counter standing in for the named function
+// adding a Function for it when the profile doesn't have one.
+func (p *Profile) funcPc(name string) uintptr {
+	if p.pcs == nil || len(p.pcs) != len(p.Funcs) {
+		p.pcs = make(map[string]uintptr, len(p.Funcs))
+		for pc, f := range p.Funcs {
+			p.pcs[f.Name] = pc
+			if pc >= p.nextPc {
+				p.nextPc = pc + 1
+			}
+		}
+	}
+	if pc, has := p.pcs[name]; has {
+		return pc
+	}
+	if p.nextPc == 0 {
+		p.nextPc = 1
+	}
+	pc := p.nextPc
+	p.nextPc++
+	p.Funcs[pc] = &Function{Name: name, FuncPc: pc}
+	p.pcs[name] = pc
+	return pc
+}
+
+// LoadSimple reads a flow graph written by WriteSimple. When the input holds
+// more than one graph (a file of segments, say) they are all merged into the
+// returned Profile.
+func LoadSimple(r io.Reader) (*Profile, error) {
+	p := NewProfile()
+	err := loadSimple(r, func() *GraphBuilder { return NewGraphBuilder(p) }, nil)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// LoadSimpleGraphs reads the flow graphs written by WriteSimple one at a
+// time. Each graph is loaded into a Profile of its own which is handed to
+// each.
+func LoadSimpleGraphs(r io.Reader, each func(*Profile) error) error {
+	var p *Profile
+	start := func() *GraphBuilder {
+		p = NewProfile()
+		return NewGraphBuilder(p)
+	}
+	return loadSimple(r, start, func() error { return each(p) })
+}
+
+// loadSimple calls start at the beginning of each graph and end (if not nil)
+// when the graph is complete
+func loadSimple(r io.Reader, start func() *GraphBuilder, end func() error) error {
+	var b *GraphBuilder
+	lines := bufio.NewScanner(r)
+	lines.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for n := 1; lines.Scan(); n++ {
+		line := strings.TrimSpace(lines.Text())
+		if line == "" {
+			continue
+		}
+		var err error
+		switch {
+		case line == "start-graph":
+			b = start()
+		case line == "end-graph":
+			if b != nil {
+				err = b.End()
+			}
+			if err == nil && b != nil && end != nil {
+				err = end()
+			}
+			b = nil
+		case b == nil:
+			err = fmt.Errorf("%q outside of a graph", line)
+		case strings.HasPrefix(line, "vertex\t"):
+			err = simpleVertex(b, line[len("vertex\t"):])
+		case strings.HasPrefix(line, "edge\t"):
+			err = simpleEdge(b, line[len("edge\t"):])
+		case strings.HasPrefix(line, "sampling\t"):
+			err = simpleSampling(b, line[len("sampling\t"):])
+		case strings.HasPrefix(line, "granularity\t"):
+			var g string
+			if g, err = unquote(line[len("granularity\t"):]); err == nil {
+				b.Granularity(g)
+			}
+		default:
+			err = fmt.Errorf("unexpected line %q", line)
+		}
+		if err != nil {
+			return fmt.Errorf("line %d: %v", n, err)
+		}
+	}
+	return lines.Err()
+}
+
+func simpleVertex(b *GraphBuilder, line string) error {
+	fields, err := splitList(line)
+	if err != nil {
+		return err
+	}
+	if len(fields) < 5 {
+		return fmt.Errorf("vertex has %d fields, expected at least 5", len(fields))
+	}
+	v := new(GraphVertex)
+	if v.Id, err = strconv.Atoi(fields[0]); err != nil {
+		return err
+	}
+	if v.Label, err = unquote(fields[1]); err != nil {
+		return err
+	}
+	if v.BasicBlockId, err = strconv.Atoi(fields[2]); err != nil {
+		return err
+	}
+	if v.FnName, err = unquote(fields[3]); err != nil {
+		return err
+	}
+	if v.Position, err = unquote(fields[4]); err != nil {
+		return err
+	}
+	if len(fields) > 5 {
+		if v.Duration, err = parseDuration(fields[5]); err != nil {
+			return err
+		}
+	}
+	if len(fields) > 7 {
+		// a predicate
+		if v.Site, err = strconv.Atoi(fields[6]); err != nil {
+			return err
+		}
+		if v.Predicate, err = unquote(fields[7]); err != nil {
+			return err
+		}
+	}
+	if len(fields) > 8 {
+		if v.Observed, err = strconv.Atoi(fields[8]); err != nil {
+			return err
+		}
+	}
+	b.Vertex(v)
+	return nil
+}
+
+func simpleEdge(b *GraphBuilder, line string) error {
+	fields, err := splitList(line)
+	if err != nil {
+		return err
+	}
+	if len(fields) < 3 {
+		return fmt.Errorf("edge has %d fields, expected 3", len(fields))
+	}
+	var ints [3]int
+	for i := range ints {
+		if ints[i], err = strconv.Atoi(fields[i]); err != nil {
+			return err
+		}
+	}
+	kind := ""
+	if len(fields) > 3 {
+		if kind, err = unquote(fields[3]); err != nil {
+			return err
+		}
+	}
+	return b.Edge(ints[0], ints[1], ints[2], kind)
+}
+
+func simpleSampling(b *GraphBuilder, line string) error {
+	fields, err := splitList(line)
+	if err != nil {
+		return err
+	}
+	if len(fields) < 2 {
+		return fmt.Errorf("sampling has %d fields, expected 2", len(fields))
+	}
+	s := new(Sampling)
+	if s.Params, err = unquote(fields[0]); err != nil {
+		return err
+	}
+	if s.Rate, err = strconv.ParseFloat(fields[1], 64); err != nil {
+		return err
+	}
+	b.Sampling(s)
+	return nil
+}
+
+// LoadDotty reads a flow graph written by WriteDotty.
+func LoadDotty(r io.Reader) (*Profile, error) {
+	p := NewProfile()
+	b := NewGraphBuilder(p)
+	lines := bufio.NewScanner(r)
+	lines.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for n := 1; lines.Scan(); n++ {
+		line := strings.TrimSpace(lines.Text())
+		if line == "" || line == "}" || strings.HasPrefix(line, "digraph") {
+			continue
+		}
+		if err := dottyLine(b, line); err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+	}
+	if err := lines.Err(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func dottyLine(b *GraphBuilder, line string) error {
+	open := strings.Index(line, "[")
+	if open < 0 || !strings.HasSuffix(line, "];") {
+		return fmt.Errorf("unexpected line %q", line)
+	}
+	attrs, err := splitList(line[open+1 : len(line)-2])
+	if err != nil {
+		return err
+	}
+	get := func(name string) (string, bool, error) {
+		for _, attr := range attrs {
+			if strings.HasPrefix(attr, name+"=") {
+				v, err := unquote(attr[len(name)+1:])
+				return v, true, err
+			}
+		}
+		return "", false, nil
+	}
+	node := strings.TrimSpace(line[:open])
+	if arrow := strings.Index(node, "->"); arrow >= 0 {
+		src, err := strconv.Atoi(strings.TrimSpace(node[:arrow]))
+		if err != nil {
+			return err
+		}
+		targ, err := strconv.Atoi(strings.TrimSpace(node[arrow+2:]))
+		if err != nil {
+			return err
+		}
+		traversed, _, err := get("traversed")
+		if err != nil {
+			return err
+		}
+		count, err := strconv.Atoi(traversed)
+		if err != nil {
+			return err
+		}
+		kind, _, err := get("kind")
+		if err != nil {
+			return err
+		}
+		return b.Edge(src, targ, count, kind)
+	}
+	v := new(GraphVertex)
+	if v.Id, err = strconv.Atoi(node); err != nil {
+		return err
+	}
+	if v.Label, _, err = get("label"); err != nil {
+		return err
+	}
+	if v.FnName, _, err = get("fn_name"); err != nil {
+		return err
+	}
+	if v.Position, _, err = get("position"); err != nil {
+		return err
+	}
+	if bbid, has, err := get("bbid"); err != nil {
+		return err
+	} else if has {
+		if v.BasicBlockId, err = strconv.Atoi(bbid); err != nil {
+			return err
+		}
+	}
+	if dur, has, err := get("duration"); err != nil {
+		return err
+	} else if has {
+		if v.Duration, err = time.ParseDuration(dur); err != nil {
+			return err
+		}
+	}
+	if pred, has, err := get("predicate"); err != nil {
+		return err
+	} else if has {
+		site, _, err := get("site")
+		if err != nil {
+			return err
+		}
+		if v.Site, err = strconv.Atoi(site); err != nil {
+			return err
+		}
+		v.Predicate = pred
+		if observed, has, err := get("observed"); err != nil {
+			return err
+		} else if has {
+			if v.Observed, err = strconv.Atoi(observed); err != nil {
+				return err
+			}
+		}
+	}
+	if v.FnName == "" && v.Label == "entry" {
+		v.FnName = "entry"
+	}
+	b.Vertex(v)
+	return nil
+}
+
+// splitList splits a comma separated list whose items may be quoted
+// strings. Items are returned as written, quotes included.
+func splitList(s string) ([]string, error) {
+	items := make([]string, 0, 6)
+	start := 0
+	quoted := false
+	for i := 0; i < len(s); i++ {
+		switch {
+		case quoted && s[i] == '\\':
+			i++
+		case s[i] == '"':
+			quoted = !quoted
+		case !quoted && s[i] == ',':
+			items = append(items, strings.TrimSpace(s[start:i]))
+			start = i + 1
+		}
+	}
+	if quoted {
+		return nil, fmt.Errorf("unterminated string in %q", s)
+	}
+	return append(items, strings.TrimSpace(s[start:])), nil
+}
+
+func unquote(s string) (string, error) {
+	if strings.HasPrefix(s, `"`) {
+		return strconv.Unquote(s)
+	}
+	return s, nil
+}
+
+func parseDuration(s string) (time.Duration, error) {
+	s, err := unquote(s)
+	if err != nil {
+		return 0, err
+	}
+	return time.ParseDuration(s)
+}
+
+// ReadFunctions adds the functions written by WriteFunctions to the
+// profile. Functions are matched up with the flow graph by name.
+func (p *Profile) ReadFunctions(r io.Reader) error {
+	var export map[string]*ExportFunction
+	if err := json.NewDecoder(r).Decode(&export); err != nil {
+		return err
+	}
+	for name, ef := range export {
+		f := p.Funcs[p.funcPc(name)]
+		if f.CFG == nil {
+			f.CFG = ef.CFG
+			f.IPDom = ef.IPDom
+		}
+		f.Calls += ef.Calls
+		dcdp := make([]map[int]bool, len(ef.DynCDP))
+		for x, preds := range ef.DynCDP {
+			dcdp[x] = make(map[int]bool, len(preds))
+			for _, pred := range preds {
+				dcdp[x][pred] = true
+			}
+		}
+		f.addDynCDP(dcdp)
+	}
+	return nil
+}
+
+// RawType is a Type read back from a serialized profile. Types are written
+// without their concrete kind so only the name and the original encoding
+// survive the round trip.
+type RawType struct {
+	Tname string
+	raw   json.RawMessage
+}
+
+func (t *RawType) Name() string {
+	return t.Tname
+}
+
+func (t *RawType) MarshalJSON() ([]byte, error) {
+	return t.raw, nil
+}
+
+// ReadObjectProfiles adds the types and object profiles written by
+// SerializeProfs to the profile.
+func (p *Profile) ReadObjectProfiles(r io.Reader) error {
+	d := json.NewDecoder(r)
+	var types struct {
+		Types []json.RawMessage
+	}
+	if err := d.Decode(&types); err == io.EOF {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, raw := range types.Types {
+		t := &RawType{raw: raw}
+		if err := json.Unmarshal(raw, t); err != nil {
+			return err
+		} else if t.Tname == "" {
+			continue
+		}
+		if _, has := p.Types[t.Tname]; !has {
+			p.Types[t.Tname] = t
+		}
+	}
+	for {
+		var fp FuncProfile
+		if err := d.Decode(&fp); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if len(fp.In) > 0 {
+			p.Inputs[fp.FuncName] = append(p.Inputs[fp.FuncName], fp.In...)
+		}
+		if len(fp.Out) > 0 {
+			p.Outputs[fp.FuncName] = append(p.Outputs[fp.FuncName], fp.Out...)
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package dgtypes
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testProfile() *Profile {
+	p := NewProfile()
+	p.Funcs[10] = &Function{
+		Name:   "main.main",
+		FuncPc: 10,
+		CFG:    [][]int{{1}, {}},
+		IPDom:  []int{1, 1},
+		Calls:  1,
+		DynCDP: []map[int]bool{{}, {0: true}},
+	}
+	p.Funcs[20] = &Function{Name: "main.f", FuncPc: 20, Calls: 3}
+	m0 := BlkEntrance{In: 10, BasicBlockId: 0}
+	m1 := BlkEntrance{In: 10, BasicBlockId: 1}
+	f0 := BlkEntrance{In: 20, BasicBlockId: 0}
+	p.Flows[FlowEdge{Src: BlkEntrance{}, Targ: m0}] = 1
+	p.Flows[FlowEdge{Src: m0, Targ: f0}] = 3
+	p.Flows[FlowEdge{Src: f0, Targ: m1}] = 3
+	p.Positions[m0] = "main.go:3:2"
+	p.Positions[m1] = "main.go:5:2"
+	p.Positions[f0] = "main.go:9:2, with a comma"
+	p.Durations[m0] = 5 * time.Millisecond
+	p.Durations[f0] = 1500 * time.Microsecond
+	p.Predicates[Predicate{At: f0, Site: 1, Name: "x < 0", Position: "main.go:9:5"}] = 2
+	p.Predicates[Predicate{At: f0, Site: 1, Name: "x == 0", Position: "main.go:9:5"}] = 1
+	p.Observed[PredicateSite{At: f0, Site: 1}] = 3
+	return p
+}
+
+func TestSimpleRoundTrip(t *testing.T) {
+	p := testProfile()
+	for _, format := range []struct {
+		name  string
+		write func(*bytes.Buffer)
+		load  func(*bytes.Buffer) (*Profile, error)
+	}{
+		{"simple",
+			func(b *bytes.Buffer) { p.WriteSimple(b) },
+			func(b *bytes.Buffer) (*Profile, error) { return LoadSimple(b) }},
+		{"dotty",
+			func(b *bytes.Buffer) { p.WriteDotty(b) },
+			func(b *bytes.Buffer) (*Profile, error) { return LoadDotty(b) }},
+	} {
+		var buf bytes.Buffer
+		format.write(&buf)
+		loaded, err := format.load(&buf)
+		if err != nil {
+			t.Fatalf("%v: %v", format.name, err)
+		}
+		if len(loaded.Flows) != len(p.Flows) {
+			t.Errorf("%v: loaded %d edges, wrote %d", format.name, len(loaded.Flows), len(p.Flows))
+		}
+		if d := loaded.Diff(p); len(d.Edges) != 0 || len(d.Blocks) != 0 {
+			t.Errorf("%v: round trip differs %v", format.name, d)
+		}
+		pred := Predicate{At: BlkEntrance{In: loaded.funcPc("main.f")}, Site: 1, Name: "x < 0", Position: "main.go:9:5"}
+		if len(loaded.Predicates) != 2 || loaded.Predicates[pred] != 2 {
+			t.Errorf("%v: predicates %v", format.name, loaded.Predicates)
+		}
+		if n := loaded.Observed[pred.SiteOf()]; n != 3 {
+			t.Errorf("%v: site observed %d times, expected 3", format.name, n)
+		}
+		pos := loaded.Positions[BlkEntrance{In: loaded.funcPc("main.f")}]
+		if pos != p.Positions[BlkEntrance{In: 20}] {
+			t.Errorf("%v: position %q", format.name, pos)
+		}
+	}
+}
+
+func TestMergeDiff(t *testing.T) {
+	p := testProfile()
+	var buf bytes.Buffer
+	p.WriteSimple(&buf)
+	p.WriteSimple(&buf)
+	twice, err := LoadSimple(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.WriteFunctions(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := twice.ReadFunctions(&buf); err != nil {
+		t.Fatal(err)
+	}
+	main := twice.Funcs[twice.funcPc("main.main")]
+	if main.Calls != 1 || len(main.CFG) != 2 || !main.DynCDP[1][0] {
+		t.Errorf("functions not read back %v", main)
+	}
+
+	merged := NewProfile()
+	for i := 0; i < 2; i++ {
+		if err := merged.Merge(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	d := merged.Diff(twice)
+	if len(d.Edges) != 0 || len(d.Blocks) != 0 {
+		t.Errorf("merged profile differs %v", d)
+	}
+	if len(d.Funcs) != 2 {
+		t.Errorf("expected call counts to differ %v", d.Funcs)
+	}
+
+	d = p.Diff(twice)
+	if len(d.Edges) != len(p.Flows) {
+		t.Fatalf("expected every edge to differ %v", d.Edges)
+	}
+	for _, e := range d.Edges {
+		if e.OtherCount != 2*e.Count {
+			t.Errorf("bad delta %v", e)
+		}
+	}
+}
+
+func TestMergeDifferentKinds(t *testing.T) {
+	sampled := &Sampling{Params: "every=2", Rate: .5}
+	for _, c := range []struct {
+		base        *Sampling // of the profile merged into
+		sampling    *Sampling
+		granularity string
+		ok          bool
+	}{
+		{nil, nil, "", true},
+		{nil, nil, FuncGranularity, false},
+		{nil, sampled, "", false},
+		{sampled, nil, "", false},
+		{sampled, &Sampling{Params: "every=2", Rate: .5}, "", true},
+		{sampled, &Sampling{Params: "every=4", Rate: .25}, "", false},
+	} {
+		p := testProfile()
+		p.Sampling = c.base
+		other := testProfile()
+		other.Sampling = c.sampling
+		other.Granularity = c.granularity
+		if err := p.Merge(other); (err == nil) != c.ok {
+			t.Errorf("merging %v at %q granularity into %v: %v", c.sampling, c.granularity, c.base, err)
+		}
+
+		// the same goes for the graphs of a file
+		var buf bytes.Buffer
+		p = testProfile()
+		p.Sampling = c.base
+		p.WriteSimple(&buf)
+		other.WriteSimple(&buf)
+		if _, err := LoadSimple(&buf); (err == nil) != c.ok {
+			t.Errorf("loading %v at %q granularity after %v: %v", c.sampling, c.granularity, c.base, err)
+		}
+	}
+
+	// an empty profile takes the kind of the first profile merged in
+	merged := NewProfile()
+	other := testProfile()
+	other.Sampling = sampled
+	for i := 0; i < 2; i++ {
+		if err := merged.Merge(other); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if merged.Sampling != sampled {
+		t.Errorf("merged profile %v", merged.Sampling)
+	}
+}
+
+func TestFailuresRoundTrip(t *testing.T) {
+	fails := []*Failure{
+		{Position: "main.go:1:1", FnName: "main.main", BasicBlockId: 2},
+		{Position: "m\x00.go:4:1", FnName: "main.f", BasicBlockId: 0},
+		{
+			Position: "main.go:7:2", FnName: "main.g", BasicBlockId: 3,
+			Message: "invariant x > 0",
+			Stack:   []Frame{{"main.go:7:2", "main.g", 3}, {"main.go:2:1", "main.main", 0}},
+		},
+	}
+	var buf bytes.Buffer
+	for _, f := range fails {
+		buf.WriteString(f.String() + "\n")
+	}
+	read, err := ReadFailures(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(read) != len(fails) {
+		t.Fatalf("read %d failures", len(read))
+	}
+	for i := range fails {
+		if !reflect.DeepEqual(read[i], fails[i]) {
+			t.Errorf("read %v, wrote %v", read[i], fails[i])
+		}
+	}
+}
+
+func TestPanicFailureRoundTrip(t *testing.T) {
+	at := Frame{Position: "main.go:3:2", FnName: "main.div", BasicBlockId: 1}
+	fail := &Failure{
+		Position:     at.Position,
+		FnName:       at.FnName,
+		BasicBlockId: at.BasicBlockId,
+		Panic: &Panic{
+			Value:       "runtime error: integer divide by zero",
+			Frames:      []Frame{at, {Position: "main.go:9:1", FnName: "main.main"}},
+			Recovered:   true,
+			RecoverSite: &Frame{Position: "main.go:7:3", FnName: "main.main$0", BasicBlockId: 2},
+		},
+	}
+	read, err := ReadFailures(strings.NewReader(fail.String() + "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(read) != 1 || !reflect.DeepEqual(read[0], fail) {
+		t.Errorf("read %v, wrote %v", read, fail)
+	}
+}
@@ -0,0 +1,324 @@
+package dgtypes
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Merge adds the counts, durations and object profiles of other to p.
+// Functions are matched by name rather than by pc so profiles of different
+// builds (or profiles read back from disk) can be merged. Profiles sampled
+// in different ways or of different granularities cannot be merged: their
+// counts are not comparable.
+func (p *Profile) Merge(other *Profile) error {
+	if !p.Empty() && !other.Empty() {
+		if err := p.sameKind(other.Sampling, other.Granularity); err != nil {
+			return err
+		}
+	} else if p.Empty() && !other.Empty() {
+		p.Sampling = other.Sampling
+		p.Granularity = other.Granularity
+	}
+	pcs := make(map[uintptr]uintptr, len(other.Funcs))
+	pc := func(o uintptr) uintptr {
+		if o == 0 {
+			return 0
+		}
+		if t, has := pcs[o]; has {
+			return t
+		}
+		t := o
+		if f, has := other.Funcs[o]; has {
+			t = p.funcPc(f.Name)
+		}
+		pcs[o] = t
+		return t
+	}
+	blk := func(b BlkEntrance) BlkEntrance {
+		return BlkEntrance{In: pc(b.In), BasicBlockId: b.BasicBlockId}
+	}
+	for o, of := range other.Funcs {
+		f := p.Funcs[pc(o)]
+		if f.CFG == nil {
+			f.CFG = of.CFG
+			f.IPDom = of.IPDom
+		}
+		f.Calls += of.Calls
+		f.addDynCDP(of.DynCDP)
+	}
+	for c, count := range other.Calls {
+		p.Calls[Call{Caller: pc(c.Caller), Callee: pc(c.Callee)}] += count
+	}
+	for c, count := range other.Contexts {
+		for i := range c {
+			c[i] = pc(c[i])
+		}
+		p.Contexts[c] += count
+	}
+	for e, count := range other.Flows {
+		p.Flows[FlowEdge{Src: blk(e.Src), Targ: blk(e.Targ), Kind: e.Kind}] += count
+	}
+	for b, pos := range other.Positions {
+		if _, has := p.Positions[blk(b)]; !has {
+			p.Positions[blk(b)] = pos
+		}
+	}
+	for b, dur := range other.Durations {
+		p.Durations[blk(b)] += dur
+	}
+	for pred, count := range other.Predicates {
+		pred.At = blk(pred.At)
+		p.Predicates[pred] += count
+	}
+	for site, count := range other.Observed {
+		site.At = blk(site.At)
+		p.Observed[site] += count
+	}
+	for name, profs := range other.Inputs {
+		p.Inputs[name] = append(p.Inputs[name], profs...)
+	}
+	for name, profs := range other.Outputs {
+		p.Outputs[name] = append(p.Outputs[name], profs...)
+	}
+	for name, t := range other.Types {
+		if _, has := p.Types[name]; !has {
+			p.Types[name] = t
+		}
+	}
+	p.CallCount += other.CallCount
+	return nil
+}
+
+// sameKind returns an error unless flows sampled as s at granularity g are
+// of the same kind as p's
+func (p *Profile) sameKind(s *Sampling, g string) error {
+	if g != p.Granularity {
+		return fmt.Errorf("profiles of %v granularity and of %v granularity cannot be merged", granularityName(p.Granularity), granularityName(g))
+	}
+	if (s == nil) != (p.Sampling == nil) || (s != nil && *s != *p.Sampling) {
+		return fmt.Errorf("profiles %v and %v cannot be merged", p.Sampling, s)
+	}
+	return nil
+}
+
+func granularityName(g string) string {
+	if g == "" {
+		return BlockGranularity
+	}
+	return g
+}
+
+// Block names a basic block by its function rather than by a pc so blocks
+// can be compared across profiles.
+type Block struct {
+	FnName       string
+	BasicBlockId int
+}
+
+// EdgeDelta is a flow graph edge traversed a different number of times in
+// two profiles. A count of 0 means the edge is missing from that profile.
+type EdgeDelta struct {
+	Src, Targ  Block
+	Kind       string // see FlowEdge
+	Count      int
+	OtherCount int
+}
+
+// BlockDelta is a basic block entered a different number of times or
+// which ran for a different total duration.
+type BlockDelta struct {
+	Block
+	Count         int
+	OtherCount    int
+	Duration      time.Duration
+	OtherDuration time.Duration
+}
+
+// FuncDelta is a function called a different number of times.
+type FuncDelta struct {
+	Name       string
+	Calls      int
+	OtherCalls int
+}
+
+// ProfileDiff holds everything which differs between two profiles. Each
+// list is sorted so diffs of the same profiles are always the same.
+type ProfileDiff struct {
+	Edges  []EdgeDelta
+	Blocks []BlockDelta
+	Funcs  []FuncDelta
+}
+
+func (d *ProfileDiff) Empty() bool {
+	return len(d.Edges) == 0 && len(d.Blocks) == 0 && len(d.Funcs) == 0
+}
+
+// Diff compares p to other. Counts from p are reported first in each delta.
+func (p *Profile) Diff(other *Profile) *ProfileDiff {
+	type edge struct {
+		src, targ Block
+		kind      string
+	}
+	edges := make(map[edge]*EdgeDelta)
+	blocks := make(map[Block]*BlockDelta)
+	funcs := make(map[string]*FuncDelta)
+	block := func(k Block) *BlockDelta {
+		if blocks[k] == nil {
+			blocks[k] = &BlockDelta{Block: k}
+		}
+		return blocks[k]
+	}
+	for i, prof := range []*Profile{p, other} {
+		for e, count := range prof.Flows {
+			k := edge{prof.block(e.Src), prof.block(e.Targ), e.Kind}
+			if edges[k] == nil {
+				edges[k] = &EdgeDelta{Src: k.src, Targ: k.targ, Kind: k.kind}
+			}
+			// edges between goroutines do not enter their target block
+			if i == 0 {
+				edges[k].Count += count
+				if e.Kind == "" {
+					block(k.targ).Count += count
+				}
+			} else {
+				edges[k].OtherCount += count
+				if e.Kind == "" {
+					block(k.targ).OtherCount += count
+				}
+			}
+		}
+		for b, dur := range prof.Durations {
+			if i == 0 {
+				block(prof.block(b)).Duration += dur
+			} else {
+				block(prof.block(b)).OtherDuration += dur
+			}
+		}
+		for _, f := range prof.Funcs {
+			if funcs[f.Name] == nil {
+				funcs[f.Name] = &FuncDelta{Name: f.Name}
+			}
+			if i == 0 {
+				funcs[f.Name].Calls += f.Calls
+			} else {
+				funcs[f.Name].OtherCalls += f.Calls
+			}
+		}
+	}
+	d := new(ProfileDiff)
+	for _, e := range edges {
+		if e.Count != e.OtherCount {
+			d.Edges = append(d.Edges, *e)
+		}
+	}
+	for _, b := range blocks {
+		if b.Count != b.OtherCount || b.Duration != b.OtherDuration {
+			d.Blocks = append(d.Blocks, *b)
+		}
+	}
+	for _, f := range funcs {
+		if f.Calls != f.OtherCalls {
+			d.Funcs = append(d.Funcs, *f)
+		}
+	}
+	sort.Slice(d.Edges, func(i, j int) bool {
+		a, b := d.Edges[i], d.Edges[j]
+		if a.Src != b.Src {
+			return a.Src.less(b.Src)
+		}
+		if a.Targ != b.Targ {
+			return a.Targ.less(b.Targ)
+		}
+		return a.Kind < b.Kind
+	})
+	sort.Slice(d.Blocks, func(i, j int) bool {
+		return d.Blocks[i].Block.less(d.Blocks[j].Block)
+	})
+	sort.Slice(d.Funcs, func(i, j int) bool {
+		return d.Funcs[i].Name < d.Funcs[j].Name
+	})
+	return d
+}
+
+func (p *Profile) block(b BlkEntrance) Block {
+	return Block{FnName: p.fn_name(b), BasicBlockId: b.BasicBlockId}
+}
+
+func (b Block) less(o Block) bool {
+	if b.FnName != o.FnName {
+		return b.FnName < o.FnName
+	}
+	return b.BasicBlockId < o.BasicBlockId
+}
+
+// Filter returns a copy of the profile holding only the functions for which
+// keep returns true. Edges into or out of dropped functions are dropped
+// (edges from the entry are kept when their target is).
+func (p *Profile) Filter(keep func(fnName string) bool) *Profile {
+	f := NewProfile()
+	kept := func(b BlkEntrance) bool {
+		return (b.In == 0 && b.BasicBlockId == 0) || keep(p.fn_name(b))
+	}
+	for pc, fn := range p.Funcs {
+		if keep(fn.Name) {
+			f.Funcs[pc] = fn
+		}
+	}
+	for c, count := range p.Calls {
+		if f.Funcs[c.Caller] != nil && f.Funcs[c.Callee] != nil {
+			f.Calls[c] = count
+		}
+	}
+	for c, count := range p.Contexts {
+		all := true
+		for _, pc := range c[:c.Len()] {
+			all = all && f.Funcs[pc] != nil
+		}
+		if all {
+			f.Contexts[c] = count
+		}
+	}
+	for e, count := range p.Flows {
+		if kept(e.Src) && kept(e.Targ) {
+			f.Flows[e] = count
+		}
+	}
+	for b, pos := range p.Positions {
+		if kept(b) {
+			f.Positions[b] = pos
+		}
+	}
+	for b, dur := range p.Durations {
+		if kept(b) {
+			f.Durations[b] = dur
+		}
+	}
+	for pred, count := range p.Predicates {
+		if kept(pred.At) {
+			f.Predicates[pred] = count
+		}
+	}
+	for site, count := range p.Observed {
+		if kept(site.At) {
+			f.Observed[site] = count
+		}
+	}
+	for name, profs := range p.Inputs {
+		if keep(name) {
+			f.Inputs[name] = profs
+		}
+	}
+	for name, profs := range p.Outputs {
+		if keep(name) {
+			f.Outputs[name] = profs
+		}
+	}
+	for name, t := range p.Types {
+		f.Types[name] = t
+	}
+	f.CallCount = p.CallCount
+	f.Sampling = p.Sampling
+	f.Granularity = p.Granularity
+	return f
+}
@@ -0,0 +1,235 @@
+package dgtypes
+
+import (
+	"compress/gzip"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The profiles are written as gzipped pprof profiles (see
+// github.com/google/pprof/proto/profile.proto) so `go tool pprof` can show
+// them. dgtypes depends on the standard library alone so the few messages
+// needed are encoded by hand.
+
+// WritePprof writes the profile's call graph as a pprof profile. Each sample
+// is a calling context with the number of calls made in it. Profiles
+// recorded without calling contexts have a sample for each call edge (the
+// callee and its caller).
+func (p *Profile) WritePprof(fout io.Writer) error {
+	g := p.CallGraph()
+	b := newPprofBuilder()
+	b.sampleType("calls", "count")
+	positions := make(map[string]string, len(g.Functions))
+	for _, f := range g.Functions {
+		positions[f.Name] = f.Position
+	}
+	sample := func(stack []string, count int) {
+		locs := make([]uint64, 0, len(stack))
+		for _, name := range stack {
+			if name == "entry" {
+				break
+			}
+			file, line := splitPosition(positions[name])
+			locs = append(locs, b.location(name, file, line, line))
+		}
+		if len(locs) > 0 {
+			b.sample(locs, int64(count))
+		}
+	}
+	if len(g.Contexts) > 0 {
+		for _, c := range g.Contexts {
+			sample(c.Stack, c.Count)
+		}
+	} else {
+		for _, c := range g.Calls {
+			sample([]string{c.Callee, c.Caller}, c.Count)
+		}
+	}
+	return b.write(fout)
+}
+
+// WriteBlockPprof writes the time spent in each basic block as a pprof
+// profile. Each block is a sample with the number of times it was entered
+// and the time spent in it (not counting the functions it called). Its
+// location is the line the block starts on so `go tool pprof -lines` shows
+// the time by line.
+func (p *Profile) WriteBlockPprof(fout io.Writer) error {
+	entered := make(map[BlkEntrance]int, len(p.Durations))
+	for e, count := range p.Flows {
+		entered[e.Targ] += count
+	}
+	blks := make([]BlkEntrance, 0, len(p.Durations))
+	for blk := range p.Durations {
+		if blk.In != 0 {
+			blks = append(blks, blk)
+		}
+	}
+	for blk := range entered {
+		if _, has := p.Durations[blk]; !has && blk.In != 0 {
+			blks = append(blks, blk)
+		}
+	}
+	sort.Slice(blks, func(i, j int) bool {
+		a, b := blks[i], blks[j]
+		if p.fn_name(a) != p.fn_name(b) {
+			return p.fn_name(a) < p.fn_name(b)
+		}
+		return a.BasicBlockId < b.BasicBlockId
+	})
+	b := newPprofBuilder()
+	b.sampleType("entries", "count")
+	b.sampleType("time", "nanoseconds")
+	b.defaultSampleType("time")
+	for _, blk := range blks {
+		file, line := splitPosition(p.Positions[blk])
+		_, start := splitPosition(p.Positions[BlkEntrance{In: blk.In}])
+		loc := b.location(p.fn_name(blk), file, start, line)
+		b.sample([]uint64{loc}, int64(entered[blk]), int64(p.Durations[blk]))
+	}
+	return b.write(fout)
+}
+
+// splitPosition splits a "file:line:col" position
+func splitPosition(pos string) (string, uint64) {
+	parts := strings.Split(pos, ":")
+	if len(parts) < 3 {
+		return pos, 0
+	}
+	line, err := strconv.ParseUint(parts[len(parts)-2], 10, 64)
+	if err != nil {
+		return pos, 0
+	}
+	return strings.Join(parts[:len(parts)-2], ":"), line
+}
+
+// pprofBuilder encodes a pprof Profile message. The functions and locations
+// are added as the samples refer to them, the string table comes last.
+type pprofBuilder struct {
+	out   []byte
+	strs  map[string]uint64
+	table []string
+	funcs map[string]uint64
+	locs  map[pprofLine]uint64
+}
+
+type pprofLine struct {
+	fn   uint64
+	line uint64
+}
+
+func newPprofBuilder() *pprofBuilder {
+	b := &pprofBuilder{
+		strs:  make(map[string]uint64),
+		funcs: make(map[string]uint64),
+		locs:  make(map[pprofLine]uint64),
+	}
+	b.str("")
+	return b
+}
+
+// str is the index of s in the string table
+func (b *pprofBuilder) str(s string) uint64 {
+	if i, has := b.strs[s]; has {
+		return i
+	}
+	i := uint64(len(b.table))
+	b.strs[s] = i
+	b.table = append(b.table, s)
+	return i
+}
+
+func (b *pprofBuilder) sampleType(typ, unit string) {
+	b.out = pbBytes(b.out, 1, pbInt(pbInt(nil, 1, b.str(typ)), 2, b.str(unit)))
+}
+
+func (b *pprofBuilder) defaultSampleType(typ string) {
+	b.out = pbInt(b.out, 14, b.str(typ))
+}
+
+// location returns the id of the location at a line of a function (which
+// starts on the line start of file)
+func (b *pprofBuilder) location(fnName, file string, start, line uint64) uint64 {
+	fn, has := b.funcs[fnName]
+	if !has {
+		fn = uint64(len(b.funcs) + 1)
+		b.funcs[fnName] = fn
+		var f []byte
+		f = pbInt(f, 1, fn)
+		f = pbInt(f, 2, b.str(fnName))
+		f = pbInt(f, 3, b.str(fnName))
+		f = pbInt(f, 4, b.str(file))
+		f = pbInt(f, 5, start)
+		b.out = pbBytes(b.out, 5, f)
+	}
+	key := pprofLine{fn: fn, line: line}
+	if id, has := b.locs[key]; has {
+		return id
+	}
+	id := uint64(len(b.locs) + 1)
+	b.locs[key] = id
+	var l []byte
+	l = pbInt(l, 1, id)
+	l = pbBytes(l, 4, pbInt(pbInt(nil, 1, fn), 2, line))
+	b.out = pbBytes(b.out, 4, l)
+	return id
+}
+
+// sample adds a sample, its locations are innermost first
+func (b *pprofBuilder) sample(locs []uint64, values ...int64) {
+	vs := make([]uint64, 0, len(values))
+	for _, v := range values {
+		vs = append(vs, uint64(v))
+	}
+	var s []byte
+	s = pbPacked(s, 1, locs)
+	s = pbPacked(s, 2, vs)
+	b.out = pbBytes(b.out, 2, s)
+}
+
+func (b *pprofBuilder) write(fout io.Writer) error {
+	out := b.out
+	for _, s := range b.table {
+		out = pbBytes(out, 6, []byte(s))
+	}
+	z := gzip.NewWriter(fout)
+	if _, err := z.Write(out); err != nil {
+		return err
+	}
+	return z.Close()
+}
+
+// The protocol buffer encoding of the field types pprof uses: varints,
+// length delimited fields and packed varints.
+
+func pbVarint(b []byte, x uint64) []byte {
+	for x >= 0x80 {
+		b = append(b, byte(x)|0x80)
+		x >>= 7
+	}
+	return append(b, byte(x))
+}
+
+// pbInt encodes a varint field, zeros are left out
+func pbInt(b []byte, field int, x uint64) []byte {
+	if x == 0 {
+		return b
+	}
+	b = pbVarint(b, uint64(field)<<3)
+	return pbVarint(b, x)
+}
+
+func pbBytes(b []byte, field int, data []byte) []byte {
+	b = pbVarint(b, uint64(field)<<3|2)
+	b = pbVarint(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+func pbPacked(b []byte, field int, xs []uint64) []byte {
+	var data []byte
+	for _, x := range xs {
+		data = pbVarint(data, x)
+	}
+	return pbBytes(b, field, data)
+}
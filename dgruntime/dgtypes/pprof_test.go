@@ -0,0 +1,278 @@
+package dgtypes
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// pprofProfile is the part of a decoded pprof Profile message the writers
+// fill in
+type pprofProfile struct {
+	sampleTypes []string // "type/unit"
+	defaultType string
+	samples     map[string][]int64 // by the names and lines of their locations
+	locations   map[uint64]pprofLine
+	functions   map[uint64]string // "name file:start"
+}
+
+// decodePprof decodes a gzipped pprof profile. It checks the references
+// between the messages as it goes.
+func decodePprof(t *testing.T, data []byte) *pprofProfile {
+	z, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := ioutil.ReadAll(z)
+	if err != nil {
+		t.Fatal(err)
+	}
+	type function struct{ name, file, start uint64 }
+	var types [][2]uint64
+	var defaultType uint64
+	var samples [][2][]uint64
+	var table []string
+	locations := make(map[uint64]pprofLine)
+	functions := make(map[uint64]function)
+	for _, f := range pbDecode(t, raw) {
+		switch f.num {
+		case 1:
+			m := pbFields(t, f.data)
+			types = append(types, [2]uint64{m[1], m[2]})
+		case 2:
+			var locs, values []uint64
+			for _, sf := range pbDecode(t, f.data) {
+				switch sf.num {
+				case 1:
+					locs = append(locs, pbUnpack(t, sf.data)...)
+				case 2:
+					values = append(values, pbUnpack(t, sf.data)...)
+				}
+			}
+			samples = append(samples, [2][]uint64{locs, values})
+		case 4:
+			var id uint64
+			var lines []pprofLine
+			for _, lf := range pbDecode(t, f.data) {
+				switch lf.num {
+				case 1:
+					id = lf.x
+				case 4:
+					m := pbFields(t, lf.data)
+					lines = append(lines, pprofLine{fn: m[1], line: m[2]})
+				}
+			}
+			if _, has := locations[id]; has || id == 0 || len(lines) != 1 {
+				t.Fatalf("bad location %d %v", id, lines)
+			}
+			locations[id] = lines[0]
+		case 5:
+			m := pbFields(t, f.data)
+			if _, has := functions[m[1]]; has || m[1] == 0 || m[2] != m[3] {
+				t.Fatalf("bad function %v", m)
+			}
+			functions[m[1]] = function{name: m[2], file: m[4], start: m[5]}
+		case 6:
+			table = append(table, string(f.data))
+		case 14:
+			defaultType = f.x
+		default:
+			t.Fatalf("unexpected field %d", f.num)
+		}
+	}
+	str := func(i uint64) string {
+		if i >= uint64(len(table)) {
+			t.Fatalf("string %d is not in the table %v", i, table)
+		}
+		return table[i]
+	}
+	if len(table) == 0 || table[0] != "" {
+		t.Fatalf("the string table must start with \"\": %q", table)
+	}
+	p := &pprofProfile{
+		samples:   make(map[string][]int64),
+		locations: locations,
+		functions: make(map[uint64]string),
+	}
+	for _, typ := range types {
+		p.sampleTypes = append(p.sampleTypes, str(typ[0])+"/"+str(typ[1]))
+	}
+	if defaultType != 0 {
+		p.defaultType = str(defaultType)
+	}
+	for id, f := range functions {
+		p.functions[id] = fmt.Sprintf("%v %v:%d", str(f.name), str(f.file), f.start)
+	}
+	for _, s := range samples {
+		stack := make([]string, 0, len(s[0]))
+		for _, loc := range s[0] {
+			l, has := locations[loc]
+			if !has {
+				t.Fatalf("sample refers to the unknown location %d", loc)
+			}
+			f, has := functions[l.fn]
+			if !has {
+				t.Fatalf("location %d refers to the unknown function %d", loc, l.fn)
+			}
+			stack = append(stack, fmt.Sprintf("%v:%d", str(f.name), l.line))
+		}
+		if len(s[1]) != len(types) {
+			t.Fatalf("sample %v has %d values for %d sample types", stack, len(s[1]), len(types))
+		}
+		values := make([]int64, 0, len(s[1]))
+		for _, v := range s[1] {
+			values = append(values, int64(v))
+		}
+		key := strings.Join(stack, ";")
+		if _, has := p.samples[key]; has {
+			t.Fatalf("duplicate sample %v", key)
+		}
+		p.samples[key] = values
+	}
+	return p
+}
+
+type pbField struct {
+	num  int
+	x    uint64 // varint fields
+	data []byte // length delimited fields
+}
+
+func pbReadVarint(t *testing.T, b []byte) (uint64, []byte) {
+	var x uint64
+	for shift := uint(0); len(b) > 0; shift += 7 {
+		c := b[0]
+		b = b[1:]
+		x |= uint64(c&0x7f) << shift
+		if c < 0x80 {
+			return x, b
+		}
+	}
+	t.Fatal("truncated varint")
+	return 0, nil
+}
+
+func pbDecode(t *testing.T, b []byte) []pbField {
+	var fields []pbField
+	for len(b) > 0 {
+		var key uint64
+		key, b = pbReadVarint(t, b)
+		f := pbField{num: int(key >> 3)}
+		switch key & 7 {
+		case 0:
+			f.x, b = pbReadVarint(t, b)
+		case 2:
+			var n uint64
+			n, b = pbReadVarint(t, b)
+			if n > uint64(len(b)) {
+				t.Fatalf("field %d is truncated", f.num)
+			}
+			f.data, b = b[:n], b[n:]
+		default:
+			t.Fatalf("field %d has the unexpected wire type %d", f.num, key&7)
+		}
+		fields = append(fields, f)
+	}
+	return fields
+}
+
+// pbFields decodes a message of varint fields
+func pbFields(t *testing.T, b []byte) map[int]uint64 {
+	m := make(map[int]uint64)
+	for _, f := range pbDecode(t, b) {
+		m[f.num] = f.x
+	}
+	return m
+}
+
+func pbUnpack(t *testing.T, b []byte) []uint64 {
+	var xs []uint64
+	for len(b) > 0 {
+		var x uint64
+		x, b = pbReadVarint(t, b)
+		xs = append(xs, x)
+	}
+	return xs
+}
+
+func TestWritePprof(t *testing.T) {
+	calls := testProfile()
+	calls.Calls[Call{Caller: 0, Callee: 10}] = 1
+	calls.Calls[Call{Caller: 10, Callee: 20}] = 3
+	contexts := testProfile()
+	contexts.Contexts[CallContext{10}] = 1
+	contexts.Contexts[CallContext{20, 10}] = 2
+	contexts.Contexts[CallContext{20, 20, 10}] = 1
+	for _, c := range []struct {
+		name      string
+		p         *Profile
+		samples   map[string][]int64
+		functions map[uint64]string // numbered as the samples first use them
+		locations map[uint64]pprofLine
+	}{
+		{"calls", calls, map[string][]int64{
+			"main.main:3":          {1},
+			"main.f:9;main.main:3": {3},
+		}, map[uint64]string{1: "main.main main.go:3", 2: "main.f main.go:9"},
+			map[uint64]pprofLine{1: {fn: 1, line: 3}, 2: {fn: 2, line: 9}}},
+		{"contexts", contexts, map[string][]int64{
+			"main.main:3":                   {1},
+			"main.f:9;main.main:3":          {2},
+			"main.f:9;main.f:9;main.main:3": {1},
+		}, map[uint64]string{1: "main.f main.go:9", 2: "main.main main.go:3"},
+			map[uint64]pprofLine{1: {fn: 1, line: 9}, 2: {fn: 2, line: 3}}},
+	} {
+		var buf bytes.Buffer
+		if err := c.p.WritePprof(&buf); err != nil {
+			t.Fatal(err)
+		}
+		got := decodePprof(t, buf.Bytes())
+		if !reflect.DeepEqual(got.sampleTypes, []string{"calls/count"}) || got.defaultType != "" {
+			t.Errorf("%v: sample types %v (default %q)", c.name, got.sampleTypes, got.defaultType)
+		}
+		if !reflect.DeepEqual(got.samples, c.samples) {
+			t.Errorf("%v: samples %v expected %v", c.name, got.samples, c.samples)
+		}
+		if !reflect.DeepEqual(got.functions, c.functions) {
+			t.Errorf("%v: functions %v expected %v", c.name, got.functions, c.functions)
+		}
+		if !reflect.DeepEqual(got.locations, c.locations) {
+			t.Errorf("%v: locations %v expected %v", c.name, got.locations, c.locations)
+		}
+	}
+}
+
+func TestWriteBlockPprof(t *testing.T) {
+	var buf bytes.Buffer
+	if err := testProfile().WriteBlockPprof(&buf); err != nil {
+		t.Fatal(err)
+	}
+	got := decodePprof(t, buf.Bytes())
+	if !reflect.DeepEqual(got.sampleTypes, []string{"entries/count", "time/nanoseconds"}) {
+		t.Errorf("sample types %v", got.sampleTypes)
+	}
+	if got.defaultType != "time" {
+		t.Errorf("default sample type %q", got.defaultType)
+	}
+	samples := map[string][]int64{
+		"main.f:9":    {3, 1500000},
+		"main.main:3": {1, 5000000},
+		"main.main:5": {3, 0},
+	}
+	if !reflect.DeepEqual(got.samples, samples) {
+		t.Errorf("samples %v expected %v", got.samples, samples)
+	}
+	// the blocks are sorted by function so main.f comes first
+	functions := map[uint64]string{1: "main.f main.go:9", 2: "main.main main.go:3"}
+	if !reflect.DeepEqual(got.functions, functions) {
+		t.Errorf("functions %v expected %v", got.functions, functions)
+	}
+	locations := map[uint64]pprofLine{1: {fn: 1, line: 9}, 2: {fn: 2, line: 3}, 3: {fn: 2, line: 5}}
+	if !reflect.DeepEqual(got.locations, locations) {
+		t.Errorf("locations %v expected %v", got.locations, locations)
+	}
+}
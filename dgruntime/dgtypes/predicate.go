@@ -0,0 +1,34 @@
+package dgtypes
+
+import (
+	"fmt"
+)
+
+// Predicate is a fact about the values at a predicate site (a branch
+// condition, a comparison, a call's result or an assignment) which held when
+// the block At evaluated the site. Profiles count how often each predicate
+// held. In the flow graph a predicate is a vertex of its own with a PredEdge
+// from its block.
+type Predicate struct {
+	At       BlkEntrance
+	Site     int    // the site's index within its function
+	Name     string // what held, eg. `x < y is true`, `x == y` or `x > 0`
+	Position string // the site's position
+}
+
+// PredicateSite is a predicate site as evaluated by the block At. Profiles
+// count how often each site was observed (evaluated), whichever of its
+// predicates held.
+type PredicateSite struct {
+	At   BlkEntrance
+	Site int
+}
+
+// SiteOf returns the site the predicate belongs to
+func (pred Predicate) SiteOf() PredicateSite {
+	return PredicateSite{At: pred.At, Site: pred.Site}
+}
+
+func (p *Profile) pred_name(pred Predicate) string {
+	return fmt.Sprintf("%v pred %d: %v", p.blk_name(pred.At), pred.Site, pred.Name)
+}
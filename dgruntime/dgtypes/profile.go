@@ -10,30 +10,64 @@ import (
 )
 
 type Profile struct {
-	Inputs    map[string][]ObjectProfile
-	Outputs   map[string][]ObjectProfile
-	Types     map[string]Type
-	Funcs     map[uintptr]*Function
-	Calls     map[Call]int
-	Flows     map[FlowEdge]int
-	Positions map[BlkEntrance]string
-	Durations map[BlkEntrance]time.Duration
-	CallCount int
+	Inputs      map[string][]ObjectProfile
+	Outputs     map[string][]ObjectProfile
+	Types       map[string]Type
+	Funcs       map[uintptr]*Function
+	Calls       map[Call]int
+	Contexts    map[CallContext]int // empty unless calling contexts were recorded
+	Flows       map[FlowEdge]int
+	Positions   map[BlkEntrance]string
+	Durations   map[BlkEntrance]time.Duration
+	Predicates  map[Predicate]int
+	Observed    map[PredicateSite]int
+	CallCount   int
+	Sampling    *Sampling          // nil unless the profile was sampled
+	Granularity string             // what the probes recorded, empty for blocks
+	pcs         map[string]uintptr // function name index for loaded profiles
+	nextPc      uintptr
 }
 
 func NewProfile() *Profile {
 	return &Profile{
-		Calls:     make(map[Call]int),
-		Funcs:     make(map[uintptr]*Function),
-		Flows:     make(map[FlowEdge]int),
-		Positions: make(map[BlkEntrance]string),
-		Durations: make(map[BlkEntrance]time.Duration),
-		Inputs:    make(map[string][]ObjectProfile),
-		Outputs:   make(map[string][]ObjectProfile),
-		Types:     make(map[string]Type),
+		Calls:      make(map[Call]int),
+		Contexts:   make(map[CallContext]int),
+		Funcs:      make(map[uintptr]*Function),
+		Flows:      make(map[FlowEdge]int),
+		Positions:  make(map[BlkEntrance]string),
+		Durations:  make(map[BlkEntrance]time.Duration),
+		Predicates: make(map[Predicate]int),
+		Observed:   make(map[PredicateSite]int),
+		Inputs:     make(map[string][]ObjectProfile),
+		Outputs:    make(map[string][]ObjectProfile),
+		Types:      make(map[string]Type),
 	}
 }
 
+// Sampling describes how a sampled profile was recorded
+type Sampling struct {
+	Params string  // the sampling settings (eg. "every=100")
+	Rate   float64 // the expected fraction of function calls recorded
+}
+
+func (s *Sampling) String() string {
+	if s == nil {
+		return "not sampled"
+	}
+	return fmt.Sprintf("sampled with %v (rate %v)", s.Params, s.Rate)
+}
+
+// The granularities a program can be instrumented at. At FuncGranularity
+// only function entries and calls are recorded (the profile's flows are the
+// calls and returns between entry blocks). At EdgeGranularity the probes name
+// the control flow edge they are on rather than the runtime inferring it from
+// the block executed before. BlockGranularity is recorded as "".
+const (
+	FuncGranularity  = "func"
+	BlockGranularity = "block"
+	EdgeGranularity  = "edge"
+)
+
 type Call struct {
 	Caller uintptr
 	Callee uintptr
@@ -91,6 +125,24 @@ func (p *Profile) WriteDotty(fout io.Writer) {
 			blks[e.Targ] = t
 		}
 	}
+	for pred := range p.Predicates {
+		if _, has := blks[pred.At]; !has {
+			continue
+		}
+		fmt.Fprintf(fout, "%d [label=%v, shape=ellipse, position=%v, fn_name=%v, bbid=%d, site=%d, predicate=%v, observed=%d];\n",
+			nextid,
+			strconv.Quote(p.pred_name(pred)),
+			strconv.Quote(pred.Position),
+			strconv.Quote(p.fn_name(pred.At)),
+			pred.At.BasicBlockId,
+			pred.Site,
+			strconv.Quote(pred.Name),
+			p.Observed[pred.SiteOf()],
+		)
+		fmt.Fprintf(fout, "%v -> %v [traversed=%d, kind=%v];\n",
+			blks[pred.At], nextid, p.Predicates[pred], strconv.Quote(PredEdge))
+		nextid++
+	}
 	for e, count := range p.Flows {
 		if _, has := blks[e.Src]; !has {
 			continue
@@ -98,10 +150,15 @@ func (p *Profile) WriteDotty(fout io.Writer) {
 		if _, has := blks[e.Targ]; !has {
 			continue
 		}
+		if e.Kind != "" {
+			fmt.Fprintf(fout, "%v -> %v [traversed=%d, kind=%v];\n",
+				blks[e.Src], blks[e.Targ], count, strconv.Quote(e.Kind))
+			continue
+		}
 		fmt.Fprintf(fout, "%v -> %v [traversed=%d];\n",
 			blks[e.Src], blks[e.Targ], count)
 	}
-	fmt.Fprintln(fout, "}\n\n")
+	fmt.Fprint(fout, "}\n\n\n")
 }
 
 func (p *Profile) runtime_name(pc uintptr) string {
@@ -130,70 +187,118 @@ func (p *Profile) blk_name(n BlkEntrance) string {
 	}
 }
 
-func (p *Profile) WriteSimple(fout io.Writer) {
+// GraphVertex is a basic block (or a predicate) of a profile's flow graph as
+// handed out by VisitGraph. Ids are assigned in visiting order, the entry is
+// always 0. binprof.Vertex has the same fields so a field added here must be
+// added there too.
+type GraphVertex struct {
+	Id           int
+	Label        string
+	BasicBlockId int
+	FnName       string
+	Position     string
+	Duration     time.Duration
+	Site         int    // the predicate's site
+	Predicate    string // the predicate's name, empty for basic blocks
+	Observed     int    // how often the predicate's site was observed
+}
+
+// VisitGraph walks the flow graph calling vertex for every basic block (the
+// entry first) and every predicate and then edge for every traversed edge.
+// The kind of an edge between goroutines is one of SpawnEdge, SendEdge or
+// CloseEdge, an edge to a predicate is a PredEdge counting how often the
+// predicate held.
+func (p *Profile) VisitGraph(vertex func(v *GraphVertex), edge func(src, targ, count int, kind string)) {
 	nextid := 1
 	blks := make(map[BlkEntrance]int)
-	entry := p.blk_name(BlkEntrance{})
-	fmt.Fprintln(fout, "start-graph")
-	fmt.Fprintf(fout, "vertex\t%d, %v, %d, %v, %v, %v\n",
-		0,
-		strconv.Quote(entry),
-		0,
-		strconv.Quote("entry"),
-		strconv.Quote("<none>"),
-		strconv.Quote("0s"),
-	)
+	vertex(&GraphVertex{
+		Id:       0,
+		Label:    p.blk_name(BlkEntrance{}),
+		FnName:   "entry",
+		Position: "<none>",
+	})
 	blks[BlkEntrance{}] = 0
-	for e, _ := range p.Flows {
-		src := p.blk_name(e.Src)
-		targ := p.blk_name(e.Targ)
-		if _, has := blks[e.Src]; !has {
-			s := nextid
-			nextid++
-			fmt.Fprintf(fout, "vertex\t%d, %v, %d, %v, %v, %v\n",
-				s,
-				strconv.Quote(src),
-				e.Src.BasicBlockId,
-				strconv.Quote(p.fn_name(e.Src)),
-				strconv.Quote(p.Positions[e.Src]),
-				strconv.Quote(p.Durations[e.Src].String()),
-			)
-			blks[e.Src] = s
-		}
-		if _, has := blks[e.Targ]; !has {
-			t := nextid
-			nextid++
-			fmt.Fprintf(fout, "vertex\t%d, %v, %d, %v, %v, %v\n",
-				t,
-				strconv.Quote(targ),
-				e.Targ.BasicBlockId,
-				strconv.Quote(p.fn_name(e.Targ)),
-				strconv.Quote(p.Positions[e.Targ]),
-				strconv.Quote(p.Durations[e.Targ].String()),
-			)
-			blks[e.Targ] = t
+	visit := func(n BlkEntrance) {
+		if _, has := blks[n]; has {
+			return
 		}
+		id := nextid
+		nextid++
+		vertex(&GraphVertex{
+			Id:           id,
+			Label:        p.blk_name(n),
+			BasicBlockId: n.BasicBlockId,
+			FnName:       p.fn_name(n),
+			Position:     p.Positions[n],
+			Duration:     p.Durations[n],
+		})
+		blks[n] = id
+	}
+	for e, _ := range p.Flows {
+		visit(e.Src)
+		visit(e.Targ)
+	}
+	preds := make(map[Predicate]int, len(p.Predicates))
+	for pred := range p.Predicates {
+		visit(pred.At)
+		preds[pred] = nextid
+		vertex(&GraphVertex{
+			Id:           nextid,
+			Label:        p.pred_name(pred),
+			BasicBlockId: pred.At.BasicBlockId,
+			FnName:       p.fn_name(pred.At),
+			Position:     pred.Position,
+			Site:         pred.Site,
+			Predicate:    pred.Name,
+			Observed:     p.Observed[pred.SiteOf()],
+		})
+		nextid++
 	}
 	for e, count := range p.Flows {
-		if _, has := blks[e.Src]; !has {
-			continue
-		}
-		if _, has := blks[e.Targ]; !has {
-			continue
-		}
-		fmt.Fprintf(fout, "edge\t%d, %d, %d\n",
-			blks[e.Src], blks[e.Targ], count)
+		edge(blks[e.Src], blks[e.Targ], count, e.Kind)
+	}
+	for pred, count := range p.Predicates {
+		edge(blks[pred.At], preds[pred], count, PredEdge)
 	}
-	fmt.Fprintln(fout, "end-graph")
 }
 
-func LoadSimple(fout io.Writer) (*Profile, error) {
-	p := NewProfile()
-	return p, nil
+func (p *Profile) WriteSimple(fout io.Writer) {
+	fmt.Fprintln(fout, "start-graph")
+	if p.Sampling != nil {
+		fmt.Fprintf(fout, "sampling\t%v, %v\n", strconv.Quote(p.Sampling.Params), p.Sampling.Rate)
+	}
+	if p.Granularity != "" {
+		fmt.Fprintf(fout, "granularity\t%v\n", strconv.Quote(p.Granularity))
+	}
+	p.VisitGraph(
+		func(v *GraphVertex) {
+			pred := ""
+			if v.Predicate != "" {
+				pred = fmt.Sprintf(", %d, %v, %d", v.Site, strconv.Quote(v.Predicate), v.Observed)
+			}
+			fmt.Fprintf(fout, "vertex\t%d, %v, %d, %v, %v, %v%v\n",
+				v.Id,
+				strconv.Quote(v.Label),
+				v.BasicBlockId,
+				strconv.Quote(v.FnName),
+				strconv.Quote(v.Position),
+				strconv.Quote(v.Duration.String()),
+				pred,
+			)
+		},
+		func(src, targ, count int, kind string) {
+			if kind != "" {
+				fmt.Fprintf(fout, "edge\t%d, %d, %d, %v\n", src, targ, count, strconv.Quote(kind))
+				return
+			}
+			fmt.Fprintf(fout, "edge\t%d, %d, %d\n", src, targ, count)
+		},
+	)
+	fmt.Fprintln(fout, "end-graph")
 }
 
 func (p *Profile) SerializeProfs(fout io.Writer) {
-	types := make([]Type, len(p.Types))
+	types := make([]Type, 0, len(p.Types))
 	for _, typ := range p.Types {
 		types = append(types, typ)
 	}
@@ -1,47 +1,108 @@
 package excludes
 
 import (
-	"strings"
+	"regexp"
 )
 
-var excludedPackages = map[string]bool{
-	"fmt":              true,
-	"net":              true,
-	"log":              true,
-	"runtime":          true,
-	"strings":          true,
-	"sync":             true,
-	"strconv":          true,
-	"io":               true,
-	"os":               true,
-	"unsafe":           true,
-	"errors":           true,
-	"internal/race":    true,
-	"math":             true,
-	"syscall":          true,
-	"time":             true,
-	"reflect":          true,
-	"unicode":          true,
-	"sort":             true,
-	"hash":             true,
-	"hash/fnv":         true,
-	"encoding/json":    true,
-	"encoding/binary":  true,
-	"bufio":            true,
-	"bytes":            true,
-	"path":             true,
-	"path/filepath":    true,
-	"encoding/base64":  true,
-	"internal":         true,
-	"internal/cpu":     true,
-	"dgruntime":        true,
-	"dgruntime/dgtype": true,
+// builtin lists the packages which are never instrumented: dgruntime and
+// the packages it imports (instrumenting them would recurse into the
+// profiler). What those packages import in turn changes from one go release
+// to the next, the instrumenter adds them for the toolchain it builds with
+// (see Policy.ExcludeDeps). The standard library's internal and vendored
+// packages are always left out.
+var builtin = []string{
+	"archive/tar",
+	"bufio",
+	"bytes",
+	"compress/gzip",
+	"dgruntime/...",
+	"encoding/binary",
+	"encoding/json",
+	"fmt",
+	"hash",
+	"internal/...",
+	"io",
+	"io/ioutil",
+	"math",
+	"net",
+	"net/url",
+	"os",
+	"os/signal",
+	"path/filepath",
+	"reflect",
+	"runtime",
+	"sort",
+	"strconv",
+	"strings",
+	"sync",
+	"sync/atomic",
+	"syscall",
+	"time",
+	"unsafe",
+	"vendor/...",
 }
 
-func ExcludedPkg(pkg string) bool {
-	parts := strings.Split(pkg, "/")
-	if len(parts) > 0 && excludedPackages[parts[0]] {
-		return true
+// defaults lists the packages which are not instrumented unless the policy
+// includes them. They are either too low level to be worth instrumenting or
+// (testing) are left alone so the goroutine running a test starts and ends
+// in the TestXxx function.
+var defaults = []string{
+	"fmt/...",
+	"hash/...",
+	"io/...",
+	"log/...",
+	"math/...",
+	"net/...",
+	"os/...",
+	"path/...",
+	"reflect/...",
+	"runtime/...",
+	"sort/...",
+	"strconv/...",
+	"strings/...",
+	"sync/...",
+	"syscall/...",
+	"testing/...",
+	"time/...",
+	"unicode/...",
+}
+
+var builtinRes, defaultRes []*regexp.Regexp
+
+func init() {
+	builtinRes = mustCompile(builtin)
+	defaultRes = mustCompile(defaults)
+}
+
+func mustCompile(patterns []string) []*regexp.Regexp {
+	res := make([]*regexp.Regexp, 0, len(patterns))
+	for _, pattern := range patterns {
+		re, err := compilePattern(pattern)
+		if err != nil {
+			panic(err)
+		}
+		res = append(res, re)
 	}
-	return excludedPackages[pkg]
+	return res
+}
+
+func builtinPatterns() []string {
+	return builtin
+}
+
+func defaultPatterns() []string {
+	return defaults
+}
+
+// ExcludedPkg reports whether pkg is one of the packages which are never
+// instrumented whatever the Policy says. (The Policy also never instruments
+// the dependencies it was given by ExcludeDeps.)
+func ExcludedPkg(pkg string) bool {
+	return matchAny(builtinRes, pkg)
+}
+
+// defaultExcludedPkg reports whether pkg is one of the packages which are
+// not instrumented unless the Policy includes them.
+func defaultExcludedPkg(pkg string) bool {
+	return matchAny(defaultRes, pkg)
 }
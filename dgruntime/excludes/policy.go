@@ -0,0 +1,234 @@
+package excludes
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Policy decides which packages and functions are instrumented. Patterns use
+// the go command's syntax: `...` matches any string (so `net/...` matches net
+// and every package below it). In addition `*` and `?` match within a single
+// path element.
+//
+// A package is instrumented when it matches an Include pattern (or there are
+// none), does not match an Exclude pattern and is not one of the packages
+// dgruntime itself depends on (see ExcludedPkg and ExcludeDeps). Some other
+// standard library packages (testing, log, ...) are only instrumented when an
+// Include pattern matches them. Functions are matched by their full dynagrok name (eg.
+// `(*github.com/x/y.T).String`).
+type Policy struct {
+	Include      []string
+	Exclude      []string
+	ExcludeFuncs []string
+	include      []*regexp.Regexp
+	exclude      []*regexp.Regexp
+	excludeFuncs []*regexp.Regexp
+	deps         map[string]bool
+}
+
+// NewPolicy makes a policy which instruments everything ExcludedPkg allows
+func NewPolicy() *Policy {
+	return &Policy{}
+}
+
+// LoadPolicy reads a policy file. Each line holds a directive and a pattern:
+//
+//	# comments and blank lines are ignored
+//	include github.com/me/prog/...
+//	exclude github.com/me/prog/vendor/...
+//	exclude-func ...String
+func LoadPolicy(path string) (*Policy, error) {
+	p := NewPolicy()
+	return p, p.Load(path)
+}
+
+// Load adds the directives in the policy file at path to the policy
+func (p *Policy) Load(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return p.Read(f)
+}
+
+// Read adds the directives from a policy file to the policy
+func (p *Policy) Read(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return fmt.Errorf("policy line %d: expected `<directive> <pattern>` got `%v`", line, text)
+		}
+		var err error
+		switch fields[0] {
+		case "include":
+			err = p.AddInclude(fields[1])
+		case "exclude":
+			err = p.AddExclude(fields[1])
+		case "exclude-func":
+			err = p.AddExcludeFunc(fields[1])
+		default:
+			err = fmt.Errorf("unknown directive %v", fields[0])
+		}
+		if err != nil {
+			return fmt.Errorf("policy line %d: %v", line, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// AddInclude adds a comma separated list of package patterns to instrument
+func (p *Policy) AddInclude(patterns string) error {
+	return addPatterns(&p.Include, &p.include, patterns)
+}
+
+// AddExclude adds a comma separated list of package patterns not to instrument
+func (p *Policy) AddExclude(patterns string) error {
+	return addPatterns(&p.Exclude, &p.exclude, patterns)
+}
+
+// AddExcludeFunc adds a comma separated list of function patterns not to
+// instrument
+func (p *Policy) AddExcludeFunc(patterns string) error {
+	return addPatterns(&p.ExcludeFuncs, &p.excludeFuncs, patterns)
+}
+
+// ExcludeDeps adds packages dgruntime depends on to the packages which are
+// never instrumented. They are the dependencies of the packages dgruntime
+// imports as the toolchain building the program has them.
+func (p *Policy) ExcludeDeps(pkgs []string) {
+	if p.deps == nil {
+		p.deps = make(map[string]bool, len(pkgs))
+	}
+	for _, pkg := range pkgs {
+		p.deps[pkg] = true
+	}
+}
+
+func addPatterns(patterns *[]string, compiled *[]*regexp.Regexp, list string) error {
+	for _, pattern := range strings.Split(list, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		re, err := compilePattern(pattern)
+		if err != nil {
+			return err
+		}
+		*patterns = append(*patterns, pattern)
+		*compiled = append(*compiled, re)
+	}
+	return nil
+}
+
+func compilePattern(pattern string) (*regexp.Regexp, error) {
+	var re bytes.Buffer
+	re.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		switch {
+		case strings.HasPrefix(pattern[i:], "/..."):
+			// like the go command `net/...` also matches `net`
+			re.WriteString("(/.*)?")
+			i += len("/...") - 1
+		case strings.HasPrefix(pattern[i:], "..."):
+			re.WriteString(".*")
+			i += len("...") - 1
+		case pattern[i] == '*':
+			re.WriteString("[^/]*")
+		case pattern[i] == '?':
+			re.WriteString("[^/]")
+		default:
+			re.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		}
+	}
+	re.WriteString("$")
+	compiled, err := regexp.Compile(re.String())
+	if err != nil {
+		return nil, fmt.Errorf("bad pattern %v: %v", pattern, err)
+	}
+	return compiled, nil
+}
+
+func matchAny(res []*regexp.Regexp, s string) bool {
+	for _, re := range res {
+		if re.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// ExcludedPkg reports whether the package at pkgPath is not instrumented
+func (p *Policy) ExcludedPkg(pkgPath string) bool {
+	if ExcludedPkg(pkgPath) || (p != nil && p.deps[pkgPath]) {
+		return true
+	}
+	if p != nil && matchAny(p.include, pkgPath) {
+		return matchAny(p.exclude, pkgPath)
+	}
+	if defaultExcludedPkg(pkgPath) {
+		return true
+	}
+	if p == nil {
+		return false
+	}
+	if len(p.include) > 0 {
+		return true
+	}
+	return matchAny(p.exclude, pkgPath)
+}
+
+// ExcludedFunc reports whether the function is not instrumented
+func (p *Policy) ExcludedFunc(fnName string) bool {
+	if p == nil {
+		return false
+	}
+	return matchAny(p.excludeFuncs, fnName)
+}
+
+// String renders the policy in the policy file format. The built in and
+// default excludes are listed as comments so the record of a run is
+// complete.
+func (p *Policy) String() string {
+	var b bytes.Buffer
+	for _, pattern := range builtinPatterns() {
+		fmt.Fprintf(&b, "# builtin exclude %v\n", pattern)
+	}
+	if p != nil {
+		deps := make([]string, 0, len(p.deps))
+		for pkg := range p.deps {
+			deps = append(deps, pkg)
+		}
+		sort.Strings(deps)
+		for _, pkg := range deps {
+			fmt.Fprintf(&b, "# builtin exclude %v\n", pkg)
+		}
+	}
+	for _, pattern := range defaultPatterns() {
+		fmt.Fprintf(&b, "# default exclude %v\n", pattern)
+	}
+	if p == nil {
+		return b.String()
+	}
+	for _, pattern := range p.Include {
+		fmt.Fprintf(&b, "include %v\n", pattern)
+	}
+	for _, pattern := range p.Exclude {
+		fmt.Fprintf(&b, "exclude %v\n", pattern)
+	}
+	for _, pattern := range p.ExcludeFuncs {
+		fmt.Fprintf(&b, "exclude-func %v\n", pattern)
+	}
+	return b.String()
+}
@@ -0,0 +1,184 @@
+package excludes
+
+import (
+	"go/build"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCompilePattern(t *testing.T) {
+	for _, c := range []struct {
+		pattern string
+		match   []string
+		not     []string
+	}{
+		{"net", []string{"net"}, []string{"net/http", "netx", "xnet"}},
+		{"net/...", []string{"net", "net/http", "net/http/pprof"}, []string{"netx", "x/net"}},
+		{"github.com/x/...", []string{"github.com/x", "github.com/x/y/z"}, []string{"github.com/xy"}},
+		{"...util", []string{"util", "a/b/util", "strutil"}, []string{"util/x"}},
+		{"a/*/c", []string{"a/b/c", "a//c"}, []string{"a/b/b/c", "a/c"}},
+		{"a/b?", []string{"a/b1", "a/bc"}, []string{"a/b", "a/b/", "a/b12"}},
+		{"...String", []string{"(*github.com/x/y.T).String", "fmt.String"}, []string{"(*x.T).Strings"}},
+		{"(*x.T).Get", []string{"(*x.T).Get"}, []string{"*x.T.Get", "(*xxT).Get"}},
+		{"a+b[c]", []string{"a+b[c]"}, []string{"aab", "a+bc"}},
+	} {
+		re, err := compilePattern(c.pattern)
+		if err != nil {
+			t.Errorf("%v: %v", c.pattern, err)
+			continue
+		}
+		for _, s := range c.match {
+			if !re.MatchString(s) {
+				t.Errorf("%v does not match %v (%v)", c.pattern, s, re)
+			}
+		}
+		for _, s := range c.not {
+			if re.MatchString(s) {
+				t.Errorf("%v matches %v (%v)", c.pattern, s, re)
+			}
+		}
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	p := NewPolicy()
+	err := p.Read(strings.NewReader(`
+# instrument the program, not its vendored packages
+include github.com/me/prog/...
+exclude github.com/me/prog/vendor/...
+exclude-func ...String,(*github.com/me/prog.T).Get
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for pkg, excluded := range map[string]bool{
+		"github.com/me/prog":            false,
+		"github.com/me/prog/lib":        false,
+		"github.com/me/prog/vendor/x":   true,
+		"github.com/me/other":           true,
+		"github.com/me/prog/internal/x": false,
+		"fmt":                           true, // built in
+		"dgruntime/dgtypes":             true,
+		"math/big":                      true, // not included
+	} {
+		if got := p.ExcludedPkg(pkg); got != excluded {
+			t.Errorf("ExcludedPkg(%v) = %v, expected %v", pkg, got, excluded)
+		}
+	}
+	for fn, excluded := range map[string]bool{
+		"(*github.com/me/prog.T).String": true,
+		"(*github.com/me/prog.T).Get":    true,
+		"(*github.com/me/prog.T).Set":    false,
+		"github.com/me/prog.main":        false,
+	} {
+		if got := p.ExcludedFunc(fn); got != excluded {
+			t.Errorf("ExcludedFunc(%v) = %v, expected %v", fn, got, excluded)
+		}
+	}
+	for _, bad := range []string{"include", "include a b", "only a"} {
+		if err := NewPolicy().Read(strings.NewReader(bad)); err == nil {
+			t.Errorf("%q: expected an error", bad)
+		}
+	}
+}
+
+func TestBuiltin(t *testing.T) {
+	for pkg, excluded := range map[string]bool{
+		"fmt":               true,
+		"runtime":           true,
+		"internal/poll":     true,
+		"dgruntime/binprof": true,
+		"math/big":          false,
+		"net/http":          false,
+		"strings/x":         false,
+		"testing":           false,
+		"github.com/x/fmt":  false,
+	} {
+		if got := ExcludedPkg(pkg); got != excluded {
+			t.Errorf("ExcludedPkg(%v) = %v, expected %v", pkg, got, excluded)
+		}
+	}
+}
+
+func TestIncludesWin(t *testing.T) {
+	var none *Policy
+	p := NewPolicy()
+	if err := p.AddInclude("math/...,net/http,testing,fmt,github.com/me/prog/..."); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.AddExclude("net/http"); err != nil {
+		t.Fatal(err)
+	}
+	for pkg, excluded := range map[string][2]bool{
+		// {without a policy, with p}
+		"math/big":           {true, false},
+		"testing":            {true, false},
+		"testing/quick":      {true, true},
+		"log":                {true, true},
+		"github.com/me/prog": {false, false},
+		"github.com/me/x":    {false, true},
+		"text/template":      {false, true},
+		"net/http":           {true, true}, // excluded again
+		"math":               {true, true}, // dgruntime depends on these
+		"fmt":                {true, true},
+	} {
+		if got := none.ExcludedPkg(pkg); got != excluded[0] {
+			t.Errorf("nil policy ExcludedPkg(%v) = %v, expected %v", pkg, got, excluded[0])
+		}
+		if got := p.ExcludedPkg(pkg); got != excluded[1] {
+			t.Errorf("ExcludedPkg(%v) = %v, expected %v", pkg, got, excluded[1])
+		}
+	}
+}
+
+// TestBuiltinImports checks that the packages dgruntime imports are built in
+// excludes (their own dependencies are added by ExcludeDeps)
+func TestBuiltinImports(t *testing.T) {
+	for _, tags := range [][]string{nil, {"dgpatched"}} {
+		ctx := build.Default
+		ctx.BuildTags = tags
+		todo := []string{"dgruntime"}
+		seen := map[string]bool{"dgruntime": true}
+		for len(todo) > 0 {
+			path := todo[0]
+			todo = todo[1:]
+			dir := filepath.Join("..", filepath.FromSlash(strings.TrimPrefix(path, "dgruntime")))
+			pkg, err := ctx.ImportDir(dir, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, imp := range pkg.Imports {
+				if !ExcludedPkg(imp) {
+					t.Errorf("%v imports %v which is not a builtin exclude (tags %v)", path, imp, tags)
+				}
+				if strings.HasPrefix(imp, "dgruntime/") && !seen[imp] {
+					seen[imp] = true
+					todo = append(todo, imp)
+				}
+			}
+		}
+	}
+}
+
+func TestExcludeDeps(t *testing.T) {
+	p := NewPolicy()
+	if err := p.AddInclude("math/..."); err != nil {
+		t.Fatal(err)
+	}
+	if p.ExcludedPkg("math/rand") {
+		t.Fatal("math/rand is excluded before it is a dependency")
+	}
+	p.ExcludeDeps([]string{"math/rand", "errors"})
+	for _, pkg := range []string{"math/rand", "errors"} {
+		if !p.ExcludedPkg(pkg) {
+			t.Errorf("the dependency %v is not excluded", pkg)
+		}
+	}
+	if p.ExcludedPkg("math/big") {
+		t.Errorf("math/big is excluded but is not a dependency")
+	}
+	if got := p.String(); !strings.Contains(got, "# builtin exclude errors\n# builtin exclude math/rand\n") {
+		t.Errorf("the dependencies are not listed in the policy:\n%v", got)
+	}
+}
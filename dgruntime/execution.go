@@ -6,31 +6,29 @@ import (
 	"io"
 	"os"
 	"runtime"
-	"strconv"
 	"strings"
 	"sync"
 )
 
 type Execution struct {
-	m          sync.Mutex
-	Goroutines []*Goroutine
-	Profile    *dgtypes.Profile
-	OutputDir  string
-	mergeCh    chan *Goroutine
-	async      sync.WaitGroup
-	fails      []*Failure
-	failed     map[string]bool
-}
-
-type Failure struct {
-	Position     string
-	FnName       string
-	BasicBlockId int
-}
-
-func (f *Failure) String() string {
-	return fmt.Sprintf(`{"Position":%v, "FnName":%v, "BasicBlockId":%d}`,
-		strconv.Quote(f.Position), strconv.Quote(f.FnName), f.BasicBlockId)
+	m           sync.Mutex
+	goroutines  registry
+	Profile     *dgtypes.Profile
+	OutputDir   string // empty when the profile is streamed (see sink.go)
+	mergeCh     chan *buffer
+	mergeMu     sync.RWMutex // read locked while sending on mergeCh
+	stopped     bool         // shutdown closed mergeCh
+	async       sync.WaitGroup
+	fails       []*dgtypes.Failure
+	failed      map[string]bool
+	Policy      string // the instrumentation policy the program was built with
+	Granularity string // what the probes record, empty for blocks (see SetGranularity)
+	Format      string // the flow graph format: text or binary
+	Contexts    int    // the length of the recorded calling contexts (see callgraph.go)
+	segments    []*segment
+	segNames    map[string]int
+	sampler     *sampler
+	out         *output
 }
 
 var execMu sync.Mutex
@@ -52,161 +50,173 @@ func pjoin(parts ...string) string {
 }
 
 func newExecution() *Execution {
-	outputDir := "/tmp/dynagrok-profile"
-	if os.Getenv("DGPROF") != "" {
-		outputDir = os.Getenv("DGPROF")
-	}
-	if err := os.MkdirAll(outputDir, os.ModeDir|0775); err != nil {
-		panic(fmt.Errorf("dynagrok's dgruntime could not make directory %v", outputDir))
-	}
+	out := newOutput()
 	e := &Execution{
 		Profile:   dgtypes.NewProfile(),
-		OutputDir: outputDir,
-		mergeCh:   make(chan *Goroutine, 15),
+		OutputDir: out.dir,
+		out:       out,
+		mergeCh:   make(chan *buffer, 15),
 		failed:    make(map[string]bool),
+		segNames:  make(map[string]int),
+		Format:    flowGraphFormat(),
+		Contexts:  callContexts(),
+		sampler:   newSampler(),
 	}
-	e.growGoroutines()
-	go func() {
-		e.async.Add(1)
-		for g := range e.mergeCh {
-			e.merge(g)
+	e.Profile.Sampling = e.sampler.Sampling()
+	e.async.Add(1)
+	goOwn(func() {
+		for b := range e.mergeCh {
+			if b.synced != nil {
+				close(b.synced)
+				continue
+			}
+			e.merge(b)
 		}
 		e.async.Done()
-	}()
+	})
 	return e
 }
 
 func (e *Execution) Goroutine(id int64) *Goroutine {
-	for id >= int64(len(e.Goroutines)) {
-		e.m.Lock()
-		for id >= int64(len(e.Goroutines)) {
-			e.growGoroutines()
-		}
-		e.m.Unlock()
-	}
-	if e.Goroutines[id] == nil {
-		e.m.Lock()
-		if e.Goroutines[id] == nil {
-			// Println(fmt.Sprintf("new goroutine %d", id))
-			e.Goroutines[id] = newGoroutine(id)
-		}
-		e.m.Unlock()
-	}
-	return e.Goroutines[id]
+	return e.goroutines.get(id)
 }
 
-func (e *Execution) Fail(fnName string, bbid int, pos string) {
+// Fail adds a failure to the failures file. The same failure (from the same
+// block, with the same message and stack) is added once.
+func (e *Execution) Fail(f *dgtypes.Failure) {
+	key := f.String()
 	e.m.Lock()
-	if !e.failed[pos] {
-		e.failed[pos] = true
-		e.fails = append(e.fails, &Failure{
-			FnName:       fnName,
-			BasicBlockId: bbid,
-			Position:     pos,
-		})
+	if !e.failed[key] {
+		e.failed[key] = true
+		e.fails = append(e.fails, f)
 	}
 	e.m.Unlock()
 }
 
-func (e *Execution) growGoroutines() {
-	n := make([]*Goroutine, (len(e.Goroutines)+1)*2)
-	copy(n, e.Goroutines)
-	// for i := len(e.Goroutines); i < len(n); i++ {
-	// 	n[i] = newGoroutine(int64(i))
-	// }
-	e.Goroutines = n
+// Merge hands a buffer to the merging goroutine. Goroutines which exit after
+// the shut down are not recorded.
+func (e *Execution) Merge(b *buffer) {
+	e.mergeMu.RLock()
+	defer e.mergeMu.RUnlock()
+	if !e.stopped {
+		e.mergeCh <- b
+	}
 }
 
-func (e *Execution) Merge(g *Goroutine) {
-	e.mergeCh <- g
+// sync waits until the goroutines which have exited so far are merged into
+// the profile.
+func (e *Execution) sync() {
+	marker := &buffer{synced: make(chan struct{})}
+	e.mergeMu.RLock()
+	if e.stopped {
+		e.mergeMu.RUnlock()
+		return
+	}
+	e.mergeCh <- marker
+	e.mergeMu.RUnlock()
+	<-marker.synced
 }
 
-func (e *Execution) merge(g *Goroutine) {
+func (e *Execution) merge(b *buffer) {
 	e.m.Lock()
 	defer e.m.Unlock()
-	if !g.Closed {
-		return
+	e.mergeCounts(b)
+}
+
+// flush moves what the live goroutines have recorded so far into the
+// profile. Goroutines are otherwise only merged when they exit.
+func (e *Execution) flush() {
+	live := e.goroutines.live()
+	bufs := make([]*buffer, 0, len(live))
+	for _, g := range live {
+		bufs = append(bufs, g.take())
 	}
-	e.Profile.CallCount += g.CallCount
-	for _, fn := range g.Funcs {
+	e.m.Lock()
+	defer e.m.Unlock()
+	for _, b := range bufs {
+		e.mergeCounts(b)
+	}
+}
+
+// mergeCounts adds the buffer's counters to the profile. e.m must be held.
+func (e *Execution) mergeCounts(b *buffer) {
+	e.Profile.CallCount += b.CallCount
+	for _, fn := range b.Funcs {
 		if x, has := e.Profile.Funcs[fn.FuncPc]; has {
 			x.Merge(fn)
 		} else {
 			e.Profile.Funcs[fn.FuncPc] = fn
 		}
 	}
-	for call, count := range g.Calls {
+	for call, count := range b.Calls {
 		e.Profile.Calls[call] += count
 	}
-	for edge, count := range g.Flows {
+	for c, count := range b.Contexts {
+		e.Profile.Contexts[c] += count
+	}
+	for edge, count := range b.Flows {
 		e.Profile.Flows[edge] += count
 	}
-	for be, pos := range g.Positions {
+	for be, pos := range b.Positions {
 		e.Profile.Positions[be] = pos
 	}
-	for be, dur := range g.Durations {
+	for be, dur := range b.Durations {
 		e.Profile.Durations[be] += dur
 	}
-	for funcName, instances := range g.Inputs {
+	for obs, count := range b.Preds {
+		if obs.Kind == predObserved {
+			e.Profile.Observed[dgtypes.PredicateSite{At: obs.At, Site: obs.Site}] += count
+			continue
+		}
+		s := b.PredSites[siteKey{In: obs.At.In, Site: obs.Site}]
+		pred := dgtypes.Predicate{At: obs.At, Site: obs.Site, Name: s.name(obs.Kind), Position: s.Pos}
+		e.Profile.Predicates[pred] += count
+	}
+	for funcName, instances := range b.Inputs {
 		e.Profile.Inputs[funcName] = append(e.Profile.Inputs[funcName], instances...)
 	}
-	for funcName, instances := range g.Outputs {
+	for funcName, instances := range b.Outputs {
 		e.Profile.Outputs[funcName] = append(e.Profile.Outputs[funcName], instances...)
 	}
-	for typeName, typ := range g.Types {
+	for typeName, typ := range b.Types {
 		e.Profile.Types[typeName] = typ
 	}
 }
 
 func shutdown(e *Execution) {
-	fmt.Println("starting shut down")
+	logf("starting shut down\n")
 	execMu.Lock()
 	defer execMu.Unlock()
 	if e == nil {
 		return
 	}
-	for _, g := range e.Goroutines {
-		if g == nil {
-			continue
-		}
-		g.m.Lock()
-		if !g.Closed && len(g.Calls) > 0 {
-			g.m.Unlock()
-			g.Exit()
+	for _, g := range e.goroutines.live() {
+		if b := g.take(); !b.empty() {
+			e.Merge(b)
 		}
 	}
+	e.mergeMu.Lock()
+	e.stopped = true
 	close(e.mergeCh)
+	e.mergeMu.Unlock()
 	e.async.Wait()
 	e.m.Lock()
 	defer e.m.Unlock()
+	for len(e.segments) > 0 {
+		// segments which were never ended did not run to completion
+		e.popSegment("incomplete")
+	}
 
 	if !e.Profile.Empty() {
-		fnPath := pjoin(e.OutputDir, "functions.json")
-		fmt.Println("writing functions to:", fnPath)
-		fn, err := os.Create(fnPath)
-		if err != nil {
-			panic(err)
-		}
-		defer fn.Close()
-		e.Profile.WriteFunctions(fn)
-
-		dotPath := pjoin(e.OutputDir, "flow-graph.dot")
-		fmt.Println("writing flow-graph to:", dotPath)
-		dot, err := os.Create(dotPath)
-		if err != nil {
-			panic(err)
-		}
-		defer dot.Close()
-		e.Profile.WriteDotty(dot)
-
-		txtPath := pjoin(e.OutputDir, "flow-graph.txt")
-		fmt.Println("writing flow-graph to:", txtPath)
-		txt, err := os.Create(txtPath)
-		if err != nil {
-			panic(err)
-		}
-		defer txt.Close()
-		e.Profile.WriteSimple(txt)
+		writeOut(e, "functions.json", func(fout io.Writer) {
+			if err := e.Profile.WriteFunctions(fout); err != nil {
+				panic(err)
+			}
+		})
+		writeOut(e, "flow-graph.dot", e.Profile.WriteDotty)
+		e.writeFlowGraph("", "flow-graph", e.Profile)
+		e.writeCallGraph(e.Profile)
+		e.writeBlockTime(e.Profile)
 	}
 
 	if len(e.Profile.Inputs) > 0 {
@@ -215,32 +225,48 @@ func shutdown(e *Execution) {
 	}
 
 	if len(e.fails) > 0 {
-		failPath := pjoin(e.OutputDir, "failures")
-		fmt.Printf("The program registered %v failures\n", len(e.fails))
-		fmt.Println("writing failures to:", failPath)
-		fout, err := os.Create(failPath)
-		if err != nil {
-			panic(err)
-		}
-		defer fout.Close()
-		for _, f := range e.fails {
-			fmt.Printf("fail: %v\n", f)
-			_, err := fmt.Fprintln(fout, f)
-			if err != nil {
-				panic(err)
+		logf("The program registered %v failures\n", len(e.fails))
+		writeOut(e, "failures", func(fout io.Writer) {
+			for _, f := range e.fails {
+				logf("fail: %v\n", f)
+				_, err := fmt.Fprintln(fout, f)
+				if err != nil {
+					panic(err)
+				}
 			}
-		}
+		})
+	}
+	if e.Policy != "" {
+		writeOut(e, "policy", func(fout io.Writer) {
+			io.WriteString(fout, e.Policy)
+		})
 	}
-	fmt.Println("done shutting down")
+	if err := e.out.close(); err != nil {
+		logf("dynagrok could not close the profile output: %v\n", err)
+	}
+	logf("done shutting down\n")
 }
 
+// writeOut writes a file (eg. functions.json) to the profile
 func writeOut(e *Execution, filename string, serializeFunc func(io.Writer)) {
-	filePath := pjoin(e.OutputDir, filename)
-	fmt.Println("writing to:", filePath)
-	fout, err := os.Create(filePath)
+	name, ext := filename, ""
+	if i := strings.Index(filename, "."); i > 0 {
+		name, ext = filename[:i], filename[i:]
+	}
+	e.writeFile("", name, ext, serializeFunc)
+}
+
+// writeFile writes the file name+ext to dir (relative to the profile
+// directory) and returns where it went
+func (e *Execution) writeFile(dir, name, ext string, serializeFunc func(io.Writer)) string {
+	fout, path, err := e.out.create(dir, name, ext)
 	if err != nil {
 		panic(err)
 	}
-	defer fout.Close()
+	logf("writing to: %v\n", path)
 	serializeFunc(fout)
+	if err := fout.Close(); err != nil {
+		panic(err)
+	}
+	return path
 }
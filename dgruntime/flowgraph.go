@@ -0,0 +1,61 @@
+package dgruntime
+
+import (
+	"dgruntime/binprof"
+	"dgruntime/dgtypes"
+	"io"
+	"os"
+)
+
+// The flow graphs are written in the simple text format unless
+// DGPROF_FORMAT=binary is set in which case the binary format (see
+// dgruntime/binprof) is used. Binary flow graphs have a .bin extension in
+// stead of .txt.
+func flowGraphFormat() string {
+	if os.Getenv("DGPROF_FORMAT") == "binary" {
+		return "binary"
+	}
+	return "text"
+}
+
+// writeFlowGraph writes the profile's flow graph to <dir>/<name>.txt (or
+// .bin, the name follows DGPROF_NAME) and returns where it went. e.m must be
+// held.
+func (e *Execution) writeFlowGraph(dir, name string, p *dgtypes.Profile) string {
+	p.Granularity = e.Granularity
+	file := e.out.flowGraphName(name)
+	if e.Format == "binary" {
+		return e.writeFile(dir, file, ".bin", func(fout io.Writer) {
+			if err := writeBinary(fout, name, p); err != nil {
+				panic(err)
+			}
+		})
+	}
+	return e.writeFile(dir, file, ".txt", p.WriteSimple)
+}
+
+// writeBlockTime writes the time spent in each basic block as a pprof
+// profile (`go tool pprof -lines -top block-time.pb.gz`)
+func (e *Execution) writeBlockTime(p *dgtypes.Profile) {
+	writeOut(e, "block-time.pb.gz", func(fout io.Writer) {
+		if err := p.WriteBlockPprof(fout); err != nil {
+			panic(err)
+		}
+	})
+}
+
+// writeBinary writes the flow graph as a single graph of a binary profile
+func writeBinary(fout io.Writer, label string, p *dgtypes.Profile) error {
+	return binprof.WriteGraph(fout, label, (*binprof.Sampling)(p.Sampling), p.Granularity,
+		func(vertex func(*binprof.Vertex), edge func(*binprof.Edge)) {
+			p.VisitGraph(
+				func(v *dgtypes.GraphVertex) {
+					bv := binprof.Vertex(*v)
+					vertex(&bv)
+				},
+				func(src, targ, count int, kind string) {
+					edge(&binprof.Edge{Src: src, Targ: targ, Count: count, Kind: kind})
+				},
+			)
+		})
+}
@@ -2,52 +2,175 @@ package dgruntime
 
 import (
 	"dgruntime/dgtypes"
+	"runtime"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unsafe"
 )
 
+// Goroutine is the recording state of one goroutine. Only the goroutine
+// itself touches its call stack and writes to its buffer so recording an
+// event takes no lock. Other goroutines (flushing a segment, shutting down)
+// swap the buffer out with take.
 type Goroutine struct {
-	m         sync.Mutex
-	GoID      int64
-	Closed    bool
+	writes uint64 // atomic: odd while the goroutine writes to buf (first for alignment)
+	GoID   int64
+	Stack  []*dgtypes.FuncCall
+	buf    unsafe.Pointer // *buffer, swapped atomically by take
+
+	spawnedFrom dgtypes.BlkEntrance // the go statement which started the goroutine
+	unwinding   *unwind             // the panic being unwound (see panics.go)
+	calls       uint64              // calls the sampler saw (see sampler.sample)
+	sampled     uint64              // calls which passed the sampler's 1 in n test
+	counting    bool                // the sampler started the counts
+}
+
+// buffer holds what a goroutine has recorded since it was last merged into
+// the execution's profile.
+type buffer struct {
 	Inputs    map[string][]dgtypes.ObjectProfile
 	Outputs   map[string][]dgtypes.ObjectProfile
 	Types     map[string]dgtypes.Type
-	Stack     []*dgtypes.FuncCall
 	Calls     map[dgtypes.Call]int
+	Contexts  map[dgtypes.CallContext]int
 	Flows     map[dgtypes.FlowEdge]int
 	Funcs     map[uintptr]*dgtypes.Function
 	Positions map[dgtypes.BlkEntrance]string
 	Durations map[dgtypes.BlkEntrance]time.Duration
+	Preds     map[predObs]int
+	PredSites map[siteKey]predSite
 	CallCount int
+	synced    chan struct{} // set on the markers used by Execution.sync
 }
 
 func newGoroutine(id int64) *Goroutine {
 	g := &Goroutine{
+		GoID:  id,
+		Stack: make([]*dgtypes.FuncCall, 0, 10),
+		buf:   unsafe.Pointer(newBuffer()),
+	}
+	g.Stack = append(g.Stack, &dgtypes.FuncCall{
+		Name: "<entry>",
+	})
+	return g
+}
+
+func newBuffer() *buffer {
+	return &buffer{
 		Inputs:    make(map[string][]dgtypes.ObjectProfile),
 		Outputs:   make(map[string][]dgtypes.ObjectProfile),
 		Types:     make(map[string]dgtypes.Type),
-		GoID:      id,
-		Stack:     make([]*dgtypes.FuncCall, 0, 10),
 		Calls:     make(map[dgtypes.Call]int),
+		Contexts:  make(map[dgtypes.CallContext]int),
 		Funcs:     make(map[uintptr]*dgtypes.Function),
 		Flows:     make(map[dgtypes.FlowEdge]int),
 		Positions: make(map[dgtypes.BlkEntrance]string),
 		Durations: make(map[dgtypes.BlkEntrance]time.Duration),
+		Preds:     make(map[predObs]int),
+		PredSites: make(map[siteKey]predSite),
 	}
-	g.Stack = append(g.Stack, &dgtypes.FuncCall{
-		Name: "<entry>",
-	})
-	return g
 }
 
+func (b *buffer) empty() bool {
+	return len(b.Calls) == 0 && len(b.Flows) == 0 && len(b.Preds) == 0 && len(b.Inputs) == 0 && len(b.Outputs) == 0
+}
+
+// begin is called by the goroutine before it records an event. It returns the
+// buffer to write to which stays valid until end is called.
+func (g *Goroutine) begin() *buffer {
+	atomic.AddUint64(&g.writes, 1)
+	return (*buffer)(atomic.LoadPointer(&g.buf))
+}
+
+func (g *Goroutine) end() {
+	atomic.AddUint64(&g.writes, 1)
+}
+
+// take replaces g's buffer with an empty one and returns the old buffer. It
+// may be called from any goroutine. A write which began before the swap
+// still uses the old buffer so take waits for it to end.
+func (g *Goroutine) take() *buffer {
+	old := (*buffer)(atomic.SwapPointer(&g.buf, unsafe.Pointer(newBuffer())))
+	if w := atomic.LoadUint64(&g.writes); w%2 == 1 {
+		for atomic.LoadUint64(&g.writes) == w {
+			runtime.Gosched()
+		}
+	}
+	return old
+}
+
+// Exit is called by the goroutine when it leaves the instrumented code. Its
+// buffer is merged into the profile in the background.
 func (g *Goroutine) Exit() {
-	g.m.Lock()
-	defer g.m.Unlock()
-	g.Closed = true
-	exec.m.Lock()
-	exec.Goroutines[g.GoID] = nil
-	exec.m.Unlock()
-	exec.Merge(g)
+	exec.goroutines.remove(g.GoID)
+	exec.Merge(g.take())
 	// Println(fmt.Sprintf("exit goroutine %d", g.GoID))
 }
+
+const registryShards = 64
+
+// registry maps goroutine ids to their Goroutine. It is sharded by id so the
+// lookups made on every instrumented event (which only read lock a shard)
+// rarely contend with goroutines entering and leaving the instrumented code.
+type registry struct {
+	shards [registryShards]registryShard
+}
+
+type registryShard struct {
+	m  sync.RWMutex
+	gs map[int64]*Goroutine
+}
+
+func (r *registry) shard(id int64) *registryShard {
+	return &r.shards[uint64(id)%registryShards]
+}
+
+// lookup returns the goroutine with the id (nil if it is not in the
+// instrumented code)
+func (r *registry) lookup(id int64) *Goroutine {
+	s := r.shard(id)
+	s.m.RLock()
+	defer s.m.RUnlock()
+	return s.gs[id]
+}
+
+// get returns the goroutine with the id creating it if needed
+func (r *registry) get(id int64) *Goroutine {
+	if g := r.lookup(id); g != nil {
+		return g
+	}
+	s := r.shard(id)
+	s.m.Lock()
+	defer s.m.Unlock()
+	if g := s.gs[id]; g != nil {
+		return g
+	}
+	if s.gs == nil {
+		s.gs = make(map[int64]*Goroutine)
+	}
+	g := newGoroutine(id)
+	s.gs[id] = g
+	return g
+}
+
+func (r *registry) remove(id int64) {
+	s := r.shard(id)
+	s.m.Lock()
+	defer s.m.Unlock()
+	delete(s.gs, id)
+}
+
+// live returns the goroutines currently in the instrumented code
+func (r *registry) live() []*Goroutine {
+	live := make([]*Goroutine, 0, registryShards)
+	for i := range r.shards {
+		s := &r.shards[i]
+		s.m.RLock()
+		for _, g := range s.gs {
+			live = append(live, g)
+		}
+		s.m.RUnlock()
+	}
+	return live
+}
@@ -0,0 +1,91 @@
+package dgruntime
+
+import (
+	"dgruntime/dgtypes"
+	"runtime"
+	"sync"
+	"testing"
+)
+
+// TestConcurrentRecording records from many goroutines while their buffers
+// are flushed (and merged when they exit). Every count must reach the
+// profile exactly once. Run it with -race.
+func TestConcurrentRecording(t *testing.T) {
+	const goroutines = 32
+	const events = 2000
+	e := &Execution{Profile: dgtypes.NewProfile()}
+	edge := func(id int64) dgtypes.FlowEdge {
+		return dgtypes.FlowEdge{Targ: dgtypes.BlkEntrance{In: uintptr(id), BasicBlockId: 1}}
+	}
+	done := make(chan struct{})
+	flushed := make(chan int)
+	go func() {
+		flushes := 0
+		for {
+			select {
+			case <-done:
+				flushed <- flushes
+				return
+			default:
+				e.flush()
+				flushes++
+			}
+		}
+	}()
+	var wg sync.WaitGroup
+	for id := int64(1); id <= goroutines; id++ {
+		wg.Add(1)
+		go func(id int64) {
+			defer wg.Done()
+			g := e.goroutines.get(id)
+			for i := 0; i < events; i++ {
+				b := g.begin()
+				b.Flows[edge(id)]++
+				if i%7 == 0 {
+					// let a flush run in the middle of the write
+					runtime.Gosched()
+				}
+				b.Positions[edge(id).Targ] = "a.go:1:1"
+				b.CallCount++
+				g.end()
+			}
+			// as Exit does, but merged right away
+			e.goroutines.remove(id)
+			e.merge(g.take())
+		}(id)
+	}
+	wg.Wait()
+	close(done)
+	t.Logf("%d flushes", <-flushed)
+	e.flush()
+	if live := e.goroutines.live(); len(live) != 0 {
+		t.Errorf("%d goroutines are still registered", len(live))
+	}
+	if e.Profile.CallCount != goroutines*events {
+		t.Errorf("call count %d expected %d", e.Profile.CallCount, goroutines*events)
+	}
+	for id := int64(1); id <= goroutines; id++ {
+		if count := e.Profile.Flows[edge(id)]; count != events {
+			t.Errorf("goroutine %d: %d flows expected %d", id, count, events)
+		}
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	var r registry
+	if r.lookup(7) != nil {
+		t.Fatal("found a goroutine in an empty registry")
+	}
+	g := r.get(7)
+	if r.get(7) != g || r.lookup(7) != g || g.GoID != 7 {
+		t.Fatal("get made a second goroutine 7")
+	}
+	r.get(7 + registryShards) // the same shard
+	if live := r.live(); len(live) != 2 {
+		t.Fatalf("%d live goroutines expected 2", len(live))
+	}
+	r.remove(7)
+	if r.lookup(7) != nil || r.lookup(7+registryShards) == nil {
+		t.Fatal("remove removed the wrong goroutine")
+	}
+}
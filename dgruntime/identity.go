@@ -0,0 +1,26 @@
+package dgruntime
+
+import (
+	"unsafe"
+)
+
+// Identity tells dgruntime which goroutine is running and which instrumented
+// function called into a hook. Two implementations are provided: one for the
+// patched runtime (built with the dgpatched tag, see src/runtime/goid.go) and
+// a portable one which works with an unmodified runtime.
+type Identity interface {
+	// GoID identifies the running goroutine.
+	GoID() int64
+	// CallerPC returns a pc inside the instrumented function which called the
+	// hook. argp points at the hook's first argument and skip counts the
+	// frames between CallerPC and the instrumented function.
+	CallerPC(argp unsafe.Pointer, skip int) uintptr
+}
+
+var identity Identity = defaultIdentity()
+
+// SetIdentity replaces the goroutine identity provider. It must be called
+// before any instrumented code runs.
+func SetIdentity(id Identity) {
+	identity = id
+}
@@ -0,0 +1,24 @@
+//go:build dgpatched
+// +build dgpatched
+
+package dgruntime
+
+import (
+	"runtime"
+	"unsafe"
+)
+
+// patched uses the accessors dynagrok adds to the runtime (src/runtime/goid.go)
+type patched struct{}
+
+func defaultIdentity() Identity {
+	return patched{}
+}
+
+func (patched) GoID() int64 {
+	return runtime.GoID()
+}
+
+func (patched) CallerPC(argp unsafe.Pointer, skip int) uintptr {
+	return runtime.GetCallerPC(argp)
+}
@@ -0,0 +1,45 @@
+//go:build !dgpatched
+// +build !dgpatched
+
+package dgruntime
+
+import (
+	"runtime"
+	"unsafe"
+)
+
+// portable works with an unmodified runtime. The goroutine id is parsed out of
+// the header runtime.Stack writes ("goroutine 18 [running]:") and the caller
+// is found with runtime.Caller. It is slower than the patched runtime but it
+// does not require rebuilding GOROOT.
+type portable struct{}
+
+func defaultIdentity() Identity {
+	return portable{}
+}
+
+func (portable) GoID() int64 {
+	var buf [64]byte
+	n := runtime.Stack(buf[:], false)
+	return parseGoID(buf[:n])
+}
+
+// parseGoID reads the id out of the header of a goroutine's stack trace
+func parseGoID(stack []byte) int64 {
+	var id int64
+	for _, c := range stack[len("goroutine "):] {
+		if c < '0' || c > '9' {
+			break
+		}
+		id = id*10 + int64(c-'0')
+	}
+	return id
+}
+
+func (portable) CallerPC(argp unsafe.Pointer, skip int) uintptr {
+	pc, _, _, ok := runtime.Caller(skip)
+	if !ok {
+		panic("dgruntime could not find the caller of an instrumentation hook")
+	}
+	return pc
+}
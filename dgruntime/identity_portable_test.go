@@ -0,0 +1,72 @@
+//go:build !dgpatched
+// +build !dgpatched
+
+package dgruntime
+
+import (
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestParseGoID(t *testing.T) {
+	for header, id := range map[string]int64{
+		"goroutine 1 [running]:\nmain.main()":        1,
+		"goroutine 18 [running]:":                    18,
+		"goroutine 9223372036854775807 [running]:":   9223372036854775807,
+		"goroutine 7 gp=0xc000002380 m=0 [running]:": 7,
+		"goroutine 42": 42, // cut off by the buffer
+	} {
+		if got := parseGoID([]byte(header)); got != id {
+			t.Errorf("parseGoID(%q) = %d expected %d", header, got, id)
+		}
+	}
+}
+
+// stackGoID reads the id from the whole of the goroutine's stack trace, -1
+// if the trace does not start with the id
+func stackGoID() int64 {
+	buf := make([]byte, 1<<16)
+	fields := strings.Fields(string(buf[:runtime.Stack(buf, false)]))
+	if len(fields) < 2 || fields[0] != "goroutine" {
+		return -1
+	}
+	id, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return -1
+	}
+	return id
+}
+
+func TestPortableGoID(t *testing.T) {
+	const n = 50
+	ids := make([]int64, n)
+	var wg sync.WaitGroup
+	var m sync.Mutex
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			id := portable{}.GoID()
+			if want := stackGoID(); id != want {
+				t.Errorf("GoID() = %d, the stack trace says %d", id, want)
+			}
+			m.Lock()
+			ids[i] = id
+			m.Unlock()
+		}(i)
+	}
+	wg.Wait()
+	seen := make(map[int64]bool, n)
+	for _, id := range ids {
+		if id <= 0 || seen[id] {
+			t.Errorf("bad or repeated goroutine id %d in %v", id, ids)
+		}
+		seen[id] = true
+	}
+	if id := (portable{}).GoID(); id != stackGoID() || seen[id] {
+		t.Errorf("the test's goroutine id %d", id)
+	}
+}
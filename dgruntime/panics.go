@@ -0,0 +1,193 @@
+package dgruntime
+
+import (
+	"dgruntime/dgtypes"
+	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// Panics are failures even when the program recovers from them. ExitFunc
+// (which every instrumented function defers) notices when it runs because of
+// a panic and records the frames the panic unwinds. The instrumenter wraps
+// each call to recover
+//
+//	r := recover()
+//
+// becomes
+//
+//	r := dgruntime.Recover(recover())
+//
+// so the block which swallowed the panic is known. The panic is added to the
+// execution's failures once it is recovered or has left the instrumented code.
+
+// unwind is the panic a goroutine is unwinding
+type unwind struct {
+	fail  *dgtypes.Failure
+	depth int // the frames of g.Stack at or above depth were unwound
+}
+
+// Recover is called with the result of each recover call in the instrumented
+// code. It returns the value unchanged.
+func Recover(v interface{}) interface{} {
+	if v == nil {
+		return v
+	}
+	execCheck()
+	value := fmt.Sprint(v)
+	g := exec.Goroutine(identity.GoID())
+	// the deferred function calling recover is on top of the stack
+	site := g.Stack[len(g.Stack)-1]
+	u := g.unwinding
+	if u == nil {
+		// the function which deferred the recovering function panicked (or
+		// an uninstrumented function it called did). If it is not on the
+		// stack (the goroutine's entry deferred the recovering function) the
+		// panic is placed at the recover.
+		panicked := site
+		if len(g.Stack) >= 2 {
+			panicked = g.Stack[len(g.Stack)-2]
+		}
+		u = g.startUnwind(panicked)
+	}
+	u.fail.Panic.Value = value
+	u.fail.Panic.RecoverSite = frame(site)
+	g.endUnwind(true)
+	return v
+}
+
+// unwound is called by ExitFunc for each function call a panic unwinds. fc
+// was just popped from the stack. It returns the kind of the edge to the
+// caller.
+func (g *Goroutine) unwound(fc *dgtypes.FuncCall) string {
+	u := g.unwinding
+	if u == nil {
+		u = g.startUnwind(fc)
+	} else if !fc.Skip {
+		u.fail.Panic.Frames = append(u.fail.Panic.Frames, *frame(fc))
+	}
+	u.depth = len(g.Stack)
+	// the rest of the call never runs, its control dependences end here
+	fc.CDStack = fc.CDStack[:0]
+	if len(g.Stack) == 1 {
+		// nothing instrumented is left to recover
+		g.endUnwind(false)
+	}
+	return dgtypes.PanicEdge
+}
+
+// resumed is called when a goroutine unwinding a panic runs code of a frame
+// the panic did not unwind: the panic was recovered by an uninstrumented
+// function.
+func (g *Goroutine) resumed() {
+	if g.unwinding != nil && len(g.Stack) <= g.unwinding.depth {
+		g.endUnwind(true)
+	}
+}
+
+func (g *Goroutine) startUnwind(fc *dgtypes.FuncCall) *unwind {
+	at := frame(fc)
+	g.unwinding = &unwind{
+		fail: &dgtypes.Failure{
+			Position:     at.Position,
+			FnName:       at.FnName,
+			BasicBlockId: at.BasicBlockId,
+			Panic:        &dgtypes.Panic{Frames: []dgtypes.Frame{*at}},
+		},
+		depth: len(g.Stack),
+	}
+	return g.unwinding
+}
+
+func (g *Goroutine) endUnwind(recovered bool) {
+	fail := g.unwinding.fail
+	fail.Panic.Recovered = recovered
+	g.unwinding = nil
+	exec.Fail(fail)
+}
+
+func frame(fc *dgtypes.FuncCall) *dgtypes.Frame {
+	if fc.Skip {
+		// the call was not sampled, only its function is known
+		return &dgtypes.Frame{FnName: fc.Name}
+	}
+	return &dgtypes.Frame{
+		Position:     fc.Pos,
+		FnName:       fc.Name,
+		BasicBlockId: fc.Last.BasicBlockId,
+	}
+}
+
+// panicUnwinding reports whether the deferred ExitFunc calling it was run by
+// a panic (rather than by the instrumented function returning or by
+// runtime.Goexit). The function which called the deferred closure is
+// inspected: it is runtime.gopanic (perhaps behind other runtime functions)
+// only when the closure runs because of a panic.
+//
+// It runs on every return of a sampled call. Symbolizing the frames each
+// time cost about 1.4µs a return, so only the closure's caller is collected
+// (more frames only when it belongs to the runtime) and the kind of each pc
+// is cached. That is under 0.5µs a return (see BenchmarkPanicUnwinding).
+func panicUnwinding() bool {
+	var pcs [8]uintptr
+	// skip runtime.Callers, panicUnwinding, ExitFunc and the closure. The
+	// closure's caller alone decides the common cases.
+	n := runtime.Callers(4, pcs[:1])
+	if n == 1 && frameKindOf(pcs[0]) == runtimeFrame {
+		n = runtime.Callers(4, pcs[:])
+	}
+	for _, pc := range pcs[:n] {
+		switch frameKindOf(pc) {
+		case panicFrame:
+			return true
+		case otherFrame:
+			return false
+		}
+	}
+	return false
+}
+
+type frameKind int
+
+const (
+	otherFrame   frameKind = iota
+	runtimeFrame           // a runtime function other than gopanic
+	panicFrame             // runtime.gopanic
+)
+
+// frameKinds caches frameKindOf by pc
+var frameKinds = struct {
+	m     sync.RWMutex
+	kinds map[uintptr]frameKind
+}{kinds: make(map[uintptr]frameKind)}
+
+// frameKindOf classifies the function(s, when calls were inlined) at pc
+func frameKindOf(pc uintptr) frameKind {
+	frameKinds.m.RLock()
+	kind, ok := frameKinds.kinds[pc]
+	frameKinds.m.RUnlock()
+	if ok {
+		return kind
+	}
+	kind = runtimeFrame
+	frames := runtime.CallersFrames([]uintptr{pc})
+	for {
+		frame, more := frames.Next()
+		if frame.Function == "runtime.gopanic" {
+			kind = panicFrame
+			break
+		}
+		if !strings.HasPrefix(frame.Function, "runtime.") {
+			kind = otherFrame
+			break
+		}
+		if !more {
+			break
+		}
+	}
+	frameKinds.m.Lock()
+	frameKinds.kinds[pc] = kind
+	frameKinds.m.Unlock()
+	return kind
+}
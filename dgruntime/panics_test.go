@@ -0,0 +1,75 @@
+package dgruntime
+
+import (
+	"os"
+	"runtime"
+	"testing"
+)
+
+// exitFunc stands in for ExitFunc: panicUnwinding skips it and the deferred
+// closure calling it
+func exitFunc(unwinding *bool) {
+	*unwinding = panicUnwinding()
+}
+
+func TestPanicUnwinding(t *testing.T) {
+	returns := func(unwinding *bool) {
+		defer func() { exitFunc(unwinding) }()
+	}
+	panics := func(unwinding *bool) {
+		defer func() { exitFunc(unwinding) }()
+		panic("a failure")
+	}
+	recovers := func(unwinding *bool) {
+		defer func() { recover() }()
+		panics(unwinding)
+	}
+	for k := 0; k < 2; k++ {
+		// the second time round the kinds of the pcs are cached
+		var returned, panicked, exited bool
+		returns(&returned)
+		recovers(&panicked)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			defer func() { exitFunc(&exited) }()
+			runtime.Goexit()
+		}()
+		<-done
+		if returned || !panicked || exited {
+			t.Errorf("returned %v panicked %v exited %v", returned, panicked, exited)
+		}
+	}
+}
+
+func BenchmarkPanicUnwinding(b *testing.B) {
+	var unwinding bool
+	for i := 0; i < b.N; i++ {
+		func() {
+			defer func() { exitFunc(&unwinding) }()
+		}()
+	}
+}
+
+func TestRecoverOutsideInstrumentedFrames(t *testing.T) {
+	e, dir := testExec(t)
+	defer os.RemoveAll(dir)
+	g := e.Goroutine(identity.GoID())
+	g.Stack = g.Stack[:1]
+	// only the goroutine's entry is on the stack
+	if v := Recover("boom"); v != "boom" {
+		t.Errorf("Recover returned %v", v)
+	}
+	if g.unwinding != nil || len(e.fails) != 1 || !e.fails[0].Panic.Recovered {
+		t.Fatalf("the panic was not recorded as recovered: %v", e.fails)
+	}
+	at(e, blk(1, 2))
+	g.Stack[1].Name = "main.f"
+	if v := Recover("boom"); v != "boom" {
+		t.Errorf("Recover returned %v", v)
+	}
+	if len(e.fails) != 2 || e.fails[1].FnName != "<entry>" || e.fails[1].Panic.RecoverSite.FnName != "main.f" {
+		t.Errorf("recovered %+v", e.fails[1])
+	}
+	g.Stack = g.Stack[:1]
+}
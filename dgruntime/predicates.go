@@ -0,0 +1,303 @@
+package dgruntime
+
+import (
+	"dgruntime/dgtypes"
+	"fmt"
+	"math"
+)
+
+// Predicates summarize the values seen at the branch conditions and
+// comparisons of a program built with `dynagrok instrument --predicates` (in
+// the style of Liblit's Cooperative Bug Isolation). Each site reports what
+// held when it was evaluated:
+//
+//	if len(q) > max {
+//
+// becomes
+//
+//	if dgruntime.CmpInt(3, "q.go:12:5", "len(q)", "max", dgruntime.Gtr, 3, dgruntime.Int64(len(q)), dgruntime.Int64(max)) {
+//
+// which records whether `len(q) < max`, `len(q) == max` or `len(q) > max`
+// held and the sign of both operands (`len(q) > 0`, `max == 0`, ...). A
+// condition which is not a comparison is wrapped in Branch which records its
+// outcome. Assignments are sites too:
+//
+//	n := parse(s)
+//
+// is followed by
+//
+//	dgruntime.ReturnedInt(4, "q.go:13:2", "parse(s)", dgruntime.Int64(n))
+//	dgruntime.CmpInt(5, "q.go:13:2", "n", "max", dgruntime.Eql, 0, dgruntime.Int64(n), dgruntime.Int64(max))
+//
+// which record the sign of the call's result and how the assigned variable
+// relates to the other variables of its type in scope (the comparison's
+// result is dropped). The predicates which held are counted per block in the
+// profile along with how often each site was observed (see
+// dgtypes.Predicate).
+
+// The instrumented code converts the values it hands over to these types
+// rather than to the predeclared ones, which the program may redeclare.
+type (
+	Int64   int64
+	Uint64  uint64
+	Float32 float32
+	Float64 float64
+	String  string
+)
+
+// The comparison operators of the Cmp functions
+const (
+	Eql = iota
+	Neq
+	Lss
+	Leq
+	Gtr
+	Geq
+)
+
+// The operands of a comparison which are not constants (the vars argument of
+// the Cmp functions). The sign of a constant is not worth recording.
+const (
+	VarX = 1 << iota
+	VarY
+)
+
+// the kinds of predicates
+const (
+	predObserved uint8 = iota // counts the site's observations
+	predFalse
+	predTrue
+	predLss
+	predEql
+	predGtr
+	predXNeg
+	predXZero
+	predXPos
+	predYNeg
+	predYZero
+	predYPos
+)
+
+// predObs counts how often a predicate held at a site of a block
+type predObs struct {
+	At   dgtypes.BlkEntrance
+	Site int
+	Kind uint8
+}
+
+// siteKey identifies a predicate site, Site is the site's index in its
+// function
+type siteKey struct {
+	In   uintptr
+	Site int
+}
+
+// predSite names the parts of a predicate site
+type predSite struct {
+	Pos  string
+	Expr string // the condition of a Branch
+	X, Y string // the operands of a comparison
+}
+
+// observation is what held at a site when it was evaluated, kinds which are 0
+// (predObserved) are not recorded
+type observation struct {
+	outcome, rel, x, y uint8
+}
+
+func (s *predSite) name(kind uint8) string {
+	switch kind {
+	case predFalse:
+		return fmt.Sprintf("%v is false", s.Expr)
+	case predTrue:
+		return fmt.Sprintf("%v is true", s.Expr)
+	case predLss:
+		return fmt.Sprintf("%v < %v", s.X, s.Y)
+	case predEql:
+		return fmt.Sprintf("%v == %v", s.X, s.Y)
+	case predGtr:
+		return fmt.Sprintf("%v > %v", s.X, s.Y)
+	case predXNeg, predXZero, predXPos:
+		return fmt.Sprintf("%v %v 0", s.X, [...]string{"<", "==", ">"}[kind-predXNeg])
+	case predYNeg, predYZero, predYPos:
+		return fmt.Sprintf("%v %v 0", s.Y, [...]string{"<", "==", ">"}[kind-predYNeg])
+	}
+	return fmt.Sprintf("unknown predicate %d", kind)
+}
+
+// Branch is called with the outcome of a branch condition. It returns cond.
+func Branch(site int, pos, expr string, cond bool) bool {
+	o := observation{outcome: predFalse}
+	if cond {
+		o.outcome = predTrue
+	}
+	observe(site, predSite{Pos: pos, Expr: expr}, o)
+	return cond
+}
+
+// ReturnedInt is called with the signed integer a call returned
+func ReturnedInt(site int, pos, call string, v Int64) {
+	o := observation{x: predXZero}
+	if v < 0 {
+		o.x = predXNeg
+	} else if v > 0 {
+		o.x = predXPos
+	}
+	observe(site, predSite{Pos: pos, X: call}, o)
+}
+
+// ReturnedUint is called with the unsigned integer a call returned
+func ReturnedUint(site int, pos, call string, v Uint64) {
+	o := observation{x: predXZero}
+	if v > 0 {
+		o.x = predXPos
+	}
+	observe(site, predSite{Pos: pos, X: call}, o)
+}
+
+// ReturnedFloat is called with the float a call returned. A NaN has no sign.
+func ReturnedFloat(site int, pos, call string, v Float64) {
+	var o observation
+	if v < 0 {
+		o.x = predXNeg
+	} else if v > 0 {
+		o.x = predXPos
+	} else if v == 0 {
+		o.x = predXZero
+	}
+	observe(site, predSite{Pos: pos, X: call}, o)
+}
+
+// CmpInt evaluates the comparison `a op b` of two signed integers
+func CmpInt(site int, pos, x, y string, op, vars int, a, b Int64) bool {
+	c := 0
+	if a < b {
+		c = -1
+	} else if a > b {
+		c = 1
+	}
+	sa, sb := 0, 0
+	if a < 0 {
+		sa = -1
+	} else if a > 0 {
+		sa = 1
+	}
+	if b < 0 {
+		sb = -1
+	} else if b > 0 {
+		sb = 1
+	}
+	return compared(site, pos, x, y, op, vars, c, sa, sb, true)
+}
+
+// CmpUint evaluates the comparison `a op b` of two unsigned integers
+func CmpUint(site int, pos, x, y string, op, vars int, a, b Uint64) bool {
+	c := 0
+	if a < b {
+		c = -1
+	} else if a > b {
+		c = 1
+	}
+	sa, sb := 0, 0
+	if a > 0 {
+		sa = 1
+	}
+	if b > 0 {
+		sb = 1
+	}
+	return compared(site, pos, x, y, op, vars, c, sa, sb, true)
+}
+
+// CmpFloat evaluates the comparison `a op b` of two floats. Only the operator
+// != holds for NaN, nothing but the observation is recorded about a NaN.
+func CmpFloat(site int, pos, x, y string, op, vars int, a, b Float64) bool {
+	if math.IsNaN(float64(a)) || math.IsNaN(float64(b)) {
+		observe(site, predSite{Pos: pos, X: x, Y: y}, observation{})
+		return op == Neq
+	}
+	c := 0
+	if a < b {
+		c = -1
+	} else if a > b {
+		c = 1
+	}
+	sa, sb := 0, 0
+	if a < 0 {
+		sa = -1
+	} else if a > 0 {
+		sa = 1
+	}
+	if b < 0 {
+		sb = -1
+	} else if b > 0 {
+		sb = 1
+	}
+	return compared(site, pos, x, y, op, vars, c, sa, sb, true)
+}
+
+// CmpString evaluates the comparison `a op b` of two strings. Strings have no
+// sign, only the relation between them is recorded.
+func CmpString(site int, pos, x, y string, op, vars int, a, b String) bool {
+	c := 0
+	if a < b {
+		c = -1
+	} else if a > b {
+		c = 1
+	}
+	return compared(site, pos, x, y, op, vars, c, 0, 0, false)
+}
+
+// compared records the outcome of a comparison (c is -1, 0 or 1 as x is less
+// than, equal to or greater than y) and returns whether `x op y` holds
+func compared(site int, pos, x, y string, op, vars, c, sx, sy int, signed bool) bool {
+	o := observation{rel: predEql}
+	if c < 0 {
+		o.rel = predLss
+	} else if c > 0 {
+		o.rel = predGtr
+	}
+	if signed && vars&VarX != 0 {
+		o.x = uint8(int(predXZero) + sx)
+	}
+	if signed && vars&VarY != 0 {
+		o.y = uint8(int(predYZero) + sy)
+	}
+	observe(site, predSite{Pos: pos, X: x, Y: y}, o)
+	switch op {
+	case Eql:
+		return c == 0
+	case Neq:
+		return c != 0
+	case Lss:
+		return c < 0
+	case Leq:
+		return c <= 0
+	case Gtr:
+		return c > 0
+	case Geq:
+		return c >= 0
+	}
+	panic(fmt.Errorf("dgruntime: unknown comparison operator %d", op))
+}
+
+// observe counts the predicates of o at the block the goroutine is executing
+func observe(site int, s predSite, o observation) {
+	execCheck()
+	g := exec.Goroutine(identity.GoID())
+	fc := g.Stack[len(g.Stack)-1]
+	if fc.Skip || fc.FuncPc == 0 {
+		return
+	}
+	b := g.begin()
+	defer g.end()
+	k := siteKey{In: fc.FuncPc, Site: site}
+	if _, has := b.PredSites[k]; !has {
+		b.PredSites[k] = s
+	}
+	b.Preds[predObs{At: fc.Last, Site: site, Kind: predObserved}]++
+	for _, kind := range [...]uint8{o.outcome, o.rel, o.x, o.y} {
+		if kind != predObserved {
+			b.Preds[predObs{At: fc.Last, Site: site, Kind: kind}]++
+		}
+	}
+}
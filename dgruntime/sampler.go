@@ -0,0 +1,141 @@
+package dgruntime
+
+import (
+	"dgruntime/dgtypes"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// sampler decides which function calls are recorded. Recording every basic
+// block is too slow for realistic workloads so the following may be set
+// (they combine, a call is recorded only when all of them agree):
+//
+//	DGPROF_SAMPLE=<n>                record 1 in every n function calls
+//	DGPROF_BURST=<on>/<off>          record <on> calls then skip <off> calls
+//	DGPROF_BUDGET=<budget>/<period>  record calls made in the first <budget>
+//	                                 of every <period> (eg. 10ms/1s)
+//
+// Nothing is recorded for a call which is not sampled (not even its blocks).
+// Calls made by it are sampled on their own. Each goroutine counts its own
+// calls for the 1 in n and burst tests so the goroutines do not contend for
+// the counts.
+type sampler struct {
+	goroutines     uint64 // atomic: goroutines which started counting (first for alignment)
+	every          uint64
+	burst, gap     uint64
+	budget, period time.Duration
+	start          time.Time
+	sampling       *dgtypes.Sampling
+}
+
+// newSampler reads the sampling settings from the environment. It returns
+// nil when every call should be recorded.
+func newSampler() *sampler {
+	s := &sampler{start: time.Now()}
+	params := make([]string, 0, 3)
+	rate := 1.0
+	if v := os.Getenv("DGPROF_SAMPLE"); v != "" {
+		n, err := strconv.ParseUint(v, 10, 64)
+		if err != nil || n == 0 {
+			panic(fmt.Errorf("dynagrok: bad DGPROF_SAMPLE=%v expected a positive integer", v))
+		}
+		s.every = n
+		params = append(params, "every="+v)
+		rate /= float64(n)
+	}
+	if v := os.Getenv("DGPROF_BURST"); v != "" {
+		on, off, err := splitPair(v, func(x string) (float64, error) {
+			n, err := strconv.ParseUint(x, 10, 64)
+			return float64(n), err
+		})
+		if err != nil || on == 0 {
+			panic(fmt.Errorf("dynagrok: bad DGPROF_BURST=%v expected <on>/<off> call counts", v))
+		}
+		s.burst, s.gap = uint64(on), uint64(off)
+		params = append(params, "burst="+v)
+		rate *= on / (on + off)
+	}
+	if v := os.Getenv("DGPROF_BUDGET"); v != "" {
+		budget, period, err := splitPair(v, func(x string) (float64, error) {
+			d, err := time.ParseDuration(x)
+			return float64(d), err
+		})
+		if err != nil || budget <= 0 || period < budget {
+			panic(fmt.Errorf("dynagrok: bad DGPROF_BUDGET=%v expected <budget>/<period> durations", v))
+		}
+		s.budget, s.period = time.Duration(budget), time.Duration(period)
+		params = append(params, "budget="+v)
+		rate *= budget / period
+	}
+	if len(params) == 0 {
+		return nil
+	}
+	s.sampling = &dgtypes.Sampling{
+		Params: strings.Join(params, " "),
+		Rate:   rate,
+	}
+	return s
+}
+
+func splitPair(v string, parse func(string) (float64, error)) (a, b float64, err error) {
+	parts := strings.Split(v, "/")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("expected a pair")
+	}
+	if a, err = parse(parts[0]); err != nil {
+		return 0, 0, err
+	}
+	if b, err = parse(parts[1]); err != nil {
+		return 0, 0, err
+	}
+	return a, b, nil
+}
+
+// sample reports whether the function call the goroutine is entering is
+// recorded
+func (s *sampler) sample(g *Goroutine) bool {
+	if s == nil {
+		return true
+	}
+	if !g.counting {
+		// a goroutine's counts start one after the last goroutine's so
+		// goroutines making a few calls (or entering the instrumented code
+		// a few calls at a time) are sampled at the rate too
+		n := atomic.AddUint64(&s.goroutines, 1) - 1
+		g.calls, g.sampled = n, n
+		if s.every > 1 {
+			g.sampled = n / s.every
+		}
+		g.counting = true
+	}
+	if s.every > 1 {
+		n := g.calls
+		g.calls++
+		if n%s.every != 0 {
+			return false
+		}
+	}
+	if s.burst > 0 {
+		n := g.sampled
+		g.sampled++
+		if n%(s.burst+s.gap) >= s.burst {
+			return false
+		}
+	}
+	if s.period > 0 && time.Since(s.start)%s.period >= s.budget {
+		return false
+	}
+	return true
+}
+
+// Sampling describes the sampler for the profiles (nil when unsampled)
+func (s *sampler) Sampling() *dgtypes.Sampling {
+	if s == nil {
+		return nil
+	}
+	return s.sampling
+}
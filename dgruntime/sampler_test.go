@@ -0,0 +1,165 @@
+package dgruntime
+
+import (
+	"dgruntime/dgtypes"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNewSampler(t *testing.T) {
+	for _, c := range []struct {
+		env    []string
+		params string
+		rate   float64
+	}{
+		{nil, "", 1},
+		{[]string{"DGPROF_SAMPLE", "4"}, "every=4", .25},
+		{[]string{"DGPROF_BURST", "2/6"}, "burst=2/6", .25},
+		{[]string{"DGPROF_BUDGET", "10ms/1s"}, "budget=10ms/1s", .01},
+		{[]string{"DGPROF_SAMPLE", "2", "DGPROF_BURST", "1/1"}, "every=2 burst=1/1", .25},
+	} {
+		unset := setenv(c.env...)
+		s := newSampler()
+		unset()
+		if c.params == "" {
+			if s != nil || s.Sampling() != nil {
+				t.Errorf("%v: expected no sampler got %v", c.env, s)
+			}
+			continue
+		}
+		want := &dgtypes.Sampling{Params: c.params, Rate: c.rate}
+		if got := s.Sampling(); !reflect.DeepEqual(got, want) {
+			t.Errorf("%v: got %v expected %v", c.env, got, want)
+		}
+	}
+	for _, env := range [][]string{
+		{"DGPROF_SAMPLE", "0"},
+		{"DGPROF_BURST", "0/3"},
+		{"DGPROF_BURST", "3"},
+		{"DGPROF_BUDGET", "2s/1s"},
+	} {
+		func() {
+			defer setenv(env...)()
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%v: expected a panic", env)
+				}
+			}()
+			newSampler()
+		}()
+	}
+}
+
+// decisions are the sampler's decisions for n calls of a goroutine as a
+// string of 1s (recorded) and 0s (skipped)
+func decisions(s *sampler, g *Goroutine, n int) string {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = '0'
+		if s.sample(g) {
+			b[i] = '1'
+		}
+	}
+	return string(b)
+}
+
+func TestSampleModes(t *testing.T) {
+	for _, c := range []struct {
+		mode string
+		s    *sampler
+		want string
+	}{
+		{"every", &sampler{every: 3}, "100100100100"},
+		{"burst", &sampler{burst: 2, gap: 3}, "110001100011"},
+		// burst counts the calls which passed the 1 in n test
+		{"every and burst", &sampler{every: 2, burst: 1, gap: 1}, "100010001000"},
+		// in the first half of the period
+		{"budget", &sampler{budget: time.Hour, period: 2 * time.Hour, start: time.Now()}, "111111111111"},
+		// in the second half
+		{"out of budget", &sampler{budget: time.Hour, period: 2 * time.Hour, start: time.Now().Add(-90 * time.Minute)}, "000000000000"},
+	} {
+		if got := decisions(c.s, newGoroutine(1), len(c.want)); got != c.want {
+			t.Errorf("%v: got %v expected %v", c.mode, got, c.want)
+		}
+	}
+}
+
+func TestSamplePerGoroutine(t *testing.T) {
+	s := &sampler{every: 2, burst: 1, gap: 1}
+	g1, g2 := newGoroutine(1), newGoroutine(2)
+	// interleaved calls do not move the other goroutine's counts, the
+	// second goroutine's start one call later
+	var got string
+	for i := 0; i < 4; i++ {
+		got += decisions(s, g1, 1) + decisions(s, g2, 1)
+	}
+	if want := "10010000"; got != want {
+		t.Errorf("got %v expected %v", got, want)
+	}
+	// every goroutine records its share of its own calls
+	var wg sync.WaitGroup
+	counts := make([]int, 8)
+	for i := range counts {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			g := newGoroutine(int64(10 + i))
+			for j := 0; j < 100; j++ {
+				if s.sample(g) {
+					counts[i]++
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	for i, n := range counts {
+		if n != 25 {
+			t.Errorf("goroutine %v recorded %v of its 100 calls expected 25", i, n)
+		}
+	}
+}
+
+// recordedCalls enters (and exits) the function n times and counts the
+// calls which were recorded. Each call enters the instrumented code anew.
+func recordedCalls(e *Execution, n int) int {
+	for i := 0; i < n; i++ {
+		EnterFunc("test.f", "a.go:1:1", NoCFG, NoIPDom)
+		ExitFunc("test.f")
+	}
+	e.sync()
+	e.m.Lock()
+	defer e.m.Unlock()
+	recorded := 0
+	for edge, count := range e.Profile.Flows {
+		if edge.Src == (dgtypes.BlkEntrance{}) {
+			recorded += count
+		}
+	}
+	return recorded
+}
+
+func TestSamplerRecords(t *testing.T) {
+	for _, c := range []struct {
+		env  []string
+		want int
+	}{
+		// a disabled sampler records everything
+		{nil, 12},
+		// a goroutine making a single call is sampled at the rate
+		{[]string{"DGPROF_SAMPLE", "3"}, 4},
+		{[]string{"DGPROF_BURST", "1/2"}, 4},
+		{[]string{"DGPROF_SAMPLE", "2", "DGPROF_BURST", "1/1"}, 3},
+	} {
+		e, dir := testExec(t)
+		os.RemoveAll(dir)
+		unset := setenv(c.env...)
+		e.sampler = newSampler()
+		unset()
+		if got := recordedCalls(e, 12); got != c.want {
+			t.Errorf("%v: recorded %v of 12 calls expected %v", c.env, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package dgruntime
+
+import (
+	"dgruntime/dgtypes"
+	"fmt"
+	"strings"
+)
+
+// A segment is a labelled slice of an execution. While a segment is open
+// everything merged into the execution goes to the segment's profile. When it
+// is closed the profile is written to <DGPROF>/ok or <DGPROF>/fail and the
+// profile which was in use before the segment resumes.
+//
+// The live goroutines have their counters flushed when a segment begins or
+// ends so a long running goroutine (eg. a server's connection handler)
+// contributes to each segment it does work in.
+type segment struct {
+	name     string
+	base     *dgtypes.Profile
+	test     TestingT         // the test the segment profiles (if any)
+	profile  *dgtypes.Profile // the segment's profile while it is set aside
+	parallel bool             // the test holds parallelTests
+}
+
+// BeginSegment starts a new profile segment. Until the matching EndSegment
+// the execution's profile only holds what happens inside the segment.
+// Segments may nest.
+func BeginSegment(name string) {
+	execCheck()
+	exec.beginSegment(name, nil)
+}
+
+// EndSegment closes the innermost segment and writes its flow graph to
+// <DGPROF>/ok/<name>.txt or <DGPROF>/fail/<name>.txt (.bin for binary
+// profiles).
+func EndSegment(ok bool) {
+	execCheck()
+	if ok {
+		exec.endSegment("ok")
+	} else {
+		exec.endSegment("fail")
+	}
+}
+
+func (e *Execution) beginSegment(name string, test TestingT) {
+	e.flush()
+	e.sync()
+	e.m.Lock()
+	defer e.m.Unlock()
+	e.segments = append(e.segments, &segment{name: name, base: e.Profile, test: test})
+	e.Profile = dgtypes.NewProfile()
+	e.Profile.Sampling = e.sampler.Sampling()
+}
+
+func (e *Execution) endSegment(label string) {
+	e.flush()
+	e.sync()
+	e.m.Lock()
+	defer e.m.Unlock()
+	if len(e.segments) <= 0 {
+		logf("dynagrok: ending a segment which was never started\n")
+		return
+	}
+	e.popSegment(label)
+}
+
+// endTest closes the segment of the test t. A test's segment is innermost
+// unless the test ran alongside another: their profiles are mixed so neither
+// is written.
+func (e *Execution) endTest(t TestingT, label string) {
+	e.flush()
+	e.sync()
+	e.m.Lock()
+	defer e.m.Unlock()
+	for i := len(e.segments) - 1; i >= 0; i-- {
+		s := e.segments[i]
+		if s.test != t {
+			continue
+		}
+		if i == len(e.segments)-1 {
+			e.popSegment(label)
+			if s.parallel {
+				parallelTests.Unlock()
+			}
+			return
+		}
+		logf("dynagrok: %v ran alongside %v, their profiles are not written\n", t.Name(), e.segments[len(e.segments)-1].name)
+		for _, dropped := range e.segments[i:] {
+			if dropped.parallel {
+				parallelTests.Unlock()
+			}
+		}
+		e.segments = e.segments[:i]
+		e.Profile = s.base
+		return
+	}
+	logf("dynagrok: ending the segment of %v which was never started\n", t.Name())
+}
+
+// suspendSegment sets the segment of the test t aside (if it is the innermost)
+// and restores the profile it replaced.
+func (e *Execution) suspendSegment(t TestingT) *segment {
+	e.flush()
+	e.sync()
+	e.m.Lock()
+	defer e.m.Unlock()
+	if len(e.segments) <= 0 || e.segments[len(e.segments)-1].test != t {
+		return nil
+	}
+	s := e.segments[len(e.segments)-1]
+	e.segments = e.segments[:len(e.segments)-1]
+	s.profile = e.Profile
+	e.Profile = s.base
+	return s
+}
+
+// resumeSegment reopens a segment set aside by suspendSegment
+func (e *Execution) resumeSegment(s *segment) {
+	e.flush()
+	e.sync()
+	e.m.Lock()
+	defer e.m.Unlock()
+	s.base = e.Profile
+	e.Profile = s.profile
+	s.profile = nil
+	s.parallel = true
+	e.segments = append(e.segments, s)
+}
+
+// popSegment writes out the innermost segment (to the directory named by
+// label) and restores the profile it replaced. e.m must be held.
+func (e *Execution) popSegment(label string) {
+	s := e.segments[len(e.segments)-1]
+	e.segments = e.segments[:len(e.segments)-1]
+	profile := e.Profile
+	e.Profile = s.base
+	if profile.Empty() {
+		return
+	}
+	e.writeFlowGraph(label, e.segmentFileName(s.name), profile)
+}
+
+// segmentFileName makes a unique file name (sans extension) from a segment's
+// name. Names are not required to be unique (a test run with -count=2
+// produces two segments with the same name).
+func (e *Execution) segmentFileName(name string) string {
+	clean := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '.':
+			return r
+		}
+		return '_'
+	}, name)
+	e.segNames[clean]++
+	if n := e.segNames[clean]; n > 1 {
+		return fmt.Sprintf("%v.%d", clean, n)
+	}
+	return clean
+}
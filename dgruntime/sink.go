@@ -0,0 +1,238 @@
+package dgruntime
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The profiles are written to the directory $DGPROF (/tmp/dynagrok-profile
+// by default) under fixed names (flow-graph.txt, ok/TestXxx.txt, failures,
+// ...). The output is configured with:
+//
+//	DGPROF=<dir>              the directory, it may contain {pid}, {time}
+//	                          and {id} (the value of DGPROF_ID) so runs do
+//	                          not overwrite each other (eg. /tmp/prof/{pid})
+//	DGPROF_NAME=<template>    the names of the flow graphs (sans extension),
+//	                          {name} is the fixed name (eg. {name}-{pid}).
+//	                          The other files (functions.json, failures,
+//	                          ...) keep their names as the tools reading
+//	                          them look for them by name.
+//	DGPROF_GZIP=1             gzip the flow graphs (.gz is added to their
+//	                          names, the localize and profile commands read
+//	                          them as they are)
+//	DGPROF_SINK=unix:<path>   stream the files to the unix socket at path
+//	DGPROF_SINK=fd:<n>        stream the files to the inherited file
+//	                          descriptor n (eg. a pipe)
+//	DGPROF_LOG=stderr|off     where dynagrok's own messages (writing to:
+//	                          ..., starting shut down, ...) go, stdout by
+//	                          default
+//
+// A stream is a tar archive holding the files under their names (relative to
+// the profile directory). `dynagrok profile collect` is a collector for the
+// socket sink.
+
+// logOut receives dynagrok's messages (see DGPROF_LOG)
+var logOut = logWriter()
+
+func logWriter() io.Writer {
+	switch os.Getenv("DGPROF_LOG") {
+	case "stderr":
+		return os.Stderr
+	case "off":
+		return ioutil.Discard
+	}
+	return os.Stdout
+}
+
+// logf writes one of dynagrok's messages
+func logf(format string, args ...interface{}) {
+	fmt.Fprintf(logOut, format, args...)
+}
+
+// sink stores the files written for an execution
+type sink interface {
+	// create opens the file at path (relative to the profile directory)
+	create(path string) (io.WriteCloser, error)
+	// where describes the file at path for the log
+	where(path string) string
+	close() error
+}
+
+// output names the files and writes them to the sink
+type output struct {
+	sink sink
+	dir  string // the directory of a dirSink, empty for streams
+	name string // the DGPROF_NAME template of the flow graphs
+	gzip bool
+	vars *strings.Replacer
+}
+
+func newOutput() *output {
+	id := os.Getenv("DGPROF_ID")
+	o := &output{
+		name: "{name}",
+		gzip: os.Getenv("DGPROF_GZIP") != "",
+	}
+	o.vars = strings.NewReplacer(
+		"{pid}", strconv.Itoa(os.Getpid()),
+		"{time}", time.Now().Format("20060102T150405.000000000"),
+		"{id}", id,
+	)
+	if v := os.Getenv("DGPROF_NAME"); v != "" {
+		o.name = v
+	}
+	switch sink := os.Getenv("DGPROF_SINK"); {
+	case sink == "" || sink == "dir":
+		dir := "/tmp/dynagrok-profile"
+		if os.Getenv("DGPROF") != "" {
+			dir = o.vars.Replace(os.Getenv("DGPROF"))
+		}
+		if err := os.MkdirAll(dir, os.ModeDir|0775); err != nil {
+			panic(fmt.Errorf("dynagrok's dgruntime could not make directory %v", dir))
+		}
+		o.dir = dir
+		o.sink = &dirSink{root: dir}
+	case strings.HasPrefix(sink, "unix:"):
+		conn, err := net.Dial("unix", strings.TrimPrefix(sink, "unix:"))
+		if err != nil {
+			panic(fmt.Errorf("dynagrok's dgruntime could not connect to DGPROF_SINK=%v: %v", sink, err))
+		}
+		o.sink = newStreamSink(sink, conn)
+	case strings.HasPrefix(sink, "fd:"):
+		fd, err := strconv.Atoi(strings.TrimPrefix(sink, "fd:"))
+		if err != nil || fd < 0 {
+			panic(fmt.Errorf("dynagrok: bad DGPROF_SINK=%v expected fd:<n>", sink))
+		}
+		o.sink = newStreamSink(sink, os.NewFile(uintptr(fd), sink))
+	default:
+		panic(fmt.Errorf("dynagrok: bad DGPROF_SINK=%v expected dir, unix:<path> or fd:<n>", sink))
+	}
+	return o
+}
+
+// flowGraphName names the file of the flow graph with the fixed name (eg.
+// flow-graph or TestXxx) after the DGPROF_NAME template
+func (o *output) flowGraphName(name string) string {
+	return o.vars.Replace(strings.Replace(o.name, "{name}", name, -1))
+}
+
+// create opens the file name+ext (eg. flow-graph and .txt) in the directory
+// dir (relative to the profile directory). It returns the file and where it
+// is.
+func (o *output) create(dir, name, ext string) (io.WriteCloser, string, error) {
+	compress := o.gzip && (ext == ".txt" || ext == ".bin")
+	if compress {
+		ext += ".gz"
+	}
+	path := name + ext
+	if dir != "" {
+		path = dir + "/" + path
+	}
+	w, err := o.sink.create(path)
+	if err != nil {
+		return nil, "", err
+	}
+	if compress {
+		w = &gzipFile{Writer: gzip.NewWriter(w), file: w}
+	}
+	return w, o.sink.where(path), nil
+}
+
+func (o *output) close() error {
+	return o.sink.close()
+}
+
+type gzipFile struct {
+	*gzip.Writer
+	file io.WriteCloser
+}
+
+func (g *gzipFile) Close() error {
+	if err := g.Writer.Close(); err != nil {
+		g.file.Close()
+		return err
+	}
+	return g.file.Close()
+}
+
+// dirSink writes the files to a directory
+type dirSink struct {
+	root string
+}
+
+func (s *dirSink) create(path string) (io.WriteCloser, error) {
+	full := pjoin(s.root, filepath.FromSlash(path))
+	if err := os.MkdirAll(filepath.Dir(full), os.ModeDir|0775); err != nil {
+		return nil, err
+	}
+	return os.Create(full)
+}
+
+func (s *dirSink) where(path string) string {
+	return pjoin(s.root, filepath.FromSlash(path))
+}
+
+func (s *dirSink) close() error {
+	return nil
+}
+
+// streamSink writes the files to a tar archive. A file is buffered until it
+// is closed as the header comes first and holds its size.
+type streamSink struct {
+	name string
+	w    io.WriteCloser
+	tw   *tar.Writer
+}
+
+func newStreamSink(name string, w io.WriteCloser) *streamSink {
+	return &streamSink{name: name, w: w, tw: tar.NewWriter(w)}
+}
+
+func (s *streamSink) create(path string) (io.WriteCloser, error) {
+	return &streamFile{sink: s, path: path}, nil
+}
+
+func (s *streamSink) where(path string) string {
+	return s.name + " " + path
+}
+
+func (s *streamSink) close() error {
+	if err := s.tw.Close(); err != nil {
+		s.w.Close()
+		return err
+	}
+	return s.w.Close()
+}
+
+type streamFile struct {
+	bytes.Buffer
+	sink *streamSink
+	path string
+}
+
+func (f *streamFile) Close() error {
+	err := f.sink.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     f.path,
+		Mode:     0664,
+		Size:     int64(f.Len()),
+		ModTime:  time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := f.sink.tw.Write(f.Bytes()); err != nil {
+		return err
+	}
+	return f.sink.tw.Flush()
+}
@@ -0,0 +1,215 @@
+package dgruntime
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"dgruntime/dgtypes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// setenv sets the environment variables (name, value, name, value, ...) and
+// returns a func unsetting them
+func setenv(vars ...string) func() {
+	for i := 0; i < len(vars); i += 2 {
+		os.Setenv(vars[i], vars[i+1])
+	}
+	return func() {
+		for i := 0; i < len(vars); i += 2 {
+			os.Unsetenv(vars[i])
+		}
+	}
+}
+
+// profileRun records a flow and a failure, writes the flow graph of a
+// segment and shuts the execution down
+func profileRun(e *Execution) {
+	record(e, 1)
+	e.Fail(&dgtypes.Failure{Message: "injected"})
+	e.m.Lock()
+	e.writeFlowGraph("ok", "TestX", e.Profile)
+	e.m.Unlock()
+	shutdown(e)
+}
+
+func TestOutputTemplates(t *testing.T) {
+	e, dir := testExec(t)
+	defer os.RemoveAll(dir)
+	defer setenv(
+		"DGPROF", filepath.Join(dir, "{id}-{pid}-{time}"),
+		"DGPROF_ID", "run1",
+		"DGPROF_NAME", "{name}.{id}",
+	)()
+	e.out = newOutput()
+	profileRun(e)
+
+	dirs, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := regexp.MustCompile(fmt.Sprintf(`^run1-%d-\d{8}T\d{6}\.\d{9}$`, os.Getpid()))
+	if len(dirs) != 1 || !name.MatchString(dirs[0].Name()) {
+		t.Fatalf("expected one directory matching %v got %v", name, dirs)
+	}
+	run := filepath.Join(dir, dirs[0].Name())
+	for _, file := range []string{
+		// the flow graphs follow DGPROF_NAME
+		"flow-graph.run1.txt",
+		"ok/TestX.run1.txt",
+		// the others keep the names they are read by
+		"functions.json",
+		"failures",
+	} {
+		if _, err := os.Stat(filepath.Join(run, filepath.FromSlash(file))); err != nil {
+			t.Errorf("%v was not written: %v", file, err)
+		}
+	}
+}
+
+func TestOutputGzip(t *testing.T) {
+	e, dir := testExec(t)
+	defer os.RemoveAll(dir)
+	defer setenv("DGPROF", dir, "DGPROF_GZIP", "1")()
+	e.out = newOutput()
+	profileRun(e)
+
+	for _, file := range []string{"flow-graph.txt.gz", "ok/TestX.txt.gz"} {
+		f, err := os.Open(filepath.Join(dir, filepath.FromSlash(file)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		z, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatalf("%v: %v", file, err)
+		}
+		p, err := dgtypes.LoadSimple(z)
+		if err != nil {
+			t.Fatalf("%v: %v", file, err)
+		}
+		if len(p.Flows) != 1 {
+			t.Errorf("%v: expected the recorded flow got %v", file, p.Flows)
+		}
+	}
+	// only the flow graphs are compressed
+	if _, err := os.Stat(filepath.Join(dir, "functions.json")); err != nil {
+		t.Error(err)
+	}
+}
+
+// untar reads the files of a profile stream
+func untar(t *testing.T, stream []byte) map[string]string {
+	files := make(map[string]string)
+	tr := tar.NewReader(bytes.NewReader(stream))
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return files
+		} else if err != nil {
+			t.Fatalf("bad stream: %v", err)
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[h.Name] = string(data)
+	}
+}
+
+func TestStreamSinks(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		// open starts reading a stream, it returns the sink and a func
+		// waiting for the stream
+		open func(t *testing.T, dir string) (string, func() []byte)
+	}{
+		{"unix", func(t *testing.T, dir string) (string, func() []byte) {
+			socket := filepath.Join(dir, "sock")
+			l, err := net.Listen("unix", socket)
+			if err != nil {
+				t.Fatal(err)
+			}
+			read := make(chan []byte, 1)
+			go func() {
+				defer l.Close()
+				conn, err := l.Accept()
+				if err != nil {
+					read <- nil
+					return
+				}
+				defer conn.Close()
+				data, _ := ioutil.ReadAll(conn)
+				read <- data
+			}()
+			return "unix:" + socket, func() []byte { return <-read }
+		}},
+		{"fd", func(t *testing.T, dir string) (string, func() []byte) {
+			pr, pw, err := os.Pipe()
+			if err != nil {
+				t.Fatal(err)
+			}
+			// the sink closes the descriptor it is given
+			fd, err := syscall.Dup(int(pw.Fd()))
+			pw.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			read := make(chan []byte, 1)
+			go func() {
+				defer pr.Close()
+				data, _ := ioutil.ReadAll(pr)
+				read <- data
+			}()
+			return fmt.Sprintf("fd:%d", fd), func() []byte { return <-read }
+		}},
+	} {
+		e, dir := testExec(t)
+		sink, wait := c.open(t, dir)
+		unset := setenv("DGPROF_SINK", sink)
+		e.out = newOutput()
+		unset()
+		profileRun(e)
+		files := untar(t, wait())
+		os.RemoveAll(dir)
+		for _, file := range []string{"flow-graph.txt", "ok/TestX.txt", "functions.json"} {
+			if _, has := files[file]; !has {
+				t.Errorf("%v: %v is missing from the stream", c.name, file)
+			}
+		}
+		if !strings.Contains(files["failures"], "injected") {
+			t.Errorf("%v: the failures were not streamed: %q", c.name, files["failures"])
+		}
+		if p, err := dgtypes.LoadSimple(strings.NewReader(files["flow-graph.txt"])); err != nil || len(p.Flows) != 1 {
+			t.Errorf("%v: the flow graph did not survive the stream: %v %v", c.name, p, err)
+		}
+		if entries, _ := ioutil.ReadDir(dir); len(entries) > 1 {
+			t.Errorf("%v: the stream wrote to the profile directory: %v", c.name, entries)
+		}
+	}
+}
+
+func TestLogWriter(t *testing.T) {
+	for _, c := range []struct {
+		log  string
+		want io.Writer
+	}{
+		{"", os.Stdout},
+		{"stderr", os.Stderr},
+		{"off", ioutil.Discard},
+	} {
+		unset := setenv("DGPROF_LOG", c.log)
+		if got := logWriter(); got != c.want {
+			t.Errorf("DGPROF_LOG=%v: logs to %v", c.log, got)
+		}
+		unset()
+	}
+}
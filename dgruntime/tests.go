@@ -0,0 +1,75 @@
+package dgruntime
+
+import (
+	"runtime"
+	"sync"
+)
+
+// TestingT is the part of *testing.T used by the test hooks. dgruntime does
+// not import testing so that programs which are not tests do not link it.
+type TestingT interface {
+	Name() string
+	Failed() bool
+	Parallel()
+}
+
+// parallelTests is held by the parallel test which is running. The execution
+// has a single profile so tests running at the same time could not be told
+// apart: instrumented parallel tests run one at a time.
+var parallelTests sync.Mutex
+
+// BeginTest is inserted at the top of each TestXxx function when a package's
+// tests are instrumented. It opens a segment named after the test.
+func BeginTest(t TestingT) {
+	execCheck()
+	exec.beginSegment(t.Name(), t)
+}
+
+// EndTest is deferred by each instrumented TestXxx function. The test's
+// segment is written to the ok or fail directory depending on whether the
+// test failed (or is panicking).
+func EndTest(t TestingT) {
+	execCheck()
+	if !t.Failed() && !panicking() {
+		exec.endTest(t, "ok")
+	} else {
+		exec.endTest(t, "fail")
+	}
+}
+
+// Parallel replaces the calls to t.Parallel in instrumented tests. The test's
+// segment is set aside while the test waits for the serial tests to finish
+// and is reopened once no other parallel test is running. Subtests do not
+// have segments of their own and run in parallel as usual.
+func Parallel(t TestingT) {
+	execCheck()
+	s := exec.suspendSegment(t)
+	t.Parallel()
+	if s == nil {
+		return
+	}
+	parallelTests.Lock()
+	exec.resumeSegment(s)
+}
+
+// TestsDone wraps the call to testing.M.Run so the profiler is shut down once
+// all of the tests have run. It returns the exit code unchanged.
+func TestsDone(code int) int {
+	Shutdown()
+	return code
+}
+
+// panicking reports whether the calling goroutine is unwinding a panic
+func panicking() bool {
+	pcs := make([]uintptr, 64)
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(2, pcs)])
+	for {
+		frame, more := frames.Next()
+		if frame.Function == "runtime.gopanic" {
+			return true
+		}
+		if !more {
+			return false
+		}
+	}
+}
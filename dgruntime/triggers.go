@@ -0,0 +1,131 @@
+package dgruntime
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Segments can be driven from outside the process. Both triggers are off
+// unless enabled through the environment:
+//
+//	DGPROF_SIGNALS=1      A segment is opened at start up. SIGUSR1 ends the
+//	                      open segment as ok and opens the next one, SIGUSR2
+//	                      does the same but labels the ended segment failed.
+//	DGPROF_HTTP=<addr>    Listen on addr for
+//	                        POST /segment/begin?name=<name>
+//	                        POST /segment/end?ok=<true|false>
+//
+// The HTTP listener speaks just enough HTTP/1.0 for curl and friends. It does
+// not use net/http so that instrumenting a program does not pull net/http
+// (and everything it imports) into the profiler. Each connection is served
+// on its own goroutine and has triggerTimeout to send its request so a
+// client which never does cannot stall the others.
+func init() {
+	if os.Getenv("DGPROF_SIGNALS") != "" {
+		startSignalTrigger()
+	}
+	if addr := os.Getenv("DGPROF_HTTP"); addr != "" {
+		if err := startHTTPTrigger(addr); err != nil {
+			logf("dynagrok could not start the segment trigger: %v\n", err)
+		}
+	}
+}
+
+func startSignalTrigger() {
+	n := 1
+	BeginSegment(fmt.Sprintf("segment-%d", n))
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGUSR1, syscall.SIGUSR2)
+	goOwn(func() {
+		for sig := range sigs {
+			EndSegment(sig == syscall.SIGUSR1)
+			n++
+			BeginSegment(fmt.Sprintf("segment-%d", n))
+		}
+	})
+}
+
+const triggerTimeout = 10 * time.Second
+
+func startHTTPTrigger(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	logf("dynagrok segment trigger listening on %v\n", l.Addr())
+	goOwn(func() {
+		serveTriggers(l)
+	})
+	return nil
+}
+
+func serveTriggers(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			logf("dynagrok segment trigger stopped: %v\n", err)
+			return
+		}
+		goOwn(func() {
+			serveTrigger(conn)
+		})
+	}
+}
+
+func serveTrigger(conn net.Conn) {
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(triggerTimeout))
+	r := bufio.NewReader(conn)
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return
+	}
+	// skip the headers
+	for {
+		h, err := r.ReadString('\n')
+		if err != nil || strings.TrimSpace(h) == "" {
+			break
+		}
+	}
+	status, msg := handleTrigger(strings.Fields(line))
+	fmt.Fprintf(conn, "HTTP/1.0 %v\r\nContent-Type: text/plain\r\nContent-Length: %d\r\n\r\n%v", status, len(msg), msg)
+}
+
+func handleTrigger(request []string) (status, msg string) {
+	if len(request) < 2 {
+		return "400 Bad Request", "malformed request\n"
+	}
+	if request[0] != "POST" {
+		return "405 Method Not Allowed", "use POST\n"
+	}
+	u, err := url.Parse(request[1])
+	if err != nil {
+		return "400 Bad Request", err.Error() + "\n"
+	}
+	q := u.Query()
+	switch u.Path {
+	case "/segment/begin":
+		name := q.Get("name")
+		if name == "" {
+			return "400 Bad Request", "name is required\n"
+		}
+		BeginSegment(name)
+		return "200 OK", "began " + name + "\n"
+	case "/segment/end":
+		ok, err := strconv.ParseBool(q.Get("ok"))
+		if err != nil {
+			return "400 Bad Request", "ok must be true or false\n"
+		}
+		EndSegment(ok)
+		return "200 OK", "ended\n"
+	}
+	return "404 Not Found", "unknown trigger " + u.Path + "\n"
+}
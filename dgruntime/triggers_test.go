@@ -0,0 +1,165 @@
+package dgruntime
+
+import (
+	"bufio"
+	"dgruntime/dgtypes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var quiet sync.Once
+
+// testExec starts a new execution (writing to a temporary directory) with
+// no channel state left over from the tests before
+func testExec(t *testing.T) (e *Execution, dir string) {
+	dir, err := ioutil.TempDir("", "dgruntime-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("DGPROF", dir)
+	defer os.Unsetenv("DGPROF")
+	execMu.Lock()
+	exec = newExecution()
+	execMu.Unlock()
+	quiet.Do(func() {
+		logOut = ioutil.Discard
+	})
+	for k := range chans {
+		s := &chans[k]
+		s.m.Lock()
+		s.ch = 0
+		s.m.Unlock()
+	}
+	return exec, dir
+}
+
+// record adds a flow to the execution's current profile
+func record(e *Execution, bbid int) {
+	e.m.Lock()
+	defer e.m.Unlock()
+	e.Profile.Flows[dgtypes.FlowEdge{Targ: dgtypes.BlkEntrance{In: 1, BasicBlockId: bbid}}]++
+}
+
+// written loads the flow graph the segment named name wrote to label
+func written(t *testing.T, dir, label, name string) *dgtypes.Profile {
+	f, err := os.Open(filepath.Join(dir, label, name+".txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	p, err := dgtypes.LoadSimple(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestHandleTrigger(t *testing.T) {
+	e, dir := testExec(t)
+	defer os.RemoveAll(dir)
+	for _, c := range []struct {
+		request string
+		status  string
+		open    int // the segments open afterwards
+	}{
+		{"", "400 Bad Request", 0},
+		{"POST", "400 Bad Request", 0},
+		{"GET /segment/begin?name=a HTTP/1.0", "405 Method Not Allowed", 0},
+		{"POST /segment/begin HTTP/1.0", "400 Bad Request", 0},
+		{"POST /segment/begin?name=%zz HTTP/1.0", "400 Bad Request", 0},
+		{"POST /segment/other HTTP/1.0", "404 Not Found", 0},
+		{"POST /segment/begin?name=a HTTP/1.0", "200 OK", 1},
+		{"POST /segment/begin?name=b HTTP/1.0", "200 OK", 2},
+		{"POST /segment/end?ok=maybe HTTP/1.0", "400 Bad Request", 2},
+		{"POST /segment/end?ok=false HTTP/1.0", "200 OK", 1},
+		{"POST /segment/end?ok=true HTTP/1.0", "200 OK", 0},
+	} {
+		status, msg := handleTrigger(strings.Fields(c.request))
+		if status != c.status {
+			t.Errorf("%q: %v (%q) expected %v", c.request, status, msg, c.status)
+		}
+		if len(e.segments) != c.open {
+			t.Errorf("%q: %d segments open expected %d", c.request, len(e.segments), c.open)
+		}
+	}
+}
+
+func TestSegmentNesting(t *testing.T) {
+	e, dir := testExec(t)
+	defer os.RemoveAll(dir)
+	base := e.Profile
+	record(e, 0)
+	BeginSegment("outer")
+	record(e, 1)
+	BeginSegment("inner")
+	record(e, 2)
+	record(e, 2)
+	EndSegment(false)
+	record(e, 3)
+	BeginSegment("empty")
+	EndSegment(true)
+	EndSegment(true)
+	if e.Profile != base || len(e.segments) != 0 {
+		t.Fatalf("the base profile was not restored (%d segments open)", len(e.segments))
+	}
+	if len(base.Flows) != 1 {
+		t.Errorf("the base profile holds the segments' flows %v", base.Flows)
+	}
+	// each segment only holds what happened while it was innermost
+	if inner := written(t, dir, "fail", "inner"); len(inner.Flows) != 1 {
+		t.Errorf("inner flows %v", inner.Flows)
+	}
+	if outer := written(t, dir, "ok", "outer"); len(outer.Flows) != 2 {
+		t.Errorf("outer flows %v", outer.Flows)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "ok", "empty.txt")); !os.IsNotExist(err) {
+		t.Errorf("an empty segment was written: %v", err)
+	}
+}
+
+func TestServeTriggers(t *testing.T) {
+	e, dir := testExec(t)
+	defer os.RemoveAll(dir)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go serveTriggers(l)
+
+	// a client which never sends its request does not hold up the others
+	idle, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idle.Close()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(triggerTimeout / 2))
+	if _, err := conn.Write([]byte("POST /segment/begin?name=x HTTP/1.0\r\nHost: localhost\r\n\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	status, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != "HTTP/1.0 200 OK\r\n" {
+		t.Errorf("status %q", status)
+	}
+	e.m.Lock()
+	open := len(e.segments)
+	e.m.Unlock()
+	if open != 1 {
+		t.Errorf("%d segments open expected 1", open)
+	}
+}
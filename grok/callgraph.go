@@ -0,0 +1,393 @@
+package grok
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	"go/types"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+import (
+	"github.com/timtadh/getopt"
+	"golang.org/x/tools/go/callgraph"
+	"golang.org/x/tools/go/callgraph/cha"
+	"golang.org/x/tools/go/callgraph/static"
+	"golang.org/x/tools/go/callgraph/vta"
+	"golang.org/x/tools/go/loader"
+	"golang.org/x/tools/go/ssa"
+	"golang.org/x/tools/go/ssa/ssautil"
+)
+
+import (
+	"github.com/timtadh/dynagrok/analysis"
+	"github.com/timtadh/dynagrok/cmd"
+	"github.com/timtadh/dynagrok/dgruntime/dgtypes"
+	"github.com/timtadh/dynagrok/dgruntime/excludes"
+)
+
+func NewCallGraphCommand(c *cmd.Config) cmd.Runnable {
+	return cmd.Cmd(
+		"callgraph",
+		`[options] -c <call-graph.json> <pkg>`,
+		`
+Overlay the dynamic call graph of a run (the call-graph.json written to the
+profile directory) on the static call graph of the program. The static call
+graph is rooted at the main and init functions of <pkg> (or at every function
+of <pkg> if it is not a main package). The overlay is written in the dot
+format:
+
+    - calls which were made are labeled with their counts
+    - calls which are possible but were never made are dashed
+    - calls which were made but are not in the static call graph are red
+      (eg. callbacks called from packages which are not instrumented)
+    - functions which are reachable but were never called are dashed
+
+Give the policy the program was instrumented with (eg. --policy=<profile>/policy)
+so functions which were not instrumented are left out.
+
+Option Flags
+    -h,--help                         Show this message
+    -c,--calls=<path>                 The call-graph.json of a run (or the
+                                      profile directory holding it)
+    -o,--output=<path>                Write the overlay to path (defaults to
+                                      stdout)
+    -a,--algorithm=<name>             The static call graph: cha (default),
+                                      static or vta
+    -u,--uncalled                     List the functions which are reachable
+                                      but were never called (instead of the
+                                      overlay)
+`+cmd.PolicyUsage,
+		"c:o:a:u",
+		append([]string{
+			"calls=",
+			"output=",
+			"algorithm=",
+			"uncalled",
+		}, cmd.PolicyLongOpts...),
+		func(r cmd.Runnable, args []string, optargs []getopt.OptArg) ([]string, *cmd.Error) {
+			callsPath := ""
+			output := ""
+			algorithm := "cha"
+			uncalled := false
+			policy := excludes.NewPolicy()
+			for _, oa := range optargs {
+				if ok, err := cmd.PolicyOpt(policy, oa); err != nil {
+					return nil, err
+				} else if ok {
+					continue
+				}
+				switch oa.Opt() {
+				case "-c", "--calls":
+					callsPath = oa.Arg()
+				case "-o", "--output":
+					output = oa.Arg()
+				case "-a", "--algorithm":
+					algorithm = oa.Arg()
+				case "-u", "--uncalled":
+					uncalled = true
+				}
+			}
+			switch algorithm {
+			case "cha", "static", "vta":
+			default:
+				return nil, cmd.Usage(r, 5, "Unknown call graph algorithm %q", algorithm)
+			}
+			if callsPath == "" {
+				return nil, cmd.Usage(r, 5, "Expected a call graph (-c)")
+			}
+			if len(args) != 1 {
+				return nil, cmd.Usage(r, 5, "Expected one package name got %v", args)
+			}
+			if fi, err := os.Stat(callsPath); err == nil && fi.IsDir() {
+				callsPath = filepath.Join(callsPath, "call-graph.json")
+			}
+			fin, err := os.Open(callsPath)
+			if err != nil {
+				return nil, cmd.Errorf(6, "Could not open the call graph %v: %v", callsPath, err)
+			}
+			dynamic, err := dgtypes.LoadCallGraph(fin)
+			fin.Close()
+			if err != nil {
+				return nil, cmd.Errorf(6, "Could not read the call graph %v: %v", callsPath, err)
+			}
+			program, err := cmd.LoadPkg(c, args[0])
+			if err != nil {
+				return nil, cmd.Usage(r, 6, err.Error())
+			}
+			g, err := staticCallGraph(program, policy, algorithm)
+			if err != nil {
+				return nil, cmd.Errorf(7, "Error building the static call graph: %v", err)
+			}
+			fout := os.Stdout
+			if output != "" {
+				f, err := os.Create(output)
+				if err != nil {
+					return nil, cmd.Errorf(8, "Could not create %v: %v", output, err)
+				}
+				defer f.Close()
+				fout = f
+			}
+			if uncalled {
+				g.writeUncalled(fout, dynamic)
+			} else {
+				g.writeOverlay(fout, dynamic)
+			}
+			return nil, nil
+		})
+}
+
+// staticGraph is the static call graph between the functions which would be
+// instrumented. Calls through functions which are not (synthetic wrappers,
+// package initializers, excluded packages) are calls to the instrumented
+// functions they reach.
+type staticGraph struct {
+	positions map[string]string // the instrumented functions
+	reachable map[string]bool
+	calls     map[[2]string]bool
+}
+
+func staticCallGraph(program *loader.Program, policy *excludes.Policy, algorithm string) (*staticGraph, error) {
+	// the instrumenter's names of the functions by their syntax
+	names := make(map[token.Pos]string)
+	g := &staticGraph{
+		positions: make(map[string]string),
+		reachable: make(map[string]bool),
+		calls:     make(map[[2]string]bool),
+	}
+	for _, pkg := range program.AllPackages {
+		if policy.ExcludedPkg(pkg.Pkg.Path()) {
+			continue
+		}
+		for _, fileAst := range pkg.Files {
+			err := analysis.Functions(pkg, fileAst, func(fn ast.Node, fnName string) error {
+				if policy.ExcludedFunc(fnName) {
+					return nil
+				}
+				names[fn.Pos()] = fnName
+				g.positions[fnName] = program.Fset.Position(fn.Pos()).String()
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	name := func(fn *ssa.Function) string {
+		if fn == nil || fn.Syntax() == nil {
+			return ""
+		}
+		return names[fn.Syntax().Pos()]
+	}
+
+	prog := ssaProgram(program)
+	prog.Build()
+	var cg *callgraph.Graph
+	switch algorithm {
+	case "static":
+		cg = static.CallGraph(prog)
+	case "vta":
+		cg = vta.CallGraph(ssautil.AllFunctions(prog), cha.CallGraph(prog))
+	default:
+		cg = cha.CallGraph(prog)
+	}
+
+	// the instrumented functions each node calls, looking through the
+	// functions which are not instrumented
+	var callees func(n *callgraph.Node, seen map[*callgraph.Node]bool, do func(string))
+	callees = func(n *callgraph.Node, seen map[*callgraph.Node]bool, do func(string)) {
+		for _, e := range n.Out {
+			if seen[e.Callee] {
+				continue
+			}
+			seen[e.Callee] = true
+			if callee := name(e.Callee.Func); callee != "" {
+				do(callee)
+			} else {
+				callees(e.Callee, seen, do)
+			}
+		}
+	}
+	for fn, n := range cg.Nodes {
+		if caller := name(fn); caller != "" {
+			callees(n, make(map[*callgraph.Node]bool), func(callee string) {
+				g.calls[[2]string{caller, callee}] = true
+			})
+		}
+	}
+
+	roots := make([]*callgraph.Node, 0, 10)
+	for _, info := range program.InitialPackages() {
+		pkg := prog.Package(info.Pkg)
+		if pkg == nil {
+			continue
+		}
+		if main := pkg.Func("main"); main != nil && pkg.Pkg.Name() == "main" {
+			roots = append(roots, cg.Nodes[main], cg.Nodes[pkg.Func("init")])
+			continue
+		}
+		for fn, n := range cg.Nodes {
+			if fn != nil && fn.Pkg == pkg {
+				roots = append(roots, n)
+			}
+		}
+	}
+	seen := make(map[*callgraph.Node]bool)
+	queue := make([]*callgraph.Node, 0, len(roots))
+	for _, n := range roots {
+		if n != nil && !seen[n] {
+			seen[n] = true
+			queue = append(queue, n)
+		}
+	}
+	for len(queue) > 0 {
+		n := queue[0]
+		queue = queue[1:]
+		if fn := name(n.Func); fn != "" {
+			g.reachable[fn] = true
+		}
+		for _, e := range n.Out {
+			if !seen[e.Callee] {
+				seen[e.Callee] = true
+				queue = append(queue, e.Callee)
+			}
+		}
+	}
+	return g, nil
+}
+
+// ssaProgram creates the SSA program of the loaded packages. Packages loaded
+// from modules do not include the standard library, the packages which were
+// not loaded are created from their types alone (their functions have no
+// bodies).
+func ssaProgram(program *loader.Program) *ssa.Program {
+	prog := ssa.NewProgram(program.Fset, ssa.InstantiateGenerics)
+	created := make(map[*types.Package]bool)
+	for _, info := range program.AllPackages {
+		prog.CreatePackage(info.Pkg, info.Files, &info.Info, info.Importable)
+		created[info.Pkg] = true
+	}
+	var imports func(pkg *types.Package)
+	imports = func(pkg *types.Package) {
+		for _, imp := range pkg.Imports() {
+			if !created[imp] {
+				created[imp] = true
+				prog.CreatePackage(imp, nil, nil, true)
+				imports(imp)
+			}
+		}
+	}
+	for _, info := range program.AllPackages {
+		imports(info.Pkg)
+	}
+	return prog
+}
+
+// writeUncalled lists the reachable functions which were never called
+func (g *staticGraph) writeUncalled(fout io.Writer, dynamic *dgtypes.CallGraph) {
+	called := calledFuncs(dynamic)
+	uncalled := make([]string, 0, len(g.reachable))
+	for fn := range g.reachable {
+		if called[fn] == 0 {
+			uncalled = append(uncalled, fn)
+		}
+	}
+	sort.Strings(uncalled)
+	for _, fn := range uncalled {
+		fmt.Fprintf(fout, "%v\t%v\n", fn, g.positions[fn])
+	}
+}
+
+// writeOverlay writes the static call graph with the dynamic call graph on
+// top of it in the dot format
+func (g *staticGraph) writeOverlay(fout io.Writer, dynamic *dgtypes.CallGraph) {
+	called := calledFuncs(dynamic)
+	counts := make(map[[2]string]int, len(dynamic.Calls))
+	for _, c := range dynamic.Calls {
+		counts[[2]string{c.Caller, c.Callee}] += c.Count
+	}
+	funcs := make([]string, 0, len(g.reachable)+len(called))
+	for fn := range g.reachable {
+		funcs = append(funcs, fn)
+	}
+	for fn := range called {
+		if !g.reachable[fn] {
+			funcs = append(funcs, fn)
+		}
+	}
+	sort.Strings(funcs)
+	ids := make(map[string]int, len(funcs)+1)
+	fmt.Fprintf(fout, "digraph {\n")
+	fmt.Fprintf(fout, "%d [label=%v, shape=rect];\n", 0, strconv.Quote("entry"))
+	ids["entry"] = 0
+	for _, fn := range funcs {
+		ids[fn] = len(ids)
+		style := ""
+		if called[fn] == 0 {
+			style = ", style=dashed, color=gray"
+		}
+		fmt.Fprintf(fout, "%d [label=%v, shape=rect, fn_name=%v, position=%v, calls=%d%v];\n",
+			ids[fn],
+			strconv.Quote(fn),
+			strconv.Quote(fn),
+			strconv.Quote(g.positions[fn]),
+			called[fn],
+			style,
+		)
+	}
+	edges := make([][2]string, 0, len(g.calls)+len(counts))
+	for e := range g.calls {
+		if g.reachable[e[0]] {
+			edges = append(edges, e)
+		}
+	}
+	for e := range counts {
+		if !g.calls[e] || !g.reachable[e[0]] {
+			edges = append(edges, e)
+		}
+	}
+	sort.Slice(edges, func(i, j int) bool {
+		if edges[i][0] != edges[j][0] {
+			return edges[i][0] < edges[j][0]
+		}
+		return edges[i][1] < edges[j][1]
+	})
+	for _, e := range edges {
+		src, has := ids[e[0]]
+		if !has {
+			continue
+		}
+		targ, has := ids[e[1]]
+		if !has {
+			continue
+		}
+		count := counts[e]
+		switch {
+		case count == 0:
+			fmt.Fprintf(fout, "%d -> %d [style=dashed, color=gray, calls=0];\n", src, targ)
+		case !g.calls[e] && e[0] != "entry":
+			fmt.Fprintf(fout, "%d -> %d [label=%d, color=red, calls=%d];\n", src, targ, count, count)
+		default:
+			fmt.Fprintf(fout, "%d -> %d [label=%d, calls=%d];\n", src, targ, count, count)
+		}
+	}
+	fmt.Fprint(fout, "}\n")
+}
+
+// calledFuncs counts the calls to each function of the dynamic call graph
+func calledFuncs(dynamic *dgtypes.CallGraph) map[string]int {
+	called := make(map[string]int, len(dynamic.Functions))
+	for _, f := range dynamic.Functions {
+		called[f.Name] += f.Calls
+	}
+	for _, c := range dynamic.Calls {
+		if called[c.Callee] == 0 {
+			called[c.Callee] = c.Count
+		}
+	}
+	return called
+}
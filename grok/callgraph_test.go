@@ -0,0 +1,122 @@
+package grok
+
+import (
+	"bytes"
+	"testing"
+)
+
+import (
+	"golang.org/x/tools/go/loader"
+)
+
+import (
+	"github.com/timtadh/dynagrok/dgruntime/dgtypes"
+	"github.com/timtadh/dynagrok/dgruntime/excludes"
+)
+
+func testStaticGraph(t *testing.T, policy *excludes.Policy) *staticGraph {
+	src := `package main
+
+func f() {}
+
+func g() { h() }
+
+func h() {}
+
+func unused() { f() }
+
+func main() {
+	f()
+	g()
+}
+`
+	conf := loader.Config{}
+	file, err := conf.ParseFile("main.go", src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf.CreateFromFiles("main", file)
+	program, err := conf.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err := staticCallGraph(program, policy, "cha")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return g
+}
+
+func TestCallGraphOverlay(t *testing.T) {
+	g := testStaticGraph(t, excludes.NewPolicy())
+	dynamic := &dgtypes.CallGraph{
+		Functions: []dgtypes.CallGraphFunc{
+			{Name: "main.main", Calls: 1},
+			{Name: "main.f", Calls: 3},
+			{Name: "main.g", Calls: 1},
+		},
+		Calls: []dgtypes.CallGraphEdge{
+			{Caller: "entry", Callee: "main.main", Count: 1},
+			{Caller: "main.main", Callee: "main.f", Count: 2},
+			{Caller: "main.main", Callee: "main.g", Count: 1},
+			{Caller: "main.g", Callee: "main.f", Count: 1},
+		},
+	}
+	var buf bytes.Buffer
+	g.writeOverlay(&buf, dynamic)
+	want := `digraph {
+0 [label="entry", shape=rect];
+1 [label="main.f", shape=rect, fn_name="main.f", position="main.go:3:1", calls=3];
+2 [label="main.g", shape=rect, fn_name="main.g", position="main.go:5:1", calls=1];
+3 [label="main.h", shape=rect, fn_name="main.h", position="main.go:7:1", calls=0, style=dashed, color=gray];
+4 [label="main.main", shape=rect, fn_name="main.main", position="main.go:11:1", calls=1];
+0 -> 4 [label=1, calls=1];
+2 -> 1 [label=1, color=red, calls=1];
+2 -> 3 [style=dashed, color=gray, calls=0];
+4 -> 1 [label=2, calls=2];
+4 -> 2 [label=1, calls=1];
+}
+`
+	if buf.String() != want {
+		t.Errorf("overlay\n%v\nexpected\n%v", buf.String(), want)
+	}
+	buf.Reset()
+	g.writeUncalled(&buf, dynamic)
+	// unused is not reachable from main
+	if want := "main.h\tmain.go:7:1\n"; buf.String() != want {
+		t.Errorf("uncalled %q expected %q", buf.String(), want)
+	}
+}
+
+func TestStaticCallGraphPolicy(t *testing.T) {
+	policy := excludes.NewPolicy()
+	if err := policy.AddExcludeFunc("main.g"); err != nil {
+		t.Fatal(err)
+	}
+	g := testStaticGraph(t, policy)
+	// the calls through main.g are calls of the functions it calls
+	for _, c := range []struct {
+		caller, callee string
+		has            bool
+	}{
+		{"main.main", "main.f", true},
+		{"main.main", "main.h", true},
+		{"main.main", "main.g", false},
+		{"main.unused", "main.f", true},
+	} {
+		if g.calls[[2]string{c.caller, c.callee}] != c.has {
+			t.Errorf("call %v -> %v expected %v", c.caller, c.callee, c.has)
+		}
+	}
+	for fn, reachable := range map[string]bool{
+		"main.main":   true,
+		"main.f":      true,
+		"main.h":      true,
+		"main.g":      false,
+		"main.unused": false,
+	} {
+		if g.reachable[fn] != reachable {
+			t.Errorf("%v reachable %v expected %v", fn, g.reachable[fn], reachable)
+		}
+	}
+}
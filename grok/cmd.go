@@ -13,23 +13,41 @@ import (
 )
 
 func NewCommand(c *cmd.Config) cmd.Runnable {
+	cfgs := NewCFGCommand(c)
+	cg := NewCallGraphCommand(c)
+	return cmd.Annotate(
+		cmd.Commands(map[string]cmd.Runnable{
+			"":        cfgs,
+			cg.Name(): cg,
+		}),
+		"grok", "", "", "", "")
+}
+
+func NewCFGCommand(c *cmd.Config) cmd.Runnable {
 	return cmd.Cmd(
 		"grok",
 		`[options] <pkg>`,
 		`
-Print CFGs for the functions in the program.
+Print CFGs for the functions in the program. See "grok callgraph --help" for
+comparing the dynamic call graph of a run to the static call graph.
 
 Option Flags
     -h,--help                         Show this message
     -f,--fn=<name>                    Only show the CFG for func <name>
-`,
+`+cmd.PolicyUsage,
 		"f:",
-		[]string{
+		append([]string{
 			"fn=",
-		},
+		}, cmd.PolicyLongOpts...),
 		func(r cmd.Runnable, args []string, optargs []getopt.OptArg) ([]string, *cmd.Error) {
 			onlyFn := ""
+			policy := excludes.NewPolicy()
 			for _, oa := range optargs {
+				if ok, err := cmd.PolicyOpt(policy, oa); err != nil {
+					return nil, err
+				} else if ok {
+					continue
+				}
 				switch oa.Opt() {
 				case "-f", "--fn":
 					onlyFn = oa.Arg()
@@ -44,7 +62,7 @@ Option Flags
 				return nil, cmd.Usage(r, 6, err.Error())
 			}
 			for _, pkg := range program.AllPackages {
-				if excludes.ExcludedPkg(pkg.Pkg.Path()) {
+				if policy.ExcludedPkg(pkg.Pkg.Path()) {
 					continue
 				}
 				for _, fileAst := range pkg.Files {
@@ -52,6 +70,9 @@ Option Flags
 						if onlyFn != "" && onlyFn != fnName {
 							return nil
 						}
+						if policy.ExcludedFunc(fnName) {
+							return nil
+						}
 						var body *[]ast.Stmt
 						switch x := fn.(type) {
 						case *ast.FuncDecl:
@@ -1,12 +1,15 @@
 package instrument
 
 import (
+	"bytes"
 	"go/ast"
 	"go/parser"
+	"go/printer"
 	"go/token"
 	"testing"
 
 	"github.com/timtadh/data-structures/test"
+	"github.com/timtadh/dynagrok/analysis"
 )
 
 func TestSanity(x *testing.T) {
@@ -71,7 +74,7 @@ func TestEmptyFunc(x *testing.T) {
 	if funcD, ok := f.Decls[0].(*ast.FuncDecl); ok {
 		mDo := mockDo{make([]*[]ast.Stmt, 0), make([]int, 0)}
 
-		blocks(&funcD.Body.List, nil, func(blk *[]ast.Stmt, id int) error {
+		analysis.Blocks(&funcD.Body.List, nil, func(blk *[]ast.Stmt, id int) error {
 			mDo.Block = append(mDo.Block, blk)
 			mDo.Id = append(mDo.Id, id)
 			return nil
@@ -83,3 +86,56 @@ func TestEmptyFunc(x *testing.T) {
 		//ast.Print(fset, f)
 	}
 }
+
+func TestBlockProbes(t *testing.T) {
+	for _, src := range []string{
+		`func f(a, b, c bool) { if a && (b || c) { g() } else { g() } }`,
+		`func f(a, b bool) bool { return a || b }`,
+		`func f(x int) { switch { case x < 0, x > 10: g(); case x == 5: g(); default: g() } }`,
+		`func f(x int) { for i := 0; i < x && x > 2; i++ { if i == 3 { continue }; g() } }`,
+		`func f(xs []int) { L: for _, x := range xs { for { if x > 0 { break L }; g() } } }`,
+		`func f(x int) { L: x--; if x > 0 { goto L } }`,
+		`func f(ch chan int) { select { case x := <-ch: _ = x; default: g() } }`,
+	} {
+		i, _, f := loadSrc(t, "package test\nfunc g() {}\n"+src+"\n")
+		fn := f.Decls[len(f.Decls)-1].(*ast.FuncDecl)
+		cfg := analysis.BuildCFG(i.program.Fset, "test.f", fn, &fn.Body.List)
+		if err := i.blockProbes(cfg, fn, &fn.Body.List); err != nil {
+			t.Errorf("%v: %v", src, err)
+			continue
+		}
+		var buf bytes.Buffer
+		if err := printer.Fprint(&buf, i.program.Fset, f); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := parser.ParseFile(token.NewFileSet(), "out.go", buf.Bytes(), 0); err != nil {
+			t.Errorf("%v: %v\n%v", src, err, buf.String())
+		}
+	}
+}
+
+func TestCheckProbes(t *testing.T) {
+	for _, c := range []struct {
+		src string
+		ok  bool
+	}{
+		{`func f() { g() }`, true},
+		{`func f(c bool) { if c { g() } }`, false},
+		{`func f(c bool) { if c { dgruntime.EnterBlk(1, ""); g() }; dgruntime.EnterBlk(2, "") }`, true},
+		{`func f(c bool) { if c { dgruntime.EnterBlk(1, ""); g() } }`, false},
+		// the exit block of a function with results is never entered
+		{`func f(c bool) int { if c { dgruntime.EnterBlk(1, ""); return 1 }; dgruntime.EnterBlk(2, ""); return 2 }`, true},
+	} {
+		fset := token.NewFileSet()
+		f, err := parser.ParseFile(fset, "test.go", "package test\n"+c.src, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fn := f.Decls[0].(*ast.FuncDecl)
+		cfg := analysis.BuildCFG(fset, "test.f", fn, &fn.Body.List)
+		i := &instrumenter{}
+		if err := i.checkProbes(cfg, &fn.Body.List); (err == nil) != c.ok {
+			t.Errorf("%v: checkProbes gave %v", c.src, err)
+		}
+	}
+}
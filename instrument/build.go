@@ -6,7 +6,6 @@ import (
 	"fmt"
 	"go/ast"
 	"go/build"
-	"go/printer"
 	"go/types"
 	"io"
 	"io/ioutil"
@@ -26,9 +25,6 @@ import (
 	"github.com/timtadh/dynagrok/dgruntime/excludes"
 )
 
-// var config = printer.Config{Mode: printer.UseSpaces | printer.TabIndent | printer.SourcePos, Tabwidth: 8}
-var config = printer.Config{Tabwidth: 8}
-
 type binaryBuilder struct {
 	config            *cmd.Config
 	buildContext      *build.Context
@@ -36,9 +32,35 @@ type binaryBuilder struct {
 	entry             string
 	_work, root, path string
 	output            string
+	cache             *Cache
+	policy            *excludes.Policy
+	test              bool
+}
+
+// BuildBinary writes out the (instrumented) program and builds it. If cache is
+// not nil (and no work directory is given) the cache's persistent work
+// directory is used and packages it already holds are not written again. The
+// packages the policy excludes (but the entry) were not instrumented and are
+// built from their own sources.
+func BuildBinary(c *cmd.Config, cache *Cache, policy *excludes.Policy, keepWork bool, work, entryPkgName, output string, program *loader.Program) (_ string, err error) {
+	return buildBinary(c, cache, policy, keepWork, work, entryPkgName, output, program, false)
 }
 
-func BuildBinary(c *cmd.Config, keepWork bool, work, entryPkgName, output string, program *loader.Program) (_ string, err error) {
+// BuildTestBinary is BuildBinary for a program instrumented with Tests(). It
+// builds the test binary (go test -c) of the entry package.
+func BuildTestBinary(c *cmd.Config, cache *Cache, policy *excludes.Policy, keepWork bool, work, entryPkgName, output string, program *loader.Program) (_ string, err error) {
+	return buildBinary(c, cache, policy, keepWork, work, entryPkgName, output, program, true)
+}
+
+func buildBinary(c *cmd.Config, cache *Cache, policy *excludes.Policy, keepWork bool, work, entryPkgName, output string, program *loader.Program, test bool) (_ string, err error) {
+	if work == "" && cache != nil {
+		work = cache.Work()
+		keepWork = true
+	} else if cache != nil {
+		// the work dir was not created by the cache so it can't vouch for
+		// its contents.
+		cache = nil
+	}
 	if work == "" {
 		work, err = ioutil.TempDir("", fmt.Sprintf("dynagrok-build-%v-", filepath.Base(entryPkgName)))
 		if err != nil {
@@ -58,8 +80,31 @@ func BuildBinary(c *cmd.Config, keepWork bool, work, entryPkgName, output string
 		root:         filepath.Join(work, "goroot"),
 		path:         filepath.Join(work, "gopath"),
 		output:       output,
+		cache:        cache,
+		policy:       policy,
+		test:         test,
 	}
-	return work, b.Build()
+	err = b.Build()
+	if err != nil {
+		return work, err
+	}
+	return work, cache.Commit()
+}
+
+// excluded reports whether the package was left alone by the instrumenter:
+// the policy excludes it and it is not the entry package (which gets the
+// profiler's hooks).
+func (b *binaryBuilder) excluded(pkg *types.Package) bool {
+	if pkg.Path() == b.entry || (b.test && pkg.Path() == b.entry+"_test") {
+		return false
+	}
+	return b.policy.ExcludedPkg(pkg.Path())
+}
+
+// inGoroot reports whether the package is one of the standard library's
+func (b *binaryBuilder) inGoroot(pkg *types.Package) bool {
+	_, err := os.Stat(filepath.Join(b.buildContext.GOROOT, "src", srcPath(pkg)))
+	return err == nil
 }
 
 func (b *binaryBuilder) basePaths() paths {
@@ -95,12 +140,19 @@ func (ps paths) PrefixedBy(s string) string {
 }
 
 func (b *binaryBuilder) Build() error {
+	if b.config.Modules {
+		return b.BuildOverlay()
+	}
 	_, err := os.Stat(filepath.Join(b.root, "src"))
 	if err != nil && os.IsNotExist(err) {
 		err = b.copyDir(
 			filepath.Join(b.config.GOROOT),
 			filepath.Join(b.root),
 			func(path string) bool {
+				if b.config.PortableRuntime {
+					// the toolchain in pkg/tool is reused as is
+					return path == "bin" || path == ".git"
+				}
 				return path == "bin" || path == "pkg" || path == ".git"
 			},
 		)
@@ -114,13 +166,6 @@ func (b *binaryBuilder) Build() error {
 	} else if err != nil {
 		return err
 	}
-	err = b.copyDir(
-		filepath.Join(b.config.DGPATH, "src", "runtime"),
-		filepath.Join(b.root, "src", "runtime"),
-	)
-	if err != nil {
-		return err
-	}
 	err = b.copyDir(
 		filepath.Join(b.config.DGPATH, "dgruntime"),
 		filepath.Join(b.root, "src", "dgruntime"),
@@ -128,25 +173,47 @@ func (b *binaryBuilder) Build() error {
 	if err != nil {
 		return err
 	}
-	err = b.rebuildGo()
-	if err != nil {
-		return err
+	if !b.config.PortableRuntime {
+		err = b.copyDir(
+			filepath.Join(b.config.DGPATH, "src", "runtime"),
+			filepath.Join(b.root, "src", "runtime"),
+		)
+		if err != nil {
+			return err
+		}
+		err = b.rebuildGo()
+		if err != nil {
+			return err
+		}
 	}
 	basePaths := b.basePaths()
 	anyStdlib := false
+	// a package and its external tests share a directory which must only be
+	// copied once (or the second copy clobbers the first's rewritten files)
+	roots := make(map[string]string)
 	for pkgType, pkgInfo := range b.program.AllPackages {
 		// if pkgInfo.Cgo {
 		// 	continue
 		// }
-		if excludes.ExcludedPkg(pkgInfo.Pkg.Path()) {
+		if b.excluded(pkgType) && b.inGoroot(pkgType) {
+			// the copy of GOROOT holds its sources (the work GOPATH only
+			// holds the packages written to it)
 			continue
 		}
-		stdlib, root, err := b.createDir(basePaths, pkgType, pkgInfo.Files)
-		if err != nil {
-			return err
+		if b.cache.Fresh(pkgInfo.Pkg.Path()) {
+			continue
 		}
-		if stdlib {
-			anyStdlib = true
+		root, created := roots[srcPath(pkgType)]
+		if !created {
+			stdlib, r, err := b.createDir(basePaths, pkgType, pkgInfo.Files)
+			if err != nil {
+				return err
+			}
+			if stdlib {
+				anyStdlib = true
+			}
+			root = r
+			roots[srcPath(pkgType)] = root
 		}
 		// errors.Logf("DEBUG", "%v -> %v", pkgInfo, root)
 		for _, f := range pkgInfo.Files {
@@ -156,7 +223,7 @@ func (b *binaryBuilder) Build() error {
 			if err != nil {
 				return err
 			}
-			err = config.Fprint(fout, b.program.Fset, f)
+			err = printFile(fout, b.program.Fset, f)
 			fout.Close()
 			if err != nil {
 				return errors.Errorf("Could not serialize tree at %v tree %v error: %v", to, f, err)
@@ -174,10 +241,14 @@ func (b *binaryBuilder) noEnv() []string {
 	}
 }
 
+// goEnv is the environment of the GOPATH mode builds (see overlay.go for the
+// modules mode). GO111MODULE is turned off as the go command otherwise
+// defaults to modules mode.
 func (b *binaryBuilder) goEnv() []string {
 	env := b.noEnv()
 	env = append(env, fmt.Sprintf("GOROOT=%v", b.root))
 	env = append(env, fmt.Sprintf("GOPATH=%v", b.path))
+	env = append(env, "GO111MODULE=off")
 	if os.Getenv("GOROOT_BOOTSTRAP") != "" {
 		env = append(env, fmt.Sprintf("GOROOT_BOOTSTRAP=%v", os.Getenv("GOROOT_BOOTSTRAP")))
 	}
@@ -278,8 +349,26 @@ func (b *binaryBuilder) dropVersion() error {
 	return err
 }
 
+// goBin is the go command used to build the instrumented program. With the
+// patched runtime it is the one rebuilt in the work GOROOT, otherwise the
+// configured toolchain is pointed at the work GOROOT through the environment.
+func (b *binaryBuilder) goBin() string {
+	if b.config.PortableRuntime {
+		return filepath.Join(b.config.GOROOT, "bin", "go")
+	}
+	return filepath.Join(b.root, "bin", "go")
+}
+
+// tags selects the dgruntime goroutine identity provider
+func (b *binaryBuilder) tags() string {
+	if b.config.PortableRuntime {
+		return ""
+	}
+	return "dgpatched"
+}
+
 func (b *binaryBuilder) goBuild(stdlib bool) error {
-	goBin := filepath.Join(b.root, "bin", "go")
+	goBin := b.goBin()
 	if stdlib {
 		c := exec.Command(goBin, "install", "-v", "std")
 		c.Stdin = os.Stdin
@@ -296,7 +385,7 @@ func (b *binaryBuilder) goBuild(stdlib bool) error {
 		// ignore os.Remove errors because it is a best effort thing
 		os.Remove(filepath.Join(b.root, "pkg", "linux_amd64", "dgruntime.a"))
 		os.Remove(filepath.Join(b.root, "pkg", "linux_amd64", "dgruntime", "excludes.a"))
-		c := exec.Command(goBin, "install", "-v", "dgruntime")
+		c := exec.Command(goBin, "install", "-v", "-tags", b.tags(), "dgruntime")
 		c.Stdin = os.Stdin
 		c.Stdout = os.Stdout
 		c.Stderr = os.Stderr
@@ -307,7 +396,7 @@ func (b *binaryBuilder) goBuild(stdlib bool) error {
 			return err
 		}
 	}
-	c := exec.Command(goBin, "build", "-o", b.output, b.entry)
+	c := exec.Command(goBin, b.buildCmd("-tags", b.tags(), "-o", b.output, b.entry)...)
 	c.Env = b.goEnv()
 	fmt.Fprintln(os.Stderr, strings.Join(c.Env, " "), c.Path, strings.Join(c.Args[1:], " "))
 	output, err := c.CombinedOutput()
@@ -315,15 +404,33 @@ func (b *binaryBuilder) goBuild(stdlib bool) error {
 	return err
 }
 
+// buildCmd is the go sub-command (and its args) which builds the output
+func (b *binaryBuilder) buildCmd(args ...string) []string {
+	if b.test {
+		return append([]string{"test", "-c"}, args...)
+	}
+	return append([]string{"build"}, args...)
+}
+
+// srcPath is the import path of the directory holding pkg. It differs from
+// the package's path for external test packages (path pkg_test) which live
+// in the directory of the package they test.
+func srcPath(pkg *types.Package) string {
+	if strings.HasSuffix(pkg.Name(), "_test") {
+		return strings.TrimSuffix(pkg.Path(), "_test")
+	}
+	return pkg.Path()
+}
+
 func (b *binaryBuilder) createDir(basePaths paths, pkg *types.Package, pkgFiles []*ast.File) (stdlib bool, root string, err error) {
 	var src string
 	for _, path := range basePaths {
-		if _, err := os.Stat(filepath.Join(path, "src", pkg.Path())); err == nil {
+		if _, err := os.Stat(filepath.Join(path, "src", srcPath(pkg))); err == nil {
 			src = path
 			break
 		}
 	}
-	srcDir, err := os.Open(filepath.Join(src, "src", pkg.Path()))
+	srcDir, err := os.Open(filepath.Join(src, "src", srcPath(pkg)))
 	if err != nil {
 		return false, "", err
 	}
@@ -337,7 +444,7 @@ func (b *binaryBuilder) createDir(basePaths paths, pkg *types.Package, pkgFiles
 		root = b.root
 		stdlib = true
 	}
-	err = os.MkdirAll(filepath.Join(root, "src", pkg.Path()), os.ModeDir|os.ModeTemporary|0775)
+	err = os.MkdirAll(filepath.Join(root, "src", srcPath(pkg)), os.ModeDir|os.ModeTemporary|0775)
 	if err != nil {
 		return false, "", err
 	}
@@ -346,11 +453,11 @@ func (b *binaryBuilder) createDir(basePaths paths, pkg *types.Package, pkgFiles
 			continue
 		}
 		name := f.Name()
-		from, err := os.Open(filepath.Join(src, "src", pkg.Path(), name))
+		from, err := os.Open(filepath.Join(src, "src", srcPath(pkg), name))
 		if err != nil {
 			return false, "", err
 		}
-		to, err := os.Create(filepath.Join(root, "src", pkg.Path(), name))
+		to, err := os.Create(filepath.Join(root, "src", srcPath(pkg), name))
 		if err != nil {
 			from.Close()
 			return false, "", err
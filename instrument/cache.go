@@ -0,0 +1,212 @@
+package instrument
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"go/types"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+import (
+	"golang.org/x/tools/go/loader"
+)
+
+import (
+	"github.com/timtadh/dynagrok/cmd"
+)
+
+// Cache is a persistent build directory for instrumented programs. It keeps
+// the instrumented output of every package keyed by a hash of the package's
+// original sources (and its imports' keys), the instrumentation mode and the
+// version of dgruntime.
+// When a program is instrumented again only the packages whose key changed
+// are rewritten (and therefore rebuilt). The GOROOT copy (and in GOPATH mode
+// the rebuilt compiler and installed std) survive between runs.
+//
+// A nil *Cache is valid and caches nothing.
+type Cache struct {
+	Dir      string
+	work     string
+	keys     map[string]string
+	manifest map[string]string
+	dirty    map[string]bool
+}
+
+// DefaultCacheDir is the cache location used when none is given on the
+// command line.
+func DefaultCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "dynagrok")
+}
+
+// OpenCache opens (creating if needed) the cache's work directory for the
+// given program and mode. The mode should name everything other than the
+// package sources which changes the instrumented output (the command, the
+// entry package, options, ...).
+func OpenCache(c *cmd.Config, dir, mode string, program *loader.Program) (*Cache, error) {
+	if dir == "" {
+		dir = DefaultCacheDir()
+	}
+	rt, err := hashDir(filepath.Join(c.DGPATH, "dgruntime"))
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "%v\x00%v\x00%v\x00%v\x00%v\x00%v", mode, rt, c.GOROOT, c.GOPATH, c.Modules, c.PortableRuntime)
+	cache := &Cache{
+		Dir:      dir,
+		work:     filepath.Join(dir, "work-"+hex.EncodeToString(h.Sum(nil))[:16]),
+		keys:     make(map[string]string),
+		manifest: make(map[string]string),
+		dirty:    make(map[string]bool),
+	}
+	err = os.MkdirAll(cache.work, os.ModeDir|0775)
+	if err != nil {
+		return nil, err
+	}
+	for _, pkg := range program.AllPackages {
+		if _, err := cache.key(program, pkg.Pkg); err != nil {
+			return nil, err
+		}
+	}
+	if bits, err := ioutil.ReadFile(cache.manifestPath()); err == nil {
+		err = json.Unmarshal(bits, &cache.manifest)
+		if err != nil {
+			return nil, fmt.Errorf("corrupt build cache manifest %v: %v", cache.manifestPath(), err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	return cache, nil
+}
+
+// Work is the persistent work directory for this program and mode
+func (c *Cache) Work() string {
+	return c.work
+}
+
+// Fresh reports whether the work directory already holds the instrumented
+// output for the package.
+func (c *Cache) Fresh(pkgPath string) bool {
+	if c == nil || c.dirty[pkgPath] {
+		return false
+	}
+	key, has := c.keys[pkgPath]
+	return has && key != "" && c.manifest[pkgPath] == key
+}
+
+// Dirty marks a package whose output does not depend only on its source (eg.
+// it was mutated). It is rewritten now and again on the next run.
+func (c *Cache) Dirty(pkgPath string) {
+	if c == nil {
+		return
+	}
+	c.dirty[pkgPath] = true
+}
+
+// Commit records the packages written to the work directory. It should be
+// called once the build succeeded.
+func (c *Cache) Commit() error {
+	if c == nil {
+		return nil
+	}
+	for pkg, key := range c.keys {
+		if c.dirty[pkg] {
+			delete(c.manifest, pkg)
+		} else {
+			c.manifest[pkg] = key
+		}
+	}
+	bits, err := json.MarshalIndent(c.manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(c.manifestPath(), bits, 0664)
+}
+
+func (c *Cache) manifestPath() string {
+	return filepath.Join(c.work, "manifest.json")
+}
+
+// key is the package's key: a hash of its sources and of the keys of the
+// packages it imports. The instrumented output depends on the types of the
+// imported packages too (the predicate picked for a comparison, the values
+// captured by a go statement, the type checked invariants) so the key of a
+// package changes with any of its transitive imports.
+func (c *Cache) key(program *loader.Program, pkg *types.Package) (string, error) {
+	if key, has := c.keys[pkg.Path()]; has {
+		return key, nil
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "%v\x00", pkg.Path())
+	if info := program.AllPackages[pkg]; info != nil {
+		names := make([]string, 0, len(info.Files))
+		for _, f := range info.Files {
+			names = append(names, program.Fset.File(f.Pos()).Name())
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(h, "%v\x00", filepath.Base(name))
+			err := hashFile(h, name)
+			if err != nil {
+				return "", err
+			}
+		}
+	}
+	imports := make([]string, 0, len(pkg.Imports()))
+	for _, imp := range pkg.Imports() {
+		key, err := c.key(program, imp)
+		if err != nil {
+			return "", err
+		}
+		imports = append(imports, imp.Path()+"\x00"+key)
+	}
+	sort.Strings(imports)
+	for _, imp := range imports {
+		fmt.Fprintf(h, "%v\x00", imp)
+	}
+	key := hex.EncodeToString(h.Sum(nil))
+	c.keys[pkg.Path()] = key
+	return key, nil
+}
+
+func hashDir(dir string) (string, error) {
+	h := sha256.New()
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(h, "%v\x00", rel)
+		return hashFile(h, path)
+	})
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func hashFile(h io.Writer, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(h, f)
+	return err
+}
@@ -0,0 +1,125 @@
+package instrument
+
+import (
+	"go/build"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+import (
+	"golang.org/x/tools/go/loader"
+)
+
+import (
+	"github.com/timtadh/dynagrok/cmd"
+)
+
+// cacheTree makes a GOPATH holding the package b which imports a, and a
+// DGPATH holding a dgruntime
+func cacheTree(t *testing.T) (dir string, c *cmd.Config) {
+	dir, err := ioutil.TempDir("", "dynagrok-cache-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, src := range map[string]string{
+		"gopath/src/a/a.go":           "package a\n\nfunc F() int { return 1 }\n",
+		"gopath/src/b/b.go":           "package b\n\nimport \"a\"\n\nfunc G() bool { return a.F() < 2 }\n",
+		"dgpath/dgruntime/runtime.go": "package dgruntime\n",
+	} {
+		writeFile(t, filepath.Join(dir, name), src)
+	}
+	return dir, &cmd.Config{GOPATH: filepath.Join(dir, "gopath"), DGPATH: filepath.Join(dir, "dgpath")}
+}
+
+func writeFile(t *testing.T, path, src string) {
+	if err := os.MkdirAll(filepath.Dir(path), 0775); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(src), 0664); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// openCache loads b (and a) and opens their cache
+func openCache(t *testing.T, dir string, c *cmd.Config, mode string) *Cache {
+	ctxt := build.Default
+	ctxt.GOPATH = c.GOPATH
+	conf := loader.Config{Build: &ctxt}
+	conf.Import("b")
+	program, err := conf.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache, err := OpenCache(c, filepath.Join(dir, "cache"), mode, program)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cache
+}
+
+func checkFresh(t *testing.T, step string, cache *Cache, want map[string]bool) {
+	for pkg, fresh := range want {
+		if cache.Fresh(pkg) != fresh {
+			t.Errorf("%v: %v fresh %v expected %v", step, pkg, cache.Fresh(pkg), fresh)
+		}
+	}
+}
+
+func TestCache(t *testing.T) {
+	t.Setenv("GO111MODULE", "off")
+	dir, c := cacheTree(t)
+	defer os.RemoveAll(dir)
+
+	cache := openCache(t, dir, c, "test")
+	checkFresh(t, "a new cache", cache, map[string]bool{"a": false, "b": false})
+	if err := cache.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	cache = openCache(t, dir, c, "test")
+	checkFresh(t, "committed", cache, map[string]bool{"a": true, "b": true})
+	if other := openCache(t, dir, c, "other"); other.Work() == cache.Work() {
+		t.Errorf("the modes share the work directory %v", cache.Work())
+	}
+	checkFresh(t, "another mode", openCache(t, dir, c, "other"), map[string]bool{"a": false, "b": false})
+
+	writeFile(t, filepath.Join(c.GOPATH, "src/b/b.go"), "package b\n\nimport \"a\"\n\nfunc G() bool { return a.F() < 3 }\n")
+	cache = openCache(t, dir, c, "test")
+	checkFresh(t, "b changed", cache, map[string]bool{"a": true, "b": false})
+	if err := cache.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	// b compares a float now: its predicates (and so its output) change
+	writeFile(t, filepath.Join(c.GOPATH, "src/a/a.go"), "package a\n\nfunc F() float64 { return 1 }\n")
+	cache = openCache(t, dir, c, "test")
+	checkFresh(t, "a changed", cache, map[string]bool{"a": false, "b": false})
+	if err := cache.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	cache = openCache(t, dir, c, "test")
+	cache.Dirty("a")
+	checkFresh(t, "a dirty", cache, map[string]bool{"a": false, "b": true})
+	if err := cache.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	cache = openCache(t, dir, c, "test")
+	checkFresh(t, "after a dirty commit", cache, map[string]bool{"a": false, "b": true})
+
+	writeFile(t, filepath.Join(c.DGPATH, "dgruntime/runtime.go"), "package dgruntime\n\nvar x int\n")
+	cache = openCache(t, dir, c, "test")
+	checkFresh(t, "dgruntime changed", cache, map[string]bool{"a": false, "b": false})
+}
+
+func TestNilCache(t *testing.T) {
+	var cache *Cache
+	cache.Dirty("a")
+	if cache.Fresh("a") {
+		t.Error("a nil cache has a fresh package")
+	}
+	if err := cache.Commit(); err != nil {
+		t.Error(err)
+	}
+}
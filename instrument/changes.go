@@ -0,0 +1,168 @@
+package instrument
+
+import (
+	"bufio"
+	"bytes"
+	"go/ast"
+	"math"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+import (
+	"github.com/timtadh/data-structures/errors"
+	"golang.org/x/tools/go/loader"
+)
+
+import (
+	"github.com/timtadh/dynagrok/analysis"
+)
+
+// lines is a range of changed lines (first to last)
+type lines struct {
+	first, last int
+}
+
+// ChangedFunctions names the functions of the program touched by the changes
+// made to the git repository holding the entry package since the revision
+// rev: the committed changes, the uncommitted ones and the untracked files.
+// A function is touched if one of its lines changed or lines were deleted
+// next to them. The names are those analysis.Functions gives (see Changed).
+func ChangedFunctions(program *loader.Program, entryPkgName, rev string) (map[string]bool, error) {
+	// git would read a revision starting with "-" as an option
+	if strings.HasPrefix(rev, "-") {
+		return nil, errors.Errorf("The revision %q is not valid: it starts with -", rev)
+	}
+	entry := program.Package(entryPkgName)
+	if entry == nil || len(entry.Files) <= 0 {
+		return nil, errors.Errorf("The entry package %v was not found in the loaded program", entryPkgName)
+	}
+	dir := filepath.Dir(program.Fset.File(entry.Files[0].Pos()).Name())
+	top, err := git(dir, "rev-parse", "--show-toplevel")
+	if err != nil {
+		return nil, err
+	}
+	top = strings.TrimSpace(top)
+	diff, err := git(top, "diff", "--no-color", "--no-ext-diff", "--src-prefix=a/", "--dst-prefix=b/", "-U0", rev, "--")
+	if err != nil {
+		return nil, err
+	}
+	changed, err := diffLines(top, diff)
+	if err != nil {
+		return nil, err
+	}
+	untracked, err := git(top, "ls-files", "--others", "--exclude-standard")
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range strings.Split(untracked, "\n") {
+		if name != "" {
+			changed[realPath(filepath.Join(top, name))] = []lines{{1, math.MaxInt32}}
+		}
+	}
+	fns := make(map[string]bool)
+	for _, pkg := range program.AllPackages {
+		for _, f := range pkg.Files {
+			ranges := changed[realPath(program.Fset.File(f.Pos()).Name())]
+			if len(ranges) == 0 {
+				continue
+			}
+			err := analysis.Functions(pkg, f, func(fn ast.Node, fnName string) error {
+				first := program.Fset.Position(fn.Pos()).Line
+				last := program.Fset.Position(fn.End()).Line
+				for _, r := range ranges {
+					if r.first <= last && first <= r.last {
+						fns[fnName] = true
+						break
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return fns, nil
+}
+
+// diffLines reads the changed lines of each file (in its new version) from
+// a diff made with -U0. A deletion changes the lines around it.
+func diffLines(top, diff string) (map[string][]lines, error) {
+	changed := make(map[string][]lines)
+	file := ""
+	s := bufio.NewScanner(strings.NewReader(diff))
+	s.Buffer(nil, 1<<24)
+	for s.Scan() {
+		line := s.Text()
+		switch {
+		case strings.HasPrefix(line, "+++ "):
+			file = ""
+			if name := strings.TrimPrefix(line, "+++ "); strings.HasPrefix(name, "b/") {
+				file = realPath(filepath.Join(top, strings.TrimPrefix(name, "b/")))
+			}
+		case strings.HasPrefix(line, "@@ ") && file != "":
+			// @@ -a[,b] +c[,d] @@
+			fields := strings.Fields(line)
+			if len(fields) < 3 || !strings.HasPrefix(fields[2], "+") {
+				return nil, errors.Errorf("bad hunk in git diff: %v", line)
+			}
+			start, count := fields[2][1:], "1"
+			if i := strings.Index(start, ","); i >= 0 {
+				start, count = start[:i], start[i+1:]
+			}
+			c, err := strconv.Atoi(start)
+			if err != nil {
+				return nil, errors.Errorf("bad hunk in git diff: %v", line)
+			}
+			d, err := strconv.Atoi(count)
+			if err != nil {
+				return nil, errors.Errorf("bad hunk in git diff: %v", line)
+			}
+			if d == 0 {
+				// the lines after line c were deleted
+				changed[file] = append(changed[file], lines{c, c + 1})
+			} else {
+				changed[file] = append(changed[file], lines{c, c + d - 1})
+			}
+		}
+	}
+	return changed, s.Err()
+}
+
+// changedMode names the changed functions for the build cache's mode (see
+// OpenCache)
+func changedMode(changed map[string]bool) string {
+	if changed == nil {
+		return ""
+	}
+	names := make([]string, 0, len(changed))
+	for name := range changed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return "changed " + strings.Join(names, " ") + "\n"
+}
+
+func git(dir string, args ...string) (string, error) {
+	c := exec.Command("git", append([]string{"-C", dir}, args...)...)
+	var stderr bytes.Buffer
+	c.Stderr = &stderr
+	out, err := c.Output()
+	if err != nil {
+		return "", errors.Errorf("git %v failed: %v\n%v", strings.Join(args, " "), err, stderr.String())
+	}
+	return string(out), nil
+}
+
+// realPath resolves the symbolic links in path so the paths git reports and
+// the paths the program was loaded from compare
+func realPath(path string) string {
+	if p, err := filepath.EvalSymlinks(path); err == nil {
+		return p
+	}
+	return path
+}
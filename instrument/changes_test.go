@@ -0,0 +1,76 @@
+package instrument
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiffLines(t *testing.T) {
+	top := "/no/such/repo"
+	for _, c := range []struct {
+		diff string
+		want map[string][]lines
+		err  bool
+	}{
+		{
+			diff: `diff --git a/a.go b/a.go
+--- a/a.go
++++ b/a.go
+@@ -3 +3 @@ func f() {
+-	g()
++	h()
+@@ -10,2 +10,3 @@ func k() {
+@@ -20,4 +21,0 @@ func m() {
+`,
+			want: map[string][]lines{
+				"/no/such/repo/a.go": {{3, 3}, {10, 12}, {21, 22}},
+			},
+		},
+		{
+			// deleted files have no new lines, new ones are all changed
+			diff: `diff --git a/old.go b/old.go
+--- a/old.go
++++ /dev/null
+@@ -1,5 +0,0 @@
+diff --git a/new.go b/new.go
+--- /dev/null
++++ b/pkg/new.go
+@@ -0,0 +1,7 @@
+`,
+			want: map[string][]lines{
+				"/no/such/repo/pkg/new.go": {{1, 7}},
+			},
+		},
+		{
+			diff: "+++ b/a.go\n@@ -1 @@\n",
+			err:  true,
+		},
+		{
+			diff: "+++ b/a.go\n@@ -1 +x,2 @@\n",
+			err:  true,
+		},
+	} {
+		got, err := diffLines(top, c.diff)
+		if c.err {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %v", c.diff, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", c.diff, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%q: changed lines %v, expected %v", c.diff, got, c.want)
+		}
+	}
+}
+
+func TestChangedFunctionsOptionRev(t *testing.T) {
+	for _, rev := range []string{"-", "--output=/tmp/x", "-p"} {
+		if _, err := ChangedFunctions(nil, "main", rev); err == nil {
+			t.Errorf("ChangedFunctions(%q) = nil error, want the revision rejected", rev)
+		}
+	}
+}
@@ -11,6 +11,8 @@ import (
 
 import (
 	"github.com/timtadh/dynagrok/cmd"
+	"github.com/timtadh/dynagrok/dgruntime/dgtypes"
+	"github.com/timtadh/dynagrok/dgruntime/excludes"
 )
 
 func NewCommand(c *cmd.Config) cmd.Runnable {
@@ -23,19 +25,55 @@ Option Flags
     -o,--output=<path>                Output file to create (defaults to pkg-name.instr)
     -w,--work=<path>                  Work directory to use (defaults to tempdir)
     --keep-work                       Keep the work directory
-`,
+    --test                            Instrument the package's tests and build
+                                      its test binary (go test -c). Each TestXxx
+                                      writes its own profile to $DGPROF/ok or
+                                      $DGPROF/fail
+    --predicates                      Record the outcomes of branch conditions
+                                      and how the operands of comparisons
+                                      relate (see localize stat)
+    --cache                           Reuse instrumented packages from the build
+                                      cache (only changed packages are rebuilt)
+    --cache-dir=<path>                Build cache location (implies --cache)
+    --changed-since=<rev>             Fully instrument only the functions
+                                      changed since the git revision <rev>
+                                      (see git diff <rev>), the others only
+                                      record their calls
+    --granularity=<level>             What the probes record: func (function
+                                      entries and calls only), block (every
+                                      basic block, the default) or edge (blocks
+                                      and the CFG edges they were entered by)
+`+cmd.PolicyUsage,
 		"o:w:",
-		[]string{
+		append([]string{
 			"output=",
 			"work=",
 			"keep-work",
-		},
+			"test",
+			"predicates",
+			"cache",
+			"cache-dir=",
+			"changed-since=",
+			"granularity=",
+		}, cmd.PolicyLongOpts...),
 		func(r cmd.Runnable, args []string, optargs []getopt.OptArg) ([]string, *cmd.Error) {
 			fmt.Println(c)
 			output := ""
 			keepWork := false
 			work := ""
+			useCache := false
+			cacheDir := ""
+			test := false
+			predicates := false
+			changedSince := ""
+			granularity := dgtypes.BlockGranularity
+			policy := excludes.NewPolicy()
 			for _, oa := range optargs {
+				if ok, err := cmd.PolicyOpt(policy, oa); err != nil {
+					return nil, err
+				} else if ok {
+					continue
+				}
 				switch oa.Opt() {
 				case "-o", "--output":
 					output = oa.Arg()
@@ -43,25 +81,80 @@ Option Flags
 					work = oa.Arg()
 				case "-k", "--keep-work":
 					keepWork = true
+				case "--test":
+					test = true
+				case "--predicates":
+					predicates = true
+				case "--cache":
+					useCache = true
+				case "--cache-dir":
+					useCache = true
+					cacheDir = oa.Arg()
+				case "--changed-since":
+					changedSince = oa.Arg()
+				case "--granularity":
+					switch oa.Arg() {
+					case dgtypes.FuncGranularity, dgtypes.BlockGranularity, dgtypes.EdgeGranularity:
+						granularity = oa.Arg()
+					default:
+						return nil, cmd.Usage(r, 5, "Expected a granularity of func, block or edge got %v", oa.Arg())
+					}
 				}
 			}
+			if granularity == dgtypes.FuncGranularity && (predicates || changedSince != "") {
+				return nil, cmd.Usage(r, 5, "--predicates and --changed-since need block probes (not --granularity=func)")
+			}
 			if len(args) != 1 {
 				return nil, cmd.Usage(r, 5, "Expected one package name got %v", args)
 			}
 			pkgName := args[0]
-			if output == "" {
+			if output == "" && test {
+				output = fmt.Sprintf("%v.test.instr", filepath.Base(pkgName))
+			} else if output == "" {
 				output = fmt.Sprintf("%v.instr", filepath.Base(pkgName))
 			}
 			fmt.Println("instrumenting", pkgName)
-			program, err := cmd.LoadPkg(c, pkgName)
+			load := cmd.LoadPkg
+			build := BuildBinary
+			opts := []Option{Policy(policy), Granularity(granularity)}
+			if test {
+				load = cmd.LoadTestPkg
+				build = BuildTestBinary
+				opts = append(opts, Tests())
+			}
+			if predicates {
+				opts = append(opts, Predicates())
+			}
+			program, err := load(c, pkgName)
 			if err != nil {
 				return nil, cmd.Usage(r, 6, err.Error())
 			}
-			err = Instrument(pkgName, program)
+			deps, err := cmd.RuntimeDeps(c)
+			if err != nil {
+				return nil, cmd.Errorf(6, "could not list the dependencies of dgruntime: %v", err)
+			}
+			policy.ExcludeDeps(deps)
+			var changed map[string]bool
+			if changedSince != "" {
+				changed, err = ChangedFunctions(program, pkgName, changedSince)
+				if err != nil {
+					return nil, cmd.Errorf(7, err.Error())
+				}
+				opts = append(opts, Changed(changed))
+			}
+			var cache *Cache
+			if useCache {
+				mode := fmt.Sprintf("instrument %v %v %v %v\n%v%v", pkgName, test, predicates, granularity, policy, changedMode(changed))
+				cache, err = OpenCache(c, cacheDir, mode, program)
+				if err != nil {
+					return nil, cmd.Errorf(7, err.Error())
+				}
+			}
+			err = Instrument(pkgName, program, append(opts, Cached(cache))...)
 			if err != nil {
 				return nil, cmd.Errorf(7, err.Error())
 			}
-			_, err = BuildBinary(c, keepWork, work, pkgName, output, program)
+			_, err = build(c, cache, policy, keepWork, work, pkgName, output, program)
 			if err != nil {
 				return nil, cmd.Errorf(8, err.Error())
 			}
@@ -0,0 +1,348 @@
+package instrument
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
+)
+
+import (
+	"golang.org/x/tools/go/ast/astutil"
+	"golang.org/x/tools/go/loader"
+)
+
+import (
+	"github.com/timtadh/dynagrok/analysis"
+)
+
+// concurrency links the flow graphs of the program's goroutines. Go
+// statements hand the spawning block to the new goroutine and channel sends,
+// receives and closes report the channel to dgruntime which pairs them up
+// (see dgruntime/concurrency.go).
+//
+// Only receives which make up a whole statement (`<-ch`, `v := <-ch`,
+// `v, ok = <-ch`), select cases and ranges over channels are reported. The
+// channel expression is evaluated a second time so channels given by an
+// expression with calls in it are skipped.
+func (i *instrumenter) concurrency(pkg *loader.PackageInfo, cfg *analysis.CFG, fnBody *[]ast.Stmt) error {
+	return analysis.Blocks(fnBody, nil, func(blk *[]ast.Stmt, id int) error {
+		for j := 0; j < len(*blk); j++ {
+			stmt := (*blk)[j]
+			labeled, isLabeled := stmt.(*ast.LabeledStmt)
+			if isLabeled {
+				stmt = labeled.Stmt
+			}
+			pos := stmt.Pos()
+			switch s := stmt.(type) {
+			case *ast.GoStmt:
+				spawn := i.mkSpawn(pkg, s)
+				if isLabeled {
+					labeled.Stmt = spawn
+				} else {
+					(*blk)[j] = spawn
+				}
+			case *ast.SendStmt:
+				if ch := i.chanExpr(s.Chan); ch != "" {
+					*blk = Insert(cfg, nil, *blk, j+1, i.mkChanOp(pos, "Send", ch))
+					j++
+				}
+			case *ast.ExprStmt:
+				if ch := i.recvExpr(s.X); ch != "" {
+					*blk = Insert(cfg, nil, *blk, j+1, i.mkChanOp(pos, "Recv", ch))
+					j++
+				} else if ch := i.closeExpr(pkg, s.X); ch != "" && !isLabeled {
+					*blk = Insert(cfg, nil, *blk, j, i.mkChanOp(pos, "Close", ch))
+					j++
+				}
+			case *ast.AssignStmt:
+				if op := i.recvAssign(s); op != nil {
+					*blk = Insert(cfg, nil, *blk, j+1, op)
+					j++
+				}
+			case *ast.SelectStmt:
+				for _, c := range s.Body.List {
+					cc := c.(*ast.CommClause)
+					if op := i.commOp(cc.Comm); op != nil {
+						cc.Body = Insert(cfg, nil, cc.Body, afterEnterBlk(cc.Body), op)
+					}
+				}
+			case *ast.RangeStmt:
+				t := pkg.Info.TypeOf(s.X)
+				if t == nil {
+					continue
+				}
+				if _, isChan := t.Underlying().(*types.Chan); !isChan {
+					continue
+				}
+				if ch := i.chanExpr(s.X); ch != "" {
+					op := i.mkChanOp(s.X.Pos(), "Recv", ch)
+					s.Body.List = Insert(cfg, nil, s.Body.List, afterEnterBlk(s.Body.List), op)
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// commOp is the statement reporting a select case's channel operation
+func (i *instrumenter) commOp(comm ast.Stmt) ast.Stmt {
+	switch s := comm.(type) {
+	case *ast.SendStmt:
+		if ch := i.chanExpr(s.Chan); ch != "" {
+			return i.mkChanOp(s.Pos(), "Send", ch)
+		}
+	case *ast.ExprStmt:
+		if ch := i.recvExpr(s.X); ch != "" {
+			return i.mkChanOp(s.Pos(), "Recv", ch)
+		}
+	case *ast.AssignStmt:
+		return i.recvAssign(s)
+	}
+	return nil
+}
+
+// recvAssign is the statement reporting the receive of `v, ok := <-ch` (or
+// `v = <-ch`, ...). It is nil if s is not a receive.
+func (i *instrumenter) recvAssign(s *ast.AssignStmt) ast.Stmt {
+	if len(s.Rhs) != 1 {
+		return nil
+	}
+	ch := i.recvExpr(s.Rhs[0])
+	if ch == "" {
+		return nil
+	}
+	if len(s.Lhs) == 2 {
+		if ok := i.chanExpr(s.Lhs[1]); ok != "" && ok != "_" {
+			return i.mkChanOp(s.Pos(), "RecvOk", ch, ok)
+		}
+	}
+	return i.mkChanOp(s.Pos(), "Recv", ch)
+}
+
+// recvExpr returns the channel received from if e is a receive
+func (i *instrumenter) recvExpr(e ast.Expr) string {
+	u, ok := astutil.Unparen(e).(*ast.UnaryExpr)
+	if !ok || u.Op != token.ARROW {
+		return ""
+	}
+	return i.chanExpr(u.X)
+}
+
+// closeExpr returns the channel closed if e is a call to the close builtin
+func (i *instrumenter) closeExpr(pkg *loader.PackageInfo, e ast.Expr) string {
+	call, ok := e.(*ast.CallExpr)
+	if !ok || len(call.Args) != 1 || !isBuiltin(pkg, call.Fun, "close") {
+		return ""
+	}
+	return i.chanExpr(call.Args[0])
+}
+
+// chanExpr returns the source of e if evaluating it again has no effect
+// (names, fields, index expressions and the like). Otherwise it is empty.
+func (i *instrumenter) chanExpr(e ast.Expr) string {
+	pure := true
+	ast.Inspect(e, func(n ast.Node) bool {
+		switch n.(type) {
+		case nil, *ast.Ident, *ast.SelectorExpr, *ast.IndexExpr, *ast.StarExpr, *ast.ParenExpr, *ast.BasicLit:
+			return true
+		}
+		pure = false
+		return false
+	})
+	if !pure {
+		return ""
+	}
+	return types.ExprString(e)
+}
+
+// afterEnterBlk is where a statement goes to run after the block's EnterBlk
+// (or EnterEdge)
+func afterEnterBlk(body []ast.Stmt) int {
+	if len(body) == 0 {
+		return 0
+	}
+	s, ok := body[0].(*ast.ExprStmt)
+	if !ok {
+		return 0
+	}
+	call, ok := s.X.(*ast.CallExpr)
+	if !ok {
+		return 0
+	}
+	sel, ok := call.Fun.(*ast.SelectorExpr)
+	if !ok || (sel.Sel.Name != "EnterBlk" && sel.Sel.Name != "EnterEdge") {
+		return 0
+	}
+	if pkg, ok := sel.X.(*ast.Ident); !ok || pkg.Name != "dgruntime" {
+		return 0
+	}
+	return 1
+}
+
+func (i *instrumenter) mkChanOp(pos token.Pos, op string, args ...string) ast.Stmt {
+	s := fmt.Sprintf("dgruntime.%v(%v)", op, args[0])
+	if len(args) > 1 {
+		s = fmt.Sprintf("dgruntime.%v(%v, %v)", op, args[0], args[1])
+	}
+	e, err := parser.ParseExprFrom(i.program.Fset, i.program.Fset.File(pos).Name(), s, parser.Mode(0))
+	if err != nil {
+		panic(fmt.Errorf("mkChanOp (%v) error: %v", s, err))
+	}
+	return &ast.ExprStmt{e}
+}
+
+// mkSpawn rewrites a go statement so the new goroutine is linked to the
+// spawning block. The function value and arguments are evaluated by the
+// spawning goroutine as before:
+//
+//	{
+//		__dgf, __dga0 := f, a
+//		__dgspawn := dgruntime.Spawn()
+//		go func() {
+//			dgruntime.Spawned(__dgspawn)
+//			defer dgruntime.SpawnDone()
+//			__dgf(__dga0)
+//		}()
+//	}
+//
+// Functions named by their declaration, function literals, constants and nil
+// are used as they are.
+func (i *instrumenter) mkSpawn(pkg *loader.PackageInfo, g *ast.GoStmt) ast.Stmt {
+	call := g.Call
+	block := &ast.BlockStmt{Lbrace: g.Pos(), Rbrace: g.End()}
+	define := func(lhs, rhs []ast.Expr) {
+		if len(lhs) > 0 {
+			block.List = append(block.List, &ast.AssignStmt{Lhs: lhs, Tok: token.DEFINE, Rhs: rhs})
+		}
+	}
+	var lhs, rhs []ast.Expr
+	fun := call.Fun
+	if captureFunc(pkg, fun) {
+		fun = ast.NewIdent("__dgf")
+		lhs = append(lhs, fun)
+		rhs = append(rhs, call.Fun)
+	}
+	args := make([]ast.Expr, 0, len(call.Args))
+	var tuple *types.Tuple
+	if len(call.Args) == 1 {
+		tuple, _ = pkg.Info.TypeOf(call.Args[0]).(*types.Tuple)
+	}
+	if tuple != nil {
+		// go f(g()) where g has more than one result
+		define(lhs, rhs)
+		lhs, rhs = nil, []ast.Expr{call.Args[0]}
+		for k := 0; k < tuple.Len(); k++ {
+			arg := ast.NewIdent(fmt.Sprintf("__dga%d", k))
+			lhs = append(lhs, arg)
+			args = append(args, arg)
+		}
+	} else {
+		for k, a := range call.Args {
+			if !captureArg(pkg, a) {
+				args = append(args, a)
+				continue
+			}
+			arg := ast.NewIdent(fmt.Sprintf("__dga%d", k))
+			lhs = append(lhs, arg)
+			rhs = append(rhs, a)
+			args = append(args, arg)
+		}
+	}
+	define(lhs, rhs)
+	spawn, err := parser.ParseExprFrom(i.program.Fset, i.program.Fset.File(g.Pos()).Name(), "dgruntime.Spawn()", parser.Mode(0))
+	if err != nil {
+		panic(fmt.Errorf("mkSpawn error: %v", err))
+	}
+	define([]ast.Expr{ast.NewIdent("__dgspawn")}, []ast.Expr{spawn})
+	s := "func() { dgruntime.Spawned(__dgspawn); defer dgruntime.SpawnDone() }()"
+	e, err := parser.ParseExprFrom(i.program.Fset, i.program.Fset.File(g.Pos()).Name(), s, parser.Mode(0))
+	if err != nil {
+		panic(fmt.Errorf("mkSpawn (%v) error: %v", s, err))
+	}
+	goroutine := e.(*ast.CallExpr)
+	body := goroutine.Fun.(*ast.FuncLit).Body
+	body.List = append(body.List, &ast.ExprStmt{&ast.CallExpr{
+		Fun:      fun,
+		Args:     args,
+		Ellipsis: call.Ellipsis,
+	}})
+	block.List = append(block.List, &ast.GoStmt{Go: g.Go, Call: goroutine})
+	return block
+}
+
+// captureFunc reports whether the function value of a go statement has to be
+// evaluated before the goroutine starts. Declared functions, methods
+// expressions, builtins and function literals do not.
+func captureFunc(pkg *loader.PackageInfo, fun ast.Expr) bool {
+	switch f := astutil.Unparen(fun).(type) {
+	case *ast.FuncLit:
+		return false
+	case *ast.Ident:
+		switch pkg.Info.Uses[f].(type) {
+		case *types.Func, *types.Builtin:
+			return false
+		}
+	case *ast.SelectorExpr:
+		if sel, has := pkg.Info.Selections[f]; has {
+			return sel.Kind() != types.MethodExpr
+		}
+		switch pkg.Info.Uses[f.Sel].(type) {
+		case *types.Func, *types.Builtin:
+			return false
+		}
+	}
+	return true
+}
+
+// captureArg reports whether an argument of a go statement has to be
+// evaluated before the goroutine starts. Untyped values (constants, nil)
+// are left in place as their type comes from the parameter.
+func captureArg(pkg *loader.PackageInfo, arg ast.Expr) bool {
+	tv, has := pkg.Info.Types[arg]
+	if !has {
+		return true
+	}
+	if tv.Value != nil || tv.IsNil() {
+		return false
+	}
+	if b, ok := tv.Type.(*types.Basic); ok && b.Info()&types.IsUntyped != 0 {
+		return false
+	}
+	return true
+}
+
+// numGoroutine wraps the program's calls to runtime.NumGoroutine in fnBody in
+// dgruntime.NumGoroutine which takes away dgruntime's own goroutines
+func (i *instrumenter) numGoroutine(pkg *loader.PackageInfo, fnBody []ast.Stmt) {
+	for _, stmt := range fnBody {
+		astutil.Apply(stmt, nil, func(c *astutil.Cursor) bool {
+			call, ok := c.Node().(*ast.CallExpr)
+			if !ok {
+				return true
+			}
+			sel, ok := call.Fun.(*ast.SelectorExpr)
+			if !ok {
+				return true
+			}
+			fn, ok := pkg.Info.Uses[sel.Sel].(*types.Func)
+			if !ok || fn.Pkg() == nil || fn.Pkg().Path() != "runtime" || fn.Name() != "NumGoroutine" {
+				return true
+			}
+			c.Replace(i.mkNumGoroutine(call))
+			return true
+		})
+	}
+}
+
+func (i *instrumenter) mkNumGoroutine(n *ast.CallExpr) ast.Expr {
+	s := "dgruntime.NumGoroutine(0)"
+	e, err := parser.ParseExprFrom(i.program.Fset, i.program.Fset.File(n.Pos()).Name(), s, parser.Mode(0))
+	if err != nil {
+		panic(fmt.Errorf("mkNumGoroutine (%v) error: %v", s, err))
+	}
+	call := e.(*ast.CallExpr)
+	call.Args[0] = n
+	return call
+}
@@ -0,0 +1,170 @@
+package instrument
+
+import (
+	"go/ast"
+	"strings"
+	"testing"
+)
+
+import (
+	"github.com/timtadh/dynagrok/analysis"
+)
+
+// instrumentConcurrency links the goroutines of src's functions and checks
+// the result type checks against dgruntime's concurrency API
+func instrumentConcurrency(t *testing.T, src string) string {
+	i, pkg, f := loadSrc(t, "package test\n"+src+"\n")
+	for _, decl := range f.Decls {
+		if fn, ok := decl.(*ast.FuncDecl); ok {
+			cfg := analysis.BuildCFG(i.program.Fset, "test."+fn.Name.Name, fn, &fn.Body.List)
+			if err := i.concurrency(pkg, cfg, &fn.Body.List); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	return checkInstrumented(t, i, f, runtimeAPI(t, "concurrency.go"))
+}
+
+func TestSpawn(t *testing.T) {
+	for _, c := range []struct {
+		src  string
+		want []string // in the instrumented source
+		not  []string // not in the instrumented source
+	}{
+		{
+			// declared functions and constants are used as they are
+			src: `func f(int, string) {}
+func g(x int) { go f(x, "a") }`,
+			want: []string{
+				`__dga0 := x`,
+				`__dgspawn := dgruntime.Spawn()`,
+				`go func() { dgruntime.Spawned(__dgspawn)`,
+				`defer dgruntime.SpawnDone()`,
+				`f(__dga0, "a") }()`,
+			},
+			not: []string{`__dgf`, `__dga1`},
+		},
+		{
+			// a function value is evaluated before the goroutine starts
+			src: `func g(fs []func(int)) { i := 0; go fs[i](i) }`,
+			want: []string{
+				`__dgf, __dga0 := fs[i], i`,
+				`__dgf(__dga0)`,
+			},
+		},
+		{
+			// as is the receiver of a method value
+			src: `type T struct{}
+func (T) m() {}
+func g(ts []T) { go ts[0].m() }`,
+			want: []string{`__dgf := ts[0].m`, `__dgf()`},
+		},
+		{
+			// method expressions and function literals are not
+			src: `type T struct{}
+func (T) m() {}
+func g(t T) { go T.m(t); go func() {}() }`,
+			want: []string{`T.m(__dga0)`, `func() {}()`},
+			not:  []string{`__dgf`},
+		},
+		{
+			// the results of a call with more than one
+			src: `func two() (int, string) { return 1, "a" }
+func f(int, string) {}
+func g() { go f(two()) }`,
+			want: []string{
+				`__dga0, __dga1 := two()`,
+				`f(__dga0, __dga1)`,
+			},
+		},
+		{
+			src: `func f(x ...int) {}
+func g(xs []int) { go f(xs...) }`,
+			want: []string{`__dga0 := xs`, `f(__dga0...)`},
+		},
+		{
+			// a labeled go statement keeps its label
+			src: `func f() {}
+func g() {
+L:
+	go f()
+	goto L
+}`,
+			want: []string{`L: { __dgspawn := dgruntime.Spawn()`, `goto L`},
+		},
+	} {
+		out := instrumentConcurrency(t, c.src)
+		for _, w := range c.want {
+			if !strings.Contains(squash(out), squash(w)) {
+				t.Errorf("%v missing from\n%v", w, out)
+			}
+		}
+		for _, n := range c.not {
+			if strings.Contains(squash(out), squash(n)) {
+				t.Errorf("unexpected %v in\n%v", n, out)
+			}
+		}
+	}
+}
+
+func TestChanOps(t *testing.T) {
+	for _, c := range []struct {
+		src  string
+		want []string // in the instrumented source
+		not  []string // not in the instrumented source
+	}{
+		{
+			src: `func f(ch chan int) { ch <- 1; <-ch; x := <-ch; x, ok := <-ch; _, _ = x, ok; close(ch) }`,
+			want: []string{
+				`ch <- 1 dgruntime.Send(ch)`,
+				`<-ch dgruntime.Recv(ch)`,
+				`x := <-ch dgruntime.Recv(ch)`,
+				`x, ok := <-ch dgruntime.RecvOk(ch, ok)`,
+				`dgruntime.Close(ch) close(ch)`,
+			},
+		},
+		{
+			// the channel is evaluated a second time, so not if it calls
+			src: `func get() chan int { return nil }
+func f() { get() <- 1; <-get() }
+func g(ch chan int) { <-ch }`,
+			want: []string{`dgruntime.Recv(ch)`},
+			not:  []string{`dgruntime.Send`, `dgruntime.Recv(get())`},
+		},
+		{
+			src: `func f(a, b chan int) {
+	select {
+	case a <- 1:
+		println()
+	case v, ok := <-b:
+		_, _ = v, ok
+	}
+	for v := range a {
+		_ = v
+	}
+}`,
+			want: []string{
+				`case a <- 1: dgruntime.Send(a) println()`,
+				`case v, ok := <-b: dgruntime.RecvOk(b, ok)`,
+				`for v := range a { dgruntime.Recv(a)`,
+			},
+		},
+		{
+			// a labeled receive is reported after it
+			src:  `func f(ch chan int) { L: <-ch; goto L }`,
+			want: []string{`L: <-ch dgruntime.Recv(ch)`},
+		},
+	} {
+		out := instrumentConcurrency(t, c.src)
+		for _, w := range c.want {
+			if !strings.Contains(squash(out), squash(w)) {
+				t.Errorf("%v missing from\n%v", w, out)
+			}
+		}
+		for _, n := range c.not {
+			if strings.Contains(squash(out), squash(n)) {
+				t.Errorf("unexpected %v in\n%v", n, out)
+			}
+		}
+	}
+}
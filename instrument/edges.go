@@ -0,0 +1,501 @@
+package instrument
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"strconv"
+)
+
+import (
+	"github.com/timtadh/data-structures/errors"
+)
+
+import (
+	"github.com/timtadh/dynagrok/analysis"
+)
+
+// edges places the probes of the edge granularity. Each edge of the CFG is
+// recorded by a probe on the edge naming both of its blocks:
+//
+//   - a condition is wrapped by dgruntime.EnterEdgeIf, it enters the block
+//     the outcome leads to,
+//   - a block falling into the next one is probed by dgruntime.EnterEdge at
+//     its end, a break, continue, goto or fallthrough before it,
+//   - the edges from a switch (type switch, select) to its cases are probed
+//     at the head of each case, the ones from a range loop's header at the
+//     head of its body and after the loop, the one from a loop's post
+//     statement back to its header in the loop's condition (or at the head
+//     of its body).
+//
+// The fallthroughs, breaks and loop entries which jump onto the probe of
+// another edge name their own edge to it first (dgruntime.EdgeFrom).
+type edges struct {
+	*probes
+	fnAst    ast.Node
+	fnBody   *[]ast.Stmt
+	pos      []token.Pos // where each block starts
+	inits    map[ast.Stmt]*ast.ForStmt
+	headers  map[*ast.ForStmt]*analysis.Block
+	fromPost map[*analysis.Block]bool // the headers entered from their post statement
+	onto     map[*ast.BranchStmt]bool // the branches jumping onto the probe of another edge
+	labeled  map[string]ast.Stmt
+	heads    []probe
+	tails    []probe
+	gotos    []probe
+}
+
+func newEdges(i *instrumenter, cfg *analysis.CFG, fnAst ast.Node, fnBody *[]ast.Stmt) *edges {
+	e := &edges{
+		probes:   newProbes(i, cfg, fnBody),
+		fnAst:    fnAst,
+		fnBody:   fnBody,
+		pos:      make([]token.Pos, len(cfg.Blocks)),
+		inits:    make(map[ast.Stmt]*ast.ForStmt),
+		headers:  make(map[*ast.ForStmt]*analysis.Block),
+		fromPost: make(map[*analysis.Block]bool),
+		onto:     make(map[*ast.BranchStmt]bool),
+		labeled:  make(map[string]ast.Stmt),
+	}
+	for _, b := range cfg.Blocks {
+		switch {
+		case len(b.Stmts) > 0:
+			e.pos[b.Id] = (*b.Stmts[0]).Pos()
+		case b.Cond != nil:
+			e.pos[b.Id] = (*b.Cond).Pos()
+		default:
+			e.pos[b.Id] = fnAst.End()
+		}
+		if len(b.Stmts) > 0 {
+			if loop, ok := (*b.Stmts[0]).(*ast.ForStmt); ok {
+				e.headers[loop] = b
+				e.fromPost[b] = loop.Post != nil
+			}
+		}
+	}
+	var stack []ast.Node
+	for _, s := range *fnBody {
+		ast.Inspect(s, func(n ast.Node) bool {
+			if n == nil {
+				stack = stack[:len(stack)-1]
+				return true
+			}
+			switch x := n.(type) {
+			case *ast.FuncLit:
+				return false
+			case *ast.ForStmt:
+				if x.Init != nil {
+					e.inits[x.Init] = x
+				}
+			case *ast.LabeledStmt:
+				e.labeled[x.Label.Name] = x.Stmt
+			case *ast.BranchStmt:
+				e.onto[x] = jumpsOntoProbe(x, stack)
+			}
+			stack = append(stack, n)
+			return true
+		})
+	}
+	return e
+}
+
+// jumpsOntoProbe reports whether the break or fallthrough (inside the
+// statements of the stack) jumps onto a probe: the one of the edge leaving
+// a range loop or of the edge from a switch to its case.
+func jumpsOntoProbe(branch *ast.BranchStmt, stack []ast.Node) bool {
+	for j := len(stack) - 1; j >= 0; j-- {
+		switch x := stack[j].(type) {
+		case *ast.SwitchStmt:
+			if branch.Tok == token.FALLTHROUGH {
+				return x.Tag != nil
+			}
+		case *ast.RangeStmt, *ast.ForStmt, *ast.TypeSwitchStmt, *ast.SelectStmt:
+		default:
+			continue
+		}
+		if branch.Tok != token.BREAK {
+			continue
+		}
+		if branch.Label != nil {
+			if j == 0 {
+				continue
+			}
+			if l, ok := stack[j-1].(*ast.LabeledStmt); !ok || l.Label.Name != branch.Label.Name {
+				continue
+			}
+		}
+		_, ok := stack[j].(*ast.RangeStmt)
+		return ok
+	}
+	return false
+}
+
+// edgeProbes places a probe on each edge of the function's CFG (see edges)
+func (i *instrumenter) edgeProbes(cfg *analysis.CFG, fnAst ast.Node, fnBody *[]ast.Stmt) error {
+	e := newEdges(i, cfg, fnAst, fnBody)
+	// the conditions are wrapped first as the probe of a post statement goes
+	// around its loop's condition
+	for _, b := range cfg.Blocks {
+		if isCond(b) {
+			e.cond(b)
+		}
+	}
+	for _, b := range cfg.Blocks {
+		if isCond(b) {
+			continue
+		}
+		for _, f := range b.Next {
+			if f.Block == nil || (isExit(f.Block) && hasResults(cfg)) {
+				continue
+			}
+			if err := e.edge(b, f); err != nil {
+				return err
+			}
+		}
+	}
+	// The probes at the head of an edge go in first so the ones before
+	// the same statement end up after them.
+	e.todo = append(append(append(e.todo, e.heads...), e.tails...), e.gotos...)
+	if err := e.insert(); err != nil {
+		return err
+	}
+	return i.checkEdges(cfg, fnBody)
+}
+
+// isCond reports whether the block ends by evaluating a condition
+func isCond(b *analysis.Block) bool {
+	if b.Cond == nil || len(b.Next) != 2 {
+		return false
+	}
+	for _, f := range b.Next {
+		if f.Type != analysis.True && f.Type != analysis.False {
+			return false
+		}
+	}
+	return true
+}
+
+func (e *edges) cond(b *analysis.Block) {
+	var t, f *analysis.Block
+	for _, flow := range b.Next {
+		if flow.Type == analysis.True {
+			t = flow.Block
+		} else {
+			f = flow.Block
+		}
+	}
+	*b.Cond = e.i.mkEnterEdgeIf(b.Id, t.Id, f.Id, e.pos[t.Id], e.pos[f.Id], *b.Cond)
+}
+
+// edge places the probe of the edge f from the block src
+func (e *edges) edge(src *analysis.Block, f *analysis.Flow) error {
+	dst := f.Block
+	if len(src.Stmts) == 0 {
+		// the entry block falls into the function's first statement
+		e.tail(src, dst, e.fnBody, first(*e.fnBody), e.intoLoop(dst, first(*e.fnBody)))
+		return nil
+	}
+	last := *src.Stmts[len(src.Stmts)-1]
+	switch f.Type {
+	case analysis.Range:
+		loop := last.(*ast.RangeStmt)
+		e.head(src, dst, &loop.Body.List, first(loop.Body.List))
+	case analysis.RangeExit:
+		list, next := e.after(last)
+		if list == nil {
+			return errors.Errorf("no statement list holds the range loop of block %d of %v", src.Id, e.cfg.Name)
+		}
+		e.head(src, dst, list, next)
+	case analysis.Switch, analysis.TypeSwitch:
+		clause := caseOf(last, f.Cases)
+		e.head(src, dst, &clause.Body, first(clause.Body))
+	case analysis.Select:
+		for _, s := range last.(*ast.SelectStmt).Body.List {
+			if comm := s.(*ast.CommClause); (comm.Comm == nil && f.Comm == nil) || (f.Comm != nil && *f.Comm == comm.Comm) {
+				e.head(src, dst, &comm.Body, first(comm.Body))
+			}
+		}
+	case analysis.Unconditional:
+		return e.fall(src, dst, last)
+	default:
+		return errors.Errorf("unexpected flow %v from block %d of %v", f, src.Id, e.cfg.Name)
+	}
+	return nil
+}
+
+// fall places the probe of the unconditional edge from src (ending with the
+// statement last) to dst
+func (e *edges) fall(src, dst *analysis.Block, last ast.Stmt) error {
+	switch x := last.(type) {
+	case *ast.BranchStmt:
+		onto := e.onto[x]
+		if x.Tok == token.GOTO {
+			onto = e.intoLoop(dst, e.labeled[x.Label.Name])
+		}
+		return e.ahead(src, dst, x, onto)
+	case *ast.ForStmt:
+		// a loop without a condition runs its body
+		e.tail(src, dst, &x.Body.List, first(x.Body.List), false)
+		return nil
+	case *ast.SwitchStmt:
+		// a switch without a tag or cases but a default one
+		clause := caseOf(x, nil)
+		e.head(src, dst, &clause.Body, first(clause.Body))
+		return nil
+	}
+	if loop, has := e.inits[last]; has {
+		// the init statement is run by the loop, the edge to its header is
+		// probed before the loop
+		onto := e.intoLoop(dst, loop)
+		if err := e.ahead(src, dst, loop, onto); err != nil {
+			return err
+		}
+		return e.gotoLoop(src, dst, loop, onto)
+	} else if loop, has := e.posts[last]; has {
+		// back to the condition
+		if e.headers[loop] != dst {
+			return errors.Errorf("the post statement of block %d of %v does not go back to its loop", src.Id, e.cfg.Name)
+		}
+		if loop.Cond != nil {
+			loop.Cond = e.i.mkEnterEdgeCond(src.Id, dst.Id, e.pos[dst.Id], loop.Cond)
+		} else {
+			e.head(src, dst, &loop.Body.List, first(loop.Body.List))
+		}
+		return nil
+	} else if clause, has := e.comms[last]; has {
+		e.tail(src, dst, &clause.Body, first(clause.Body), false)
+		return nil
+	}
+	list, next := e.after(last)
+	if list == nil {
+		return errors.Errorf("no statement list holds the end of block %d of %v", src.Id, e.cfg.Name)
+	}
+	e.tail(src, dst, list, next, e.intoLoop(dst, next))
+	return nil
+}
+
+// intoLoop reports whether the statement s is a loop with the header dst
+// which is probed at its head (see fall) so the edges running into it name
+// themselves ahead
+func (e *edges) intoLoop(dst *analysis.Block, s ast.Stmt) bool {
+	for l, ok := s.(*ast.LabeledStmt); ok; l, ok = s.(*ast.LabeledStmt) {
+		s = l.Stmt
+	}
+	loop, ok := s.(*ast.ForStmt)
+	return ok && e.headers[loop] == dst && e.fromPost[dst]
+}
+
+// gotoLoop probes the edge from the block src (a label on a loop running
+// its init statement) to the loop's header before the gotos jumping to the
+// label. They jump past the probe placed before the loop.
+func (e *edges) gotoLoop(src, dst *analysis.Block, loop *ast.ForStmt, onto bool) error {
+	for _, f := range src.Prev {
+		if len(f.Block.Stmts) == 0 {
+			continue
+		}
+		branch, ok := (*f.Block.Stmts[len(f.Block.Stmts)-1]).(*ast.BranchStmt)
+		if !ok || branch.Tok != token.GOTO || e.labeled[branch.Label.Name] != ast.Stmt(loop) {
+			continue
+		}
+		list, has := e.lists[branch]
+		if !has {
+			return errors.Errorf("no statement list holds the goto of block %d of %v", f.Block.Id, e.cfg.Name)
+		}
+		e.gotos = append(e.gotos, probe{blk: f.Block, list: list, before: branch, stmt: e.mkEdge(src, dst, onto)})
+	}
+	return nil
+}
+
+// head probes the edge from src to dst before the statement next of list
+// (at its end when next is nil)
+func (e *edges) head(src, dst *analysis.Block, list *[]ast.Stmt, next ast.Stmt) {
+	e.heads = append(e.heads, probe{blk: dst, list: list, before: next, stmt: e.mkEdge(src, dst, false)})
+}
+
+// tail probes the edge from src to dst at the end of src: before the
+// statement next of list (at its end when next is nil). When onto is true
+// the edge names itself for the probe control reaches next.
+func (e *edges) tail(src, dst *analysis.Block, list *[]ast.Stmt, next ast.Stmt, onto bool) {
+	e.tails = append(e.tails, probe{blk: src, list: list, before: next, stmt: e.mkEdge(src, dst, onto)})
+}
+
+// ahead probes the edge from src to dst before the statement s
+func (e *edges) ahead(src, dst *analysis.Block, s ast.Stmt, onto bool) error {
+	list, has := e.lists[s]
+	if !has {
+		return errors.Errorf("no statement list holds the end of block %d of %v", src.Id, e.cfg.Name)
+	}
+	e.tail(src, dst, list, s, onto)
+	return nil
+}
+
+// after is the list holding the statement s and the statement following it
+// (nil at the end of the list)
+func (e *edges) after(s ast.Stmt) (*[]ast.Stmt, ast.Stmt) {
+	list, has := e.lists[s]
+	if !has {
+		return nil, nil
+	}
+	j := indexOf(*list, s)
+	if j < 0 || j+1 >= len(*list) {
+		return list, nil
+	}
+	return list, (*list)[j+1]
+}
+
+func (e *edges) mkEdge(src, dst *analysis.Block, onto bool) ast.Stmt {
+	if onto {
+		return e.i.mkEdgeFrom(e.fnAst.Pos(), src.Id, dst.Id)
+	}
+	return e.i.mkEnterEdge(e.pos[dst.Id], src.Id, dst.Id)
+}
+
+// caseOf is the case of the switch (or type switch) stmt with the
+// expressions cases (the default case for nil). A default case is added to
+// a switch without one for the edge taken when no case matches.
+func caseOf(stmt ast.Stmt, cases *[]ast.Expr) *ast.CaseClause {
+	var body *ast.BlockStmt
+	switch x := stmt.(type) {
+	case *ast.SwitchStmt:
+		body = x.Body
+	case *ast.TypeSwitchStmt:
+		body = x.Body
+	}
+	for _, s := range body.List {
+		clause := s.(*ast.CaseClause)
+		if (cases == nil && clause.List == nil) || (cases != nil && cases == &clause.List) {
+			return clause
+		}
+	}
+	clause := &ast.CaseClause{Case: body.Rbrace, Colon: body.Rbrace}
+	body.List = append(body.List, clause)
+	return clause
+}
+
+// first is the first statement of the list (nil if it is empty)
+func first(list []ast.Stmt) ast.Stmt {
+	if len(list) == 0 {
+		return nil
+	}
+	return list[0]
+}
+
+// checkEdges verifies that every edge of the function's CFG is probed and
+// that the probes name edges of the CFG
+func (i *instrumenter) checkEdges(cfg *analysis.CFG, fnBody *[]ast.Stmt) error {
+	probed := make(map[[2]int]bool)
+	for _, s := range *fnBody {
+		ast.Inspect(s, func(n ast.Node) bool {
+			switch x := n.(type) {
+			case *ast.FuncLit:
+				// instrumented as a function of its own
+				return false
+			case *ast.CallExpr:
+				for _, edge := range probedEdges(x) {
+					probed[edge] = true
+				}
+			}
+			return true
+		})
+	}
+	edges := make(map[[2]int]bool)
+	for _, b := range cfg.Blocks {
+		for _, f := range b.Next {
+			if f.Block == nil || (isExit(f.Block) && hasResults(cfg)) {
+				continue
+			}
+			edge := [2]int{b.Id, f.Block.Id}
+			if !probed[edge] {
+				return errors.Errorf("the edge from block %d to %d of %v has no probe", edge[0], edge[1], cfg.Name)
+			}
+			edges[edge] = true
+		}
+	}
+	for edge := range probed {
+		if edges[edge] {
+			continue
+		}
+		return errors.Errorf("a probe of %v names the edge from block %d to %d which is not in its CFG", cfg.Name, edge[0], edge[1])
+	}
+	return nil
+}
+
+// probedEdges are the edges (source and destination blocks) named by a
+// call to dgruntime.EnterEdge, EnterEdgeFromCond, EnterEdgeIf or EdgeFrom
+func probedEdges(call *ast.CallExpr) [][2]int {
+	sel, ok := call.Fun.(*ast.SelectorExpr)
+	if !ok {
+		return nil
+	}
+	if pkg, ok := sel.X.(*ast.Ident); !ok || pkg.Name != "dgruntime" {
+		return nil
+	}
+	ids := make([]int, 0, 3)
+	for _, arg := range call.Args {
+		lit, ok := arg.(*ast.BasicLit)
+		if !ok || lit.Kind != token.INT {
+			break
+		}
+		id, err := strconv.Atoi(lit.Value)
+		if err != nil {
+			return nil
+		}
+		ids = append(ids, id)
+	}
+	switch {
+	case (sel.Sel.Name == "EnterEdge" || sel.Sel.Name == "EnterEdgeFromCond" || sel.Sel.Name == "EdgeFrom") && len(ids) >= 2:
+		return [][2]int{{ids[0], ids[1]}}
+	case sel.Sel.Name == "EnterEdgeIf" && len(ids) >= 3:
+		return [][2]int{{ids[0], ids[1]}, {ids[0], ids[2]}}
+	}
+	return nil
+}
+
+func (i *instrumenter) mkEnterEdge(pos token.Pos, src, dst int) ast.Stmt {
+	s := fmt.Sprintf("dgruntime.EnterEdge(%d, %d, %v)", src, dst, strconv.Quote(i.program.Fset.Position(pos).String()))
+	e, err := parser.ParseExprFrom(i.program.Fset, i.program.Fset.File(pos).Name(), s, parser.Mode(0))
+	if err != nil {
+		panic(fmt.Errorf("mkEnterEdge (%v) error: %v", s, err))
+	}
+	return &ast.ExprStmt{e}
+}
+
+func (i *instrumenter) mkEdgeFrom(pos token.Pos, src, dst int) ast.Stmt {
+	s := fmt.Sprintf("dgruntime.EdgeFrom(%d, %d)", src, dst)
+	e, err := parser.ParseExprFrom(i.program.Fset, i.program.Fset.File(pos).Name(), s, parser.Mode(0))
+	if err != nil {
+		panic(fmt.Errorf("mkEdgeFrom (%v) error: %v", s, err))
+	}
+	return &ast.ExprStmt{e}
+}
+
+// mkEnterEdgeCond puts the probe of the edge from src to dst in front of
+// the condition cond
+func (i *instrumenter) mkEnterEdgeCond(src, dst int, pos token.Pos, cond ast.Expr) ast.Expr {
+	s := fmt.Sprintf("dgruntime.EnterEdgeFromCond(%d, %d, %v)", src, dst, strconv.Quote(i.program.Fset.Position(pos).String()))
+	enter, err := parser.ParseExprFrom(i.program.Fset, i.program.Fset.File(cond.Pos()).Name(), s, parser.Mode(0))
+	if err != nil {
+		panic(fmt.Errorf("mkEnterEdgeCond (%v) error: %v", s, err))
+	}
+	return &ast.BinaryExpr{
+		X:     enter,
+		Y:     cond,
+		Op:    token.LAND,
+		OpPos: cond.Pos(),
+	}
+}
+
+// mkEnterEdgeIf wraps the condition cond of the block src in the probe of
+// its edges to t and f (starting at tpos and fpos)
+func (i *instrumenter) mkEnterEdgeIf(src, t, f int, tpos, fpos token.Pos, cond ast.Expr) ast.Expr {
+	s := fmt.Sprintf("dgruntime.EnterEdgeIf(%d, %d, %d, %v, %v, true)", src, t, f,
+		strconv.Quote(i.program.Fset.Position(tpos).String()), strconv.Quote(i.program.Fset.Position(fpos).String()))
+	e, err := parser.ParseExprFrom(i.program.Fset, i.program.Fset.File(cond.Pos()).Name(), s, parser.Mode(0))
+	if err != nil {
+		panic(fmt.Errorf("mkEnterEdgeIf (%v) error: %v", s, err))
+	}
+	call := e.(*ast.CallExpr)
+	call.Args[len(call.Args)-1] = cond
+	return call
+}
@@ -0,0 +1,171 @@
+package instrument
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+import (
+	"github.com/timtadh/dynagrok/analysis"
+	"github.com/timtadh/dynagrok/dgruntime/dgtypes"
+)
+
+// positions matches the source positions the probes are given
+var positions = regexp.MustCompile(`, "test.go:\d+:\d+"`)
+
+func TestEdgeProbes(t *testing.T) {
+	api := runtimeAPI(t, "dgruntime.go", "concurrency.go")
+	for _, c := range []struct {
+		src  string
+		want []string
+	}{
+		{
+			// the loop is entered onto the probe of the edge from its post
+			// statement, the continue goes to the post statement
+			src: `func f(n int) { for i := 0; i < n; i++ { if i == 2 { continue }; g() } }`,
+			want: []string{
+				`dgruntime.EdgeFrom(0, 1)
+				for i := 0; dgruntime.EnterEdgeFromCond(4, 1) && dgruntime.EnterEdgeIf(1, 3, 2, i < n); i++ {`,
+				`dgruntime.EnterEdge(5, 4)
+				continue`,
+				`g()
+				dgruntime.EnterEdge(6, 4)
+				}`,
+			},
+		},
+		{
+			// the break leaves onto the probe of the loop's exit
+			src: `func f(xs []int) { for _, x := range xs { if x > 0 { break }; g() }; g() }`,
+			want: []string{
+				`dgruntime.EnterEdge(0, 1)
+				for _, x := range xs {
+				dgruntime.EnterEdge(1, 2)`,
+				`dgruntime.EdgeFrom(4, 3)
+				break`,
+				`g()
+				dgruntime.EnterEdge(5, 1)
+				}
+				dgruntime.EnterEdge(1, 3)
+				g()`,
+			},
+		},
+		{
+			// the fallthrough falls onto the probe of the next case, the
+			// edge taken when no case matches goes in a default case
+			src: `func f(x int) { switch x { case 1: g(); fallthrough; case 2: g() }; g() }`,
+			want: []string{
+				`case 1:
+				dgruntime.EnterEdge(0, 2)
+				g()
+				dgruntime.EdgeFrom(2, 3)
+				fallthrough`,
+				`case 2:
+				dgruntime.EnterEdge(0, 3)
+				g()
+				dgruntime.EnterEdge(3, 1)`,
+				`default:
+				dgruntime.EnterEdge(0, 1)
+				}`,
+			},
+		},
+		{
+			src: `func f(ch chan int) { select { case <-ch: g(); case ch <- 1: break; default: }; g() }`,
+			want: []string{
+				`case <-ch:
+				dgruntime.EnterEdge(0, 2)
+				dgruntime.Recv(ch)
+				g()
+				dgruntime.EnterEdge(2, 1)`,
+				`case ch <- 1:
+				dgruntime.EnterEdge(0, 3)
+				dgruntime.Send(ch)
+				dgruntime.EnterEdge(3, 1)
+				break`,
+				`default:
+				dgruntime.EnterEdge(0, 1)
+				}`,
+			},
+		},
+		{
+			// the goto jumps past the probes before the label
+			src: `func f(n int) { i := 0; L: for i = 0; i < n; i++ { g() }; if n > i { goto L } }`,
+			want: []string{
+				`i := 0
+				dgruntime.EnterEdge(0, 1)
+				dgruntime.EdgeFrom(1, 2)
+				L:
+				for i = 0; dgruntime.EnterEdgeFromCond(5, 2) && dgruntime.EnterEdgeIf(2, 4, 3, i < n); i++ {`,
+				`dgruntime.EnterEdge(6, 1)
+				dgruntime.EdgeFrom(1, 2)
+				goto L`,
+			},
+		},
+		{
+			src:  `func f(a, b bool) { if a && b { g() } }`,
+			want: []string{`if dgruntime.EnterEdgeIf(0, 3, 2, a) && dgruntime.EnterEdgeIf(3, 1, 2, b) {`},
+		},
+		{
+			// a loop without a condition enters its body from its post
+			// statement at the head of the body
+			src: `func f(n int) { for i := 0; ; i++ { if i > n { return } } }`,
+			want: []string{
+				`dgruntime.EdgeFrom(0, 1)
+				for i := 0; ; i++ {
+				dgruntime.EnterEdge(2, 1)
+				if dgruntime.EnterEdgeIf(1, 3, 2, i > n) {
+				return`,
+			},
+		},
+	} {
+		i, pkg, f := loadSrc(t, "package test\nfunc g() {}\n"+c.src+"\n")
+		i.granularity = dgtypes.EdgeGranularity
+		fn := f.Decls[len(f.Decls)-1].(*ast.FuncDecl)
+		if err := i.fnBody(pkg, "test.f", fn, &fn.Body.List); err != nil {
+			t.Errorf("%v: %v", c.src, err)
+			continue
+		}
+		out := checkInstrumented(t, i, f, api)
+		got := squash(positions.ReplaceAllString(out, ""))
+		for _, want := range c.want {
+			if !strings.Contains(got, squash(want)) {
+				t.Errorf("%v: %v missing from\n%v", c.src, want, out)
+			}
+		}
+		if strings.Contains(got, "dgruntime.EnterBlk") {
+			t.Errorf("%v: unexpected block probe in\n%v", c.src, out)
+		}
+	}
+}
+
+func TestCheckEdges(t *testing.T) {
+	for _, c := range []struct {
+		src string
+		ok  bool
+	}{
+		{`func f() { g() }`, true},
+		{`func f(c bool) { if c { g() } }`, false},
+		{`func f(c bool) { if dgruntime.EnterEdgeIf(0, 1, 2, "", "", c) { g(); dgruntime.EnterEdge(1, 2, "") } }`, true},
+		// the edge from the body of the if is missing
+		{`func f(c bool) { if dgruntime.EnterEdgeIf(0, 1, 2, "", "", c) { g() } }`, false},
+		// there is no edge from the exit
+		{`func f(c bool) { if dgruntime.EnterEdgeIf(0, 1, 2, "", "", c) { g(); dgruntime.EdgeFrom(1, 2) }; dgruntime.EnterEdge(2, 1, "") }`, false},
+		// the exit block of a function with results is never entered
+		{`func f(c bool) int { if dgruntime.EnterEdgeIf(0, 1, 2, "", "", c) { return 1 }; return 2 }`, true},
+	} {
+		fset := token.NewFileSet()
+		f, err := parser.ParseFile(fset, "test.go", "package test\n"+c.src, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fn := f.Decls[0].(*ast.FuncDecl)
+		cfg := analysis.BuildCFG(fset, "test.f", fn, &fn.Body.List)
+		i := &instrumenter{}
+		if err := i.checkEdges(cfg, &fn.Body.List); (err == nil) != c.ok {
+			t.Errorf("%v: checkEdges gave %v", c.src, err)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package instrument
+
+import (
+	"bytes"
+	"go/ast"
+	"go/parser"
+	"go/printer"
+	"strings"
+	"testing"
+)
+
+import (
+	"github.com/timtadh/dynagrok/dgruntime/dgtypes"
+)
+
+// instrumentSrc instruments the functions of src at the granularity and
+// prints the result
+func instrumentSrc(t *testing.T, src, granularity string) string {
+	i, pkg, f := loadSrc(t, "package test\n"+src+"\n")
+	i.granularity = granularity
+	for _, decl := range f.Decls {
+		if fn, ok := decl.(*ast.FuncDecl); ok {
+			if err := i.fnBody(pkg, "test."+fn.Name.Name, fn, &fn.Body.List); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	var buf bytes.Buffer
+	if err := printer.Fprint(&buf, i.program.Fset, f); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func TestGranularity(t *testing.T) {
+	src := `func f(c bool) int {
+	x := 0
+	if c {
+		x = 1
+	}
+	return x
+}`
+	for _, c := range []struct {
+		granularity string
+		want        []string
+		not         []string
+	}{
+		{
+			granularity: dgtypes.FuncGranularity,
+			want:        []string{`dgruntime.EnterFunc("test.f", "test.go:2:1", dgruntime.NoCFG, dgruntime.NoIPDom)`},
+			not:         []string{`dgruntime.EnterBlk`, `dgruntime.EnterEdge`, `__cfg`},
+		},
+		{
+			granularity: dgtypes.BlockGranularity,
+			want:        []string{`dgruntime.EnterBlk(1, "test.go:5:3")`, `dgruntime.EnterBlk(2, "test.go:7:2")`},
+			not:         []string{`dgruntime.EnterEdge`},
+		},
+		{
+			// the condition names both of its edges, the body of the if
+			// its edge to the return
+			granularity: dgtypes.EdgeGranularity,
+			want: []string{
+				`if dgruntime.EnterEdgeIf(0, 1, 2, "test.go:5:3", "test.go:7:2", c) {`,
+				`x = 1
+		dgruntime.EnterEdge(1, 2, "test.go:7:2")`,
+			},
+			not: []string{`dgruntime.EnterBlk`, `dgruntime.EnterEdge(-1`},
+		},
+	} {
+		out := instrumentSrc(t, src, c.granularity)
+		for _, want := range c.want {
+			if !strings.Contains(squash(out), squash(want)) {
+				t.Errorf("%v: %v missing from\n%v", c.granularity, want, out)
+			}
+		}
+		for _, not := range c.not {
+			if strings.Contains(squash(out), squash(not)) {
+				t.Errorf("%v: unexpected %v in\n%v", c.granularity, not, out)
+			}
+		}
+	}
+}
+
+func TestProbeId(t *testing.T) {
+	for _, c := range []struct {
+		src string
+		id  int
+		ok  bool
+	}{
+		{`dgruntime.EnterBlk(3, "a.go:1:1")`, 3, true},
+		{`dgruntime.EnterBlkFromCond(4, "a.go:1:1")`, 4, true},
+		{`dgruntime.EnterEdge(2, 5, "a.go:1:1")`, 0, false},
+		{`dgruntime.EnterFunc("f", "a.go:1:1", nil, nil)`, 0, false},
+		{`other.EnterBlk(3, "a.go:1:1")`, 0, false},
+	} {
+		e, err := parser.ParseExpr(c.src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		id, ok := probeId(e.(*ast.CallExpr))
+		if id != c.id || ok != c.ok {
+			t.Errorf("%v: got %v, %v expected %v, %v", c.src, id, ok, c.id, c.ok)
+		}
+	}
+}
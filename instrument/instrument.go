@@ -14,6 +14,7 @@ import (
 
 	"github.com/timtadh/data-structures/errors"
 	"github.com/timtadh/dynagrok/analysis"
+	"github.com/timtadh/dynagrok/dgruntime/dgtypes"
 	"github.com/timtadh/dynagrok/dgruntime/excludes"
 	"golang.org/x/tools/go/ast/astutil"
 	"golang.org/x/tools/go/loader"
@@ -23,21 +24,96 @@ type instrumenter struct {
 	program     *loader.Program
 	entry       string
 	currentFile *ast.File
+	cache       *Cache
+	policy      *excludes.Policy
+	tests       bool
+	predicates  bool
+	changed     map[string]bool
+	granularity string
 }
 
-func Instrument(entryPkgName string, program *loader.Program) (err error) {
+// Option configures the instrumenter
+type Option func(i *instrumenter)
+
+// Cached skips the packages whose instrumented output is already held by the
+// build cache.
+func Cached(c *Cache) Option {
+	return func(i *instrumenter) {
+		i.cache = c
+	}
+}
+
+// Policy restricts instrumentation to the packages and functions the policy
+// allows. The entry package's main function is always instrumented as it
+// starts and stops the profiler.
+func Policy(p *excludes.Policy) Option {
+	return func(i *instrumenter) {
+		i.policy = p
+	}
+}
+
+// Tests instruments the entry package's tests in stead of a main function.
+// The program must have been loaded with cmd.LoadTestPkg. Each TestXxx
+// function is profiled as a separate segment (see dgruntime.BeginTest) and
+// the profiler is shut down when testing.M.Run returns.
+func Tests() Option {
+	return func(i *instrumenter) {
+		i.tests = true
+	}
+}
+
+// Predicates records the outcomes of branch conditions and how the operands
+// of comparisons relate (see dgruntime/predicates.go).
+func Predicates() Option {
+	return func(i *instrumenter) {
+		i.predicates = true
+	}
+}
+
+// Changed instruments the functions named in changed fully and gives the
+// others an entry probe alone (dgruntime.EnterFunc and ExitFunc): no block
+// probes, predicates or channel operations. See ChangedFunctions.
+func Changed(changed map[string]bool) Option {
+	return func(i *instrumenter) {
+		i.changed = changed
+	}
+}
+
+// Granularity sets what the probes record: dgtypes.FuncGranularity (function
+// entries and calls alone, the functions get no block probes, predicates or
+// channel operations), dgtypes.BlockGranularity (the default) or
+// dgtypes.EdgeGranularity (a probe on each edge of the CFG names the edge,
+// see edgeProbes).
+func Granularity(granularity string) Option {
+	return func(i *instrumenter) {
+		i.granularity = granularity
+	}
+}
+
+func Instrument(entryPkgName string, program *loader.Program, opts ...Option) (err error) {
 	entry := program.Package(entryPkgName)
 	if entry == nil {
 		return errors.Errorf("The entry package was not found in the loaded program")
 	}
-	if entry.Pkg.Name() != "main" {
+	i := &instrumenter{
+		program:     program,
+		entry:       entryPkgName,
+		granularity: dgtypes.BlockGranularity,
+	}
+	for _, opt := range opts {
+		opt(i)
+	}
+	if entry.Pkg.Name() != "main" && !i.tests {
 		return errors.Errorf("The entry package was not main")
 	}
-	i := &instrumenter{
-		program: program,
-		entry:   entryPkgName,
+	err = i.instrument()
+	if err != nil {
+		return err
 	}
-	return i.instrument()
+	if i.tests {
+		return i.addTestMain(entry)
+	}
+	return nil
 }
 
 func (i *instrumenter) instrument() (err error) {
@@ -45,13 +121,19 @@ func (i *instrumenter) instrument() (err error) {
 		// if pkg.Cgo {
 		// 	continue
 		// }
-		if excludes.ExcludedPkg(pkg.Pkg.Path()) {
+		if i.policy.ExcludedPkg(pkg.Pkg.Path()) && !i.isEntry(pkg) {
+			continue
+		}
+		if i.cache.Fresh(pkg.Pkg.Path()) {
 			continue
 		}
 		for _, fileAst := range pkg.Files {
 			i.currentFile = fileAst
 			hadFunc := false
 			err = analysis.Functions(pkg, fileAst, func(fn ast.Node, fnName string) error {
+				if !i.isHook(pkg, fnName, fn) && (i.policy.ExcludedPkg(pkg.Pkg.Path()) || i.policy.ExcludedFunc(fnName)) {
+					return nil
+				}
 				hadFunc = true
 				switch x := fn.(type) {
 				case *ast.FuncDecl:
@@ -81,70 +163,23 @@ func (i *instrumenter) instrument() (err error) {
 	return nil
 }
 func (i *instrumenter) fnBody(pkg *loader.PackageInfo, fnName string, fnAst ast.Node, fnBody *[]ast.Stmt) error {
+	// The user's invariants become ordinary statements of the function.
+	if err := i.invariants(pkg, fnAst, fnBody); err != nil {
+		return err
+	}
+	if i.tests {
+		i.wrapParallel(pkg, *fnBody)
+	}
+	full := i.granularity != dgtypes.FuncGranularity && (i.changed == nil || i.changed[fnName])
+	if i.predicates && full {
+		i.predicateSites(pkg, fnBody)
+	}
 	cfg := analysis.BuildCFG(i.program.Fset, fnName, fnAst, fnBody)
+	_, isTestMain := i.testMain(pkg, fnAst)
 	if true {
-		// first collect the instrumentation points (IPs)
-		// build a map from lexical blocks to a sequence of IPs
-		// The IPs are basic blocks from the CFG
-		instr := make(map[*[]ast.Stmt][]*analysis.Block)
-		for _, b := range cfg.Blocks {
-			if b.Id == 0 {
-				// skip the entry block as it is covered by the EnterFunc call.
-			} else if len(b.Stmts) <= 0 {
-				// if there are no statements skip this block
-			} else if b.Body != nil {
-				// we can insert a statement
-				// associate the basic block with the lexical block
-				instr[b.Body] = append(instr[b.Body], b)
-			} else {
-				// try expression level instrumentation
-				err := i.exprInstrument(b)
-				if err != nil {
-					return err
-				}
-			}
-		}
-		// Now instrument each lexical block
-		for body, blks := range instr {
-			// First stort the IPs (Basic Blocks) in reverse order according
-			// to where they start in the lexical block. That way we can
-			// safely insert the instrumentation points (by doing it in
-			// reverse
-			sort.Slice(blks, func(i, j int) bool {
-				return blks[i].StartsAt > blks[j].StartsAt
-			})
-			// instrument the entry to each block
-			for _, b := range blks {
-				// get a position
-				var pos token.Pos
-				if len(b.Stmts) > 0 {
-					pos = (*b.Stmts[0]).Pos()
-				} else {
-					// if there are no statements skip this block
-					continue
-				}
-				switch stmt := (*body)[b.StartsAt].(type) {
-				// If the insertion point for the instrumentation is a LabeledStmt
-				// then we have two special cases
-				case *ast.LabeledStmt:
-					switch stmt.Stmt.(type) {
-					case *ast.ForStmt, *ast.SwitchStmt, *ast.SelectStmt, *ast.TypeSwitchStmt, *ast.RangeStmt:
-						// if it is one of the statements which allow labeled breaks/continues
-						// then we can't insert instrumentation here. (But, don't worry we can insert
-						// it inside of these statements so very little is lost).
-					default:
-						// Otherwise, in order to ensure our instrumentation is called first
-						// (before any function calls) we need to replace the inner portion
-						// of the LabeledStmt.
-						*body = Insert(cfg, b, *body, b.StartsAt+1, stmt.Stmt)
-						stmt.Stmt = i.mkEnterBlk(pos, b.Id)
-						cfg.AddAllToBlk(b, stmt.Stmt)
-					}
-				default:
-					// The general case, simply insert our instrumentation at the starting
-					// points of the basic block in the lexical block.
-					*body = Insert(cfg, b, *body, b.StartsAt, i.mkEnterBlk(pos, b.Id))
-				}
+		if full {
+			if err := i.blockProbes(cfg, fnAst, fnBody); err != nil {
+				return err
 			}
 		}
 		// Finally, we need to check for the existence of an os.Exit call and insert a
@@ -158,7 +193,8 @@ func (i *instrumenter) fnBody(pkg *loader.PackageInfo, fnName string, fnAst ast.
 						switch e := expr.(type) {
 						case *ast.SelectorExpr:
 							if ident, ok := e.X.(*ast.Ident); ok {
-								if ident.Name == "os" && e.Sel.Name == "Exit" {
+								if ident.Name == "os" && e.Sel.Name == "Exit" && !isTestMain {
+									// (TestMain shuts down once testing.M.Run returns)
 									*blk = Insert(cfg, nil, *blk, j, i.mkShutdownNow(pos))
 									j++
 								}
@@ -176,45 +212,177 @@ func (i *instrumenter) fnBody(pkg *loader.PackageInfo, fnName string, fnAst ast.
 		if err != nil {
 			return nil
 		}
+		// Link the goroutines: go statements and channel operations.
+		if full {
+			if err := i.concurrency(pkg, cfg, fnBody); err != nil {
+				return err
+			}
+		}
+		// Find out where panics are recovered.
+		i.recovers(pkg, fnBody)
+		// Don't let the program count dgruntime's goroutines.
+		i.numGoroutine(pkg, *fnBody)
+	}
+	var entry *analysis.Block
+	if len(cfg.Blocks) > 0 {
+		entry = cfg.Blocks[0]
+	}
+	var stmts []ast.Stmt
+	if i.isMain(pkg, fnName) {
+		stmts = append(stmts, i.mkSetPolicy(fnAst.Pos()), i.mkSetGranularity(fnAst.Pos()), i.mkShutdown(fnAst.Pos()))
 	}
-	pdt := cfg.PostDominators()
 	cfgName := "__cfg"
 	ipdomName := "__ipdom"
-	if len(cfg.Blocks) > 0 {
-		*fnBody = Insert(cfg, cfg.Blocks[0], *fnBody, 0, i.mkCfg(fnAst.Pos(), cfg, cfgName))
-		*fnBody = Insert(cfg, cfg.Blocks[0], *fnBody, 1, i.mkIdom(fnAst.Pos(), pdt, ipdomName))
-		*fnBody = Insert(cfg, cfg.Blocks[0], *fnBody, 2, i.mkEnterFunc(fnAst.Pos(), fnName, cfgName, ipdomName))
-		*fnBody = Insert(cfg, cfg.Blocks[0], *fnBody, 3, i.mkExitFunc(fnAst.Pos(), fnName))
-		if pkg.Pkg.Path() == i.entry && fnName == fmt.Sprintf("%v.main", pkg.Pkg.Path()) {
-			*fnBody = Insert(cfg, cfg.Blocks[0], *fnBody, 0, i.mkShutdown(fnAst.Pos()))
-		}
+	if i.granularity == dgtypes.FuncGranularity {
+		// the runtime only needs the tables to follow the blocks
+		cfgName, ipdomName = "dgruntime.NoCFG", "dgruntime.NoIPDom"
 	} else {
-		*fnBody = Insert(cfg, nil, *fnBody, 0, i.mkCfg(fnAst.Pos(), cfg, cfgName))
-		*fnBody = Insert(cfg, nil, *fnBody, 1, i.mkIdom(fnAst.Pos(), pdt, ipdomName))
-		*fnBody = Insert(cfg, nil, *fnBody, 2, i.mkEnterFunc(fnAst.Pos(), fnName, cfgName, ipdomName))
-		*fnBody = Insert(cfg, nil, *fnBody, 3, i.mkExitFunc(fnAst.Pos(), fnName))
-		if pkg.Pkg.Path() == i.entry && fnName == fmt.Sprintf("%v.main", pkg.Pkg.Path()) {
-			*fnBody = Insert(cfg, nil, *fnBody, 0, i.mkShutdown(fnAst.Pos()))
-		}
+		pdt := cfg.PostDominators()
+		stmts = append(stmts, i.mkCfg(fnAst.Pos(), cfg, cfgName), i.mkIdom(fnAst.Pos(), pdt, ipdomName))
+	}
+	stmts = append(stmts, i.mkEnterFunc(fnAst.Pos(), fnName, cfgName, ipdomName), i.mkExitFunc(fnAst.Pos(), fnName))
+	for j, stmt := range stmts {
+		*fnBody = Insert(cfg, entry, *fnBody, j, stmt)
 	}
+	i.testHooks(cfg, entry, pkg, fnAst, fnBody)
 	return nil
 }
 
-func (i *instrumenter) exprInstrument(b *analysis.Block) error {
+// blockProbes places an entry probe (dgruntime.EnterBlk) in each basic block
+// of the function but its entry block (see dgruntime.EnterFunc). At edge
+// granularity the probes are on the edges instead (see edgeProbes).
+func (i *instrumenter) blockProbes(cfg *analysis.CFG, fnAst ast.Node, fnBody *[]ast.Stmt) error {
+	if i.granularity == dgtypes.EdgeGranularity {
+		return i.edgeProbes(cfg, fnAst, fnBody)
+	}
+	// first collect the instrumentation points (IPs)
+	// build a map from lexical blocks to a sequence of IPs
+	// The IPs are basic blocks from the CFG
+	instr := make(map[*[]ast.Stmt][]*analysis.Block)
+	probes := newProbes(i, cfg, fnBody)
+	for _, b := range cfg.Blocks {
+		if b.Id == 0 {
+			// skip the entry block as it is covered by the EnterFunc call.
+		} else if isExit(b) {
+			// the function falls off its end into this block
+			if !hasResults(cfg) {
+				probes.end(b, fnBody, fnAst.End())
+			}
+		} else if b.Body != nil {
+			// we can insert a statement
+			// associate the basic block with the lexical block
+			instr[b.Body] = append(instr[b.Body], b)
+			if labeledBlk(b) {
+				// gotos jump past the probe placed before the label
+				if err := probes.jumps(b); err != nil {
+					return err
+				}
+			}
+		} else {
+			// try expression level instrumentation
+			err := i.exprInstrument(probes, b)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	// Now instrument each lexical block
+	for body, blks := range instr {
+		// First stort the IPs (Basic Blocks) in reverse order according
+		// to where they start in the lexical block. That way we can
+		// safely insert the instrumentation points (by doing it in
+		// reverse. Blocks starting at the same statement (a loop's body
+		// and a label starting it) are entered in the order they were
+		// made.
+		sort.Slice(blks, func(i, j int) bool {
+			if blks[i].StartsAt == blks[j].StartsAt {
+				return blks[i].Id > blks[j].Id
+			}
+			return blks[i].StartsAt > blks[j].StartsAt
+		})
+		// instrument the entry to each block
+		for _, b := range blks {
+			// get a position
+			var pos token.Pos
+			if len(b.Stmts) > 0 {
+				pos = (*b.Stmts[0]).Pos()
+			} else {
+				// if there are no statements skip this block
+				continue
+			}
+			switch stmt := (*body)[b.StartsAt].(type) {
+			// If the insertion point for the instrumentation is a LabeledStmt
+			// then we have two special cases
+			case *ast.LabeledStmt:
+				switch {
+				case stmt.Label.Name != b.Name || labeledBlk(b):
+					// The block is entered before the label (it is the body of a loop
+					// starting with the labeled statement) or the label is one which
+					// allows labeled breaks/continues and must stay on its statement.
+					// The probe goes before the label (and before the gotos jumping
+					// to it, see probes.jumps).
+					*body = Insert(cfg, b, *body, b.StartsAt, i.mkEnterBlk(pos, b))
+				default:
+					// Otherwise, in order to ensure our instrumentation is called first
+					// (before any function calls) we need to replace the inner portion
+					// of the LabeledStmt.
+					*body = Insert(cfg, b, *body, b.StartsAt+1, stmt.Stmt)
+					stmt.Stmt = i.mkEnterBlk(pos, b)
+					cfg.AddAllToBlk(b, stmt.Stmt)
+				}
+			default:
+				// The general case, simply insert our instrumentation at the starting
+				// points of the basic block in the lexical block.
+				*body = Insert(cfg, b, *body, b.StartsAt, i.mkEnterBlk(pos, b))
+			}
+		}
+	}
+	// Then the blocks which do not start a sequence of statements.
+	if err := probes.insert(); err != nil {
+		return err
+	}
+	return i.checkProbes(cfg, fnBody)
+}
+
+func (i *instrumenter) isMain(pkg *loader.PackageInfo, fnName string) bool {
+	return pkg.Pkg.Path() == i.entry && fnName == fmt.Sprintf("%v.main", pkg.Pkg.Path())
+}
+
+// isHook reports whether the function starts or stops the profiler (or a
+// segment). They are instrumented regardless of the policy.
+func (i *instrumenter) isHook(pkg *loader.PackageInfo, fnName string, fnAst ast.Node) bool {
+	_, isTest := i.testFunc(pkg, fnAst)
+	_, isTestMain := i.testMain(pkg, fnAst)
+	return i.isMain(pkg, fnName) || isTest || isTestMain
+}
+
+// exprInstrument instruments a block which does not start a sequence of
+// statements: a condition evaluated in a block of its own (see
+// analysis.CFG.visitCond), an else if, a loop's header or post statement or a
+// select case without a body.
+func (i *instrumenter) exprInstrument(p *probes, b *analysis.Block) error {
 	if len(b.Stmts) <= 0 {
+		if b.Cond != nil {
+			*b.Cond = &ast.ParenExpr{X: i.mkEnterBlkCond(nil, *b.Cond, b)}
+		}
 		return nil
 	}
-	s := b.Stmts[0]
+	s := b.Stmts[len(b.Stmts)-1]
+	pos := (*b.Stmts[0]).Pos()
 	// This is a list of all statement types.
 	// More may be instrumentable in this fashion than are shown
 	switch stmt := (*s).(type) {
 	case *ast.BadStmt:
 	case *ast.DeclStmt:
 	case *ast.EmptyStmt:
-	case *ast.ExprStmt:
-	case *ast.SendStmt:
-	case *ast.IncDecStmt:
-	case *ast.AssignStmt:
+	case *ast.ExprStmt, *ast.SendStmt, *ast.IncDecStmt, *ast.AssignStmt:
+		if loop, has := p.posts[stmt]; has {
+			// entered after the loop's body and by its continues
+			p.end(b, &loop.Body.List, loop.Body.Rbrace)
+			return p.jumps(b)
+		} else if clause, has := p.comms[stmt]; has && len(clause.Body) == 0 {
+			p.end(b, &clause.Body, clause.Colon)
+		}
 	case *ast.GoStmt:
 	case *ast.DeferStmt:
 	case *ast.ReturnStmt:
@@ -222,10 +390,30 @@ func (i *instrumenter) exprInstrument(b *analysis.Block) error {
 	case *ast.BranchStmt:
 	case *ast.BlockStmt:
 	case *ast.IfStmt:
-		stmt.Cond = i.mkEnterBlkCond(stmt, stmt.Cond, b.Id)
+		if stmt.Init == nil {
+			stmt.Cond = i.mkEnterBlkCond(stmt, stmt.Cond, b)
+		} else {
+			// an else if with an init statement becomes an else block
+			*s = &ast.BlockStmt{
+				Lbrace: stmt.Pos(),
+				List:   []ast.Stmt{i.mkEnterBlk(pos, b), stmt},
+				Rbrace: stmt.End(),
+			}
+		}
 	case *ast.ForStmt:
-		stmt.Cond = i.mkEnterBlkCond(stmt, stmt.Cond, b.Id)
+		if stmt.Cond != nil {
+			stmt.Cond = i.mkEnterBlkCond(stmt, stmt.Cond, b)
+		} else {
+			// the loop's body is empty
+			p.end(b, &stmt.Body.List, stmt.Body.Lbrace)
+		}
 	case *ast.RangeStmt:
+		// entered from before the loop, after its body and by its continues
+		if err := p.before(b, stmt); err != nil {
+			return err
+		}
+		p.end(b, &stmt.Body.List, stmt.Body.Rbrace)
+		return p.jumps(b)
 	case *ast.SelectStmt:
 	case *ast.TypeSwitchStmt:
 	case *ast.SwitchStmt:
@@ -239,6 +427,21 @@ func (i *instrumenter) exprInstrument(b *analysis.Block) error {
 	return nil
 }
 
+// labeledBlk reports whether the block is the one labeled by a label which
+// allows labeled breaks/continues. Its probe can not replace the labeled
+// statement.
+func labeledBlk(b *analysis.Block) bool {
+	l, ok := (*b.Body)[b.StartsAt].(*ast.LabeledStmt)
+	if !ok || l.Label.Name != b.Name {
+		return false
+	}
+	switch l.Stmt.(type) {
+	case *ast.ForStmt, *ast.SwitchStmt, *ast.SelectStmt, *ast.TypeSwitchStmt, *ast.RangeStmt:
+		return true
+	}
+	return false
+}
+
 func Insert(cfg *analysis.CFG, cfgBlk *analysis.Block, blk []ast.Stmt, j int, stmt ast.Stmt) []ast.Stmt {
 	if cfg != nil {
 		if cfgBlk == nil {
@@ -338,6 +541,24 @@ func (i *instrumenter) mkShutdown(pos token.Pos) ast.Stmt {
 	return &ast.DeferStmt{Call: e.(*ast.CallExpr)}
 }
 
+func (i *instrumenter) mkSetPolicy(pos token.Pos) ast.Stmt {
+	s := fmt.Sprintf("dgruntime.SetPolicy(%v)", strconv.Quote(i.policy.String()))
+	e, err := parser.ParseExprFrom(i.program.Fset, i.program.Fset.File(pos).Name(), s, parser.Mode(0))
+	if err != nil {
+		panic(fmt.Errorf("mkSetPolicy (%v) error: %v", s, err))
+	}
+	return &ast.ExprStmt{e}
+}
+
+func (i *instrumenter) mkSetGranularity(pos token.Pos) ast.Stmt {
+	s := fmt.Sprintf("dgruntime.SetGranularity(%v)", strconv.Quote(i.granularity))
+	e, err := parser.ParseExprFrom(i.program.Fset, i.program.Fset.File(pos).Name(), s, parser.Mode(0))
+	if err != nil {
+		panic(fmt.Errorf("mkSetGranularity (%v) error: %v", s, err))
+	}
+	return &ast.ExprStmt{e}
+}
+
 func (i *instrumenter) mkShutdownNow(pos token.Pos) ast.Stmt {
 	s := "dgruntime.Shutdown()"
 	e, err := parser.ParseExprFrom(i.program.Fset, i.program.Fset.File(pos).Name(), s, parser.Mode(0))
@@ -347,9 +568,10 @@ func (i *instrumenter) mkShutdownNow(pos token.Pos) ast.Stmt {
 	return &ast.ExprStmt{e}
 }
 
-func (i *instrumenter) mkEnterBlk(pos token.Pos, bbid int) ast.Stmt {
-	p := i.program.Fset.Position(pos)
-	s := fmt.Sprintf("dgruntime.EnterBlk(%d, %v)", bbid, strconv.Quote(p.String()))
+// mkEnterBlk makes the entry probe of the block b. (At edge granularity the
+// probes are on the edges, see edgeProbes.)
+func (i *instrumenter) mkEnterBlk(pos token.Pos, b *analysis.Block) ast.Stmt {
+	s := i.enterCall("", pos, b)
 	e, err := parser.ParseExprFrom(i.program.Fset, i.program.Fset.File(pos).Name(), s, parser.Mode(0))
 	if err != nil {
 		panic(fmt.Errorf("mkEnterBlk (%v) error: %v", s, err))
@@ -357,15 +579,14 @@ func (i *instrumenter) mkEnterBlk(pos token.Pos, bbid int) ast.Stmt {
 	return &ast.ExprStmt{e}
 }
 
-func (i *instrumenter) mkEnterBlkCond(stmt ast.Stmt, expr ast.Expr, bbid int) ast.Expr {
+func (i *instrumenter) mkEnterBlkCond(stmt ast.Stmt, expr ast.Expr, b *analysis.Block) ast.Expr {
 	var pos token.Pos
 	if expr != nil {
 		pos = expr.Pos()
 	} else {
 		pos = stmt.Pos()
 	}
-	p := i.program.Fset.Position(pos)
-	enterStr := fmt.Sprintf("dgruntime.EnterBlkFromCond(%d, %v)", bbid, strconv.Quote(p.String()))
+	enterStr := i.enterCall("FromCond", pos, b)
 	enter, err := parser.ParseExprFrom(i.program.Fset, i.program.Fset.File(pos).Name(), enterStr, parser.Mode(0))
 	if err != nil {
 		panic(err)
@@ -382,6 +603,13 @@ func (i *instrumenter) mkEnterBlkCond(stmt ast.Stmt, expr ast.Expr, bbid int) as
 	}
 }
 
+// enterCall is the call entering the block b (see mkEnterBlk), suffix
+// picks the variant (eg. FromCond)
+func (i *instrumenter) enterCall(suffix string, pos token.Pos, b *analysis.Block) string {
+	p := strconv.Quote(i.program.Fset.Position(pos).String())
+	return fmt.Sprintf("dgruntime.EnterBlk%v(%d, %v)", suffix, b.Id, p)
+}
+
 func (i *instrumenter) mkCfg(pos token.Pos, cfg *analysis.CFG, varName string) ast.Stmt {
 	nexts := cfg.Nexts()
 	parts := make([]string, 0, len(nexts))
@@ -390,9 +618,9 @@ func (i *instrumenter) mkCfg(pos token.Pos, cfg *analysis.CFG, varName string) a
 		for _, x := range next {
 			bits = append(bits, fmt.Sprintf("%d", x))
 		}
-		parts = append(parts, fmt.Sprintf("[]int{%s}", strings.Join(bits, ", ")))
+		parts = append(parts, fmt.Sprintf("{%s}", strings.Join(bits, ", ")))
 	}
-	s := fmt.Sprintf("[][]int{%s}", strings.Join(parts, ", "))
+	s := fmt.Sprintf("dgruntime.CFG{%s}", strings.Join(parts, ", "))
 	arr, err := parser.ParseExprFrom(i.program.Fset, i.program.Fset.File(pos).Name(), s, parser.Mode(0))
 	if err != nil {
 		panic(fmt.Errorf("mkCfg (%v) error: %v", s, err))
@@ -411,7 +639,7 @@ func (i *instrumenter) mkIdom(pos token.Pos, dt *analysis.DominatorTree, varName
 	for _, y := range idom {
 		parts = append(parts, fmt.Sprintf("%d", y))
 	}
-	s := fmt.Sprintf("[]int{%s}", strings.Join(parts, ", "))
+	s := fmt.Sprintf("dgruntime.IPDom{%s}", strings.Join(parts, ", "))
 	arr, err := parser.ParseExprFrom(i.program.Fset, i.program.Fset.File(pos).Name(), s, parser.Mode(0))
 	if err != nil {
 		panic(fmt.Errorf("mkIdom (%v) error: %v", s, err))
@@ -0,0 +1,218 @@
+package instrument
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+import (
+	"github.com/timtadh/data-structures/errors"
+	"golang.org/x/tools/go/loader"
+)
+
+const invariantDirective = "//dynagrok:invariant "
+
+// invariants compiles the `//dynagrok:invariant <expr>` comments of a
+// function into calls to dgruntime.Assert. A comment in the function's body
+// is checked where it is (after the statement before it). A comment in the
+// doc of a function declaration is checked when the function is entered and
+// when it returns:
+//
+//	//dynagrok:invariant len(s.items) <= s.cap
+//	func (s *stack) push(x int) {
+//		s.items = append(s.items, x)
+//		//dynagrok:invariant s.items[len(s.items)-1] == x
+//	}
+//
+// The expression is type checked in the scope of the comment and must be a
+// boolean. It runs before the block instrumentation is added so the checks
+// are part of the function's basic blocks. Comments inside of function
+// literals belong to the literals.
+func (i *instrumenter) invariants(pkg *loader.PackageInfo, fnAst ast.Node, fnBody *[]ast.Stmt) error {
+	var body *ast.BlockStmt
+	var doc *ast.CommentGroup
+	switch fn := fnAst.(type) {
+	case *ast.FuncDecl:
+		body, doc = fn.Body, fn.Doc
+	case *ast.FuncLit:
+		body = fn.Body
+	}
+	if body == nil || i.currentFile == nil {
+		return nil
+	}
+	type check struct {
+		blk  *[]ast.Stmt
+		at   int
+		stmt ast.Stmt
+	}
+	checks := make([]check, 0, 10)
+	if doc != nil {
+		for _, c := range doc.List {
+			expr, ok := invariant(c)
+			if !ok {
+				continue
+			}
+			// the scope of the function's parameters and results
+			assert, err := i.mkAssert(pkg, body.Lbrace+1, c, expr)
+			if err != nil {
+				return err
+			}
+			exit, err := i.mkAssert(pkg, body.Lbrace+1, c, expr)
+			if err != nil {
+				return err
+			}
+			checks = append(checks,
+				check{fnBody, 0, assert},
+				check{fnBody, 0, deferred(c.Pos(), exit)})
+		}
+	}
+	for _, cg := range i.currentFile.Comments {
+		if cg.Pos() < body.Lbrace || cg.End() > body.Rbrace {
+			continue
+		}
+		for _, c := range cg.List {
+			expr, ok := invariant(c)
+			if !ok {
+				continue
+			}
+			blk, scope := enclosingBlock(body, fnBody, c.Pos())
+			if blk == nil {
+				continue
+			}
+			assert, err := i.mkAssert(pkg, scope, c, expr)
+			if err != nil {
+				return err
+			}
+			at := sort.Search(len(*blk), func(j int) bool {
+				return (*blk)[j].Pos() > c.Pos()
+			})
+			checks = append(checks, check{blk, at, assert})
+		}
+	}
+	// insert the last first so the earlier insertion points do not move
+	for j := len(checks) - 1; j >= 0; j-- {
+		c := checks[j]
+		*c.blk = Insert(nil, nil, *c.blk, c.at, c.stmt)
+	}
+	return nil
+}
+
+// invariant returns the expression of an invariant comment
+func invariant(c *ast.Comment) (string, bool) {
+	if !strings.HasPrefix(c.Text, invariantDirective) {
+		return "", false
+	}
+	return strings.TrimSpace(strings.TrimPrefix(c.Text, invariantDirective)), true
+}
+
+// enclosingBlock finds the innermost statement list of the function body
+// which contains pos and the position to type check an invariant at pos in.
+// The list is nil if pos is inside of a function literal. The scope of a case
+// (or comm) clause ends with its last statement so an invariant after it is
+// checked at the start of the last statement (what the statement declares
+// cannot be used after it anyway).
+func enclosingBlock(body *ast.BlockStmt, fnBody *[]ast.Stmt, pos token.Pos) (*[]ast.Stmt, token.Pos) {
+	blk := fnBody
+	scope := pos
+	inLit := false
+	ast.Inspect(body, func(n ast.Node) bool {
+		if n == nil || inLit || pos < n.Pos() || pos >= n.End() {
+			return false
+		}
+		switch x := n.(type) {
+		case *ast.FuncLit:
+			inLit = true
+			return false
+		case *ast.BlockStmt:
+			if x != body {
+				blk = &x.List
+			}
+			// a clause of a switch (or select) runs to the next one
+			for _, stmt := range x.List {
+				switch c := stmt.(type) {
+				case *ast.CaseClause:
+					if pos > c.Colon {
+						blk = &c.Body
+						scope = clauseScope(c.Colon, c.Body, pos)
+					}
+				case *ast.CommClause:
+					if pos > c.Colon {
+						blk = &c.Body
+						scope = clauseScope(c.Colon, c.Body, pos)
+					}
+				}
+			}
+		}
+		return true
+	})
+	if inLit {
+		return nil, token.NoPos
+	}
+	return blk, scope
+}
+
+// clauseScope is a position in the scope of the clause for an invariant at
+// pos in its body
+func clauseScope(colon token.Pos, body []ast.Stmt, pos token.Pos) token.Pos {
+	if len(body) == 0 {
+		return colon
+	}
+	if last := body[len(body)-1]; pos >= last.End() {
+		return last.Pos()
+	}
+	return pos
+}
+
+// mkAssert type checks the invariant in the scope at pos and builds the
+// statement checking it:
+//
+//	dgruntime.Assert(<expr>, "invariant <expr> (file.go:12:2)")
+func (i *instrumenter) mkAssert(pkg *loader.PackageInfo, pos token.Pos, c *ast.Comment, src string) (ast.Stmt, error) {
+	p := i.program.Fset.Position(c.Pos())
+	expr, err := parser.ParseExprFrom(i.program.Fset, p.Filename, src, parser.Mode(0))
+	if err != nil {
+		return nil, errors.Errorf("%v: bad invariant %q: %v", p, src, err)
+	}
+	info := &types.Info{Types: make(map[ast.Expr]types.TypeAndValue)}
+	if err := types.CheckExpr(i.program.Fset, pkg.Pkg, pos, expr, info); err != nil {
+		return nil, errors.Errorf("%v: bad invariant %q: %v", p, src, err)
+	}
+	typ := info.Types[expr].Type
+	b, ok := typ.Underlying().(*types.Basic)
+	if !ok || b.Info()&types.IsBoolean == 0 {
+		return nil, errors.Errorf("%v: invariant %q is not a boolean", p, src)
+	}
+	cond := src
+	if typ != b {
+		// a named boolean type, Assert takes a bool
+		cond = fmt.Sprintf("bool(%v)", src)
+	}
+	msg := fmt.Sprintf("invariant %v (%v)", src, p)
+	call := fmt.Sprintf("dgruntime.Assert(%v, %v)", cond, strconv.Quote(msg))
+	e, err := parser.ParseExprFrom(i.program.Fset, p.Filename, call, parser.Mode(0))
+	if err != nil {
+		panic(fmt.Errorf("mkAssert (%v) error: %v", call, err))
+	}
+	// the check is reported at the comment when it starts a basic block
+	e.(*ast.CallExpr).Fun.(*ast.SelectorExpr).X.(*ast.Ident).NamePos = c.End()
+	return &ast.ExprStmt{e}, nil
+}
+
+// deferred wraps the statement in `defer func() { <stmt> }()`
+func deferred(pos token.Pos, stmt ast.Stmt) ast.Stmt {
+	return &ast.DeferStmt{
+		Defer: pos,
+		Call: &ast.CallExpr{
+			Fun: &ast.FuncLit{
+				Type: &ast.FuncType{Func: pos, Params: &ast.FieldList{}},
+				Body: &ast.BlockStmt{Lbrace: pos, List: []ast.Stmt{stmt}, Rbrace: pos},
+			},
+		},
+	}
+}
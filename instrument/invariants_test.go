@@ -0,0 +1,173 @@
+package instrument
+
+import (
+	"go/ast"
+	"go/types"
+	"strings"
+	"testing"
+)
+
+// assertAt is the condition of the dgruntime.Assert at stmts[at] ("" if it
+// is not one)
+func assertAt(stmts []ast.Stmt, at int) string {
+	if at >= len(stmts) {
+		return ""
+	}
+	e, ok := stmts[at].(*ast.ExprStmt)
+	if !ok {
+		return ""
+	}
+	call, ok := e.X.(*ast.CallExpr)
+	if !ok || types.ExprString(call.Fun) != "dgruntime.Assert" {
+		return ""
+	}
+	return types.ExprString(call.Args[0])
+}
+
+func TestMkAssert(t *testing.T) {
+	for _, c := range []struct {
+		expr string
+		cond string
+		err  string
+	}{
+		{"x > 0", "x > 0", ""},
+		// Assert takes a bool
+		{"x > 0 && b", "bool(x > 0 && b)", ""},
+		{"b", "bool(b)", ""},
+		{"x + 1", "", "is not a boolean"},
+		{"s", "", "is not a boolean"},
+		{"y > 0", "", "bad invariant"},
+		{"x > ", "", "bad invariant"},
+	} {
+		src := "type B bool\nfunc f(x int, b B, s string) {\n\t//dynagrok:invariant " + c.expr + "\n}"
+		i, pkg, f := loadSrc(t, "package test\n"+src+"\n")
+		fn := f.Decls[len(f.Decls)-1].(*ast.FuncDecl)
+		comment := f.Comments[0].List[0]
+		stmt, err := i.mkAssert(pkg, comment.Pos(), comment, c.expr)
+		if c.err != "" {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("%v: expected an error containing %q got %v", c.expr, c.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %v", c.expr, err)
+			continue
+		}
+		if got := assertAt([]ast.Stmt{stmt}, 0); got != c.cond {
+			t.Errorf("%v: asserts %q expected %q", c.expr, got, c.cond)
+		}
+		msg := stmt.(*ast.ExprStmt).X.(*ast.CallExpr).Args[1]
+		if want := `"invariant ` + c.expr + ` (test.go:4:2)"`; types.ExprString(msg) != want {
+			t.Errorf("%v: message %v expected %v", c.expr, types.ExprString(msg), want)
+		}
+		fn.Body.List = append(fn.Body.List, stmt)
+		checkInstrumented(t, i, f, runtimeAPI(t, "dgruntime.go"))
+	}
+}
+
+func TestInvariantPlacement(t *testing.T) {
+	src := `package test
+func g() {}
+func f(x int, ch chan int) {
+	g()
+	//dynagrok:invariant x != 3
+	if x > 0 {
+		g()
+		//dynagrok:invariant x > 0
+	} else {
+		//dynagrok:invariant x <= 0
+		g()
+	}
+	switch x {
+	case 1:
+		//dynagrok:invariant x == 1
+		g()
+		//dynagrok:invariant x >= 1
+	}
+	select {
+	case v := <-ch:
+		x = v
+		//dynagrok:invariant v == x
+	default:
+		//dynagrok:invariant ch == nil
+	}
+	func() {
+		//dynagrok:invariant x == 2
+		g()
+	}()
+}
+`
+	i, pkg, f := loadSrc(t, src)
+	i.currentFile = f
+	fn := f.Decls[len(f.Decls)-1].(*ast.FuncDecl)
+	if err := i.invariants(pkg, fn, &fn.Body.List); err != nil {
+		t.Fatal(err)
+	}
+	body := fn.Body.List
+	ifStmt := body[2].(*ast.IfStmt)
+	switchStmt := body[3].(*ast.SwitchStmt)
+	selectStmt := body[4].(*ast.SelectStmt)
+	lit := body[5].(*ast.ExprStmt).X.(*ast.CallExpr).Fun.(*ast.FuncLit)
+	for _, c := range []struct {
+		where string
+		stmts []ast.Stmt
+		at    int
+		want  string
+	}{
+		{"the body", body, 1, "x != 3"},
+		{"the if", ifStmt.Body.List, 1, "x > 0"},
+		{"the else", ifStmt.Else.(*ast.BlockStmt).List, 0, "x <= 0"},
+		{"the case", switchStmt.Body.List[0].(*ast.CaseClause).Body, 0, "x == 1"},
+		// the end of a clause is in the clause
+		{"the end of the case", switchStmt.Body.List[0].(*ast.CaseClause).Body, 2, "x >= 1"},
+		{"the comm clause", selectStmt.Body.List[0].(*ast.CommClause).Body, 1, "v == x"},
+		{"the empty clause", selectStmt.Body.List[1].(*ast.CommClause).Body, 0, "ch == nil"},
+		// the literal's invariants are compiled with the literal
+		{"the func literal", lit.Body.List, 0, ""},
+	} {
+		if got := assertAt(c.stmts, c.at); got != c.want {
+			t.Errorf("%v: asserts %q at %v expected %q", c.where, got, c.at, c.want)
+		}
+	}
+	if err := i.invariants(pkg, lit, &lit.Body.List); err != nil {
+		t.Fatal(err)
+	}
+	if got := assertAt(lit.Body.List, 0); got != "x == 2" {
+		t.Errorf("the func literal asserts %q expected %q", got, "x == 2")
+	}
+	checkInstrumented(t, i, f, runtimeAPI(t, "dgruntime.go"))
+}
+
+func TestEntryExitInvariants(t *testing.T) {
+	src := `package test
+//dynagrok:invariant n >= 0 && r >= 0
+func f(n int) (r int) {
+	r = n
+	return r
+}
+`
+	i, pkg, f := loadSrc(t, src)
+	i.currentFile = f
+	fn := f.Decls[0].(*ast.FuncDecl)
+	if err := i.invariants(pkg, fn, &fn.Body.List); err != nil {
+		t.Fatal(err)
+	}
+	want := "n >= 0 && r >= 0"
+	if got := assertAt(fn.Body.List, 0); got != want {
+		t.Errorf("the entry asserts %q expected %q", got, want)
+	}
+	// the exit is checked by a deferred call so it sees the results
+	d, ok := fn.Body.List[1].(*ast.DeferStmt)
+	if !ok {
+		t.Fatalf("expected the exit check to be deferred got %T", fn.Body.List[1])
+	}
+	lit := d.Call.Fun.(*ast.FuncLit)
+	if got := assertAt(lit.Body.List, 0); got != want {
+		t.Errorf("the exit asserts %q expected %q", got, want)
+	}
+	if len(fn.Body.List) != 4 {
+		t.Errorf("expected the two checks before the body got %v statements", len(fn.Body.List))
+	}
+	checkInstrumented(t, i, f, runtimeAPI(t, "dgruntime.go"))
+}
@@ -0,0 +1,160 @@
+package instrument
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+import (
+	"github.com/timtadh/data-structures/errors"
+)
+
+import (
+	"github.com/timtadh/dynagrok/cmd"
+)
+
+// overlay is the json document consumed by `go build -overlay`
+type overlay struct {
+	Replace map[string]string
+}
+
+// BuildOverlay builds the instrumented program with the stock toolchain. In
+// stead of copying GOROOT and GOPATH into the work directory the rewritten
+// files are written to <work>/overlay and handed to `go build -overlay`. The
+// dgruntime package is copied into <work>/dgruntime as a stand alone module
+// and wired into the main module by overlaying its go.mod with a require and
+// replace directive.
+func (b *binaryBuilder) BuildOverlay() error {
+	entry := b.program.Package(b.entry)
+	if entry == nil || len(entry.Files) <= 0 {
+		return errors.Errorf("The entry package %v was not found in the loaded program", b.entry)
+	}
+	entryDir := filepath.Dir(b.program.Fset.File(entry.Files[0].Pos()).Name())
+	gomod, err := b.goEnvVar(entryDir, "GOMOD")
+	if err != nil {
+		return err
+	}
+	if gomod == "" || gomod == os.DevNull {
+		return errors.Errorf("%v is not in a module (go env GOMOD was empty)", b.entry)
+	}
+	orig, err := ioutil.ReadFile(gomod)
+	if err != nil {
+		return err
+	}
+	dgruntime := filepath.Join(b._work, "dgruntime")
+	err = b.copyDir(filepath.Join(b.config.DGPATH, "dgruntime"), dgruntime)
+	if err != nil {
+		return err
+	}
+	// dgruntime is compiled with the language version of the main module
+	dgmod := fmt.Sprintf("module dgruntime\n\n%v\n", goDirective(orig))
+	err = ioutil.WriteFile(filepath.Join(dgruntime, "go.mod"), []byte(dgmod), 0664)
+	if err != nil {
+		return err
+	}
+	files := filepath.Join(b._work, "overlay")
+	err = os.MkdirAll(files, os.ModeDir|os.ModeTemporary|0775)
+	if err != nil {
+		return err
+	}
+	o := overlay{Replace: make(map[string]string)}
+	modfile := filepath.Join(files, "go.mod")
+	err = ioutil.WriteFile(modfile, overlayGoMod(orig, dgruntime), 0664)
+	if err != nil {
+		return err
+	}
+	o.Replace[gomod] = modfile
+	for _, pkgInfo := range b.program.AllPackages {
+		if b.excluded(pkgInfo.Pkg) {
+			// built from its own sources
+			continue
+		}
+		fresh := b.cache.Fresh(pkgInfo.Pkg.Path())
+		for _, f := range pkgInfo.Files {
+			from := b.program.Fset.File(f.Pos()).Name()
+			to := filepath.Join(files, pkgInfo.Pkg.Path(), filepath.Base(from))
+			o.Replace[from] = to
+			if fresh {
+				continue
+			}
+			err := os.MkdirAll(filepath.Dir(to), os.ModeDir|os.ModeTemporary|0775)
+			if err != nil {
+				return err
+			}
+			fout, err := os.Create(to)
+			if err != nil {
+				return err
+			}
+			err = printFile(fout, b.program.Fset, f)
+			fout.Close()
+			if err != nil {
+				return errors.Errorf("Could not serialize tree at %v tree %v error: %v", to, f, err)
+			}
+		}
+	}
+	overlayPath := filepath.Join(b._work, "overlay.json")
+	bits, err := json.MarshalIndent(&o, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(overlayPath, bits, 0664)
+	if err != nil {
+		return err
+	}
+	output, err := filepath.Abs(b.output)
+	if err != nil {
+		return err
+	}
+	c := exec.Command(b.stockGo(), b.buildCmd("-mod=mod", "-overlay", overlayPath, "-o", output, b.entry)...)
+	c.Dir = entryDir
+	c.Env = cmd.ModuleEnv(b.config)
+	fmt.Fprintf(os.Stderr, "cd %v; %v %v\n", c.Dir, c.Path, strings.Join(c.Args[1:], " "))
+	out, err := c.CombinedOutput()
+	fmt.Fprintln(os.Stderr, string(out))
+	return err
+}
+
+// overlayGoMod is a copy of the main module's go.mod (orig) which requires
+// the work directory's copy of dgruntime.
+func overlayGoMod(orig []byte, dgruntime string) []byte {
+	return []byte(fmt.Sprintf("%s\nrequire dgruntime v0.0.0\n\nreplace dgruntime => %v\n", orig, dgruntime))
+}
+
+// goDirective is the go line of a go.mod (eg. "go 1.21") without its
+// comment. A go.mod without one is read as go 1.16 by the go command.
+func goDirective(mod []byte) string {
+	for _, line := range strings.Split(string(mod), "\n") {
+		if i := strings.Index(line, "//"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "go" {
+			return "go " + fields[1]
+		}
+	}
+	return "go 1.16"
+}
+
+func (b *binaryBuilder) goEnvVar(dir, name string) (string, error) {
+	c := exec.Command(b.stockGo(), "env", name)
+	c.Dir = dir
+	c.Env = cmd.ModuleEnv(b.config)
+	output, err := c.CombinedOutput()
+	if err != nil {
+		return "", errors.Errorf("go env %v failed: %v\n%v", name, err, string(output))
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// stockGo is the go command of the configured GOROOT (or the one on the PATH)
+func (b *binaryBuilder) stockGo() string {
+	if b.config.GOROOT != "" {
+		return filepath.Join(b.config.GOROOT, "bin", "go")
+	}
+	return "go"
+}
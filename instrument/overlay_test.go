@@ -0,0 +1,64 @@
+package instrument
+
+import (
+	"go/types"
+	"strings"
+	"testing"
+)
+
+import (
+	"github.com/timtadh/dynagrok/dgruntime/excludes"
+)
+
+func TestGoDirective(t *testing.T) {
+	for _, c := range []struct {
+		mod  string
+		want string
+	}{
+		{"module example.com/m\n\ngo 1.21\n", "go 1.21"},
+		{"module example.com/m\ngo 1.22.3 // pinned\ntoolchain go1.23.0\n", "go 1.22.3"},
+		{"module example.com/m\n// go 1.10\n\ngo 1.18\n", "go 1.18"},
+		{"module example.com/m\n", "go 1.16"},
+	} {
+		if got := goDirective([]byte(c.mod)); got != c.want {
+			t.Errorf("goDirective(%q) = %q, want %q", c.mod, got, c.want)
+		}
+	}
+}
+
+func TestOverlayGoMod(t *testing.T) {
+	orig := "module example.com/m\n\ngo 1.21\n"
+	got := string(overlayGoMod([]byte(orig), "/work/dgruntime"))
+	if !strings.HasPrefix(got, orig) {
+		t.Errorf("overlayGoMod dropped the main module's go.mod:\n%v", got)
+	}
+	for _, want := range []string{"require dgruntime v0.0.0\n", "replace dgruntime => /work/dgruntime\n"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("overlayGoMod is missing %q:\n%v", want, got)
+		}
+	}
+}
+
+func TestBuilderExcluded(t *testing.T) {
+	policy := excludes.NewPolicy()
+	if err := policy.AddExclude("example.com/m/..."); err != nil {
+		t.Fatal(err)
+	}
+	policy.ExcludeDeps([]string{"math/rand"})
+	b := &binaryBuilder{entry: "example.com/m", policy: policy, test: true}
+	for _, c := range []struct {
+		path string
+		want bool
+	}{
+		{"example.com/m", false},
+		{"example.com/m_test", false},
+		{"example.com/m/sub", true},
+		{"math/rand", true},
+		{"fmt", true},
+		{"example.com/other", false},
+	} {
+		if got := b.excluded(types.NewPackage(c.path, "p")); got != c.want {
+			t.Errorf("excluded(%v) = %v, want %v", c.path, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package instrument
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/types"
+)
+
+import (
+	"golang.org/x/tools/go/ast/astutil"
+	"golang.org/x/tools/go/loader"
+)
+
+// recovers wraps the function's calls to recover so dgruntime learns where
+// panics are swallowed (see dgruntime/panics.go):
+//
+//	recover()  =>  dgruntime.Recover(recover())
+//
+// recover still runs in the deferred function. Function literals are
+// instrumented on their own and `defer recover()` (which never recovers) is
+// left alone.
+func (i *instrumenter) recovers(pkg *loader.PackageInfo, fnBody *[]ast.Stmt) {
+	for _, stmt := range *fnBody {
+		astutil.Apply(stmt, func(c *astutil.Cursor) bool {
+			switch n := c.Node().(type) {
+			case *ast.FuncLit:
+				return false
+			case *ast.CallExpr:
+				switch c.Parent().(type) {
+				case *ast.DeferStmt, *ast.GoStmt:
+					return true
+				}
+				if isBuiltin(pkg, n.Fun, "recover") {
+					c.Replace(i.mkRecover(n))
+					return false
+				}
+			}
+			return true
+		}, nil)
+	}
+}
+
+func (i *instrumenter) mkRecover(call *ast.CallExpr) ast.Expr {
+	s := "dgruntime.Recover()"
+	e, err := parser.ParseExprFrom(i.program.Fset, i.program.Fset.File(call.Pos()).Name(), s, parser.Mode(0))
+	if err != nil {
+		panic(fmt.Errorf("mkRecover (%v) error: %v", s, err))
+	}
+	wrap := e.(*ast.CallExpr)
+	wrap.Args = []ast.Expr{call}
+	return wrap
+}
+
+// isBuiltin reports whether fun names the builtin function
+func isBuiltin(pkg *loader.PackageInfo, fun ast.Expr, name string) bool {
+	id, ok := astutil.Unparen(fun).(*ast.Ident)
+	if !ok {
+		return false
+	}
+	b, ok := pkg.Info.Uses[id].(*types.Builtin)
+	return ok && b.Name() == name
+}
@@ -0,0 +1,377 @@
+package instrument
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"strconv"
+)
+
+import (
+	"golang.org/x/tools/go/ast/astutil"
+	"golang.org/x/tools/go/loader"
+)
+
+import (
+	"github.com/timtadh/dynagrok/analysis"
+)
+
+var cmpOps = map[token.Token]string{
+	token.EQL: "Eql",
+	token.NEQ: "Neq",
+	token.LSS: "Lss",
+	token.LEQ: "Leq",
+	token.GTR: "Gtr",
+	token.GEQ: "Geq",
+}
+
+// predicateSites instruments the predicate sites of a function (see
+// dgruntime/predicates.go). Comparisons of numbers and strings are replaced
+// by a call which evaluates the comparison and records how the operands
+// relate:
+//
+//	x < y  =>  dgruntime.CmpInt(0, "f.go:3:5", "x", "y", dgruntime.Lss, 3, dgruntime.Int64(x), dgruntime.Int64(y))
+//
+// and the conditions of if and for statements and of tagless switch cases
+// which are not comparisons themselves are wrapped in dgruntime.Branch. The
+// operands of && and || are conditions of their own (each is evaluated in a
+// basic block of its own, see analysis.CFG).
+// Assignments are followed by the return value and scalar pair sites (see
+// assignSites). The sites are numbered in the order they are instrumented.
+// Function literals are instrumented on their own.
+func (i *instrumenter) predicateSites(pkg *loader.PackageInfo, fnBody *[]ast.Stmt) {
+	site := 0
+	var branch func(cond *ast.Expr)
+	branch = func(cond *ast.Expr) {
+		if *cond == nil {
+			return
+		}
+		switch e := (*cond).(type) {
+		case *ast.ParenExpr:
+			branch(&e.X)
+			return
+		case *ast.BinaryExpr:
+			if e.Op == token.LAND || e.Op == token.LOR {
+				branch(&e.X)
+				branch(&e.Y)
+				return
+			}
+		}
+		if i.cmpFunc(pkg, astutil.Unparen(*cond)) != "" || !isBool(pkg, *cond) {
+			return
+		}
+		*cond = i.mkBranch(site, *cond)
+		site++
+	}
+	for _, stmt := range *fnBody {
+		astutil.Apply(stmt, func(c *astutil.Cursor) bool {
+			switch n := c.Node().(type) {
+			case *ast.FuncLit:
+				return false
+			case *ast.IfStmt:
+				branch(&n.Cond)
+			case *ast.ForStmt:
+				branch(&n.Cond)
+			case *ast.SwitchStmt:
+				if n.Tag != nil {
+					break
+				}
+				for _, s := range n.Body.List {
+					cc := s.(*ast.CaseClause)
+					for j := range cc.List {
+						branch(&cc.List[j])
+					}
+				}
+			case *ast.BinaryExpr:
+				if f := i.cmpFunc(pkg, n); f != "" {
+					c.Replace(i.mkCmp(pkg, site, f, n))
+					site++
+				}
+			}
+			return true
+		}, nil)
+	}
+	i.assignSites(pkg, fnBody, &site)
+}
+
+// assignSites adds the sites following the assignments to scalar (number)
+// variables. When the value assigned is the result of a function call the
+// sign of the result is recorded:
+//
+//	n, err := parse(s)
+//	dgruntime.ReturnedInt(7, "q.go:13:2", "parse(s)", dgruntime.Int64(n))
+//
+// and an assigned variable is compared to each of the variables (of the
+// function) of the same type in scope:
+//
+//	dgruntime.CmpInt(8, "q.go:13:2", "n", "max", dgruntime.Eql, 0, dgruntime.Int64(n), dgruntime.Int64(max))
+//
+// Only assignments which are statements of a block are instrumented (not
+// the init and post statements of if, for and switch).
+func (i *instrumenter) assignSites(pkg *loader.PackageInfo, fnBody *[]ast.Stmt, site *int) {
+	analysis.Blocks(fnBody, nil, func(blk *[]ast.Stmt, id int) error {
+		for j := 0; j < len(*blk); j++ {
+			assign, ok := (*blk)[j].(*ast.AssignStmt)
+			if !ok {
+				continue
+			}
+			after := make([]ast.Stmt, 0, len(assign.Lhs))
+			call, results := i.assignedCall(pkg, assign)
+			for k, lhs := range assign.Lhs {
+				f, conv := scalarFunc(pkg.Info.TypeOf(lhs))
+				if f == "" {
+					continue
+				}
+				if call != nil {
+					if x := i.chanExpr(lhs); x != "" && x != "_" {
+						name := types.ExprString(call)
+						if results > 1 {
+							name = fmt.Sprintf("result %d of %v", k, name)
+						}
+						after = append(after, i.mkReturned(*site, assign, f, name, conv, lhs))
+						*site++
+					}
+				}
+				id, ok := lhs.(*ast.Ident)
+				if !ok || id.Name == "_" {
+					continue
+				}
+				for _, other := range scalarsInScope(pkg, assign, id) {
+					after = append(after, &ast.ExprStmt{i.mkPair(*site, assign, f, conv, id, other)})
+					*site++
+				}
+			}
+			for k, stmt := range after {
+				*blk = Insert(nil, nil, *blk, j+1+k, stmt)
+			}
+			j += len(after)
+		}
+		return nil
+	})
+}
+
+// assignedCall is the call whose results are assigned (nil if the assignment
+// does not assign the results of a function call) and the number of results
+// it has
+func (i *instrumenter) assignedCall(pkg *loader.PackageInfo, assign *ast.AssignStmt) (*ast.CallExpr, int) {
+	if len(assign.Rhs) != 1 || (assign.Tok != token.ASSIGN && assign.Tok != token.DEFINE) {
+		return nil, 0
+	}
+	call, ok := astutil.Unparen(assign.Rhs[0]).(*ast.CallExpr)
+	if !ok {
+		return nil, 0
+	}
+	if tv, has := pkg.Info.Types[call.Fun]; !has || tv.IsType() || tv.IsBuiltin() {
+		// conversions and builtins (len, cap, ...) are not calls
+		return nil, 0
+	}
+	return call, len(assign.Lhs)
+}
+
+// scalarFunc is the suffix of the dgruntime functions recording values of
+// the type (Int, Uint or Float) and the conversion to their argument type
+// (see convert).
+// It is empty for other types.
+func scalarFunc(t types.Type) (f, conv string) {
+	if t == nil {
+		return "", ""
+	}
+	basic, ok := t.Underlying().(*types.Basic)
+	if !ok {
+		return "", ""
+	}
+	switch info := basic.Info(); {
+	case info&types.IsUntyped != 0:
+	case info&types.IsUnsigned != 0:
+		return "Uint", "Uint64"
+	case info&types.IsInteger != 0:
+		return "Int", "Int64"
+	case info&types.IsFloat != 0:
+		return "Float", "Float64"
+	}
+	return "", ""
+}
+
+// scalarsInScope are the local variables (and parameters) visible after the
+// assignment which have the same type as the assigned variable
+func scalarsInScope(pkg *loader.PackageInfo, assign *ast.AssignStmt, id *ast.Ident) []*types.Var {
+	obj := pkg.Info.ObjectOf(id)
+	if obj == nil {
+		return nil
+	}
+	scope := pkg.Pkg.Scope().Innermost(assign.Pos())
+	seen := make(map[string]bool)
+	var vars []*types.Var
+	for ; scope != nil && scope != pkg.Pkg.Scope() && scope != types.Universe; scope = scope.Parent() {
+		for _, name := range scope.Names() {
+			if seen[name] {
+				// shadowed by a variable of an inner scope
+				continue
+			}
+			v, ok := scope.Lookup(name).(*types.Var)
+			if !ok || v.Pos() >= assign.Pos() || !v.Pos().IsValid() {
+				continue
+			}
+			seen[name] = true
+			if v == obj || name == "_" || !types.Identical(v.Type(), obj.Type()) {
+				continue
+			}
+			vars = append(vars, v)
+		}
+	}
+	return vars
+}
+
+func (i *instrumenter) mkReturned(site int, assign *ast.AssignStmt, f, call, conv string, lhs ast.Expr) ast.Stmt {
+	p := i.program.Fset.Position(assign.Pos())
+	s := fmt.Sprintf("dgruntime.Returned%v(%d, %v, %v)",
+		f, site, strconv.Quote(p.String()), strconv.Quote(call))
+	x := convert(assign.End(), conv, i.reparse(assign, types.ExprString(lhs)))
+	return &ast.ExprStmt{i.mkPredCall(assign.End(), s, x)}
+}
+
+func (i *instrumenter) mkPair(site int, assign *ast.AssignStmt, f, conv string, x *ast.Ident, y *types.Var) ast.Expr {
+	p := i.program.Fset.Position(assign.Pos())
+	s := fmt.Sprintf("dgruntime.Cmp%v(%d, %v, %v, %v, dgruntime.Eql, 0)",
+		f, site, strconv.Quote(p.String()), strconv.Quote(x.Name), strconv.Quote(y.Name()))
+	return i.mkPredCall(assign.End(), s,
+		convert(assign.End(), conv, ast.NewIdent(x.Name)),
+		convert(assign.End(), conv, ast.NewIdent(y.Name())))
+}
+
+// reparse parses the expression src (a copy of an expression of the
+// assignment)
+func (i *instrumenter) reparse(assign *ast.AssignStmt, src string) ast.Expr {
+	e, err := parser.ParseExprFrom(i.program.Fset, i.program.Fset.File(assign.Pos()).Name(), src, parser.Mode(0))
+	if err != nil {
+		panic(fmt.Errorf("reparse (%v) error: %v", src, err))
+	}
+	return e
+}
+
+// cmpFunc is the dgruntime function evaluating the comparison e. It is empty
+// if e is not a comparison of numbers or strings (or is a constant). Both
+// operands must be numbers or strings: an interface compared to a number
+// can not be converted to the number's type.
+func (i *instrumenter) cmpFunc(pkg *loader.PackageInfo, e ast.Expr) string {
+	b, ok := e.(*ast.BinaryExpr)
+	if !ok || cmpOps[b.Op] == "" || !isBool(pkg, b) {
+		return ""
+	}
+	for _, operand := range []ast.Expr{b.X, b.Y} {
+		t := pkg.Info.TypeOf(operand)
+		if t == nil {
+			return ""
+		}
+		if _, ok := t.Underlying().(*types.Basic); !ok {
+			return ""
+		}
+	}
+	operand := b.X
+	if tv, has := pkg.Info.Types[b.X]; has && (tv.Value != nil || isUntyped(tv.Type)) {
+		operand = b.Y
+	}
+	t := pkg.Info.TypeOf(operand)
+	if t == nil {
+		return ""
+	}
+	basic, ok := t.Underlying().(*types.Basic)
+	if !ok || basic.Info()&types.IsUntyped != 0 {
+		return ""
+	}
+	switch info := basic.Info(); {
+	case info&types.IsUnsigned != 0:
+		return "CmpUint"
+	case info&types.IsInteger != 0:
+		return "CmpInt"
+	case info&types.IsFloat != 0:
+		return "CmpFloat"
+	case info&types.IsString != 0:
+		return "CmpString"
+	}
+	return ""
+}
+
+// isBool reports whether e is a non-constant expression of type bool (its
+// value can be handed to and returned from dgruntime unchanged)
+func isBool(pkg *loader.PackageInfo, e ast.Expr) bool {
+	tv, has := pkg.Info.Types[e]
+	if !has || tv.Value != nil {
+		return false
+	}
+	return tv.Type == types.Typ[types.Bool] || tv.Type == types.Typ[types.UntypedBool]
+}
+
+func isUntyped(t types.Type) bool {
+	b, ok := t.(*types.Basic)
+	return ok && b.Info()&types.IsUntyped != 0
+}
+
+func (i *instrumenter) mkBranch(site int, cond ast.Expr) ast.Expr {
+	p := i.program.Fset.Position(cond.Pos())
+	s := fmt.Sprintf("dgruntime.Branch(%d, %v, %v)",
+		site, strconv.Quote(p.String()), strconv.Quote(types.ExprString(cond)))
+	return i.mkPredCall(cond.Pos(), s, cond)
+}
+
+func (i *instrumenter) mkCmp(pkg *loader.PackageInfo, site int, f string, b *ast.BinaryExpr) ast.Expr {
+	p := i.program.Fset.Position(b.Pos())
+	vars := 0
+	for k, operand := range []ast.Expr{b.X, b.Y} {
+		if tv := pkg.Info.Types[operand]; tv.Value == nil {
+			vars |= 1 << uint(k)
+		}
+	}
+	conv := map[string]string{
+		"CmpInt":    "Int64",
+		"CmpUint":   "Uint64",
+		"CmpFloat":  "Float64",
+		"CmpString": "String",
+	}[f]
+	s := fmt.Sprintf("dgruntime.%v(%d, %v, %v, %v, dgruntime.%v, %d)",
+		f, site,
+		strconv.Quote(p.String()),
+		strconv.Quote(types.ExprString(b.X)),
+		strconv.Quote(types.ExprString(b.Y)),
+		cmpOps[b.Op], vars)
+	args := make([]ast.Expr, 0, 2)
+	for _, operand := range []ast.Expr{b.X, b.Y} {
+		arg := operand
+		if tv := pkg.Info.Types[operand]; tv.Value != nil && isFloat32(tv.Type) {
+			// the constant is rounded to the other operand's float32 first
+			// (float64(f) == float64(0.1) is false for f = 0.1)
+			arg = convert(operand.Pos(), "Float32", operand)
+		}
+		args = append(args, convert(operand.Pos(), conv, arg))
+	}
+	return i.mkPredCall(b.Pos(), s, args...)
+}
+
+// convert is the conversion of x to the type t names in dgruntime (see
+// dgruntime.Int64). The program may redeclare the predeclared types.
+func convert(pos token.Pos, t string, x ast.Expr) ast.Expr {
+	return &ast.CallExpr{
+		Fun:  &ast.SelectorExpr{X: &ast.Ident{NamePos: pos, Name: "dgruntime"}, Sel: ast.NewIdent(t)},
+		Args: []ast.Expr{x},
+	}
+}
+
+func isFloat32(t types.Type) bool {
+	b, ok := t.Underlying().(*types.Basic)
+	return ok && b.Kind() == types.Float32
+}
+
+// mkPredCall parses the call s to dgruntime and appends the args. The call
+// is placed at pos.
+func (i *instrumenter) mkPredCall(pos token.Pos, s string, args ...ast.Expr) ast.Expr {
+	call, err := parser.ParseExprFrom(i.program.Fset, i.program.Fset.File(pos).Name(), s, parser.Mode(0))
+	if err != nil {
+		panic(fmt.Errorf("mkPredCall (%v) error: %v", s, err))
+	}
+	c := call.(*ast.CallExpr)
+	c.Fun.(*ast.SelectorExpr).X.(*ast.Ident).NamePos = pos
+	c.Args = append(c.Args, args...)
+	return c
+}
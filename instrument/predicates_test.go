@@ -0,0 +1,181 @@
+package instrument
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"go/types"
+	"strings"
+	"testing"
+
+	"golang.org/x/tools/go/ast/astutil"
+	"golang.org/x/tools/go/loader"
+)
+
+type importerFunc func(path string) (*types.Package, error)
+
+func (f importerFunc) Import(path string) (*types.Package, error) { return f(path) }
+
+// loadSrc loads (and type checks) src, with its comments, as the package
+// test
+func loadSrc(t *testing.T, src string) (*instrumenter, *loader.PackageInfo, *ast.File) {
+	conf := loader.Config{ParserMode: parser.ParseComments}
+	f, err := conf.ParseFile("test.go", src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf.CreateFromFiles("test", f)
+	program, err := conf.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &instrumenter{program: program, entry: "test"}, program.Created[0], f
+}
+
+// runtimeAPI is the dgruntime package type checked from the source of the
+// given files alone (predicates.go by default). The rest of the package is
+// missing so its errors are ignored: the signatures of the functions are all
+// that is needed.
+func runtimeAPI(t *testing.T, names ...string) *types.Package {
+	if len(names) == 0 {
+		names = []string{"predicates.go"}
+	}
+	fset := token.NewFileSet()
+	files := make([]*ast.File, 0, len(names))
+	for _, name := range names {
+		f, err := parser.ParseFile(fset, "../dgruntime/"+name, nil, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, f)
+	}
+	conf := types.Config{
+		Importer: importerFunc(func(path string) (*types.Package, error) {
+			return nil, fmt.Errorf("%v is not needed", path)
+		}),
+		Error: func(error) {},
+	}
+	pkg, _ := conf.Check("dgruntime", fset, files, nil)
+	return pkg
+}
+
+// checkInstrumented prints the instrumented file and type checks it against
+// the dgruntime API
+func checkInstrumented(t *testing.T, i *instrumenter, f *ast.File, api *types.Package) string {
+	astutil.AddImport(i.program.Fset, f, "dgruntime")
+	var buf bytes.Buffer
+	if err := printer.Fprint(&buf, i.program.Fset, f); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	fset := token.NewFileSet()
+	parsed, err := parser.ParseFile(fset, "out.go", out, 0)
+	if err != nil {
+		t.Fatalf("%v\n%v", err, out)
+	}
+	conf := types.Config{
+		Importer: importerFunc(func(path string) (*types.Package, error) {
+			if path == "dgruntime" {
+				return api, nil
+			}
+			return nil, fmt.Errorf("unexpected import %v", path)
+		}),
+	}
+	if _, err := conf.Check("test", fset, []*ast.File{parsed}, nil); err != nil {
+		t.Errorf("the instrumented code does not type check: %v\n%v", err, out)
+	}
+	return out
+}
+
+// squash drops the white space the printer lays the code out with
+func squash(s string) string {
+	return strings.Join(strings.Fields(s), "")
+}
+
+func TestPredicateSites(t *testing.T) {
+	api := runtimeAPI(t)
+	for _, c := range []struct {
+		src  string
+		want []string // in the instrumented source
+		not  []string // not in the instrumented source
+	}{
+		{
+			src:  `func f(x, y int) { if x < y { } }`,
+			want: []string{`dgruntime.CmpInt(0, "test.go:2:23", "x", "y", dgruntime.Lss, 3, dgruntime.Int64(x), dgruntime.Int64(y))`},
+		},
+		{
+			src:  `func f(x uint8, s string) bool { return x >= 3 && s != "a" }`,
+			want: []string{`dgruntime.CmpUint(0,`, `dgruntime.Geq, 1, dgruntime.Uint64(x), dgruntime.Uint64(3))`, `dgruntime.CmpString(1,`, `dgruntime.String(s), dgruntime.String("a"))`},
+		},
+		{
+			// the constant is rounded to float32 as the comparison does
+			src:  `func f(x float32) bool { return x == 0.1 || 16777217 < x }`,
+			want: []string{`dgruntime.Float64(x), dgruntime.Float64(dgruntime.Float32(0.1)))`, `dgruntime.Float64(dgruntime.Float32(16777217)), dgruntime.Float64(x))`},
+		},
+		{
+			src:  `type T float32; func f(x T) bool { return x > 1.5 }`,
+			want: []string{`dgruntime.Float64(x), dgruntime.Float64(dgruntime.Float32(1.5)))`},
+		},
+		{
+			src:  `func f(x float64) bool { return x == 0.1 }`,
+			want: []string{`dgruntime.Float64(x), dgruntime.Float64(0.1))`},
+			not:  []string{`dgruntime.Float32`},
+		},
+		{
+			// an interface compared to a number is not a comparison of numbers
+			src:  `func f(i int, n interface{}) bool { if i == n { return true }; return n != 3 }`,
+			want: []string{`dgruntime.Branch(0, "test.go:2:40", "i == n", i == n)`},
+			not:  []string{`dgruntime.Cmp`},
+		},
+		{
+			src:  `func f(a, b bool) { for a && !b { } }`,
+			want: []string{`dgruntime.Branch(0, "test.go:2:25", "a", a)`, `dgruntime.Branch(1, "test.go:2:30", "!b", !b)`},
+		},
+		{
+			src: `func g() (int, error) { return 0, nil }
+func f(max int) int {
+	n, err := g()
+	if err != nil {
+		return 0
+	}
+	return n
+}`,
+			want: []string{
+				`dgruntime.ReturnedInt(1, "test.go:4:2", "result 0 of g()", dgruntime.Int64(n))`,
+				`dgruntime.CmpInt(2, "test.go:4:2", "n", "max", dgruntime.Eql, 0, dgruntime.Int64(n), dgruntime.Int64(max))`,
+			},
+		},
+		{
+			// conversions and builtins are not calls
+			src:  `func f(s string) int { n := len(s); m := int(n); return m }`,
+			want: []string{`dgruntime.CmpInt(0, "test.go:2:37", "m", "n", dgruntime.Eql, 0, dgruntime.Int64(m), dgruntime.Int64(n))`},
+			not:  []string{`dgruntime.Returned`},
+		},
+		{
+			// the program may redeclare the predeclared types
+			src:  `const int64, float64 = 1, 2; func f(x int, y float32) bool { return x < int64 || y > 0.5 }`,
+			want: []string{`dgruntime.Int64(x), dgruntime.Int64(int64))`, `dgruntime.Float64(y), dgruntime.Float64(dgruntime.Float32(0.5)))`},
+		},
+	} {
+		i, pkg, f := loadSrc(t, "package test\n"+c.src+"\n")
+		for _, decl := range f.Decls {
+			if fn, ok := decl.(*ast.FuncDecl); ok {
+				i.predicateSites(pkg, &fn.Body.List)
+			}
+		}
+		out := checkInstrumented(t, i, f, api)
+		for _, want := range c.want {
+			if !strings.Contains(squash(out), squash(want)) {
+				t.Errorf("%v: %v missing from\n%v", c.src, want, out)
+			}
+		}
+		for _, not := range c.not {
+			if strings.Contains(squash(out), squash(not)) {
+				t.Errorf("%v: unexpected %v in\n%v", c.src, not, out)
+			}
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package instrument
+
+import (
+	"go/ast"
+	"go/token"
+	"strconv"
+)
+
+import (
+	"github.com/timtadh/data-structures/errors"
+)
+
+import (
+	"github.com/timtadh/dynagrok/analysis"
+)
+
+// probes places the entry probes (dgruntime.EnterBlk) which are not at the
+// start of their basic block's statements: the probes of the blocks which
+// are entered by jumping back to a loop (a range loop's header and a for
+// loop's post statement), of the select cases without a body and of the
+// exit of the function. They are placed before a statement or at the end of
+// a list of statements. The statements are found by identity when the probes
+// are inserted as the blocks starting a list of statements are instrumented
+// first (inserting statements moves the ones after them).
+type probes struct {
+	i     *instrumenter
+	cfg   *analysis.CFG
+	lists map[ast.Stmt]*[]ast.Stmt // the list holding a statement
+	posts map[ast.Stmt]*ast.ForStmt
+	comms map[ast.Stmt]*ast.CommClause
+	todo  []probe
+}
+
+type probe struct {
+	blk    *analysis.Block
+	list   *[]ast.Stmt
+	before ast.Stmt // nil to put the probe at the end of the list
+	pos    token.Pos
+	stmt   ast.Stmt // the probe, nil for the block's EnterBlk
+}
+
+func newProbes(i *instrumenter, cfg *analysis.CFG, fnBody *[]ast.Stmt) *probes {
+	p := &probes{
+		i:     i,
+		cfg:   cfg,
+		lists: make(map[ast.Stmt]*[]ast.Stmt),
+		posts: make(map[ast.Stmt]*ast.ForStmt),
+		comms: make(map[ast.Stmt]*ast.CommClause),
+	}
+	analysis.Blocks(fnBody, nil, func(blk *[]ast.Stmt, id int) error {
+		for _, s := range *blk {
+			p.lists[s] = blk
+			for l, ok := s.(*ast.LabeledStmt); ok; l, ok = l.Stmt.(*ast.LabeledStmt) {
+				p.lists[l.Stmt] = blk
+			}
+		}
+		return nil
+	})
+	for _, s := range *fnBody {
+		ast.Inspect(s, func(n ast.Node) bool {
+			switch x := n.(type) {
+			case *ast.FuncLit:
+				return false
+			case *ast.ForStmt:
+				if x.Post != nil {
+					p.posts[x.Post] = x
+				}
+			case *ast.CommClause:
+				if x.Comm != nil {
+					p.comms[x.Comm] = x
+				}
+			}
+			return true
+		})
+	}
+	return p
+}
+
+// before probes blk before the statement s (and before its labels)
+func (p *probes) before(blk *analysis.Block, s ast.Stmt) error {
+	list, has := p.lists[s]
+	if !has {
+		return errors.Errorf("no statement list holds the start of block %d of %v", blk.Id, p.cfg.Name)
+	}
+	p.todo = append(p.todo, probe{blk: blk, list: list, before: s, pos: s.Pos()})
+	return nil
+}
+
+// end probes blk at the end of the list
+func (p *probes) end(blk *analysis.Block, list *[]ast.Stmt, pos token.Pos) {
+	p.todo = append(p.todo, probe{blk: blk, list: list, pos: pos})
+}
+
+// jumps probes blk before each goto and continue which jumps to it. The
+// probes placed at the block's start (or before its label) are not run by
+// them. (A break jumps to the statement after the one it breaks out of so
+// it runs the probes placed there.)
+func (p *probes) jumps(blk *analysis.Block) error {
+	for _, f := range blk.Prev {
+		if len(f.Block.Stmts) == 0 {
+			continue
+		}
+		branch, ok := (*f.Block.Stmts[len(f.Block.Stmts)-1]).(*ast.BranchStmt)
+		if !ok || (branch.Tok != token.GOTO && branch.Tok != token.CONTINUE) {
+			continue
+		}
+		if err := p.before(blk, branch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// insert inserts the probes in the order they were added
+func (p *probes) insert() error {
+	for _, x := range p.todo {
+		j := len(*x.list)
+		if x.before != nil {
+			j = indexOf(*x.list, x.before)
+			if j < 0 {
+				return errors.Errorf("lost the statement starting block %d of %v", x.blk.Id, p.cfg.Name)
+			}
+		}
+		stmt := x.stmt
+		if stmt == nil {
+			stmt = p.i.mkEnterBlk(x.pos, x.blk)
+		}
+		*x.list = Insert(p.cfg, x.blk, *x.list, j, stmt)
+	}
+	return nil
+}
+
+// indexOf is the index of the statement s (or of the labeled statement
+// labeling it) in list
+func indexOf(list []ast.Stmt, s ast.Stmt) int {
+	for j, x := range list {
+		for {
+			if x == s {
+				return j
+			}
+			l, ok := x.(*ast.LabeledStmt)
+			if !ok {
+				break
+			}
+			x = l.Stmt
+		}
+	}
+	return -1
+}
+
+// isExit reports whether blk is the block entered by falling off the end of
+// the function
+func isExit(blk *analysis.Block) bool {
+	return blk.Id != 0 && len(blk.Stmts) == 0 && blk.Cond == nil
+}
+
+// hasResults reports whether the function returns values. Such a function
+// ends in a terminating statement so its exit block is never entered.
+func hasResults(cfg *analysis.CFG) bool {
+	return cfg.Type.Results != nil && len(cfg.Type.Results.List) > 0
+}
+
+// checkProbes verifies that every basic block of the function has an entry
+// probe. The entry block is entered by dgruntime.EnterFunc.
+func (i *instrumenter) checkProbes(cfg *analysis.CFG, fnBody *[]ast.Stmt) error {
+	probed := make(map[int]bool, len(cfg.Blocks))
+	for _, s := range *fnBody {
+		ast.Inspect(s, func(n ast.Node) bool {
+			switch x := n.(type) {
+			case *ast.FuncLit:
+				// instrumented as a function of its own
+				return false
+			case *ast.CallExpr:
+				if id, ok := probeId(x); ok {
+					probed[id] = true
+				}
+			}
+			return true
+		})
+	}
+	for _, b := range cfg.Blocks {
+		if b.Id == 0 || probed[b.Id] || (isExit(b) && hasResults(cfg)) {
+			continue
+		}
+		return errors.Errorf("block %d of %v has no entry probe", b.Id, cfg.Name)
+	}
+	return nil
+}
+
+// probeId is the block id of a call to dgruntime.EnterBlk or
+// dgruntime.EnterBlkFromCond
+func probeId(call *ast.CallExpr) (int, bool) {
+	sel, ok := call.Fun.(*ast.SelectorExpr)
+	if !ok {
+		return 0, false
+	}
+	if sel.Sel.Name != "EnterBlk" && sel.Sel.Name != "EnterBlkFromCond" {
+		return 0, false
+	}
+	if pkg, ok := sel.X.(*ast.Ident); !ok || pkg.Name != "dgruntime" || len(call.Args) == 0 {
+		return 0, false
+	}
+	lit, ok := call.Args[0].(*ast.BasicLit)
+	if !ok || lit.Kind != token.INT {
+		return 0, false
+	}
+	id, err := strconv.Atoi(lit.Value)
+	if err != nil {
+		return 0, false
+	}
+	return id, true
+}
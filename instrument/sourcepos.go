@@ -0,0 +1,139 @@
+package instrument
+
+import (
+	"go/ast"
+	"go/printer"
+	"go/token"
+	"io"
+	"reflect"
+)
+
+// config prints the files of the instrumented program with //line
+// directives so the positions the compiler records (in error messages, panics
+// and stack traces) are the positions in the original source.
+var config = printer.Config{Mode: printer.RawFormat | printer.SourcePos, Tabwidth: 8}
+
+// printFile writes the (instrumented) file f
+func printFile(fout io.Writer, fset *token.FileSet, f *ast.File) error {
+	sourcePositions(fset, f)
+	return config.Fprint(fout, fset, f)
+}
+
+var posType = reflect.TypeOf(token.NoPos)
+
+// sourcePositions moves the nodes added by the instrumentation to the
+// positions of the code they instrument. They are parsed from strings so
+// their positions are in files of their own (which the printer would write
+// as //line directives to line 1 and lay out by). A node takes the position
+// of the first original node it holds (eg. the condition a probe is
+// prepended to). A statement holding none takes the position of the
+// original statement after it (the one its probe is placed before) or of
+// the closing brace of its block. Anything else takes the position of its
+// parent.
+func sourcePositions(fset *token.FileSet, f *ast.File) {
+	file := fset.File(f.Pos())
+	if file == nil {
+		return
+	}
+	orig := func(p token.Pos) bool {
+		return int(p) >= file.Base() && int(p) <= file.Base()+file.Size()
+	}
+	first := func(n ast.Node) (pos token.Pos) {
+		ast.Inspect(n, func(n ast.Node) bool {
+			if n == nil || pos.IsValid() {
+				return false
+			}
+			if orig(n.Pos()) {
+				pos = n.Pos()
+				return false
+			}
+			return true
+		})
+		return pos
+	}
+	anchors := make(map[ast.Node]token.Pos)
+	list := func(stmts []ast.Stmt, end token.Pos) {
+		next := end
+		for j := len(stmts) - 1; j >= 0; j-- {
+			if p := first(stmts[j]); p.IsValid() {
+				next = p
+			} else if next.IsValid() {
+				anchors[stmts[j]] = next
+			}
+		}
+	}
+	parents := []token.Pos{f.Pos()}
+	ast.Inspect(f, func(n ast.Node) bool {
+		if n == nil {
+			parents = parents[:len(parents)-1]
+			return true
+		}
+		switch x := n.(type) {
+		case *ast.BlockStmt:
+			end := x.Rbrace
+			if !orig(end) {
+				end = token.NoPos
+			}
+			list(x.List, end)
+		case *ast.CaseClause:
+			list(x.Body, token.NoPos)
+		case *ast.CommClause:
+			list(x.Body, token.NoPos)
+		}
+		pos := n.Pos()
+		if !orig(pos) {
+			if p, has := anchors[n]; has {
+				pos = p
+			} else if p := first(n); p.IsValid() {
+				pos = p
+			} else {
+				pos = parents[len(parents)-1]
+			}
+		}
+		setPositions(n, orig, pos)
+		parents = append(parents, pos)
+		return true
+	})
+}
+
+// setPositions sets the positions of the node n (not of its children) which
+// are not original to pos. The missing positions of the nodes built without
+// any (see positioned) are set as well: the printer estimates them from the
+// text printed before, which may flush the comments after the node (eg. the
+// //go:noinline of the next function) into the middle of it.
+func setPositions(n ast.Node, orig func(token.Pos) bool, pos token.Pos) {
+	v := reflect.ValueOf(n)
+	if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Struct {
+		return
+	}
+	fill := positioned(n)
+	v = v.Elem()
+	for j := 0; j < v.NumField(); j++ {
+		field := v.Field(j)
+		if field.Type() != posType || !field.CanSet() {
+			continue
+		}
+		p := token.Pos(field.Int())
+		if p.IsValid() && !orig(p) {
+			field.SetInt(int64(pos))
+		} else if !p.IsValid() && fill && v.Type().Field(j).Name != "Ellipsis" {
+			field.SetInt(int64(pos))
+		}
+	}
+}
+
+// positioned is true for the nodes whose positions the parser always sets.
+// (Elsewhere a missing position means a missing token, eg. the Lparen of an
+// import declaration without parentheses. The Ellipsis of a call is missing
+// without the "...".)
+func positioned(n ast.Node) bool {
+	switch n.(type) {
+	case *ast.Ident, *ast.BasicLit, *ast.CompositeLit, *ast.ParenExpr,
+		*ast.IndexExpr, *ast.SliceExpr, *ast.TypeAssertExpr, *ast.CallExpr,
+		*ast.StarExpr, *ast.UnaryExpr, *ast.BinaryExpr, *ast.KeyValueExpr,
+		*ast.AssignStmt, *ast.IncDecStmt, *ast.GoStmt, *ast.DeferStmt,
+		*ast.ReturnStmt, *ast.BlockStmt:
+		return true
+	}
+	return false
+}
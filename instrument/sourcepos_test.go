@@ -0,0 +1,164 @@
+package instrument
+
+import (
+	"bytes"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"testing"
+)
+
+import (
+	"golang.org/x/tools/go/loader"
+)
+
+func TestSourcePositions(t *testing.T) {
+	src := `package test
+
+func f(c bool) {
+	g()
+
+	if c {
+		g()
+	}
+}
+
+func g() {}
+`
+	for _, c := range []struct {
+		name string
+		add  func(fn *ast.FuncDecl, probe ast.Expr)
+		want int // the line of the probe in the original source
+	}{
+		{
+			name: "before a statement",
+			add: func(fn *ast.FuncDecl, probe ast.Expr) {
+				fn.Body.List = append([]ast.Stmt{&ast.ExprStmt{X: probe}}, fn.Body.List...)
+			},
+			want: 4,
+		},
+		{
+			name: "before a statement after a blank line",
+			add: func(fn *ast.FuncDecl, probe ast.Expr) {
+				fn.Body.List = append(fn.Body.List[:1], &ast.ExprStmt{X: probe}, fn.Body.List[1])
+			},
+			want: 6,
+		},
+		{
+			name: "at the end of a block",
+			add: func(fn *ast.FuncDecl, probe ast.Expr) {
+				fn.Body.List = append(fn.Body.List, &ast.ExprStmt{X: probe})
+			},
+			want: 9,
+		},
+		{
+			name: "in a nested block",
+			add: func(fn *ast.FuncDecl, probe ast.Expr) {
+				body := fn.Body.List[1].(*ast.IfStmt).Body
+				body.List = append([]ast.Stmt{&ast.ExprStmt{X: probe}}, body.List...)
+			},
+			want: 7,
+		},
+		{
+			name: "in a condition",
+			add: func(fn *ast.FuncDecl, probe ast.Expr) {
+				s := fn.Body.List[1].(*ast.IfStmt)
+				s.Cond = &ast.BinaryExpr{X: probe, Op: token.LAND, Y: s.Cond}
+			},
+			want: 6,
+		},
+	} {
+		fset := token.NewFileSet()
+		f, err := parser.ParseFile(fset, "test.go", src, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// added code is parsed from strings (see mkEnterBlk)
+		probe, err := parser.ParseExprFrom(fset, "test.go", "probe()", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.add(f.Decls[0].(*ast.FuncDecl), probe)
+		var buf bytes.Buffer
+		if err := printFile(&buf, fset, f); err != nil {
+			t.Fatal(err)
+		}
+		out := token.NewFileSet()
+		printed, err := parser.ParseFile(out, "out.go", buf.Bytes(), 0)
+		if err != nil {
+			t.Fatalf("%v: %v\n%v", c.name, err, buf.String())
+		}
+		found := false
+		ast.Inspect(printed, func(n ast.Node) bool {
+			call, ok := n.(*ast.CallExpr)
+			if !ok {
+				return true
+			}
+			if id, ok := call.Fun.(*ast.Ident); ok && id.Name == "probe" {
+				found = true
+				if p := out.Position(call.Pos()); p.Filename != "test.go" || p.Line != c.want {
+					t.Errorf("%v: the probe is at %v, expected test.go:%d\n%v", c.name, p, c.want, buf.String())
+				}
+			}
+			return true
+		})
+		if !found {
+			t.Errorf("%v: no probe in\n%v", c.name, buf.String())
+		}
+	}
+}
+
+// The statements added after an assignment are built without positions
+// (see mkPair). The printer estimates the positions of their tokens from the
+// text before them, which places the directive of the next function inside.
+func TestSourcePositionsKeepDirectives(t *testing.T) {
+	src := `package test
+
+//go:noinline
+func f(x, y int) *int {
+	x = x*y + y
+	return &x
+}
+
+//go:noinline
+func g(x int) *int {
+	return &x
+}
+`
+	conf := loader.Config{ParserMode: parser.ParseComments}
+	f, err := conf.ParseFile("test.go", src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf.CreateFromFiles("test", f)
+	program, err := conf.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := &instrumenter{program: program, entry: "test"}
+	fn := f.Decls[0].(*ast.FuncDecl)
+	i.predicateSites(program.Created[0], &fn.Body.List)
+	var buf bytes.Buffer
+	if err := printFile(&buf, program.Fset, f); err != nil {
+		t.Fatal(err)
+	}
+	printed, err := parser.ParseFile(token.NewFileSet(), "out.go", buf.Bytes(), parser.ParseComments)
+	if err != nil {
+		t.Fatalf("%v\n%v", err, buf.String())
+	}
+	for _, decl := range printed.Decls {
+		fn, ok := decl.(*ast.FuncDecl)
+		if !ok {
+			continue
+		}
+		directive := false
+		if fn.Doc != nil {
+			for _, c := range fn.Doc.List {
+				directive = directive || c.Text == "//go:noinline"
+			}
+		}
+		if !directive {
+			t.Errorf("the directive of %v moved\n%v", fn.Name, buf.String())
+		}
+	}
+}
@@ -0,0 +1,265 @@
+package instrument
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+import (
+	"github.com/timtadh/data-structures/errors"
+	"golang.org/x/tools/go/ast/astutil"
+	"golang.org/x/tools/go/loader"
+)
+
+import (
+	"github.com/timtadh/dynagrok/analysis"
+)
+
+// testMainFile is the name of the file holding the TestMain added to packages
+// which do not have one.
+const testMainFile = "dynagrok_testmain_test.go"
+
+// isEntry reports whether pkg is the entry package or (when instrumenting
+// tests) its external test package.
+func (i *instrumenter) isEntry(pkg *loader.PackageInfo) bool {
+	return pkg.Pkg.Path() == i.entry || (i.tests && pkg.Pkg.Path() == i.entry+"_test")
+}
+
+// testFunc reports whether fnAst is a TestXxx function of the package under
+// test and returns its *testing.T parameter.
+func (i *instrumenter) testFunc(pkg *loader.PackageInfo, fnAst ast.Node) (*ast.Field, bool) {
+	fn, ok := fnAst.(*ast.FuncDecl)
+	if !ok || !i.tests || !i.isEntry(pkg) || fn.Recv != nil || fn.Name.Name == "TestMain" {
+		return nil, false
+	}
+	if !isTestName(fn.Name.Name) || !strings.HasSuffix(i.program.Fset.File(fn.Pos()).Name(), "_test.go") {
+		return nil, false
+	}
+	return i.onlyParam(pkg, fn, "*testing.T")
+}
+
+// testMain reports whether fnAst is the TestMain of the package under test
+// and returns its *testing.M parameter.
+func (i *instrumenter) testMain(pkg *loader.PackageInfo, fnAst ast.Node) (*ast.Field, bool) {
+	fn, ok := fnAst.(*ast.FuncDecl)
+	if !ok || !i.tests || !i.isEntry(pkg) || fn.Recv != nil || fn.Name.Name != "TestMain" {
+		return nil, false
+	}
+	return i.onlyParam(pkg, fn, "*testing.M")
+}
+
+func (i *instrumenter) onlyParam(pkg *loader.PackageInfo, fn *ast.FuncDecl, typ string) (*ast.Field, bool) {
+	params := fn.Type.Params.List
+	if len(params) != 1 || len(params[0].Names) > 1 {
+		return nil, false
+	}
+	t := pkg.Info.TypeOf(params[0].Type)
+	if t == nil || types.TypeString(t, nil) != typ {
+		return nil, false
+	}
+	return params[0], true
+}
+
+// isTestName follows the go command's rule: Test followed by nothing or by a
+// character which is not a lower case letter.
+func isTestName(name string) bool {
+	if !strings.HasPrefix(name, "Test") {
+		return false
+	}
+	if len(name) == len("Test") {
+		return true
+	}
+	r, _ := utf8.DecodeRuneInString(name[len("Test"):])
+	return !unicode.IsLower(r)
+}
+
+// testHooks opens and closes a segment around each TestXxx function and
+// shuts the profiler down when a TestMain's call to testing.M.Run returns.
+// It is called after the rest of the instrumentation has been inserted so
+// the hooks surround the function's EnterFunc and ExitFunc calls.
+func (i *instrumenter) testHooks(cfg *analysis.CFG, blk *analysis.Block, pkg *loader.PackageInfo, fnAst ast.Node, fnBody *[]ast.Stmt) {
+	if t, ok := i.testFunc(pkg, fnAst); ok {
+		if len(t.Names) == 0 || t.Names[0].Name == "_" {
+			t.Names = []*ast.Ident{ast.NewIdent("__dgt")}
+		}
+		name := t.Names[0].Name
+		*fnBody = Insert(cfg, blk, *fnBody, 0, i.mkEndTest(fnAst.Pos(), name))
+		*fnBody = Insert(cfg, blk, *fnBody, 0, i.mkBeginTest(fnAst.Pos(), name))
+	}
+	if _, ok := i.testMain(pkg, fnAst); ok {
+		i.wrapRun(pkg, fnAst)
+		*fnBody = Insert(cfg, blk, *fnBody, 0, i.mkSetGranularity(fnAst.Pos()))
+		*fnBody = Insert(cfg, blk, *fnBody, 0, i.mkSetPolicy(fnAst.Pos()))
+	}
+}
+
+// wrapRun replaces the calls to testing.M.Run in fnAst with
+// dgruntime.TestsDone(m.Run())
+func (i *instrumenter) wrapRun(pkg *loader.PackageInfo, fnAst ast.Node) {
+	astutil.Apply(fnAst, nil, func(c *astutil.Cursor) bool {
+		call, ok := c.Node().(*ast.CallExpr)
+		if !ok {
+			return true
+		}
+		sel, ok := call.Fun.(*ast.SelectorExpr)
+		if !ok || sel.Sel.Name != "Run" {
+			return true
+		}
+		if t := pkg.Info.TypeOf(sel.X); t == nil || types.TypeString(t, nil) != "*testing.M" {
+			return true
+		}
+		c.Replace(i.mkTestsDone(call))
+		return true
+	})
+}
+
+// wrapParallel replaces the calls to testing.T.Parallel in body with
+// dgruntime.Parallel(t) which runs the parallel tests one at a time so each
+// test's segment only holds what the test did. Every instrumented function
+// is wrapped (not only the TestXxx functions) as a test may call Parallel
+// from a helper. The calls are found by the method they call so a Parallel
+// promoted from an embedded *testing.T is wrapped too.
+func (i *instrumenter) wrapParallel(pkg *loader.PackageInfo, body []ast.Stmt) {
+	for _, stmt := range body {
+		astutil.Apply(stmt, nil, func(c *astutil.Cursor) bool {
+			call, ok := c.Node().(*ast.CallExpr)
+			if !ok {
+				return true
+			}
+			if t := parallelT(pkg, call); t != nil {
+				c.Replace(i.mkParallel(t))
+			}
+			return true
+		})
+	}
+}
+
+// parallelT is the *testing.T whose Parallel method the call calls, nil if
+// the call is not a call of (*testing.T).Parallel
+func parallelT(pkg *loader.PackageInfo, call *ast.CallExpr) ast.Expr {
+	sel, ok := call.Fun.(*ast.SelectorExpr)
+	if !ok || sel.Sel.Name != "Parallel" || len(call.Args) != 0 {
+		return nil
+	}
+	fn, ok := pkg.Info.Uses[sel.Sel].(*types.Func)
+	if !ok || fn.FullName() != "(*testing.T).Parallel" {
+		return nil
+	}
+	selection := pkg.Info.Selections[sel]
+	if selection == nil || selection.Kind() != types.MethodVal {
+		return nil
+	}
+	// follow the embedded fields to the *testing.T
+	t := sel.X
+	typ := selection.Recv()
+	path := selection.Index()
+	for _, index := range path[:len(path)-1] {
+		if ptr, ok := typ.Underlying().(*types.Pointer); ok {
+			typ = ptr.Elem()
+		}
+		st, ok := typ.Underlying().(*types.Struct)
+		if !ok {
+			return nil
+		}
+		field := st.Field(index)
+		t = &ast.SelectorExpr{X: t, Sel: &ast.Ident{NamePos: sel.Sel.Pos(), Name: field.Name()}}
+		typ = field.Type()
+	}
+	if _, ok := typ.Underlying().(*types.Pointer); !ok {
+		// an addressable testing.T
+		t = &ast.UnaryExpr{OpPos: t.Pos(), Op: token.AND, X: t}
+	}
+	return t
+}
+
+// addTestMain gives the package under test a TestMain if neither it nor its
+// external test package has one. The TestMain records the policy and the
+// granularity and shuts the profiler down after the tests have run.
+func (i *instrumenter) addTestMain(entry *loader.PackageInfo) error {
+	pkgs := []*loader.PackageInfo{entry}
+	if xtest := i.program.Package(i.entry + "_test"); xtest != nil {
+		pkgs = append(pkgs, xtest)
+	}
+	for _, pkg := range pkgs {
+		for _, f := range pkg.Files {
+			for _, decl := range f.Decls {
+				if _, has := i.testMain(pkg, decl); has {
+					return nil
+				}
+			}
+		}
+	}
+	if len(entry.Files) <= 0 {
+		return errors.Errorf("The package under test %v has no files", i.entry)
+	}
+	dir := filepath.Dir(i.program.Fset.File(entry.Files[0].Pos()).Name())
+	src := fmt.Sprintf(`package %v
+
+import (
+	__dgos "os"
+	__dgtesting "testing"
+
+	"dgruntime"
+)
+
+func TestMain(m *__dgtesting.M) {
+	dgruntime.SetPolicy(%v)
+	dgruntime.SetGranularity(%v)
+	__dgos.Exit(dgruntime.TestsDone(m.Run()))
+}
+`, entry.Pkg.Name(), strconv.Quote(i.policy.String()), strconv.Quote(i.granularity))
+	f, err := parser.ParseFile(i.program.Fset, filepath.Join(dir, testMainFile), src, parser.ParseComments)
+	if err != nil {
+		return errors.Errorf("could not make TestMain: %v", err)
+	}
+	entry.Files = append(entry.Files, f)
+	return nil
+}
+
+func (i *instrumenter) mkBeginTest(pos token.Pos, t string) ast.Stmt {
+	s := fmt.Sprintf("dgruntime.BeginTest(%v)", t)
+	e, err := parser.ParseExprFrom(i.program.Fset, i.program.Fset.File(pos).Name(), s, parser.Mode(0))
+	if err != nil {
+		panic(fmt.Errorf("mkBeginTest (%v) error: %v", s, err))
+	}
+	return &ast.ExprStmt{e}
+}
+
+func (i *instrumenter) mkEndTest(pos token.Pos, t string) ast.Stmt {
+	s := fmt.Sprintf("func() { dgruntime.EndTest(%v) }()", t)
+	e, err := parser.ParseExprFrom(i.program.Fset, i.program.Fset.File(pos).Name(), s, parser.Mode(0))
+	if err != nil {
+		panic(fmt.Errorf("mkEndTest (%v) error: %v", s, err))
+	}
+	return &ast.DeferStmt{Call: e.(*ast.CallExpr)}
+}
+
+func (i *instrumenter) mkTestsDone(run *ast.CallExpr) ast.Expr {
+	s := "dgruntime.TestsDone(0)"
+	e, err := parser.ParseExprFrom(i.program.Fset, i.program.Fset.File(run.Pos()).Name(), s, parser.Mode(0))
+	if err != nil {
+		panic(fmt.Errorf("mkTestsDone (%v) error: %v", s, err))
+	}
+	call := e.(*ast.CallExpr)
+	call.Args[0] = run
+	return call
+}
+
+func (i *instrumenter) mkParallel(t ast.Expr) ast.Expr {
+	s := "dgruntime.Parallel(nil)"
+	e, err := parser.ParseExprFrom(i.program.Fset, i.program.Fset.File(t.Pos()).Name(), s, parser.Mode(0))
+	if err != nil {
+		panic(fmt.Errorf("mkParallel (%v) error: %v", s, err))
+	}
+	call := e.(*ast.CallExpr)
+	call.Args[0] = t
+	return call
+}
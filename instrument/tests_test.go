@@ -0,0 +1,157 @@
+package instrument
+
+import (
+	"bytes"
+	"go/ast"
+	"go/printer"
+	"strings"
+	"testing"
+)
+
+import (
+	"golang.org/x/tools/go/loader"
+)
+
+import (
+	"github.com/timtadh/dynagrok/dgruntime/dgtypes"
+	"github.com/timtadh/dynagrok/dgruntime/excludes"
+)
+
+// instrumentTests instruments the test file src of the package test as
+// instrument --test does and prints the package's files
+func instrumentTests(t *testing.T, src string) string {
+	conf := loader.Config{
+		// only the package under test needs its bodies checked
+		TypeCheckFuncBodies: func(path string) bool { return path == "test" },
+	}
+	f, err := conf.ParseFile("/src/test/test_test.go", src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf.CreateFromFiles("test", f)
+	program, err := conf.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkg := program.Created[0]
+	i := &instrumenter{
+		program:     program,
+		entry:       "test",
+		tests:       true,
+		policy:      excludes.NewPolicy(),
+		granularity: dgtypes.BlockGranularity,
+	}
+	for _, decl := range f.Decls {
+		if fn, ok := decl.(*ast.FuncDecl); ok {
+			if err := i.fnBody(pkg, "test."+fn.Name.Name, fn, &fn.Body.List); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := i.addTestMain(pkg); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	for _, file := range pkg.Files {
+		if err := printer.Fprint(&buf, program.Fset, file); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.String()
+}
+
+func checkContains(t *testing.T, out string, want, not []string) {
+	for _, w := range want {
+		if !strings.Contains(squash(out), squash(w)) {
+			t.Errorf("%v missing from\n%v", w, out)
+		}
+	}
+	for _, n := range not {
+		if strings.Contains(squash(out), squash(n)) {
+			t.Errorf("unexpected %v in\n%v", n, out)
+		}
+	}
+}
+
+func TestTestHooks(t *testing.T) {
+	out := instrumentTests(t, `package test
+
+import "testing"
+
+type helper struct {
+	*testing.T
+	n int
+}
+
+type value struct {
+	testing.T
+}
+
+type other struct{}
+
+func (other) Parallel() {}
+
+func parallel(t *testing.T) {
+	t.Parallel()
+}
+
+func TestA(t *testing.T) {
+	parallel(t)
+	t.Run("sub", func(t *testing.T) {
+		t.Parallel()
+	})
+	h := &helper{T: t}
+	h.Parallel()
+	var v value
+	v.Parallel()
+	other{}.Parallel()
+}
+
+func TestB(*testing.T) {}
+
+func TestMain(m *testing.M) {
+	m.Run()
+}
+`)
+	checkContains(t, out, []string{
+		// the segment of each test
+		`func TestA(t *testing.T) { dgruntime.BeginTest(t) defer func() { dgruntime.EndTest(t) }()`,
+		`func TestB(__dgt *testing.T) { dgruntime.BeginTest(__dgt) defer func() { dgruntime.EndTest(__dgt) }()`,
+		// every call of Parallel
+		`func parallel(t *testing.T) {`,
+		`dgruntime.Parallel(t)`,
+		`t.Run("sub", func(t *testing.T) {`,
+		`dgruntime.Parallel(h.T)`,
+		`dgruntime.Parallel(&v.T)`,
+		`other{}.Parallel()`,
+		// the TestMain shuts the profiler down
+		`dgruntime.SetPolicy(`,
+		`dgruntime.SetGranularity("block")`,
+		`dgruntime.TestsDone(m.Run())`,
+	}, []string{
+		`t.Parallel()`,
+		`h.Parallel()`,
+		`v.Parallel()`,
+		`func TestMain(m *__dgtesting.M)`,
+	})
+	if n := strings.Count(squash(out), "dgruntime.Parallel(t)"); n != 2 {
+		t.Errorf("%d calls of dgruntime.Parallel(t) expected 2\n%v", n, out)
+	}
+	if n := strings.Count(out, "dgruntime.BeginTest("); n != 2 {
+		t.Errorf("%d segments expected 2 (the subtest and TestMain get none)\n%v", n, out)
+	}
+}
+
+func TestAddTestMain(t *testing.T) {
+	out := instrumentTests(t, `package test
+
+import "testing"
+
+func TestA(t *testing.T) {}
+`)
+	checkContains(t, out, []string{
+		`func TestMain(m *__dgtesting.M) {`,
+		`dgruntime.SetGranularity("block")`,
+		`__dgos.Exit(dgruntime.TestsDone(m.Run()))`,
+	}, nil)
+}
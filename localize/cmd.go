@@ -9,6 +9,7 @@ import (
 	discflo "github.com/timtadh/dynagrok/localize/discflo/cmd"
 	"github.com/timtadh/dynagrok/localize/locavore"
 	"github.com/timtadh/dynagrok/localize/mine"
+	"github.com/timtadh/dynagrok/localize/predicates"
 	"github.com/timtadh/dynagrok/localize/stat"
 )
 
@@ -18,6 +19,7 @@ func NewCommand(c *cmd.Config) cmd.Runnable {
 	df := discflo.NewCommand(c)
 	m := mine.NewCommand(c)
 	locav := locavore.NewCommand(c)
+	preds := predicates.NewCommand(c)
 	return cmd.Concat(
 		main,
 		cmd.Commands(map[string]cmd.Runnable{
@@ -25,6 +27,7 @@ func NewCommand(c *cmd.Config) cmd.Runnable {
 			df.Name():    df,
 			m.Name():     m,
 			locav.Name(): locav,
+			preds.Name(): preds,
 		}),
 	)
 }
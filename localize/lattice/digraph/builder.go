@@ -1,5 +1,9 @@
 package digraph
 
+import (
+	"math"
+)
+
 import (
 	"github.com/timtadh/data-structures/errors"
 )
@@ -11,6 +15,11 @@ type Builder struct {
 	VertexColors map[int]int
 	EdgeColors   map[int]int
 	Graphs       int
+	granularity  string    // of the graphs loaded so far
+	vcounts      []int     // times the vertices were recorded (see counted)
+	ecounts      []int     // times the edges were recorded
+	vweights     []float64 // of the vertices of the graphs ended so far
+	eweights     []float64 // of the edges of the graphs ended so far
 }
 
 func Build(V, E int) *Builder {
@@ -29,6 +38,68 @@ func Build(V, E int) *Builder {
 	}
 }
 
+// counted records how many times the edge added last (and so its target)
+// was recorded as traversed
+func (b *Builder) counted(count int) {
+	for len(b.ecounts) < len(b.E) {
+		b.ecounts = append(b.ecounts, 0)
+	}
+	for len(b.vcounts) < len(b.V) {
+		b.vcounts = append(b.vcounts, 0)
+	}
+	e := &b.E[len(b.E)-1]
+	b.ecounts[len(b.E)-1] += count
+	b.vcounts[e.Targ] += count
+}
+
+// sampled ends the current graph which was sampled at rate (1 for an
+// unsampled graph) weighting its vertices and edges (see weight)
+func (b *Builder) sampled(rate float64) {
+	for len(b.vweights) < len(b.V) {
+		count := 0
+		if idx := len(b.vweights); idx < len(b.vcounts) {
+			count = b.vcounts[idx]
+		}
+		b.vweights = append(b.vweights, weight(count, rate))
+	}
+	for len(b.eweights) < len(b.E) {
+		count := 0
+		if idx := len(b.eweights); idx < len(b.ecounts) {
+			count = b.ecounts[idx]
+		}
+		b.eweights = append(b.eweights, weight(count, rate))
+	}
+}
+
+// weight estimates the number of graphs a vertex (or edge) recorded count
+// times in a graph sampled at rate stands for. A sampled run records each
+// call with probability rate so the vertex ran about count/rate times and was
+// recorded at least once with probability 1-(1-rate)^(count/rate). The weight
+// is the inverse of that probability (as in the Horvitz-Thompson estimator):
+// vertices recorded once stand for more of the graphs than the one they were
+// seen in, vertices recorded many times only for it.
+func weight(count int, rate float64) float64 {
+	if rate >= 1 || rate <= 0 || count <= 0 {
+		return 1
+	}
+	return 1 / (1 - math.Pow(1-rate, float64(count)/rate))
+}
+
+// granular records the granularity of a graph ("" for blocks). Graphs of
+// any granularity load but the graphs compared must all be of the same one:
+// a block missing from a graph of function entries was not unexecuted.
+func (b *Builder) granular(granularity string) error {
+	if granularity == "" {
+		granularity = "block"
+	}
+	if b.granularity == "" {
+		b.granularity = granularity
+	} else if b.granularity != granularity {
+		return errors.Errorf("graphs of %v granularity and of %v granularity cannot be compared", b.granularity, granularity)
+	}
+	return nil
+}
+
 func (b *Builder) Build(indexVertex func(*Vertex), indexEdge func(*Edge)) *Digraph {
 	g := &Digraph{
 		V:       make(Vertices, len(b.V)),
@@ -37,6 +108,10 @@ func (b *Builder) Build(indexVertex func(*Vertex), indexEdge func(*Edge)) *Digra
 		Kids:    make([][]int, len(b.V)),
 		Parents: make([][]int, len(b.V)),
 		Graphs:  b.Graphs,
+
+		Granularity:   b.granularity,
+		vertexWeights: b.vweights,
+		edgeWeights:   b.eweights,
 	}
 	for i := range b.V {
 		g.V[i].Idx = b.V[i].Idx
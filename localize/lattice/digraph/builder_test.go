@@ -0,0 +1,68 @@
+package digraph
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestWeight(t *testing.T) {
+	for _, c := range []struct {
+		count int
+		rate  float64
+		want  float64
+	}{
+		{0, .5, 1},
+		{7, 1, 1},
+		{1, .5, 4. / 3},                        // ran twice, recorded at least once 3/4 of the time
+		{2, .5, 16. / 15},                      // ran four times
+		{1, .01, 1 / (1 - math.Pow(.99, 100))}, // about e/(e-1)
+		{100, .01, 1},
+	} {
+		if got := weight(c.count, c.rate); math.Abs(got-c.want) > 1e-4 {
+			t.Errorf("weight(%v, %v) = %v, expected %v", c.count, c.rate, got, c.want)
+		}
+	}
+}
+
+func TestLoadSampledWeights(t *testing.T) {
+	// an unsampled graph and a graph sampled at 1/2 in which blk 1 was
+	// recorded once and blk 2 eight times
+	profile := `start-graph
+vertex	0, "entry", 0, "entry", "<none>", "0s"
+vertex	1, "main.main blk 1", 1, "main.main", "main.go:3:2", "0s"
+edge	0, 1, 1
+end-graph
+start-graph
+sampling	"every=2", 0.5
+vertex	0, "entry", 0, "entry", "<none>", "0s"
+vertex	1, "main.main blk 1", 1, "main.main", "main.go:3:2", "0s"
+vertex	2, "main.main blk 2", 2, "main.main", "main.go:5:2", "0s"
+edge	0, 1, 1
+edge	1, 2, 8
+end-graph
+`
+	labels := NewLabels()
+	idx, err := LoadSimple(NewInfo(), labels, strings.NewReader(profile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	blk1 := labels.Color("main.main blk 1")
+	blk2 := labels.Color("main.main blk 2")
+	for _, c := range []struct {
+		color int
+		want  float64
+	}{
+		{labels.Color("entry"), 2},
+		{blk1, 1 + 4./3},
+		{blk2, 1 / (1 - math.Pow(.5, 16))},
+	} {
+		if got := idx.VertexWeight(c.color); math.Abs(got-c.want) > 1e-4 {
+			t.Errorf("vertex %v weighs %v, expected %v", labels.Label(c.color), got, c.want)
+		}
+	}
+	edge := Colors{blk1, blk2, labels.Color("")}
+	if got, want := idx.EdgeWeights[edge], 1/(1-math.Pow(.5, 16)); math.Abs(got-want) > 1e-4 {
+		t.Errorf("edge weighs %v, expected %v", got, want)
+	}
+}
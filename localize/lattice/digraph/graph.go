@@ -7,4 +7,30 @@ type Digraph struct {
 	Kids    [][]int
 	Parents [][]int
 	Graphs  int
+
+	// Granularity is what the probes of the profiles recorded: func, block
+	// or edge (empty when no graph was loaded).
+	Granularity string
+
+	vertexWeights []float64 // nil unless loaded from profiles
+	edgeWeights   []float64
+}
+
+// VertexWeight is the estimated number of graphs the vertex idx stands for.
+// It is 1 unless the vertex's graph was sampled: a sampled graph may be
+// missing vertices which ran but were not recorded.
+func (g *Digraph) VertexWeight(idx int) float64 {
+	if idx >= len(g.vertexWeights) {
+		return 1
+	}
+	return g.vertexWeights[idx]
+}
+
+// EdgeWeight is the estimated number of graphs the edge idx stands for (see
+// VertexWeight)
+func (g *Digraph) EdgeWeight(idx int) float64 {
+	if idx >= len(g.edgeWeights) {
+		return 1
+	}
+	return g.edgeWeights[idx]
 }
@@ -18,12 +18,13 @@ type Indices struct {
 	SrcIndex       map[IdColorColor][]int // (SrcIdx, EdgeColor, TargColor) -> TargIdx (where Idx in G.V)
 	TargIndex      map[IdColorColor][]int // (TargIdx, EdgeColor, SrcColor) -> SrcIdx (where Idx in G.V)
 	EdgeIndex      map[Edge]*Edge
-	EdgeCounts     map[Colors]int   // (src-color, targ-color, edge-color) -> count
-	FreqEdges      []Colors         // frequent color triples
-	EdgesFromColor map[int][]Colors // freq src-colors -> color triples
-	EdgesToColor   map[int][]Colors // freq targ-colors -> color triples
-	VertexColors   map[int]int      // the color frequency for vertices
-	EdgeColors     map[int]int      // the color frequency for edges
+	EdgeCounts     map[Colors]int     // (src-color, targ-color, edge-color) -> count
+	EdgeWeights    map[Colors]float64 // the EdgeCounts corrected for sampling
+	FreqEdges      []Colors           // frequent color triples
+	EdgesFromColor map[int][]Colors   // freq src-colors -> color triples
+	EdgesToColor   map[int][]Colors   // freq targ-colors -> color triples
+	VertexColors   map[int]int        // the color frequency for vertices
+	EdgeColors     map[int]int        // the color frequency for edges
 }
 
 func NewIndices(b *Builder, minSupport int) *Indices {
@@ -36,6 +37,7 @@ func NewIndices(b *Builder, minSupport int) *Indices {
 		TargIndex:      make(map[IdColorColor][]int, len(b.V)),
 		EdgeIndex:      make(map[Edge]*Edge, len(b.E)),
 		EdgeCounts:     make(map[Colors]int, len(b.EdgeColors)),
+		EdgeWeights:    make(map[Colors]float64, len(b.EdgeColors)),
 		FreqEdges:      make([]Colors, 0, len(b.EdgeColors)),
 		EdgesFromColor: make(map[int][]Colors, len(b.VertexColors)),
 		EdgesToColor:   make(map[int][]Colors, len(b.VertexColors)),
@@ -85,9 +87,21 @@ func NewIndices(b *Builder, minSupport int) *Indices {
 					colorKey)
 			}
 		})
+	for idx := range i.G.E {
+		i.EdgeWeights[i.Colors(&i.G.E[idx])] += i.G.EdgeWeight(idx)
+	}
 	return i
 }
 
+// VertexWeight is the number of graphs the vertices of color are estimated
+// to occur in: len(ColorIndex[color]) corrected for sampling.
+func (i *Indices) VertexWeight(color int) (w float64) {
+	for _, idx := range i.ColorIndex[color] {
+		w += i.G.VertexWeight(idx)
+	}
+	return w
+}
+
 func (i *Indices) VertexColorFrequency(color int) int {
 	return i.VertexColors[color]
 }
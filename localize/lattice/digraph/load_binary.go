@@ -0,0 +1,92 @@
+package digraph
+
+import (
+	"bufio"
+	"io"
+)
+
+import (
+	"github.com/timtadh/data-structures/errors"
+)
+
+import (
+	"github.com/timtadh/dynagrok/dgruntime/binprof"
+)
+
+// Load reads flow graphs in either the simple text format or the binary
+// format (see dgruntime/binprof). The format is detected from the first
+// bytes of the input so a stream must not mix the two.
+func Load(info *Info, labels *Labels, input io.Reader) (*Indices, error) {
+	r := bufio.NewReader(input)
+	prefix, err := r.Peek(len(binprof.Magic))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if binprof.IsBinary(prefix) {
+		return LoadBinary(info, labels, r)
+	}
+	return LoadSimple(info, labels, r)
+}
+
+// LoadBinary reads flow graphs in the binary format
+func LoadBinary(info *Info, labels *Labels, input io.Reader) (*Indices, error) {
+	l := &SimpleLoader{
+		Builder: Build(100, 1000),
+		Labels:  labels,
+		Info:    info,
+		vidxs:   make(map[int]int),
+	}
+	return l.loadBinary(input)
+}
+
+func (l *SimpleLoader) loadBinary(input io.Reader) (*Indices, error) {
+	r, err := binprof.NewReader(input)
+	if err != nil {
+		return nil, err
+	}
+	graph := 0
+	rate := 1.0
+	granularity := ""
+	for {
+		rec, err := r.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		switch rec.Kind {
+		case binprof.GraphStart:
+			rate = 1
+			granularity = ""
+		case binprof.GraphEnd:
+			l.Builder.sampled(rate)
+			if err := l.Builder.granular(granularity); err != nil {
+				return nil, err
+			}
+			graph++
+		case binprof.SamplingRecord:
+			rate = rec.Sampling.Rate
+			if rate <= 0 || rate > 1 {
+				return nil, errors.Errorf("sampling rate %v is not in (0, 1]", rate)
+			}
+		case binprof.GranularityRecord:
+			granularity = rec.Granularity
+		case binprof.VertexRecord:
+			v := &rec.Vertex
+			color := l.Labels.Color(v.Label)
+			l.addVertex(v.Id, color, v.BasicBlockId, v.FnName, v.Position)
+			if v.Predicate != "" {
+				l.Info.AddPredicate(color, v.Predicate)
+			}
+		case binprof.EdgeRecord:
+			err := l.addEdge(rec.Edge.Src, rec.Edge.Targ, rec.Edge.Count, rec.Edge.Kind)
+			if err != nil {
+				return nil, err
+			}
+		default:
+			return nil, errors.Errorf("Unexpected record kind %q", rec.Kind)
+		}
+	}
+	l.Builder.Graphs = graph
+	return NewIndices(l.Builder, 0), nil
+}
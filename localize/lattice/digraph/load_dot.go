@@ -180,7 +180,8 @@ func (p *dotParse) loadEdge(n *combos.Node) (err error) {
 	label := ""
 	for _, attr := range n.Get(2).Children {
 		name := attr.Get(0).Value.(string)
-		if name == "label" {
+		if name == "label" || name == "kind" {
+			// dynagrok's flow graphs give edges between goroutines a kind
 			label = attr.Get(1).Value.(string)
 			break
 		}
@@ -13,17 +13,19 @@ import (
 )
 
 type Info struct {
-	lock      sync.Mutex
-	Positions map[int]string
-	FnNames   map[int]string
-	BBIds     map[int]int
+	lock       sync.Mutex
+	Positions  map[int]string
+	FnNames    map[int]string
+	BBIds      map[int]int
+	Predicates map[int]string // the colors which are predicates (not blocks)
 }
 
 func NewInfo() *Info {
 	return &Info{
-		Positions: make(map[int]string),
-		FnNames:   make(map[int]string),
-		BBIds:     make(map[int]int),
+		Positions:  make(map[int]string),
+		FnNames:    make(map[int]string),
+		BBIds:      make(map[int]int),
+		Predicates: make(map[int]string),
 	}
 }
 
@@ -35,12 +37,25 @@ func (i *Info) Add(color, bbid int, fnName, pos string) {
 	i.lock.Unlock()
 }
 
+func (i *Info) AddPredicate(color int, pred string) {
+	i.lock.Lock()
+	i.Predicates[color] = pred
+	i.lock.Unlock()
+}
+
 func (i Info) Get(color int) (bbid int, fnName, pos string) {
 	i.lock.Lock()
 	defer i.lock.Unlock()
 	return i.BBIds[color], i.FnNames[color], i.Positions[color]
 }
 
+// Predicate returns the predicate the color stands for (empty for a block)
+func (i *Info) Predicate(color int) string {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	return i.Predicates[color]
+}
+
 type SimpleLoader struct {
 	Builder *Builder
 	Labels  *Labels
@@ -60,6 +75,8 @@ func LoadSimple(info *Info, labels *Labels, input io.Reader) (*Indices, error) {
 
 func (l *SimpleLoader) load(input io.Reader) (*Indices, error) {
 	graph := 0
+	rate := 1.0
+	granularity := ""
 	scanner := bufio.NewScanner(input)
 	for scanner.Scan() {
 		line := strings.TrimSpace(scanner.Text())
@@ -70,8 +87,29 @@ func (l *SimpleLoader) load(input io.Reader) (*Indices, error) {
 		kind, rest := split[0], split[1:]
 		switch kind {
 		case "start-graph":
+			rate = 1
+			granularity = ""
 		case "end-graph":
+			l.Builder.sampled(rate)
+			if err := l.Builder.granular(granularity); err != nil {
+				return nil, err
+			}
 			graph++
+		case "sampling":
+			r, err := l.sampling(rest)
+			if err != nil {
+				return nil, err
+			}
+			rate = r
+		case "granularity":
+			if len(rest) != 1 {
+				return nil, errors.Errorf("line in unexpected format: `%v`", line)
+			}
+			g, err := strconv.Unquote(rest[0])
+			if err != nil {
+				return nil, err
+			}
+			granularity = g
 		case "vertex":
 			err := l.vertex(rest)
 			if err != nil {
@@ -101,8 +139,9 @@ func (l *SimpleLoader) vertex(rest []string) error {
 	if err != nil {
 		return err
 	}
-	if len(tokens) != 5 {
-		return errors.Errorf("line in unexpected format (expected 5 tokens): `%v`", tokens)
+	// later fields (eg. the block's duration) are not used by the lattice
+	if len(tokens) < 5 {
+		return errors.Errorf("line in unexpected format (expected at least 5 tokens): `%v`", tokens)
 	}
 	id, err := strconv.Atoi(tokens[0])
 	if err != nil {
@@ -124,10 +163,40 @@ func (l *SimpleLoader) vertex(rest []string) error {
 	if err != nil {
 		return err
 	}
-	l.addVertex(id, l.Labels.Color(label), bbid, fnName, pos)
+	color := l.Labels.Color(label)
+	l.addVertex(id, color, bbid, fnName, pos)
+	if len(tokens) > 7 {
+		// a predicate which held in block bbid
+		pred, err := strconv.Unquote(tokens[7])
+		if err != nil {
+			return err
+		}
+		l.Info.AddPredicate(color, pred)
+	}
 	return nil
 }
 
+func (l *SimpleLoader) sampling(rest []string) (float64, error) {
+	if len(rest) != 1 {
+		return 0, errors.Errorf("line in unexpected format: `%v`", rest)
+	}
+	tokens, err := l.tokens(rest[0])
+	if err != nil {
+		return 0, err
+	}
+	if len(tokens) < 2 {
+		return 0, errors.Errorf("line in unexpected format (expected 2 tokens): `%v`", tokens)
+	}
+	rate, err := strconv.ParseFloat(tokens[1], 64)
+	if err != nil {
+		return 0, err
+	}
+	if rate <= 0 || rate > 1 {
+		return 0, errors.Errorf("sampling rate %v is not in (0, 1]", rate)
+	}
+	return rate, nil
+}
+
 func (l *SimpleLoader) edge(rest []string) error {
 	if len(rest) != 1 {
 		return errors.Errorf("line in unexpected format: `%v`", rest)
@@ -136,8 +205,8 @@ func (l *SimpleLoader) edge(rest []string) error {
 	if err != nil {
 		return err
 	}
-	if len(tokens) != 3 {
-		return errors.Errorf("line in unexpected format (expected 3 tokens): `%v`", tokens)
+	if len(tokens) < 3 {
+		return errors.Errorf("line in unexpected format (expected at least 3 tokens): `%v`", tokens)
 	}
 	src, err := strconv.Atoi(tokens[0])
 	if err != nil {
@@ -147,7 +216,20 @@ func (l *SimpleLoader) edge(rest []string) error {
 	if err != nil {
 		return err
 	}
-	return l.addEdge(src, targ)
+	count, err := strconv.Atoi(tokens[2])
+	if err != nil {
+		return err
+	}
+	// control flow edges have no kind, edges between goroutines (spawn, send
+	// and close) and to predicates are coloured by their kind
+	kind := ""
+	if len(tokens) > 3 {
+		kind, err = strconv.Unquote(tokens[3])
+		if err != nil {
+			return err
+		}
+	}
+	return l.addEdge(src, targ, count, kind)
 }
 
 func (l *SimpleLoader) tokens(s string) ([]string, error) {
@@ -193,13 +275,14 @@ func (l *SimpleLoader) addVertex(id, color, bbid int, fnName, pos string) {
 	l.Info.Add(color, bbid, fnName, pos)
 }
 
-func (l *SimpleLoader) addEdge(sid, tid int) error {
+func (l *SimpleLoader) addEdge(sid, tid, count int, kind string) error {
 	if sidx, has := l.vidxs[sid]; !has {
 		return errors.Errorf("unknown src id %v", tid)
 	} else if tidx, has := l.vidxs[tid]; !has {
 		return errors.Errorf("unknown targ id %v", tid)
 	} else {
-		l.Builder.AddEdge(&l.Builder.V[sidx], &l.Builder.V[tidx], l.Labels.Color(""))
+		l.Builder.AddEdge(&l.Builder.V[sidx], &l.Builder.V[tidx], l.Labels.Color(kind))
+		l.Builder.counted(count)
 	}
 	return nil
 }
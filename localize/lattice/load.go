@@ -26,14 +26,17 @@ func Load(failPath, okPath string) (l *Lattice, err error) {
 
 func LoadFrom(failFile, okFile io.Reader) (l *Lattice, err error) {
 	return NewLattice(func(l *Lattice) error {
-		fail, err := digraph.LoadSimple(l.Info, l.Labels, failFile)
+		fail, err := digraph.Load(l.Info, l.Labels, failFile)
 		if err != nil {
 			return fmt.Errorf("Could not load profiles from failed executions\n%v", err)
 		}
-		ok, err := digraph.LoadSimple(l.Info, l.Labels, okFile)
+		ok, err := digraph.Load(l.Info, l.Labels, okFile)
 		if err != nil {
 			return fmt.Errorf("Could not load profiles from successful executions\n%v", err)
 		}
+		if f, o := fail.G.Granularity, ok.G.Granularity; f != "" && o != "" && f != o {
+			return fmt.Errorf("The failed executions were profiled at %v granularity and the successful ones at %v granularity", f, o)
+		}
 		l.Fail = fail
 		l.Ok = ok
 		return nil
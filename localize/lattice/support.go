@@ -47,6 +47,31 @@ func (n *Node) FIS() int {
 	return fis
 }
 
+// SampledFIS is FIS corrected for sampling: each independent embedding is
+// weighted by the number of graphs it is estimated to occur in, the weight
+// of its least recorded vertex (see digraph.Digraph.VertexWeight).
+func (n *Node) SampledFIS() float64 {
+	seen := make(map[int]bool, len(n.Embeddings)*len(n.SubGraph.V))
+	fis := 0.0
+	for _, emb := range n.Embeddings {
+		saw := false
+		w := 1.0
+		for e := emb; e != nil; e = e.Prev {
+			if seen[e.EmbIdx] {
+				saw = true
+			}
+			seen[e.EmbIdx] = true
+			if ew := n.l.Fail.G.VertexWeight(e.EmbIdx); ew > w {
+				w = ew
+			}
+		}
+		if !saw {
+			fis += w
+		}
+	}
+	return fis
+}
+
 func fis(embs subgraph.Embeddings) subgraph.Embeddings {
 	out := make(subgraph.Embeddings, 0, len(embs))
 	seen := make(map[int]bool)
@@ -7,6 +7,7 @@ import (
 
 	"github.com/timtadh/data-structures/errors"
 	"github.com/timtadh/dynagrok/localize/lattice"
+	"github.com/timtadh/dynagrok/localize/lattice/digraph"
 )
 
 type ScoreFunc func(prF, prFandNode, prO, prOandNode float64) float64
@@ -66,21 +67,30 @@ func FailureProbability(lat *lattice.Lattice, n *lattice.Node) (prF, prFandNode
 	F := float64(lat.Fail.G.Graphs)
 	O := float64(lat.Ok.G.Graphs)
 	T := F + O
-	f := float64(n.FIS())
+	f := sampled(n.SampledFIS(), lat.Fail.G)
 	return O / T, f / T
 }
 
+// sampled caps the number of graphs a pattern is estimated to occur in (see
+// digraph.Digraph.VertexWeight) at the number of graphs
+func sampled(count float64, g *digraph.Digraph) float64 {
+	if count > float64(g.Graphs) {
+		return float64(g.Graphs)
+	}
+	return count
+}
+
 func totalEdgeAndVertexOkPr(lat *lattice.Lattice, n *lattice.Node) (o float64) {
 	F := float64(lat.Fail.G.Graphs)
 	O := float64(lat.Ok.G.Graphs)
 	T := F + O
 	for i := range n.SubGraph.E {
-		count := lat.Ok.EdgeCounts[n.SubGraph.Colors(i)]
-		o += float64(count) / T
+		count := lat.Ok.EdgeWeights[n.SubGraph.Colors(i)]
+		o += sampled(count, lat.Ok.G) / T
 	}
 	for i := range n.SubGraph.V {
-		count := float64(len(lat.Ok.ColorIndex[n.SubGraph.V[i].Color]))
-		o += float64(count) / T
+		count := lat.Ok.VertexWeight(n.SubGraph.V[i].Color)
+		o += sampled(count, lat.Ok.G) / T
 	}
 	return o
 }
@@ -123,6 +133,7 @@ func LocalizeNodes(score *Score) ScoredLocations {
 				Position:     pos,
 				FnName:       fnName,
 				BasicBlockId: bbid,
+				Predicate:    lat.Info.Predicate(color),
 			},
 			n.Score,
 		})
@@ -136,6 +147,7 @@ type Location struct {
 	Position     string
 	FnName       string
 	BasicBlockId int
+	Predicate    string // set when the location is a predicate of the block
 }
 
 type ScoredLocation struct {
@@ -146,6 +158,9 @@ type ScoredLocation struct {
 type ScoredLocations []*ScoredLocation
 
 func (l *Location) String() string {
+	if l.Predicate != "" {
+		return fmt.Sprintf("%v, %v, %v, %q", l.Position, l.FnName, l.BasicBlockId, l.Predicate)
+	}
 	return fmt.Sprintf("%v, %v, %v", l.Position, l.FnName, l.BasicBlockId)
 }
 
@@ -0,0 +1,121 @@
+package predicates
+
+import (
+	"sort"
+)
+
+import (
+	"github.com/timtadh/dynagrok/dgruntime/dgtypes"
+	"github.com/timtadh/dynagrok/localize/mine"
+)
+
+// Runs counts the runs in which each predicate site was observed and each
+// predicate held (at least once). As in Liblit's Cooperative Bug Isolation
+// a predicate is only compared between the runs which observed its site.
+type Runs struct {
+	Fails, Oks int
+	observed   map[site]*[2]int // runs which observed the site: failing, succeeding
+	held       map[pred]*[2]int // runs in which the predicate held: failing, succeeding
+}
+
+type site struct {
+	FnName       string
+	BasicBlockId int
+	Site         int
+}
+
+type pred struct {
+	site
+	Name     string
+	Position string
+}
+
+func NewRuns() *Runs {
+	return &Runs{
+		observed: make(map[site]*[2]int),
+		held:     make(map[pred]*[2]int),
+	}
+}
+
+// Add counts the predicates of a run's profile
+func (r *Runs) Add(p *dgtypes.Profile, failed bool) {
+	run := 1
+	if failed {
+		run = 0
+		r.Fails++
+	} else {
+		r.Oks++
+	}
+	fnName := func(b dgtypes.BlkEntrance) string {
+		if f, has := p.Funcs[b.In]; has {
+			return f.Name
+		}
+		return "unknown"
+	}
+	seen := make(map[site]bool)
+	for s, count := range p.Observed {
+		if count > 0 {
+			seen[site{fnName(s.At), s.At.BasicBlockId, s.Site}] = true
+		}
+	}
+	for pr, count := range p.Predicates {
+		if count <= 0 {
+			continue
+		}
+		k := pred{site{fnName(pr.At), pr.At.BasicBlockId, pr.Site}, pr.Name, pr.Position}
+		// profiles without observation counts observed the sites whose
+		// predicates held
+		seen[k.site] = true
+		if r.held[k] == nil {
+			r.held[k] = new([2]int)
+		}
+		r.held[k][run]++
+	}
+	for s := range seen {
+		if r.observed[s] == nil {
+			r.observed[s] = new([2]int)
+		}
+		r.observed[s][run]++
+	}
+}
+
+// Rank scores every predicate which held in some run. The probabilities
+// handed to score are over the runs which observed the predicate's site.
+func (r *Runs) Rank(score mine.ScoreFunc) mine.ScoredLocations {
+	preds := make([]pred, 0, len(r.held))
+	for k := range r.held {
+		preds = append(preds, k)
+	}
+	// ties keep a stable order
+	sort.Slice(preds, func(i, j int) bool {
+		a, b := preds[i], preds[j]
+		if a.Position != b.Position {
+			return a.Position < b.Position
+		}
+		if a.Site != b.Site {
+			return a.Site < b.Site
+		}
+		return a.Name < b.Name
+	})
+	result := make(mine.ScoredLocations, 0, len(preds))
+	for _, k := range preds {
+		held := r.held[k]
+		observed := r.observed[k.site]
+		T := float64(observed[0] + observed[1])
+		prF := float64(observed[0]) / T
+		prO := float64(observed[1]) / T
+		prFandPred := float64(held[0]) / T
+		prOandPred := float64(held[1]) / T
+		result = append(result, &mine.ScoredLocation{
+			Location: mine.Location{
+				Position:     k.Position,
+				FnName:       k.FnName,
+				BasicBlockId: k.BasicBlockId,
+				Predicate:    k.Name,
+			},
+			Score: score(prF, prFandPred, prO, prOandPred),
+		})
+	}
+	result.Sort()
+	return result
+}
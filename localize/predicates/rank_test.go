@@ -0,0 +1,170 @@
+package predicates
+
+import (
+	"reflect"
+	"testing"
+)
+
+import (
+	"github.com/timtadh/dynagrok/dgruntime/dgtypes"
+	"github.com/timtadh/dynagrok/localize/mine"
+)
+
+// run is a synthetic profile: the times the sites at main.f's blocks were
+// observed (nil for a profile without observation counts) and the times each
+// predicate held
+type run struct {
+	failed   bool
+	observed map[int]int
+	held     map[string]int // "<bbid> <name>"
+}
+
+var testPreds = map[string]dgtypes.Predicate{
+	"1 x < 0":  {At: dgtypes.BlkEntrance{In: 1, BasicBlockId: 1}, Site: 0, Name: "x < 0", Position: "main.go:5:3"},
+	"1 x >= 0": {At: dgtypes.BlkEntrance{In: 1, BasicBlockId: 1}, Site: 0, Name: "x >= 0", Position: "main.go:5:3"},
+	"2 ok":     {At: dgtypes.BlkEntrance{In: 1, BasicBlockId: 2}, Site: 1, Name: "ok", Position: "main.go:9:3"},
+	"2 !ok":    {At: dgtypes.BlkEntrance{In: 1, BasicBlockId: 2}, Site: 1, Name: "!ok", Position: "main.go:9:3"},
+}
+
+func (r run) profile() *dgtypes.Profile {
+	p := dgtypes.NewProfile()
+	p.Funcs[1] = &dgtypes.Function{Name: "main.f", FuncPc: 1}
+	for bbid, count := range r.observed {
+		p.Observed[dgtypes.PredicateSite{At: dgtypes.BlkEntrance{In: 1, BasicBlockId: bbid}, Site: bbid - 1}] = count
+	}
+	for name, count := range r.held {
+		p.Predicates[testPreds[name]] = count
+	}
+	return p
+}
+
+func testSite(bbid int) site {
+	return site{FnName: "main.f", BasicBlockId: bbid, Site: bbid - 1}
+}
+
+func testPred(name string) pred {
+	p := testPreds[name]
+	return pred{testSite(p.At.BasicBlockId), p.Name, p.Position}
+}
+
+func addRuns(runs []run) *Runs {
+	r := NewRuns()
+	for _, run := range runs {
+		r.Add(run.profile(), run.failed)
+	}
+	return r
+}
+
+func TestRunsAdd(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		runs     []run
+		observed map[int][2]int    // by bbid: failing, succeeding runs
+		held     map[string][2]int // failing, succeeding runs
+	}{
+		{
+			name: "counts runs not observations",
+			runs: []run{
+				{true, map[int]int{1: 5}, map[string]int{"1 x < 0": 3, "1 x >= 0": 2}},
+				{false, map[int]int{1: 2}, map[string]int{"1 x >= 0": 2}},
+				{false, map[int]int{1: 1}, map[string]int{"1 x >= 0": 1}},
+			},
+			observed: map[int][2]int{1: {1, 2}},
+			held:     map[string][2]int{"1 x < 0": {1, 0}, "1 x >= 0": {1, 2}},
+		},
+		{
+			name: "a site observed without any predicate holding",
+			runs: []run{
+				{true, map[int]int{1: 1, 2: 1}, map[string]int{"1 x < 0": 1}},
+				{false, map[int]int{1: 1}, map[string]int{"1 x >= 0": 1}},
+				{false, map[int]int{1: 1, 2: 0}, map[string]int{"1 x >= 0": 1, "2 ok": 0}},
+			},
+			observed: map[int][2]int{1: {1, 2}, 2: {1, 0}},
+			held:     map[string][2]int{"1 x < 0": {1, 0}, "1 x >= 0": {0, 2}},
+		},
+		{
+			name: "no Observed counts",
+			runs: []run{
+				{true, nil, map[string]int{"1 x < 0": 1, "2 !ok": 4}},
+				{false, nil, map[string]int{"1 x >= 0": 1}},
+				{false, map[int]int{2: 1}, map[string]int{"2 ok": 1}},
+			},
+			observed: map[int][2]int{1: {1, 1}, 2: {1, 1}},
+			held:     map[string][2]int{"1 x < 0": {1, 0}, "1 x >= 0": {0, 1}, "2 !ok": {1, 0}, "2 ok": {0, 1}},
+		},
+	} {
+		r := addRuns(c.runs)
+		fails, oks := 0, 0
+		for _, run := range c.runs {
+			if run.failed {
+				fails++
+			} else {
+				oks++
+			}
+		}
+		if r.Fails != fails || r.Oks != oks {
+			t.Errorf("%v: %d fails %d oks expected %d %d", c.name, r.Fails, r.Oks, fails, oks)
+		}
+		observed := make(map[site][2]int)
+		for s, counts := range r.observed {
+			observed[s] = *counts
+		}
+		wantObserved := make(map[site][2]int)
+		for bbid, counts := range c.observed {
+			wantObserved[testSite(bbid)] = counts
+		}
+		if !reflect.DeepEqual(observed, wantObserved) {
+			t.Errorf("%v: observed %v expected %v", c.name, observed, wantObserved)
+		}
+		held := make(map[pred][2]int)
+		for p, counts := range r.held {
+			held[p] = *counts
+		}
+		wantHeld := make(map[pred][2]int)
+		for name, counts := range c.held {
+			wantHeld[testPred(name)] = counts
+		}
+		if !reflect.DeepEqual(held, wantHeld) {
+			t.Errorf("%v: held %v expected %v", c.name, held, wantHeld)
+		}
+	}
+}
+
+func TestRunsRank(t *testing.T) {
+	r := addRuns([]run{
+		{true, map[int]int{1: 1, 2: 1}, map[string]int{"1 x < 0": 1, "2 !ok": 1}},
+		{true, map[int]int{1: 1}, map[string]int{"1 x < 0": 1}},
+		{false, map[int]int{1: 1, 2: 1}, map[string]int{"1 x >= 0": 1, "2 ok": 1}},
+		{false, map[int]int{1: 1, 2: 1}, map[string]int{"1 x < 0": 1, "2 ok": 1}},
+	})
+
+	// the probabilities are over the runs which observed the site, the
+	// predicates are scored in the order of their positions
+	type probs struct{ prF, prFandPred, prO, prOandPred float64 }
+	var got []probs
+	r.Rank(func(prF, prFandPred, prO, prOandPred float64) float64 {
+		got = append(got, probs{prF, prFandPred, prO, prOandPred})
+		return 0
+	})
+	want := []probs{
+		{2.0 / 4, 2.0 / 4, 2.0 / 4, 1.0 / 4}, // x < 0
+		{2.0 / 4, 0, 2.0 / 4, 1.0 / 4},       // x >= 0
+		{1.0 / 3, 1.0 / 3, 2.0 / 3, 0},       // !ok
+		{1.0 / 3, 0, 2.0 / 3, 2.0 / 3},       // ok
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("probabilities %v expected %v", got, want)
+	}
+
+	ranked := r.Rank(mine.Scores[mine.ScoreAbbrvs["p"]])
+	wantRanked := mine.ScoredLocations{
+		{Location: mine.Location{Position: "main.go:9:3", FnName: "main.f", BasicBlockId: 2, Predicate: "!ok"}, Score: 1},
+		{Location: mine.Location{Position: "main.go:5:3", FnName: "main.f", BasicBlockId: 1, Predicate: "x < 0"}, Score: 2.0 / 3},
+		// ties keep the order of their positions
+		{Location: mine.Location{Position: "main.go:5:3", FnName: "main.f", BasicBlockId: 1, Predicate: "x >= 0"}, Score: 0},
+		{Location: mine.Location{Position: "main.go:9:3", FnName: "main.f", BasicBlockId: 2, Predicate: "ok"}, Score: 0},
+	}
+	if !reflect.DeepEqual(ranked, wantRanked) {
+		t.Errorf("ranked\n%v\nexpected\n%v", ranked, wantRanked)
+	}
+}
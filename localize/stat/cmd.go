@@ -52,14 +52,14 @@ Option Flags
     -h,--help                         Show this message
     -o,--output=<path>                Output file to create
                                       (defaults to standard output)
-    -s,--score=<score>              Statistical method to use
-    --scores                         List localization methods available
+    -s,--score=<score>                Statistical method to use
+    --scores                          List localization methods available
 `,
-		"o:w:m:",
+		"o:s:",
 		[]string{
 			"output=",
-			"method=",
-			"methods",
+			"score=",
+			"scores",
 		},
 		func(r cmd.Runnable, args []string, optargs []getopt.OptArg) ([]string, *cmd.Error) {
 			for _, oa := range optargs {
@@ -82,7 +82,7 @@ Option Flags
 						o.Score = m
 						o.ScoreName = name
 					} else {
-						return nil, cmd.Errorf(1, "Localization method '%v' is not supported. (use --methods to get a list)", oa.Arg())
+						return nil, cmd.Errorf(1, "Localization method '%v' is not supported. (use --scores to get a list)", oa.Arg())
 					}
 				}
 			}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
@@ -20,6 +21,7 @@ import (
 
 import (
 	"github.com/timtadh/dynagrok/cmd"
+	dgprof "github.com/timtadh/dynagrok/profile"
 )
 
 type Remote struct {
@@ -82,12 +84,14 @@ func (r *Remote) Reconfig(opts ...RemoteOption) {
 	}
 }
 
-func (r *Remote) Env(dgprof string) []string {
+// Env is the environment of the remote program. Its profile is streamed to
+// the sink (see dgruntime/sink.go).
+func (r *Remote) Env(sink string) []string {
 	env := []string{
 		fmt.Sprintf("PATH=%v", os.Getenv("PATH")),
 		fmt.Sprintf("USER=%v", os.Getenv("USER")),
 		fmt.Sprintf("HOME=%v", os.Getenv("HOME")),
-		fmt.Sprintf("DGPROF=%v", dgprof),
+		fmt.Sprintf("DGPROF_SINK=%v", sink),
 	}
 	if r.Config != nil {
 		env = append(env, fmt.Sprintf("GOROOT=%v", r.Config.GOROOT))
@@ -103,28 +107,43 @@ func (r *Remote) Env(dgprof string) []string {
 	return env
 }
 
+// Execute runs the program. Its profile is streamed back through a pipe (the
+// program's file descriptor 3) so no profile directory is needed.
 func (r *Remote) Execute(args []string, stdin []byte) (stdout, stderr, profile, failures []byte, ok bool, err error) {
-	_, name := filepath.Split(r.Path)
-	dgprof, err := ioutil.TempDir("", fmt.Sprintf("dynagrok-dgprof-%v-", name))
+	pr, pw, err := os.Pipe()
 	if err != nil {
 		return nil, nil, nil, nil, false, err
 	}
-	defer os.RemoveAll(dgprof)
+	defer pr.Close()
 
 	var outbuf, errbuf bytes.Buffer
 	inbuf := bytes.NewBuffer(stdin)
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 	c := exec.Command(r.Path, args...)
-	c.Env = r.Env(dgprof)
+	c.Env = r.Env("fd:3")
 	c.Stdin = inbuf
 	c.Stdout = &outbuf
 	c.Stderr = &errbuf
+	c.ExtraFiles = []*os.File{pw}
 
 	err = c.Start()
+	pw.Close()
 	if err != nil {
 		return nil, nil, nil, nil, false, err
 	}
+	streamed := make(chan error, 1)
+	go func() {
+		streamed <- dgprof.ReadStream(pr, func(name string, f io.Reader) (err error) {
+			switch name {
+			case "flow-graph.txt":
+				profile, err = ioutil.ReadAll(f)
+			case "failures":
+				failures, err = ioutil.ReadAll(f)
+			}
+			return err
+		})
+	}()
 	var timeKilled bool
 	var memKilled bool
 	go r.watch(ctx, cancel, c, &timeKilled, &memKilled)
@@ -136,6 +155,10 @@ func (r *Remote) Execute(args []string, stdin []byte) (stdout, stderr, profile,
 		case *exec.ExitError:
 			// skip
 		default:
+			// the stream goroutine sets profile and failures, let it
+			// finish before returning
+			pr.Close()
+			<-streamed
 			return nil, nil, nil, nil, false, err
 		}
 	}
@@ -144,30 +167,9 @@ func (r *Remote) Execute(args []string, stdin []byte) (stdout, stderr, profile,
 		timeKilled = true
 	}
 	ok = c.ProcessState.Success() // && !timeKilled && !memKilled
-
-	fgPath := filepath.Join(dgprof, "flow-graph.txt")
-	if _, err := os.Stat(fgPath); err == nil {
-		fg, err := os.Open(fgPath)
-		if err != nil {
-			return nil, nil, nil, nil, false, err
-		}
-		profile, err = ioutil.ReadAll(fg)
-		fg.Close()
-		if err != nil {
-			return nil, nil, nil, nil, false, err
-		}
-	}
-	failsPath := filepath.Join(dgprof, "failures")
-	if _, err := os.Stat(failsPath); err == nil {
-		fails, err := os.Open(failsPath)
-		if err != nil {
-			return nil, nil, nil, nil, false, err
-		}
-		failures, err = ioutil.ReadAll(fails)
-		fails.Close()
-		if err != nil {
-			return nil, nil, nil, nil, false, err
-		}
+	if err := <-streamed; err != nil {
+		// the program was killed before its profile was complete
+		errors.Logf("ERROR", "Could not read the profile: %v", err)
 	}
 
 	return outbuf.Bytes(), errbuf.Bytes(), profile, failures, ok, nil
@@ -0,0 +1,86 @@
+package test
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// failing is a program calling dgruntime as an instrumented program which
+// reports a failure would
+const failing = `package main
+
+import "dgruntime"
+
+func main() {
+	defer func() { dgruntime.Shutdown() }()
+	dgruntime.EnterFunc("main.main", "main.go:5:1", dgruntime.NoCFG, dgruntime.NoIPDom)
+	dgruntime.Fail("injected")
+	dgruntime.ExitFunc("main.main")
+}
+`
+
+// buildFailing builds the failing program against this tree's dgruntime in
+// a GOPATH of its own under dir
+func buildFailing(t *testing.T, dir string) string {
+	goBin, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go is needed to build a program using dgruntime")
+	}
+	dgruntime, err := filepath.Abs(filepath.Join("..", "..", "dgruntime"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gopath := filepath.Join(dir, "gopath")
+	src := filepath.Join(gopath, "src", "failing")
+	if err := os.MkdirAll(src, os.ModeDir|0775); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(dgruntime, filepath.Join(gopath, "src", "dgruntime")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(src, "main.go"), []byte(failing), 0664); err != nil {
+		t.Fatal(err)
+	}
+	prog := filepath.Join(dir, "failing")
+	build := exec.Command(goBin, "build", "-o", prog, ".")
+	build.Dir = src
+	build.Env = append(os.Environ(), "GOPATH="+gopath, "GO111MODULE=off", "GOFLAGS=")
+	if out, err := build.CombinedOutput(); err != nil {
+		t.Fatalf("could not build the program: %v\n%s", err, out)
+	}
+	return prog
+}
+
+func TestRemoteExecute(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dynagrok-remote-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	r, err := NewRemote(buildFailing(t, dir), Timeout(time.Minute), MaxMegabytes(1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, _, profile, failures, ok, err := r.Execute(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Errorf("the program failed")
+	}
+	// the profile came through the program's file descriptor 3
+	if !strings.Contains(string(profile), "main.main") {
+		t.Errorf("the flow graph was not streamed back: %q", profile)
+	}
+	if !strings.Contains(string(failures), "injected") {
+		t.Errorf("the failures were not streamed back: %q", failures)
+	}
+	if !strings.Contains(string(stdout), "writing to: fd:3 flow-graph.txt") {
+		t.Errorf("expected the flow graph to be written to fd:3 got %q", stdout)
+	}
+}
@@ -10,6 +10,7 @@ import (
 )
 
 import (
+	"github.com/timtadh/dynagrok/dgruntime/dgtypes"
 	"github.com/timtadh/dynagrok/localize/lattice"
 	"github.com/timtadh/dynagrok/localize/lattice/digraph"
 )
@@ -21,6 +22,7 @@ type Testcase struct {
 	executed bool
 	ok       bool
 	profile  []byte
+	fails    []*dgtypes.Failure
 	lines    []int
 }
 
@@ -46,6 +48,25 @@ func (t *Testcase) Failed() bool {
 	return !t.ok
 }
 
+// Failures are what the run reported in its failures file: failures injected
+// by mutants and panics (including the ones the program recovered from).
+func (t *Testcase) Failures() []*dgtypes.Failure {
+	if !t.executed {
+		panic("failures called before execute")
+	}
+	return t.fails
+}
+
+// Panicked reports whether the run panicked, even if it recovered.
+func (t *Testcase) Panicked() bool {
+	for _, f := range t.Failures() {
+		if f.Panic != nil {
+			return true
+		}
+	}
+	return false
+}
+
 func (t *Testcase) Usable() bool {
 	if !t.executed {
 		panic("usable called before execute")
@@ -66,7 +87,7 @@ func (t *Testcase) Digraph(l *lattice.Lattice) (*digraph.Indices, error) {
 	if err != nil {
 		return nil, err
 	}
-	return digraph.LoadSimple(l.Info, l.Labels, &buf)
+	return digraph.Load(l.Info, l.Labels, &buf)
 }
 
 func (t *Testcase) Hash() int {
@@ -90,6 +111,10 @@ func (t *Testcase) Execute() error {
 	t.executed = true
 	t.ok = ok && len(fails) <= 0
 	t.profile = profile
+	t.fails, err = dgtypes.ReadFailures(bytes.NewReader(fails))
+	if err != nil {
+		errors.Logf("ERROR", "could not read the failures file: %v", err)
+	}
 	if false {
 		errors.Logf("INFO", "executed %v %v %v %v %v", len(t.Case), len(profile) > 0, len(fails), ok, t.ok)
 	}
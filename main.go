@@ -11,11 +11,14 @@ import (
 
 import (
 	"github.com/timtadh/dynagrok/cmd"
+	"github.com/timtadh/dynagrok/coverage"
 	"github.com/timtadh/dynagrok/grok"
 	"github.com/timtadh/dynagrok/instrument"
 	"github.com/timtadh/dynagrok/localize"
 	"github.com/timtadh/dynagrok/mutate"
 	"github.com/timtadh/dynagrok/objectstate"
+	"github.com/timtadh/dynagrok/profile"
+	"github.com/timtadh/dynagrok/selftest"
 )
 
 func main() {
@@ -28,6 +31,9 @@ func main() {
 	mut := mutate.NewCommand(&config)
 	loc := localize.NewCommand(&config)
 	obj := objectstate.NewCommand(&config)
+	prof := profile.NewCommand(&config)
+	cov := coverage.NewCommand(&config)
+	self := selftest.NewCommand(&config)
 	cmd.Main(cmd.Concat(
 		main,
 		cmd.Commands(map[string]cmd.Runnable{
@@ -36,6 +42,9 @@ func main() {
 			mut.Name():  mut,
 			loc.Name():  loc,
 			obj.Name():  obj,
+			prof.Name(): prof,
+			cov.Name():  cov,
+			self.Name(): self,
 		}),
 	), &cleanup)
 }
@@ -50,6 +59,10 @@ Option Flags
     -r,--go-root=<path>               go root
     -g,--go-path=<path>               go path
     -d,--dynagrok-path=<path>         dynagrok path
+    --modules                         Load packages with go modules and build with
+                                      the stock toolchain (go build -overlay)
+    --portable-runtime                Do not patch and rebuild GOROOT, dgruntime
+                                      identifies goroutines with runtime.Stack
 `,
 		"p:r:g:d:",
 		[]string{
@@ -57,12 +70,16 @@ Option Flags
 			"go-root=",
 			"go-path=",
 			"dynagrok-path=",
+			"modules",
+			"portable-runtime",
 		},
 		func(r cmd.Runnable, args []string, optargs []getopt.OptArg) ([]string, *cmd.Error) {
 			GOROOT := os.Getenv("GOROOT")
 			GOPATH := os.Getenv("GOPATH")
 			DGPATH := os.Getenv("DGPATH")
 			cpuProfile := ""
+			modules := false
+			portable := false
 			for _, oa := range optargs {
 				switch oa.Opt() {
 				case "-p", "--cpu-profile":
@@ -73,6 +90,10 @@ Option Flags
 					DGPATH = oa.Arg()
 				case "-r", "--go-root":
 					GOROOT = oa.Arg()
+				case "--modules":
+					modules = true
+				case "--portable-runtime":
+					portable = true
 				}
 			}
 			if cpuProfile != "" {
@@ -90,9 +111,12 @@ Option Flags
 				*cleanup = clean
 			}
 			*c = cmd.Config{
-				GOROOT: GOROOT,
-				GOPATH: GOPATH,
-				DGPATH: DGPATH,
+				GOROOT:  GOROOT,
+				GOPATH:  GOPATH,
+				DGPATH:  DGPATH,
+				Modules: modules,
+
+				PortableRuntime: portable || modules,
 			}
 			return args, nil
 		})
@@ -14,6 +14,7 @@ import (
 
 import (
 	"github.com/timtadh/dynagrok/cmd"
+	"github.com/timtadh/dynagrok/dgruntime/excludes"
 	"github.com/timtadh/dynagrok/instrument"
 )
 
@@ -34,9 +35,12 @@ Option Flags
     -m,--mutation=<mut>               Only use the specified mutations (may be specified
                                       multiple times or with a comma separated list).
     --mutations                       List the available mutations
-`,
+    --cache                           Reuse unmutated packages from the build
+                                      cache (only mutated packages are rebuilt)
+    --cache-dir=<path>                Build cache location (implies --cache)
+`+cmd.PolicyUsage,
 		"o:w:r:m:",
-		[]string{
+		append([]string{
 			"output=",
 			"work=",
 			"keep-work",
@@ -45,7 +49,9 @@ Option Flags
 			"only=",
 			"mutation=",
 			"mutations",
-		},
+			"cache",
+			"cache-dir=",
+		}, cmd.PolicyLongOpts...),
 		func(r cmd.Runnable, args []string, optargs []getopt.OptArg) ([]string, *cmd.Error) {
 			output := ""
 			keepWork := false
@@ -54,7 +60,15 @@ Option Flags
 			addInstrumentation := false
 			only := make(map[string]bool)
 			allowedMuts := make(map[string]bool)
+			useCache := false
+			cacheDir := ""
+			policy := excludes.NewPolicy()
 			for _, oa := range optargs {
+				if ok, err := cmd.PolicyOpt(policy, oa); err != nil {
+					return nil, err
+				} else if ok {
+					continue
+				}
 				switch oa.Opt() {
 				case "-o", "--output":
 					output = oa.Arg()
@@ -96,6 +110,11 @@ Option Flags
 						fmt.Println("  -", mut)
 					}
 					return nil, nil
+				case "--cache":
+					useCache = true
+				case "--cache-dir":
+					useCache = true
+					cacheDir = oa.Arg()
 				}
 			}
 			if len(args) != 1 {
@@ -110,18 +129,37 @@ Option Flags
 			if err != nil {
 				return nil, cmd.Usage(r, 6, err.Error())
 			}
-			mutations, err := Mutate(mutate, only, allowedMuts, addInstrumentation, pkgName, program)
+			deps, err := cmd.RuntimeDeps(c)
+			if err != nil {
+				return nil, cmd.Errorf(6, "could not list the dependencies of dgruntime: %v", err)
+			}
+			policy.ExcludeDeps(deps)
+			var cache *instrument.Cache
+			if useCache {
+				mode := fmt.Sprintf("mutate %v %v\n%v", pkgName, addInstrumentation, policy)
+				cache, err = instrument.OpenCache(c, cacheDir, mode, program)
+				if err != nil {
+					return nil, cmd.Errorf(7, err.Error())
+				}
+			}
+			mutations, err := Mutate(mutate, only, allowedMuts, policy, addInstrumentation, pkgName, program)
 			if err != nil {
 				return nil, cmd.Errorf(7, err.Error())
 			}
+			// mutated packages (and the entry which gets a shutdown hook)
+			// differ from run to run so the cache can't hold them.
+			cache.Dirty(pkgName)
+			for _, pkg := range MutatedPkgs(program, mutations) {
+				cache.Dirty(pkg)
+			}
 			if addInstrumentation {
-				err = instrument.Instrument(pkgName, program)
+				err = instrument.Instrument(pkgName, program, instrument.Cached(cache), instrument.Policy(policy))
 				if err != nil {
 					return nil, cmd.Errorf(8, err.Error())
 				}
 			}
 			// return nil, cmd.Errorf(1, "early exit for no build")
-			work, err = instrument.BuildBinary(c, keepWork, work, pkgName, output, program)
+			work, err = instrument.BuildBinary(c, cache, policy, keepWork, work, pkgName, output, program)
 			if err != nil {
 				return nil, cmd.Errorf(9, err.Error())
 			}
@@ -41,10 +41,11 @@ type mutator struct {
 	program       *loader.Program
 	entry         string
 	only          map[string]bool
+	policy        *excludes.Policy
 	instrumenting bool
 }
 
-func Mutate(mutate float64, only, allowedMuts map[string]bool, instrumenting bool, entryPkgName string, program *loader.Program) (mutants []*ExportedMut, err error) {
+func Mutate(mutate float64, only, allowedMuts map[string]bool, policy *excludes.Policy, instrumenting bool, entryPkgName string, program *loader.Program) (mutants []*ExportedMut, err error) {
 	entry := program.Package(entryPkgName)
 	if entry == nil {
 		return nil, errors.Errorf("The entry package was not found in the loaded program")
@@ -56,6 +57,7 @@ func Mutate(mutate float64, only, allowedMuts map[string]bool, instrumenting boo
 		program:       program,
 		entry:         entryPkgName,
 		only:          only,
+		policy:        policy,
 		instrumenting: instrumenting,
 	}
 	muts, err := m.collect()
@@ -82,11 +84,29 @@ func Mutate(mutate float64, only, allowedMuts map[string]bool, instrumenting boo
 	return mutants, nil
 }
 
+// MutatedPkgs lists the packages containing the given mutations
+func MutatedPkgs(program *loader.Program, mutants []*ExportedMut) []string {
+	files := make(map[string]bool, len(mutants))
+	for _, m := range mutants {
+		files[m.SrcPosition.Filename] = true
+	}
+	pkgs := make([]string, 0, len(mutants))
+	for _, pkg := range program.AllPackages {
+		for _, f := range pkg.Files {
+			if files[program.Fset.File(f.Pos()).Name()] {
+				pkgs = append(pkgs, pkg.Pkg.Path())
+				break
+			}
+		}
+	}
+	return pkgs
+}
+
 func (m *mutator) pkgAllowed(pkg *loader.PackageInfo) bool {
 	// if pkg.Cgo {
 	// 	return false
 	// }
-	if excludes.ExcludedPkg(pkg.Pkg.Path()) {
+	if m.policy.ExcludedPkg(pkg.Pkg.Path()) {
 		return false
 	}
 	if len(m.only) > 0 && !m.only[pkg.Pkg.Path()] {
@@ -103,6 +123,9 @@ func (m *mutator) collect() (muts Mutations, err error) {
 		}
 		for _, fileAst := range pkg.Files {
 			err = analysis.Functions(pkg, fileAst, func(fn ast.Node, fnName string) error {
+				if m.policy.ExcludedFunc(fnName) {
+					return nil
+				}
 				var body *[]ast.Stmt
 				switch x := fn.(type) {
 				case *ast.FuncDecl:
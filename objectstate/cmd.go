@@ -11,6 +11,7 @@ import (
 
 import (
 	"github.com/timtadh/dynagrok/cmd"
+	"github.com/timtadh/dynagrok/dgruntime/excludes"
 	"github.com/timtadh/dynagrok/instrument"
 )
 
@@ -25,21 +26,34 @@ Option Flags
     -w,--work=<path>                  Work directory to use (defaults to tempdir)
 	-m,--method=<method-name>         Name of a specific method to profile
     --keep-work                       Keep the work directory
-`,
+    --cache                           Reuse instrumented packages from the build
+                                      cache (only changed packages are rebuilt)
+    --cache-dir=<path>                Build cache location (implies --cache)
+`+cmd.PolicyUsage,
 		"o:w:m:",
-		[]string{
+		append([]string{
 			"output=",
 			"work=",
 			"method=",
 			"keep-work",
-		},
+			"cache",
+			"cache-dir=",
+		}, cmd.PolicyLongOpts...),
 		func(r cmd.Runnable, args []string, optargs []getopt.OptArg) ([]string, *cmd.Error) {
 			fmt.Println(c)
 			output := ""
 			keepWork := false
 			work := ""
 			method := ""
+			useCache := false
+			cacheDir := ""
+			policy := excludes.NewPolicy()
 			for _, oa := range optargs {
+				if ok, err := cmd.PolicyOpt(policy, oa); err != nil {
+					return nil, err
+				} else if ok {
+					continue
+				}
 				switch oa.Opt() {
 				case "-o", "--output":
 					output = oa.Arg()
@@ -49,6 +63,11 @@ Option Flags
 					method = oa.Arg()
 				case "-k", "--keep-work":
 					keepWork = true
+				case "--cache":
+					useCache = true
+				case "--cache-dir":
+					useCache = true
+					cacheDir = oa.Arg()
 				}
 			}
 			if len(args) != 1 {
@@ -62,17 +81,30 @@ Option Flags
 			if err != nil {
 				return nil, cmd.Usage(r, 6, err.Error())
 			}
+			deps, err := cmd.RuntimeDeps(c)
+			if err != nil {
+				return nil, cmd.Errorf(6, "could not list the dependencies of dgruntime: %v", err)
+			}
+			policy.ExcludeDeps(deps)
+			var cache *instrument.Cache
+			if useCache {
+				mode := fmt.Sprintf("objectstate %v %v\n%v", pkgName, method, policy)
+				cache, err = instrument.OpenCache(c, cacheDir, mode, program)
+				if err != nil {
+					return nil, cmd.Errorf(7, err.Error())
+				}
+			}
 			fmt.Println("instrumenting for object-state", pkgName)
-			err = Instrument(pkgName, method, program)
+			err = Instrument(pkgName, method, program, cache, policy)
 			if err != nil {
 				return nil, cmd.Errorf(7, err.Error())
 			}
 			fmt.Println("instrumenting", pkgName)
-			err = instrument.Instrument(pkgName, program)
+			err = instrument.Instrument(pkgName, program, instrument.Cached(cache), instrument.Policy(policy))
 			if err != nil {
 				return nil, cmd.Errorf(8, err.Error())
 			}
-			_, err = instrument.BuildBinary(c, keepWork, work, pkgName, output, program)
+			_, err = instrument.BuildBinary(c, cache, policy, keepWork, work, pkgName, output, program)
 			if err != nil {
 				return nil, cmd.Errorf(9, err.Error())
 			}
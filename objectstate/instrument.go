@@ -28,9 +28,11 @@ type instrumenter struct {
 	// TODO check if currentFile is what we want - iirc this is used to find
 	// import statements
 	currentFile *ast.File
+	cache       *instrument.Cache
+	policy      *excludes.Policy
 }
 
-func Instrument(entryPkgName string, methodName string, program *loader.Program) (err error) {
+func Instrument(entryPkgName string, methodName string, program *loader.Program, cache *instrument.Cache, policy *excludes.Policy) (err error) {
 	entry := program.Package(entryPkgName)
 	if entry == nil {
 		return errors.Errorf("The entry package was not found in the loaded program")
@@ -42,6 +44,8 @@ func Instrument(entryPkgName string, methodName string, program *loader.Program)
 		program: program,
 		entry:   entryPkgName,
 		method:  methodName,
+		cache:   cache,
+		policy:  policy,
 	}
 	return i.instrument()
 }
@@ -51,7 +55,10 @@ func (i *instrumenter) instrument() (err error) {
 		//if len(pkg.BuildPackage.CgoFiles) > 0 {
 		//	continue
 		//}
-		if excludes.ExcludedPkg(pkg.Pkg.Path()) {
+		if i.policy.ExcludedPkg(pkg.Pkg.Path()) {
+			continue
+		}
+		if i.cache.Fresh(pkg.Pkg.Path()) {
 			continue
 		}
 		for _, fileAst := range pkg.Files {
@@ -61,6 +68,9 @@ func (i *instrumenter) instrument() (err error) {
 				if i.method != "" && !strings.Contains(fnName, i.method) {
 					return nil
 				}
+				if i.policy.ExcludedFunc(fnName) {
+					return nil
+				}
 				hadFunc = true
 				switch x := fn.(type) {
 				case *ast.FuncDecl:
@@ -0,0 +1,381 @@
+package profile
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+import (
+	"github.com/timtadh/getopt"
+)
+
+import (
+	"github.com/timtadh/dynagrok/cmd"
+	"github.com/timtadh/dynagrok/dgruntime/dgtypes"
+	"github.com/timtadh/dynagrok/dgruntime/excludes"
+)
+
+func NewCommand(c *cmd.Config) cmd.Runnable {
+	merge := NewMergeCommand(c)
+	diff := NewDiffCommand(c)
+	stats := NewStatsCommand(c)
+	filter := NewFilterCommand(c)
+	pprof := NewPprofCommand(c)
+	collect := NewCollectCommand(c)
+	return cmd.Concat(
+		NewProfileMain(c),
+		cmd.Commands(map[string]cmd.Runnable{
+			merge.Name():   merge,
+			diff.Name():    diff,
+			stats.Name():   stats,
+			filter.Name():  filter,
+			pprof.Name():   pprof,
+			collect.Name(): collect,
+		}),
+	)
+}
+
+func NewProfileMain(c *cmd.Config) cmd.Runnable {
+	return cmd.Cmd("profile",
+		`[options]`,
+		`
+Work with the flow graphs written by instrumented programs. Wherever a
+<profiles> argument is expected give flow graph files (or directories of them)
+in the text or binary format. The graphs are summed into a single weighted
+graph before the sub-command runs.
+
+Option Flags
+    -h,--help                         Show this message
+`,
+		"",
+		[]string{},
+		func(r cmd.Runnable, args []string, optargs []getopt.OptArg) ([]string, *cmd.Error) {
+			for _, oa := range optargs {
+				switch oa.Opt() {
+				}
+			}
+			return args, nil
+		})
+}
+
+const outputUsage = `
+    -o,--output=<path>                Output file to create
+                                      (defaults to standard output)
+`
+
+func NewMergeCommand(c *cmd.Config) cmd.Runnable {
+	return cmd.Cmd("merge",
+		`[options] <profiles>+`,
+		`
+Sum many flow graphs into one weighted flow graph
+
+Option Flags
+    -h,--help                         Show this message`+outputUsage+`    --binary                          Write the binary format
+`,
+		"o:",
+		[]string{
+			"output=",
+			"binary",
+		},
+		func(r cmd.Runnable, args []string, optargs []getopt.OptArg) ([]string, *cmd.Error) {
+			output := ""
+			binary := false
+			for _, oa := range optargs {
+				switch oa.Opt() {
+				case "-o", "--output":
+					output = oa.Arg()
+				case "--binary":
+					binary = true
+				}
+			}
+			if len(args) < 1 {
+				return nil, cmd.Usage(r, 2, "Expected at least one profile")
+			}
+			p, err := Load(args)
+			if err != nil {
+				return nil, cmd.Err(2, err)
+			}
+			if err := Write(p, output, binary); err != nil {
+				return nil, cmd.Err(1, err)
+			}
+			return nil, nil
+		})
+}
+
+func NewFilterCommand(c *cmd.Config) cmd.Runnable {
+	return cmd.Cmd("filter",
+		`[options] <profiles>+`,
+		`
+Keep only the blocks of the packages and functions allowed by the policy
+flags. Edges to or from dropped blocks are dropped too.
+
+Option Flags
+    -h,--help                         Show this message`+outputUsage+`    --binary                          Write the binary format
+`+cmd.PolicyUsage,
+		"o:",
+		append([]string{
+			"output=",
+			"binary",
+		}, cmd.PolicyLongOpts...),
+		func(r cmd.Runnable, args []string, optargs []getopt.OptArg) ([]string, *cmd.Error) {
+			output := ""
+			binary := false
+			policy := excludes.NewPolicy()
+			for _, oa := range optargs {
+				if handled, err := cmd.PolicyOpt(policy, oa); err != nil {
+					return nil, err
+				} else if handled {
+					continue
+				}
+				switch oa.Opt() {
+				case "-o", "--output":
+					output = oa.Arg()
+				case "--binary":
+					binary = true
+				}
+			}
+			if len(args) < 1 {
+				return nil, cmd.Usage(r, 2, "Expected at least one profile")
+			}
+			p, err := Load(args)
+			if err != nil {
+				return nil, cmd.Err(2, err)
+			}
+			p = p.Filter(func(fnName string) bool {
+				return !policy.ExcludedPkg(Package(fnName)) && !policy.ExcludedFunc(fnName)
+			})
+			if err := Write(p, output, binary); err != nil {
+				return nil, cmd.Err(1, err)
+			}
+			return nil, nil
+		})
+}
+
+func NewPprofCommand(c *cmd.Config) cmd.Runnable {
+	return cmd.Cmd("pprof",
+		`[options] <profiles>+`,
+		`
+Write the time spent in each basic block as a gzipped pprof profile. The
+samples are the blocks located at the lines they start on:
+
+    $ dynagrok profile pprof -o blocks.pb.gz /tmp/prof
+    $ go tool pprof -lines -top blocks.pb.gz
+
+Instrumented programs write the same profile to block-time.pb.gz.
+
+Option Flags
+    -h,--help                         Show this message`+outputUsage,
+		"o:",
+		[]string{
+			"output=",
+		},
+		func(r cmd.Runnable, args []string, optargs []getopt.OptArg) ([]string, *cmd.Error) {
+			output := ""
+			for _, oa := range optargs {
+				switch oa.Opt() {
+				case "-o", "--output":
+					output = oa.Arg()
+				}
+			}
+			if len(args) < 1 {
+				return nil, cmd.Usage(r, 2, "Expected at least one profile")
+			}
+			p, err := Load(args)
+			if err != nil {
+				return nil, cmd.Err(2, err)
+			}
+			return nil, withOutput(output, p.WriteBlockPprof)
+		})
+}
+
+func NewDiffCommand(c *cmd.Config) cmd.Runnable {
+	return cmd.Cmd("diff",
+		`[options] <failing-profiles> <succeeding-profiles>`,
+		`
+Show the edges and blocks executed by the failing runs but never by the
+succeeding runs along with how often the failing runs executed them.
+
+Option Flags
+    -h,--help                         Show this message`+outputUsage+`    -a,--all                          Show every edge and block whose counts
+                                      differ (not just the failure only ones)
+`,
+		"o:a",
+		[]string{
+			"output=",
+			"all",
+		},
+		func(r cmd.Runnable, args []string, optargs []getopt.OptArg) ([]string, *cmd.Error) {
+			output := ""
+			all := false
+			for _, oa := range optargs {
+				switch oa.Opt() {
+				case "-o", "--output":
+					output = oa.Arg()
+				case "-a", "--all":
+					all = true
+				}
+			}
+			if len(args) != 2 {
+				return nil, cmd.Usage(r, 2, "Expected 2 arguments for failing/successful profiles got: [%v]", strings.Join(args, ", "))
+			}
+			fails, err := Load(args[:1])
+			if err != nil {
+				return nil, cmd.Err(2, err)
+			}
+			oks, err := Load(args[1:])
+			if err != nil {
+				return nil, cmd.Err(2, err)
+			}
+			return nil, withOutput(output, func(fout io.Writer) error {
+				return writeDiff(fout, fails, oks, all)
+			})
+		})
+}
+
+func writeDiff(fout io.Writer, fails, oks *dgtypes.Profile, all bool) error {
+	d := fails.Diff(oks)
+	positions := Positions(oks)
+	for b, pos := range Positions(fails) {
+		positions[b] = pos
+	}
+	w := tabwriter.NewWriter(fout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "edge\tfailing\tsucceeding")
+	for _, e := range d.Edges {
+		if all || e.OtherCount == 0 {
+			arrow := "->"
+			if e.Kind != "" {
+				arrow = "-" + e.Kind + "->"
+			}
+			fmt.Fprintf(w, "%v %v %v\t%d\t%d\n", blockName(e.Src), arrow, blockName(e.Targ), e.Count, e.OtherCount)
+		}
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "block\tfailing\tsucceeding\tposition")
+	for _, b := range d.Blocks {
+		if all && b.Count != b.OtherCount || b.Count > 0 && b.OtherCount == 0 {
+			fmt.Fprintf(w, "%v\t%d\t%d\t%v\n", blockName(b.Block), b.Count, b.OtherCount, positions[b.Block])
+		}
+	}
+	return w.Flush()
+}
+
+func NewStatsCommand(c *cmd.Config) cmd.Runnable {
+	return cmd.Cmd("stats",
+		`[options] <pkg> <profiles>+`,
+		`
+Report block coverage per package and per function against the static
+control flow graphs of <pkg>. The graphs are rebuilt from the source so it
+must be the same source that was instrumented. Functions which never ran are
+reported with no covered blocks.
+
+Without --include only the packages with at least one executed function (and
+<pkg> itself) are reported.
+
+Option Flags
+    -h,--help                         Show this message`+outputUsage+`    -f,--functions=<path>             A functions.json file (may be repeated)
+                                      giving the call counts
+    --test                            Report on the package's tests too (use
+                                      with profiles from instrument --test)
+`+cmd.PolicyUsage,
+		"o:f:",
+		append([]string{
+			"output=",
+			"functions=",
+			"test",
+		}, cmd.PolicyLongOpts...),
+		func(r cmd.Runnable, args []string, optargs []getopt.OptArg) ([]string, *cmd.Error) {
+			output := ""
+			functions := make([]string, 0, 10)
+			test := false
+			policy := excludes.NewPolicy()
+			for _, oa := range optargs {
+				if ok, err := cmd.PolicyOpt(policy, oa); err != nil {
+					return nil, err
+				} else if ok {
+					continue
+				}
+				switch oa.Opt() {
+				case "-o", "--output":
+					output = oa.Arg()
+				case "-f", "--functions":
+					functions = append(functions, oa.Arg())
+				case "--test":
+					test = true
+				}
+			}
+			if len(args) < 2 {
+				return nil, cmd.Usage(r, 2, "Expected a package and at least one profile got %v", args)
+			}
+			pkgName := args[0]
+			p, err := Load(args[1:])
+			if err != nil {
+				return nil, cmd.Err(2, err)
+			}
+			if err := LoadFunctions(p, functions); err != nil {
+				return nil, cmd.Err(2, err)
+			}
+			load := cmd.LoadPkg
+			if test {
+				load = cmd.LoadTestPkg
+			}
+			program, err := load(c, pkgName)
+			if err != nil {
+				return nil, cmd.Usage(r, 6, err.Error())
+			}
+			fns, err := Coverage(program, Reported(pkgName, policy, p), p)
+			if err != nil {
+				return nil, cmd.Err(1, err)
+			}
+			return nil, withOutput(output, func(fout io.Writer) error {
+				return writeStats(fout, fns)
+			})
+		})
+}
+
+func writeStats(fout io.Writer, fns []*FuncCoverage) error {
+	pkgs := make(map[string]*FuncCoverage)
+	names := make([]string, 0, 10)
+	for _, f := range fns {
+		pkg := Package(f.Name)
+		if pkgs[pkg] == nil {
+			pkgs[pkg] = &FuncCoverage{Name: pkg}
+			names = append(names, pkg)
+		}
+		pkgs[pkg].Covered += f.Covered
+		pkgs[pkg].Blocks += f.Blocks
+		pkgs[pkg].Calls += f.Calls
+	}
+	sort.Strings(names)
+	w := tabwriter.NewWriter(fout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "package\tcovered\tblocks\tcoverage")
+	for _, name := range names {
+		pkg := pkgs[name]
+		fmt.Fprintf(w, "%v\t%d\t%d\t%.1f%%\n", pkg.Name, pkg.Covered, pkg.Blocks, pkg.Percent())
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "function\tcovered\tblocks\tcoverage\tcalls")
+	for _, f := range fns {
+		fmt.Fprintf(w, "%v\t%d\t%d\t%.1f%%\t%d\n", f.Name, f.Covered, f.Blocks, f.Percent(), f.Calls)
+	}
+	return w.Flush()
+}
+
+func withOutput(path string, write func(io.Writer) error) *cmd.Error {
+	fout := os.Stdout
+	if path != "" {
+		var err error
+		fout, err = os.Create(path)
+		if err != nil {
+			return cmd.Errorf(1, "Could not create output file: %v, error: %v", path, err)
+		}
+		defer fout.Close()
+	}
+	if err := write(fout); err != nil {
+		return cmd.Err(1, err)
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package profile
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+import (
+	"github.com/timtadh/data-structures/errors"
+	"github.com/timtadh/getopt"
+)
+
+import (
+	"github.com/timtadh/dynagrok/cmd"
+)
+
+func NewCollectCommand(c *cmd.Config) cmd.Runnable {
+	return cmd.Cmd("collect",
+		`[options] -l <socket> <dir>`,
+		`
+Collect the profiles streamed by instrumented programs run with
+DGPROF_SINK=unix:<socket>. Each run's files are written to a directory of
+their own, <dir>/<n> for the n-th run to connect:
+
+    $ dynagrok profile collect -l /tmp/dgprof.sock /tmp/prof &
+    $ DGPROF_SINK=unix:/tmp/dgprof.sock ./prog.instr
+
+Option Flags
+    -h,--help                         Show this message
+    -l,--listen=<path>                The unix socket to listen on
+    -n,--runs=<n>                     Exit after n runs (defaults to running
+                                      until interrupted)
+`,
+		"l:n:",
+		[]string{
+			"listen=",
+			"runs=",
+		},
+		func(r cmd.Runnable, args []string, optargs []getopt.OptArg) ([]string, *cmd.Error) {
+			listen := ""
+			runs := 0
+			for _, oa := range optargs {
+				switch oa.Opt() {
+				case "-l", "--listen":
+					listen = oa.Arg()
+				case "-n", "--runs":
+					n, err := strconv.Atoi(oa.Arg())
+					if err != nil || n <= 0 {
+						return nil, cmd.Usage(r, 2, "Expected a positive number of runs got %v", oa.Arg())
+					}
+					runs = n
+				}
+			}
+			if listen == "" {
+				return nil, cmd.Usage(r, 2, "Expected a socket to listen on (-l)")
+			}
+			if len(args) != 1 {
+				return nil, cmd.Usage(r, 2, "Expected one output directory got %v", args)
+			}
+			if err := collect(listen, args[0], runs); err != nil {
+				return nil, cmd.Err(1, err)
+			}
+			return nil, nil
+		})
+}
+
+// collect accepts runs on the socket until it has seen runs of them (or
+// forever if runs is 0) and extracts each into a numbered directory of dir
+func collect(socket, dir string, runs int) error {
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+	go func() {
+		if _, ok := <-sigs; ok {
+			l.Close()
+		}
+	}()
+	for n := 1; runs == 0 || n <= runs; n++ {
+		conn, err := l.Accept()
+		if err != nil {
+			if runs == 0 {
+				// interrupted
+				return nil
+			}
+			return err
+		}
+		runDir := filepath.Join(dir, strconv.Itoa(n))
+		err = Extract(conn, runDir)
+		conn.Close()
+		if err != nil {
+			errors.Logf("ERROR", "run %d: %v", n, err)
+			continue
+		}
+		fmt.Println("collected", runDir)
+	}
+	return nil
+}
+
+// Extract writes the files of a profile stream (see dgruntime/sink.go) to
+// dir. A stream cut short (the program was killed) keeps the files which
+// were complete.
+func Extract(stream io.Reader, dir string) error {
+	return ReadStream(stream, func(name string, r io.Reader) error {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), os.ModeDir|0775); err != nil {
+			return err
+		}
+		fout, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		defer fout.Close()
+		_, err = io.Copy(fout, r)
+		return err
+	})
+}
+
+// ReadStream calls each with the name (a slash separated path relative to
+// the profile directory) and the contents of each file in a profile stream
+func ReadStream(stream io.Reader, each func(name string, r io.Reader) error) error {
+	tr := tar.NewReader(stream)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return errors.Errorf("bad profile stream: %v", err)
+		}
+		if h.Typeflag != tar.TypeReg {
+			continue
+		}
+		name := filepath.ToSlash(filepath.Clean(filepath.FromSlash(h.Name)))
+		if filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return errors.Errorf("bad profile stream: file %q is outside of the profile", h.Name)
+		}
+		if err := each(name, tr); err != nil {
+			return err
+		}
+	}
+}
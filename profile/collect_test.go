@@ -0,0 +1,186 @@
+package profile
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/timtadh/dynagrok/dgruntime/dgtypes"
+)
+
+// streamer is a program calling dgruntime as an instrumented program would
+const streamer = `package main
+
+import "dgruntime"
+
+func main() {
+	defer func() { dgruntime.Shutdown() }()
+	dgruntime.EnterFunc("main.main", "main.go:5:1", dgruntime.NoCFG, dgruntime.NoIPDom)
+	dgruntime.Fail("injected")
+	dgruntime.ExitFunc("main.main")
+}
+`
+
+// buildStreamer builds the streamer against this tree's dgruntime in a
+// GOPATH of its own under dir
+func buildStreamer(t *testing.T, dir string) string {
+	goBin, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go is needed to build a program using dgruntime")
+	}
+	dgruntime, err := filepath.Abs(filepath.Join("..", "dgruntime"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gopath := filepath.Join(dir, "gopath")
+	src := filepath.Join(gopath, "src", "streamer")
+	if err := os.MkdirAll(src, os.ModeDir|0775); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(dgruntime, filepath.Join(gopath, "src", "dgruntime")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(src, "main.go"), []byte(streamer), 0664); err != nil {
+		t.Fatal(err)
+	}
+	prog := filepath.Join(dir, "streamer")
+	build := exec.Command(goBin, "build", "-o", prog, ".")
+	build.Dir = src
+	build.Env = append(os.Environ(), "GOPATH="+gopath, "GO111MODULE=off", "GOFLAGS=")
+	if out, err := build.CombinedOutput(); err != nil {
+		t.Fatalf("could not build the streamer: %v\n%s", err, out)
+	}
+	return prog
+}
+
+func TestCollect(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dynagrok-collect-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	prog := buildStreamer(t, dir)
+	socket := filepath.Join(dir, "sock")
+	out := filepath.Join(dir, "out")
+	collected := make(chan error, 1)
+	go func() {
+		collected <- collect(socket, out, 1)
+	}()
+	// the program dials as soon as it starts so wait for the socket
+	for i := 0; i < 1000; i++ {
+		if _, err := os.Stat(socket); err == nil {
+			break
+		}
+		select {
+		case err := <-collected:
+			t.Fatalf("collect stopped: %v", err)
+		case <-time.After(time.Millisecond):
+		}
+	}
+	run := exec.Command(prog)
+	run.Env = append(os.Environ(), "DGPROF_SINK=unix:"+socket, "DGPROF_LOG=off")
+	var stdout bytes.Buffer
+	run.Stdout = &stdout
+	if err := run.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-collected; err != nil {
+		t.Fatal(err)
+	}
+	if stdout.Len() != 0 {
+		t.Errorf("DGPROF_LOG=off logged %q", stdout.String())
+	}
+	for _, file := range []string{"flow-graph.txt", "functions.json", "failures"} {
+		if _, err := os.Stat(filepath.Join(out, "1", file)); err != nil {
+			t.Errorf("%v was not collected: %v", file, err)
+		}
+	}
+}
+
+func TestReadStream(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dynagrok-stream-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	prog := buildStreamer(t, dir)
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pr.Close()
+	run := exec.Command(prog)
+	run.Env = append(os.Environ(),
+		"DGPROF_SINK=fd:3",
+		"DGPROF_GZIP=1",
+		"DGPROF_NAME={name}-{id}",
+		"DGPROF_ID=run1",
+		"DGPROF_LOG=stderr",
+	)
+	var stdout, stderr bytes.Buffer
+	run.Stdout = &stdout
+	run.Stderr = &stderr
+	run.ExtraFiles = []*os.File{pw}
+	if err := run.Start(); err != nil {
+		t.Fatal(err)
+	}
+	pw.Close()
+	files := make(map[string][]byte)
+	err = ReadStream(pr, func(name string, r io.Reader) error {
+		data, err := ioutil.ReadAll(r)
+		files[name] = data
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := run.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	// the flow graph is named after DGPROF_NAME and compressed
+	graph := filepath.Join(dir, "flow-graph-run1.txt.gz")
+	if data, has := files["flow-graph-run1.txt.gz"]; !has {
+		t.Errorf("the flow graph is missing from %v", names(files))
+	} else if err := ioutil.WriteFile(graph, data, 0664); err != nil {
+		t.Fatal(err)
+	} else if p, err := Load([]string{graph}); err != nil {
+		t.Errorf("the streamed flow graph does not load: %v", err)
+	} else if !hasFunc(p, "main.main") {
+		t.Errorf("the streamed flow graph lost main.main: %v", p.Funcs)
+	}
+	// the files read by name keep their names
+	if !strings.Contains(string(files["failures"]), "injected") {
+		t.Errorf("the failures are missing from %v", names(files))
+	}
+	if _, has := files["functions.json"]; !has {
+		t.Errorf("functions.json is missing from %v", names(files))
+	}
+	if stdout.Len() != 0 || !strings.Contains(stderr.String(), "done shutting down") {
+		t.Errorf("DGPROF_LOG=stderr logged %q to stdout and %q to stderr", stdout.String(), stderr.String())
+	}
+}
+
+func hasFunc(p *dgtypes.Profile, name string) bool {
+	for _, fn := range p.Funcs {
+		if fn.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func names(files map[string][]byte) []string {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	return names
+}
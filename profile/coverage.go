@@ -0,0 +1,162 @@
+package profile
+
+import (
+	"fmt"
+	"go/ast"
+	"sort"
+	"strings"
+)
+
+import (
+	"github.com/timtadh/data-structures/errors"
+	"golang.org/x/tools/go/loader"
+)
+
+import (
+	"github.com/timtadh/dynagrok/analysis"
+	"github.com/timtadh/dynagrok/dgruntime/dgtypes"
+	"github.com/timtadh/dynagrok/dgruntime/excludes"
+)
+
+// FuncCoverage is the number of basic blocks of a function (or package)
+// which were executed.
+type FuncCoverage struct {
+	Name    string
+	Covered int
+	Blocks  int
+	Calls   int
+}
+
+func (f *FuncCoverage) Percent() float64 {
+	if f.Blocks == 0 {
+		return 0
+	}
+	return 100 * float64(f.Covered) / float64(f.Blocks)
+}
+
+// Coverage computes the block coverage of every function of the packages
+// for which report returns true against their static control flow graphs.
+// A function which never ran counts with none of its blocks covered. The
+// blocks without statements (the exits of the functions) are never
+// instrumented so they are not counted. The result is sorted by name.
+func Coverage(program *loader.Program, report func(pkg *loader.PackageInfo) bool, p *dgtypes.Profile) ([]*FuncCoverage, error) {
+	covered := make(map[string]map[int]bool)
+	for e := range p.Flows {
+		if e.Targ.In == 0 || e.Kind != "" {
+			// (edges between goroutines do not enter their target)
+			continue
+		}
+		f, has := p.Funcs[e.Targ.In]
+		if !has {
+			continue
+		}
+		if covered[f.Name] == nil {
+			covered[f.Name] = make(map[int]bool)
+		}
+		covered[f.Name][e.Targ.BasicBlockId] = true
+	}
+	calls := make(map[string]int, len(p.Funcs))
+	for _, f := range p.Funcs {
+		calls[f.Name] += f.Calls
+	}
+	fns := make([]*FuncCoverage, 0, len(p.Funcs))
+	for _, pkg := range program.AllPackages {
+		if !report(pkg) {
+			continue
+		}
+		for _, fileAst := range pkg.Files {
+			err := analysis.Functions(pkg, fileAst, func(fn ast.Node, fnName string) error {
+				var body *ast.BlockStmt
+				switch x := fn.(type) {
+				case *ast.FuncDecl:
+					body = x.Body
+				case *ast.FuncLit:
+					body = x.Body
+				default:
+					return errors.Errorf("unexpected type %T", x)
+				}
+				if body == nil {
+					return nil
+				}
+				cfg := analysis.BuildCFG(program.Fset, fnName, fn, &body.List)
+				f := &FuncCoverage{Name: fnName, Calls: calls[fnName]}
+				for _, b := range cfg.Blocks {
+					if b.Id != 0 && len(b.Stmts) == 0 && b.Cond == nil {
+						continue
+					}
+					f.Blocks++
+					if covered[fnName][b.Id] {
+						f.Covered++
+					}
+				}
+				fns = append(fns, f)
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	sort.Slice(fns, func(i, j int) bool {
+		return fns[i].Name < fns[j].Name
+	})
+	return fns, nil
+}
+
+// Reported picks the packages reported on for the package pkgName: the
+// package itself (and its external tests), the packages included by the
+// policy when it includes any or else the packages with a function in the
+// profile.
+func Reported(pkgName string, policy *excludes.Policy, p *dgtypes.Profile) func(pkg *loader.PackageInfo) bool {
+	executed := make(map[string]bool)
+	for _, f := range p.Funcs {
+		executed[Package(f.Name)] = true
+	}
+	return func(pkg *loader.PackageInfo) bool {
+		path := pkg.Pkg.Path()
+		if path == pkgName || path == pkgName+"_test" {
+			return true
+		}
+		if policy.ExcludedPkg(path) {
+			return false
+		}
+		return len(policy.Include) > 0 || executed[path]
+	}
+}
+
+// Positions maps the blocks of the profile to their source positions
+func Positions(p *dgtypes.Profile) map[dgtypes.Block]string {
+	positions := make(map[dgtypes.Block]string, len(p.Positions))
+	for b, pos := range p.Positions {
+		if f, has := p.Funcs[b.In]; has {
+			positions[dgtypes.Block{FnName: f.Name, BasicBlockId: b.BasicBlockId}] = pos
+		}
+	}
+	return positions
+}
+
+// Package returns the import path of the package a function belongs to
+// given its dynagrok name (eg. `(*github.com/x/y.T).String` is in
+// github.com/x/y). The names are `<path>.F`, `<path>.F$1` (a function
+// literal) or `(<path>.T).M` so the package ends at the last dot of the
+// qualified name, the path itself may hold dots (gopkg.in/yaml.v2.F).
+func Package(fnName string) string {
+	name := fnName
+	if strings.HasPrefix(name, "(") {
+		name = strings.TrimLeft(name, "(*")
+		if end := strings.Index(name, ")"); end >= 0 {
+			name = name[:end]
+		}
+	}
+	if dot := strings.LastIndex(name, "."); dot > strings.LastIndex(name, "/") {
+		return name[:dot]
+	}
+	return name
+}
+
+func blockName(b dgtypes.Block) string {
+	if b.FnName == "entry" && b.BasicBlockId == 0 {
+		return "entry"
+	}
+	return fmt.Sprintf("%v blk %d", b.FnName, b.BasicBlockId)
+}
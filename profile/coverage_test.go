@@ -0,0 +1,95 @@
+package profile
+
+import (
+	"reflect"
+	"testing"
+)
+
+import (
+	"golang.org/x/tools/go/loader"
+)
+
+import (
+	"github.com/timtadh/dynagrok/dgruntime/dgtypes"
+	"github.com/timtadh/dynagrok/dgruntime/excludes"
+)
+
+func TestCoverage(t *testing.T) {
+	src := `package test
+
+func f(x int) int {
+	if x > 0 {
+		return 1
+	}
+	return 2
+}
+
+func g() {
+	f(1)
+}
+
+func never(x int) int {
+	if x > 0 {
+		return 1
+	}
+	return 2
+}
+`
+	conf := loader.Config{}
+	file, err := conf.ParseFile("test.go", src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf.CreateFromFiles("test", file)
+	program, err := conf.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := func(pc uintptr, bbid int) dgtypes.BlkEntrance {
+		return dgtypes.BlkEntrance{In: pc, BasicBlockId: bbid}
+	}
+	p := dgtypes.NewProfile()
+	p.Funcs[1] = &dgtypes.Function{Name: "test.f", FuncPc: 1, Calls: 3}
+	p.Funcs[2] = &dgtypes.Function{Name: "test.g", FuncPc: 2, Calls: 1}
+	p.Flows[dgtypes.FlowEdge{Targ: at(2, 0)}] = 1
+	p.Flows[dgtypes.FlowEdge{Src: at(2, 0), Targ: at(1, 0)}] = 3
+	p.Flows[dgtypes.FlowEdge{Src: at(1, 0), Targ: at(1, 1)}] = 3
+	p.Flows[dgtypes.FlowEdge{Src: at(1, 0), Targ: at(1, 2), Kind: dgtypes.SpawnEdge}] = 1
+	fns, err := Coverage(program, Reported("test", excludes.NewPolicy(), p), p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*FuncCoverage{
+		{Name: "test.f", Covered: 2, Blocks: 3, Calls: 3},
+		{Name: "test.g", Covered: 1, Blocks: 1, Calls: 1},
+		// never ran but its blocks count
+		{Name: "test.never", Covered: 0, Blocks: 3},
+	}
+	if !reflect.DeepEqual(fns, want) {
+		for _, f := range fns {
+			t.Logf("%+v", f)
+		}
+		t.Fatal("unexpected coverage")
+	}
+	if fns, err := Coverage(program, Reported("other", excludes.NewPolicy(), dgtypes.NewProfile()), p); err != nil || len(fns) != 0 {
+		t.Errorf("reported %v, %v for a package without executed functions", fns, err)
+	}
+}
+
+func TestPackage(t *testing.T) {
+	for fn, pkg := range map[string]string{
+		"main.main":                       "main",
+		"main.main$1":                     "main",
+		"github.com/x/y.F":                "github.com/x/y",
+		"github.com/x/y.F$2$1":            "github.com/x/y",
+		"(*github.com/x/y.T).String":      "github.com/x/y",
+		"(github.com/x/y.T).String$1":     "github.com/x/y",
+		"gopkg.in/yaml.v2.Unmarshal":      "gopkg.in/yaml.v2",
+		"(*gopkg.in/yaml.v2.decoder).run": "gopkg.in/yaml.v2",
+		"example.com/a.b/c.F":             "example.com/a.b/c",
+	} {
+		if got := Package(fn); got != pkg {
+			t.Errorf("Package(%q) = %q expected %q", fn, got, pkg)
+		}
+	}
+}
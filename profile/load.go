@@ -0,0 +1,172 @@
+package profile
+
+import (
+	"bufio"
+	"io"
+	"os"
+)
+
+import (
+	"github.com/timtadh/data-structures/errors"
+)
+
+import (
+	"github.com/timtadh/dynagrok/cmd"
+	"github.com/timtadh/dynagrok/dgruntime/binprof"
+	"github.com/timtadh/dynagrok/dgruntime/dgtypes"
+)
+
+// Load reads the flow graphs in paths (files or directories of files) and
+// merges them into a single profile. As with `localize stat` the flow graphs
+// may be in the simple text format or the binary format but not a mix.
+func Load(paths []string) (*dgtypes.Profile, error) {
+	input, closeall, err := cmd.Inputs(paths)
+	if err != nil {
+		return nil, err
+	}
+	defer closeall()
+	r := bufio.NewReader(input)
+	prefix, err := r.Peek(len(binprof.Magic))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if binprof.IsBinary(prefix) {
+		return LoadBinary(r)
+	}
+	return dgtypes.LoadSimple(r)
+}
+
+// LoadGraphs reads the flow graphs in paths (as Load does) one at a time.
+// Each graph (a run or a segment of one) is loaded into a profile of its own
+// which is handed to each.
+func LoadGraphs(paths []string, each func(*dgtypes.Profile) error) error {
+	input, closeall, err := cmd.Inputs(paths)
+	if err != nil {
+		return err
+	}
+	defer closeall()
+	r := bufio.NewReader(input)
+	prefix, err := r.Peek(len(binprof.Magic))
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if binprof.IsBinary(prefix) {
+		var p *dgtypes.Profile
+		start := func() *dgtypes.GraphBuilder {
+			p = dgtypes.NewProfile()
+			return dgtypes.NewGraphBuilder(p)
+		}
+		return loadBinary(r, start, func() error { return each(p) })
+	}
+	return dgtypes.LoadSimpleGraphs(r, each)
+}
+
+// LoadBinary reads (and merges) flow graphs in the binary format
+func LoadBinary(input io.Reader) (*dgtypes.Profile, error) {
+	p := dgtypes.NewProfile()
+	err := loadBinary(input, func() *dgtypes.GraphBuilder { return dgtypes.NewGraphBuilder(p) }, nil)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// loadBinary calls start at the beginning of each graph and end (if not nil)
+// when the graph is complete
+func loadBinary(input io.Reader, start func() *dgtypes.GraphBuilder, end func() error) error {
+	r, err := binprof.NewReader(input)
+	if err != nil {
+		return err
+	}
+	var b *dgtypes.GraphBuilder
+	for {
+		rec, err := r.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		switch {
+		case rec.Kind == binprof.GraphStart:
+			b = start()
+		case rec.Kind == binprof.GraphEnd:
+			if b != nil {
+				if err := b.End(); err != nil {
+					return err
+				}
+			}
+			if b != nil && end != nil {
+				if err := end(); err != nil {
+					return err
+				}
+			}
+			b = nil
+		case b == nil:
+			return errors.Errorf("Record %q outside of a graph", rec.Kind)
+		case rec.Kind == binprof.VertexRecord:
+			b.Vertex((*dgtypes.GraphVertex)(&rec.Vertex))
+		case rec.Kind == binprof.SamplingRecord:
+			b.Sampling((*dgtypes.Sampling)(&rec.Sampling))
+		case rec.Kind == binprof.GranularityRecord:
+			b.Granularity(rec.Granularity)
+		case rec.Kind == binprof.EdgeRecord:
+			if err := b.Edge(rec.Edge.Src, rec.Edge.Targ, rec.Edge.Count, rec.Edge.Kind); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// LoadFunctions reads functions.json files (written along side the flow
+// graph of every run) into the profile.
+func LoadFunctions(p *dgtypes.Profile, paths []string) error {
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		err = p.ReadFunctions(f)
+		f.Close()
+		if err != nil {
+			return errors.Errorf("Could not read %v: %v", path, err)
+		}
+	}
+	return nil
+}
+
+// Write writes the profile's flow graph to path (or standard output when
+// path is empty) in the text or binary format.
+func Write(p *dgtypes.Profile, path string, binary bool) error {
+	var fout io.Writer = os.Stdout
+	if path != "" {
+		f, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		fout = f
+	}
+	if !binary {
+		p.WriteSimple(fout)
+		return nil
+	}
+	return writeBinary(fout, p)
+}
+
+// writeBinary writes the flow graph as a single graph of a binary profile.
+// It is dgruntime's writeBinary: the two cannot share code beyond binprof as
+// dgruntime's packages are imported by a different path.
+func writeBinary(fout io.Writer, p *dgtypes.Profile) error {
+	return binprof.WriteGraph(fout, "profile", (*binprof.Sampling)(p.Sampling), p.Granularity,
+		func(vertex func(*binprof.Vertex), edge func(*binprof.Edge)) {
+			p.VisitGraph(
+				func(v *dgtypes.GraphVertex) {
+					bv := binprof.Vertex(*v)
+					vertex(&bv)
+				},
+				func(src, targ, count int, kind string) {
+					edge(&binprof.Edge{Src: src, Targ: targ, Count: count, Kind: kind})
+				},
+			)
+		})
+}
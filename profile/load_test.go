@@ -0,0 +1,56 @@
+package profile
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/timtadh/dynagrok/dgruntime/dgtypes"
+)
+
+func TestBinaryRoundTrip(t *testing.T) {
+	p := dgtypes.NewProfile()
+	p.Funcs[10] = &dgtypes.Function{Name: "main.main", FuncPc: 10, Calls: 1}
+	m0 := dgtypes.BlkEntrance{In: 10, BasicBlockId: 0}
+	m1 := dgtypes.BlkEntrance{In: 10, BasicBlockId: 1}
+	p.Flows[dgtypes.FlowEdge{Src: dgtypes.BlkEntrance{}, Targ: m0}] = 1
+	p.Flows[dgtypes.FlowEdge{Src: m0, Targ: m1}] = 4
+	p.Positions[m0] = "main.go:3:2"
+	p.Positions[m1] = "main.go:5:2"
+	p.Durations[m1] = 1500 * time.Microsecond
+	p.Predicates[dgtypes.Predicate{At: m1, Site: 2, Name: "x < 0", Position: "main.go:5:5"}] = 3
+	p.Observed[dgtypes.PredicateSite{At: m1, Site: 2}] = 4
+	p.Sampling = &dgtypes.Sampling{Params: "every=2", Rate: .5}
+	p.Granularity = dgtypes.FuncGranularity
+
+	var buf bytes.Buffer
+	if err := writeBinary(&buf, p); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadBinary(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := loaded.Diff(p); len(d.Edges) != 0 || len(d.Blocks) != 0 {
+		t.Errorf("round trip differs %v", d)
+	}
+	if len(loaded.Predicates) != 1 {
+		t.Errorf("predicates %v", loaded.Predicates)
+	}
+	for pred, count := range loaded.Predicates {
+		if count != 3 || pred.Name != "x < 0" || pred.Site != 2 {
+			t.Errorf("predicate %v held %d times", pred, count)
+		}
+		if n := loaded.Observed[pred.SiteOf()]; n != 4 {
+			t.Errorf("site observed %d times, expected 4", n)
+		}
+	}
+	if s := loaded.Sampling; s == nil || *s != *p.Sampling {
+		t.Errorf("sampling %v", s)
+	}
+	if loaded.Granularity != p.Granularity {
+		t.Errorf("granularity %q", loaded.Granularity)
+	}
+}
@@ -0,0 +1,153 @@
+package selftest
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"time"
+)
+
+import (
+	"github.com/timtadh/getopt"
+)
+
+import (
+	"github.com/timtadh/dynagrok/cmd"
+)
+
+func NewCommand(c *cmd.Config) cmd.Runnable {
+	return cmd.Cmd(
+		"selftest",
+		`[options] [<corpus>...]`,
+		`
+Instrument the programs of a corpus (directories of single file main
+packages, or the files themselves) and check that instrumenting them does not
+change what they do. The corpus defaults to examples/compiler-tests under the
+dynagrok path.
+
+Each program is built as is and instrumented (in modules mode). The programs
+under a directory named runs are run both ways (with the arguments of a
+"// run arg..." header) and their standard output and exit status compared.
+Programs which do not build as is are skipped. A line is reported for each
+program:
+
+    ok   oks/runs/closure.go
+    FAIL oks/runs/defer.go: stdout differs at line 3: "1", expected "2"
+    skip errors/runs/alias.go: does not build: ./alias.go:19:7: ...
+
+A corpus directory may list the programs known to fail in a file named
+known-failures (a program and the reason on each line). Their failures are
+reported as known:
+
+    known oks/runs/divmod.go: instrumented: did not exit within 1m0s (...)
+
+The exit status is 1 if any other program failed.
+
+Option Flags
+    -h,--help                         Show this message
+    -w,--work=<path>                  Work directory to use (defaults to tempdir)
+    --keep-work                       Keep the work directory (the modules, the
+                                      instrumentation logs, the stderr of the
+                                      runs and the profiles)
+    -j,--jobs=<n>                     Programs to test at once (defaults to the
+                                      number of cpus)
+    -t,--timeout=<duration>           Time limit of each run (defaults to 1m,
+                                      instrumented programs run a lot slower)
+    --predicates                      Instrument with --predicates
+`,
+		"w:j:t:",
+		[]string{
+			"work=",
+			"keep-work",
+			"jobs=",
+			"timeout=",
+			"predicates",
+		},
+		func(r cmd.Runnable, args []string, optargs []getopt.OptArg) ([]string, *cmd.Error) {
+			work := ""
+			keepWork := false
+			h := &Harness{
+				Config:  c,
+				Timeout: time.Minute,
+				Jobs:    runtime.NumCPU(),
+			}
+			for _, oa := range optargs {
+				switch oa.Opt() {
+				case "-w", "--work":
+					work = oa.Arg()
+				case "--keep-work":
+					keepWork = true
+				case "-j", "--jobs":
+					n, err := strconv.Atoi(oa.Arg())
+					if err != nil || n <= 0 {
+						return nil, cmd.Usage(r, 2, "Expected a positive number of jobs got %v", oa.Arg())
+					}
+					h.Jobs = n
+				case "-t", "--timeout":
+					d, err := time.ParseDuration(oa.Arg())
+					if err != nil || d <= 0 {
+						return nil, cmd.Usage(r, 2, "Expected a duration (eg. 30s) got %v", oa.Arg())
+					}
+					h.Timeout = d
+				case "--predicates":
+					h.Predicates = true
+				}
+			}
+			if c.DGPATH == "" {
+				return nil, cmd.Usage(r, 2, "The dynagrok path (-d) is needed to instrument the corpus")
+			}
+			if len(args) == 0 {
+				args = []string{filepath.Join(c.DGPATH, "examples", "compiler-tests")}
+			}
+			var progs []*Program
+			h.Known = make(map[string]string)
+			for _, root := range args {
+				p, err := Corpus(root)
+				if err != nil {
+					return nil, cmd.Err(2, err)
+				}
+				progs = append(progs, p...)
+				if info, err := os.Stat(root); err != nil || !info.IsDir() {
+					continue
+				}
+				known, err := ReadKnown(filepath.Join(root, "known-failures"))
+				if err != nil {
+					return nil, cmd.Err(2, err)
+				}
+				for name, why := range known {
+					h.Known[name] = why
+				}
+			}
+			if work == "" {
+				tmp, err := ioutil.TempDir("", "dynagrok-selftest-")
+				if err != nil {
+					return nil, cmd.Err(1, err)
+				}
+				work = tmp
+			} else if abs, err := filepath.Abs(work); err != nil {
+				return nil, cmd.Err(1, err)
+			} else {
+				work = abs
+			}
+			h.Work = work
+			if !keepWork {
+				defer os.RemoveAll(work)
+			}
+			counts := make(map[Status]int)
+			err := h.Test(progs, func(result *Result) {
+				counts[result.Status]++
+				fmt.Println(result)
+			})
+			if err != nil {
+				return nil, cmd.Err(1, err)
+			}
+			fmt.Printf("%d ok, %d failed, %d known failures, %d skipped\n", counts[Ok], counts[Fail], counts[Known], counts[Skip])
+			if counts[Fail] > 0 {
+				return nil, cmd.Errorf(1, "%d of %d programs failed", counts[Fail], len(progs))
+			}
+			return nil, nil
+		})
+}
@@ -0,0 +1,386 @@
+package selftest
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"go/parser"
+	"go/token"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+import (
+	"github.com/timtadh/dynagrok/cmd"
+)
+
+// The corpus programs are single file main packages (from the go
+// distribution's test directory). Each is copied into a module of its own
+// in the work directory, built as is, instrumented and built again by
+// running `dynagrok --modules instrument` on it. The programs under a
+// directory named runs are then run both ways and their outputs compared.
+//
+// A program which does not build as is (the errorcheck tests, programs
+// needing files of their own) is skipped: there is nothing to compare the
+// instrumented program against. The failures listed in a corpus directory's
+// known-failures file (see ReadKnown) are reported apart from the others.
+
+// goMod is the go.mod of a corpus program's module. The programs predate
+// the per iteration loop variables of go 1.22.
+const goMod = "module selftest\n\ngo 1.21\n"
+
+// Status is the outcome of a corpus program
+type Status string
+
+const (
+	Ok    Status = "ok"
+	Fail  Status = "FAIL"
+	Known Status = "known" // a failure of a program listed as known to fail
+	Skip  Status = "skip"
+)
+
+// Result is the outcome of a corpus program and why
+type Result struct {
+	Name   string // the program relative to the corpus directory
+	Status Status
+	Reason string
+}
+
+func (r *Result) String() string {
+	if r.Reason == "" {
+		return fmt.Sprintf("%-4v %v", r.Status, r.Name)
+	}
+	return fmt.Sprintf("%-4v %v: %v", r.Status, r.Name, r.Reason)
+}
+
+// Harness instruments and runs the corpus programs
+type Harness struct {
+	Config     *cmd.Config
+	Dynagrok   string            // the dynagrok executable (defaults to the running one)
+	Work       string            // the modules are made under Work
+	Timeout    time.Duration     // of each run
+	Jobs       int               // programs tested at once
+	Predicates bool              // instrument with --predicates
+	Known      map[string]string // the programs known to fail and why
+}
+
+// Program is a corpus program
+type Program struct {
+	Name string // relative to the corpus directory
+	Path string
+	Run  bool     // run it and compare the outputs (it is under runs)
+	Args []string // from its `// run arg...` header
+}
+
+// Corpus lists the programs under root (a directory or a single file)
+func Corpus(root string) ([]*Program, error) {
+	var progs []*Program
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || filepath.Ext(path) != ".go" {
+			return nil
+		}
+		name, err := filepath.Rel(root, path)
+		if err != nil || name == "." {
+			name = filepath.Base(path)
+		}
+		p := &Program{Name: name, Path: path}
+		for _, dir := range strings.Split(filepath.ToSlash(filepath.Dir(path)), "/") {
+			if dir == "runs" {
+				p.Run = true
+			}
+		}
+		if p.Run {
+			p.Args, err = runArgs(path)
+			if err != nil {
+				return err
+			}
+		}
+		progs = append(progs, p)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(progs, func(i, j int) bool { return progs[i].Name < progs[j].Name })
+	return progs, nil
+}
+
+// ReadKnown reads a known failures file. Each line names a program
+// (relative to the corpus directory) followed by why it fails:
+//
+//	# comments and blank lines are ignored
+//	oks/runs/divmod.go too slow for the portable goroutine identity
+//
+// A missing file lists no programs.
+func ReadKnown(path string) (map[string]string, error) {
+	known := make(map[string]string)
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return known, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.SplitN(line, " ", 2)
+		why := ""
+		if len(fields) == 2 {
+			why = strings.TrimSpace(fields[1])
+		}
+		known[filepath.FromSlash(fields[0])] = why
+	}
+	return known, s.Err()
+}
+
+// runArgs are the arguments given in a program's `// run arg...` header
+func runArgs(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	line, err := bufio.NewReader(f).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	fields := strings.Fields(line)
+	if len(fields) < 2 || fields[0] != "//" || fields[1] != "run" {
+		return nil, nil
+	}
+	return fields[2:], nil
+}
+
+// Test tests the programs, report is called with each result in the order
+// of the programs
+func (h *Harness) Test(progs []*Program, report func(*Result)) error {
+	self := h.Dynagrok
+	if self == "" {
+		var err error
+		if self, err = os.Executable(); err != nil {
+			return err
+		}
+	}
+	jobs := h.Jobs
+	if jobs <= 0 {
+		jobs = 1
+	}
+	results := make([]chan *Result, len(progs))
+	for i := range results {
+		results[i] = make(chan *Result, 1)
+	}
+	todo := make(chan int)
+	for j := 0; j < jobs; j++ {
+		go func() {
+			for i := range todo {
+				dir := filepath.Join(h.Work, fmt.Sprintf("%03d-%v", i, strings.TrimSuffix(filepath.Base(progs[i].Path), ".go")))
+				results[i] <- h.known(h.program(self, dir, progs[i]))
+			}
+		}()
+	}
+	go func() {
+		for i := range progs {
+			todo <- i
+		}
+		close(todo)
+	}()
+	for _, r := range results {
+		report(<-r)
+	}
+	return nil
+}
+
+// known marks the failure of a program listed in Known
+func (h *Harness) known(r *Result) *Result {
+	why, has := h.Known[r.Name]
+	if r.Status != Fail || !has {
+		return r
+	}
+	r.Status = Known
+	if why != "" {
+		r.Reason = fmt.Sprintf("%v (%v)", r.Reason, why)
+	}
+	return r
+}
+
+func (h *Harness) program(self, dir string, p *Program) *Result {
+	result := func(status Status, format string, args ...interface{}) *Result {
+		return &Result{Name: p.Name, Status: status, Reason: fmt.Sprintf(format, args...)}
+	}
+	if err := h.module(dir, p); err != nil {
+		return result(Fail, "could not make its module: %v", err)
+	}
+	if out, err := h.goCmd(dir, "build", "-o", "prog", ".").CombinedOutput(); err != nil {
+		return result(Skip, "does not build: %v", firstLine(out, err))
+	}
+	if pkg, err := packageName(p.Path); err != nil {
+		return result(Fail, "%v", err)
+	} else if pkg != "main" {
+		return result(Skip, "package %v is not a program", pkg)
+	}
+	args := []string{"--modules", "-d", h.Config.DGPATH}
+	if h.Config.GOROOT != "" {
+		args = append(args, "-r", h.Config.GOROOT)
+	}
+	args = append(args, "instrument", "--keep-work", "-w", filepath.Join(dir, "work"), "-o", "prog.instr")
+	if h.Predicates {
+		args = append(args, "--predicates")
+	}
+	c := exec.Command(self, append(args, "selftest")...)
+	c.Dir = dir
+	out, err := c.CombinedOutput()
+	ioutil.WriteFile(filepath.Join(dir, "instrument.log"), out, 0664)
+	if err != nil {
+		return result(Fail, "could not be instrumented: %v", instrumentError(out, err))
+	}
+	if _, err := os.Stat(filepath.Join(dir, "prog.instr")); err != nil {
+		return result(Fail, "the instrumented program was not built (see %v)", filepath.Join(dir, "instrument.log"))
+	}
+	if !p.Run {
+		return result(Ok, "")
+	}
+	want, err := h.run(dir, "./prog", p.Args, nil)
+	if err != nil {
+		return result(Skip, "%v", err)
+	}
+	got, err := h.run(dir, "./prog.instr", p.Args, []string{
+		"DGPROF=" + filepath.Join(dir, "profile"),
+		"DGPROF_LOG=off",
+	})
+	if err != nil {
+		return result(Fail, "instrumented: %v", err)
+	}
+	if got.status != want.status {
+		return result(Fail, "exit status %v, expected %v", got.status, want.status)
+	}
+	if !bytes.Equal(got.stdout, want.stdout) {
+		return result(Fail, "stdout differs %v", firstDiff(want.stdout, got.stdout))
+	}
+	return result(Ok, "")
+}
+
+// module makes the module holding the program
+func (h *Harness) module(dir string, p *Program) error {
+	if err := os.MkdirAll(dir, os.ModeDir|0775); err != nil {
+		return err
+	}
+	src, err := ioutil.ReadFile(p.Path)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "go.mod"), []byte(goMod), 0664); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, filepath.Base(p.Path)), src, 0664)
+}
+
+func (h *Harness) goCmd(dir string, args ...string) *exec.Cmd {
+	goBin := "go"
+	if h.Config.GOROOT != "" {
+		goBin = filepath.Join(h.Config.GOROOT, "bin", "go")
+	}
+	c := exec.Command(goBin, args...)
+	c.Dir = dir
+	c.Env = cmd.ModuleEnv(h.Config)
+	return c
+}
+
+type run struct {
+	stdout []byte
+	status int
+}
+
+// run runs a program (with env added to the environment) until it exits or
+// times out
+func (h *Harness) run(dir, prog string, args, env []string) (*run, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), h.Timeout)
+	defer cancel()
+	c := exec.CommandContext(ctx, prog, args...)
+	c.Dir = dir
+	c.Env = append(os.Environ(), env...)
+	var stdout bytes.Buffer
+	c.Stdout = &stdout
+	stderr, err := os.Create(filepath.Join(dir, filepath.Base(prog)+".stderr"))
+	if err != nil {
+		return nil, err
+	}
+	defer stderr.Close()
+	c.Stderr = stderr
+	err = c.Run()
+	if ctx.Err() != nil {
+		return nil, fmt.Errorf("did not exit within %v", h.Timeout)
+	}
+	if _, ok := err.(*exec.ExitError); err != nil && !ok {
+		return nil, err
+	}
+	return &run{stdout: stdout.Bytes(), status: c.ProcessState.ExitCode()}, nil
+}
+
+// firstDiff describes the first line where got differs from want
+func firstDiff(want, got []byte) string {
+	w := strings.Split(string(want), "\n")
+	g := strings.Split(string(got), "\n")
+	for i := 0; i < len(w) && i < len(g); i++ {
+		if w[i] != g[i] {
+			return fmt.Sprintf("at line %d: %q, expected %q", i+1, g[i], w[i])
+		}
+	}
+	return fmt.Sprintf("in length: %d lines, expected %d", len(g), len(w))
+}
+
+func firstLine(out []byte, err error) string {
+	for _, line := range strings.Split(string(out), "\n") {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+			return line
+		}
+	}
+	return err.Error()
+}
+
+// instrumentError picks the error out of the output of instrument: the
+// first compiler error or else the first line after "instrumenting <pkg>"
+// which is not logging
+func instrumentError(out []byte, err error) string {
+	lines := strings.Split(string(out), "\n")
+	for i, line := range lines {
+		if strings.HasPrefix(line, "# ") && i+1 < len(lines) && lines[i+1] != "" {
+			return strings.TrimSpace(lines[i+1])
+		}
+	}
+	for i, line := range lines {
+		if !strings.HasPrefix(line, "instrumenting ") {
+			continue
+		}
+		for _, line := range lines[i+1:] {
+			line = strings.TrimSpace(line)
+			if strings.Trim(line, "0123456789 ") == "" || strings.Contains(line, " INFO (") || strings.HasPrefix(line, "cd ") {
+				continue
+			}
+			return line
+		}
+	}
+	return err.Error()
+}
+
+// packageName is the name of the package the program's file declares
+func packageName(path string) (string, error) {
+	f, err := parser.ParseFile(token.NewFileSet(), path, nil, parser.PackageClauseOnly)
+	if err != nil {
+		return "", err
+	}
+	return f.Name.Name, nil
+}
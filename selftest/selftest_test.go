@@ -0,0 +1,107 @@
+package selftest
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/timtadh/dynagrok/cmd"
+)
+
+func TestReadKnown(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dynagrok-selftest-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "known-failures")
+	if known, err := ReadKnown(path); err != nil || len(known) != 0 {
+		t.Fatalf("a missing file gave %v, %v", known, err)
+	}
+	src := "# slow\n\noks/runs/divmod.go  too slow\noks/runs/peano.go\n"
+	if err := ioutil.WriteFile(path, []byte(src), 0664); err != nil {
+		t.Fatal(err)
+	}
+	known, err := ReadKnown(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		filepath.FromSlash("oks/runs/divmod.go"): "too slow",
+		filepath.FromSlash("oks/runs/peano.go"):  "",
+	}
+	if len(known) != len(want) {
+		t.Fatalf("read %v, expected %v", known, want)
+	}
+	for name, why := range want {
+		if got, has := known[name]; !has || got != why {
+			t.Errorf("%v: read %q, expected %q", name, got, why)
+		}
+	}
+}
+
+// TestCorpus runs the selftest command's harness over the compiler-tests
+// corpus (with and without predicates). It builds dynagrok and takes a
+// while, so it only runs when DGSELFTEST is set (eg. `make selftest`).
+func TestCorpus(t *testing.T) {
+	if os.Getenv("DGSELFTEST") == "" {
+		t.Skip("set DGSELFTEST=1 to instrument and run the compiler-tests corpus")
+	}
+	dgpath, err := filepath.Abs("..")
+	if err != nil {
+		t.Fatal(err)
+	}
+	work, err := ioutil.TempDir("", "dynagrok-selftest-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(work)
+	dynagrok := filepath.Join(work, "dynagrok")
+	build := exec.Command("go", "build", "-o", dynagrok, ".")
+	build.Dir = dgpath
+	if out, err := build.CombinedOutput(); err != nil {
+		t.Fatalf("could not build dynagrok: %v\n%s", err, out)
+	}
+	corpus := filepath.Join(dgpath, "examples", "compiler-tests")
+	progs, err := Corpus(corpus)
+	if err != nil {
+		t.Fatal(err)
+	}
+	known, err := ReadKnown(filepath.Join(corpus, "known-failures"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, predicates := range []bool{false, true} {
+		name := "blocks"
+		if predicates {
+			name = "predicates"
+		}
+		t.Run(name, func(t *testing.T) {
+			h := &Harness{
+				Config:     &cmd.Config{DGPATH: dgpath, GOROOT: os.Getenv("GOROOT")},
+				Dynagrok:   dynagrok,
+				Work:       filepath.Join(work, name),
+				Timeout:    time.Minute,
+				Jobs:       runtime.NumCPU(),
+				Predicates: predicates,
+				Known:      known,
+			}
+			err := h.Test(progs, func(r *Result) {
+				if r.Status == Fail {
+					t.Error(r)
+				} else {
+					t.Log(r)
+				}
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}